@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/ghaggin/sso/internal/audit"
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/idp"
+	"github.com/ghaggin/sso/internal/lockout"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/samldebug"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/term"
+)
+
+const usage = `usage: sso <command> [arguments]
+
+  serve idp|sp|all                 run the idp, the sp or both in one process
+  user add [flags] <username>      create a user, -first, -last, -email and -roles
+                                   set its details, the password is prompted for
+                                   or read from stdin
+  user list                        list users
+  user passwd <username>           set a user's password and lift any lockout
+  user disable <username>          disable a user
+  user enable <username>           enable a disabled user
+  sp register [flags] <file|url>   trust the service provider in the metadata,
+                                   -groups limits it to their members,
+                                   -relay-state is sent with idp initiated
+                                   logins and -evil registers it for
+                                   adversarial testing at /service/evil,
+                                   when evil.enabled is set
+  sp list                          list registered service providers
+  sp remove <entity id>            stop trusting a service provider
+  metadata export [-file path]     write the idp's saml metadata
+  config validate                  check config/config.yaml
+  saml decode [message]            decode a SAMLRequest or SAMLResponse and print
+                                   its xml
+  saml inspect [-key file] [message]
+                                   summarise a message, decrypting its assertion
+                                   with the sp's key
+  saml verify [flags] [message]    check a message as the sp would: signature
+                                   (-cert file or -metadata file|url, the idp's
+                                   by default), -audience, -destination,
+                                   -request-id and the time window (-now)
+
+Commands act on the configured repository and stores directly. The json
+repository is written when a command finishes and again when the idp stops,
+so stop the idp before changing users with it.
+
+A saml message is a post form or redirect url value, a url or query string
+carrying one, or xml, given as it is or in a file. It is read from stdin when
+not given.`
+
+// errUsage is returned for arguments that don't make a command
+var errUsage = errors.New("see sso help")
+
+// runCommand runs one of the commands in usage
+func runCommand(args []string) error {
+	if len(args) < 2 {
+		if args[0] == "help" {
+			fmt.Println(usage)
+			return nil
+		}
+		return errUsage
+	}
+
+	switch args[0] + " " + args[1] {
+	case "serve idp", "serve sp", "serve all":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return serve(args[1])
+	case "user add":
+		return userAdd(args[2:])
+	case "user list":
+		return userList()
+	case "user passwd":
+		return userPasswd(args[2:])
+	case "user disable":
+		return userDisable(args[2:], true)
+	case "user enable":
+		return userDisable(args[2:], false)
+	case "sp register":
+		return spRegister(args[2:])
+	case "sp list":
+		return spList()
+	case "sp remove":
+		return spRemove(args[2:])
+	case "metadata export":
+		return metadataExport(args[2:])
+	case "config validate":
+		return configValidate()
+	case "saml decode":
+		return samlDecode(args[2:])
+	case "saml inspect":
+		return samlInspect(args[2:])
+	case "saml verify":
+		return samlVerify(args[2:])
+	}
+	return errUsage
+}
+
+// runIdP runs fn with the idp's dependencies started but nothing served,
+// targets are populated by fx before it runs. Only what targets need is
+// built, so the session store isn't opened.
+func runIdP(fn func(ctx context.Context) error, targets ...any) error {
+	app := fx.New(
+		withMode("idp"),
+		idp.Module,
+		fx.NopLogger,
+		// commands print their own results, keep the log to problems
+		fx.Decorate(func(log *zap.Logger) *zap.Logger {
+			return log.WithOptions(zap.IncreaseLevel(zapcore.WarnLevel), zap.AddStacktrace(zapcore.FatalLevel))
+		}),
+		fx.Populate(targets...),
+	)
+	if err := start(app); err != nil {
+		return err
+	}
+
+	err := fn(context.Background())
+	if stopErr := stop(app); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// record audits a command that changed something, as the admin api does for
+// its requests
+func record(a *audit.Logger, args []string, err error) {
+	actor := "cli"
+	if u, uerr := user.Current(); uerr == nil {
+		actor = "cli:" + u.Username
+	}
+	status := 0
+	if err != nil {
+		status = 1
+	}
+	a.Record(audit.Event{
+		Actor:  actor,
+		Method: "CLI",
+		Path:   strings.Join(args, " "),
+		Status: status,
+	})
+}
+
+func userAdd(args []string) error {
+	fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+	first := fs.String("first", "", "first name")
+	last := fs.String("last", "", "last name")
+	email := fs.String("email", "", "email address")
+	roles := fs.String("roles", "", "comma separated roles")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	u := &model.User{
+		Name:  fs.Arg(0),
+		First: *first,
+		Last:  *last,
+		Email: *email,
+	}
+	if *roles != "" {
+		u.Roles = strings.Split(*roles, ",")
+	}
+
+	var ctrl *idp.Controller
+	var a *audit.Logger
+	return runIdP(func(ctx context.Context) (err error) {
+		defer func() { record(a, []string{"user", "add", u.Name}, err) }()
+
+		if err := ctrl.ValidateRoles(u.Roles); err != nil {
+			return err
+		}
+		u.Password, err = readPassword("password: ")
+		if err != nil {
+			return err
+		}
+		if err := ctrl.CreateUser(ctx, u); err != nil {
+			return err
+		}
+		fmt.Printf("created user %s with id %d\n", u.Name, u.ID)
+		return nil
+	}, &ctrl, &a)
+}
+
+func userList() error {
+	var ctrl *idp.Controller
+	return runIdP(func(ctx context.Context) error {
+		users, err := ctrl.GetUsers(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tNAME\tEMAIL\tROLES\tSTATUS")
+		for _, u := range users {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Name, strings.TrimSpace(u.First+" "+u.Last), u.Email, strings.Join(u.Roles, ","), status)
+		}
+		return w.Flush()
+	}, &ctrl)
+}
+
+// userPasswd sets a password subject to the policy, and lifts a lockout so
+// an admin locked out of the web ui can get back in
+func userPasswd(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	username := args[0]
+
+	var ctrl *idp.Controller
+	var limiter *lockout.Limiter
+	var a *audit.Logger
+	return runIdP(func(ctx context.Context) (err error) {
+		defer func() { record(a, []string{"user", "passwd", username}, err) }()
+
+		if _, err := ctrl.GetUserByName(ctx, username); err != nil {
+			return fmt.Errorf("user %s: %w", username, err)
+		}
+		password, err := readPassword("new password: ")
+		if err != nil {
+			return err
+		}
+		if err := ctrl.ChangePassword(ctx, username, password); err != nil {
+			return err
+		}
+		if err := limiter.Unlock(ctx, username, "cli"); err != nil {
+			return err
+		}
+		fmt.Printf("changed the password of %s\n", username)
+		return nil
+	}, &ctrl, &limiter, &a)
+}
+
+func userDisable(args []string, disabled bool) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	username := args[0]
+	action := "enable"
+	if disabled {
+		action = "disable"
+	}
+
+	var ctrl *idp.Controller
+	var a *audit.Logger
+	return runIdP(func(ctx context.Context) (err error) {
+		defer func() { record(a, []string{"user", action, username}, err) }()
+
+		u, err := ctrl.GetUserByName(ctx, username)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", username, err)
+		}
+		u.Disabled = disabled
+		if err := ctrl.UpdateUser(ctx, u); err != nil {
+			return err
+		}
+		fmt.Printf("%sd %s\n", action, username)
+		if disabled {
+			fmt.Println("sessions already signed in last until they expire or are revoked at /sessions")
+		}
+		return nil
+	}, &ctrl, &a)
+}
+
+// readPassword prompts on a terminal, otherwise the first line of stdin is
+// the password so it can be piped in
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return "", errors.New("no password on stdin")
+		}
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(password) == 0 {
+		return "", errors.New("the password can't be empty")
+	}
+
+	fmt.Fprint(os.Stderr, "again: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(again) != string(password) {
+		return "", errors.New("the passwords don't match")
+	}
+	return string(password), nil
+}
+
+// runRegistry runs fn against the registered sps. The registry is shared
+// with a running idp, which picks up the change straight away.
+func runRegistry(args []string, fn func(sps *idp.ServiceProviderStore) error) error {
+	var cfg *config.Config
+	var a *audit.Logger
+	return runIdP(func(_ context.Context) error {
+		err := fn(idp.NewServiceProviderStore(cfg.IdentityProvider.ServiceProvidersPath))
+		if args != nil {
+			record(a, args, err)
+		}
+		return err
+	}, &cfg, &a)
+}
+
+func spRegister(args []string) error {
+	fs := flag.NewFlagSet("sp register", flag.ContinueOnError)
+	fs.Bool("evil", false, "register the sp for adversarial testing")
+	fs.String("relay-state", "", "RelayState of idp initiated logins")
+	fs.String("groups", "", "comma separated groups allowed to use the sp, everyone when empty")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	// settings not given are left as an earlier registration set them
+	q := url.Values{}
+	fs.Visit(func(f *flag.Flag) {
+		q.Set(strings.ReplaceAll(f.Name, "-", "_"), f.Value.String())
+	})
+	update, err := idp.SettingsUpdate(q)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := readServiceProviderMetadata(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if metadata.EntityID == "" || len(metadata.SPSSODescriptors) == 0 {
+		return fmt.Errorf("%s is not service provider metadata", fs.Arg(0))
+	}
+
+	return runRegistry([]string{"sp", "register", metadata.EntityID}, func(sps *idp.ServiceProviderStore) error {
+		if err := sps.Put(metadata); err != nil {
+			return err
+		}
+		if err := sps.UpdateSettings(metadata.EntityID, update); err != nil {
+			return err
+		}
+		fmt.Printf("registered %s\n", metadata.EntityID)
+		return nil
+	})
+}
+
+// readServiceProviderMetadata reads metadata from a file, or fetches it
+// when source is an http(s) url
+func readServiceProviderMetadata(source string) (*saml.EntityDescriptor, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return idp.ParseServiceProviderMetadata(f)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	return idp.ParseServiceProviderMetadata(resp.Body)
+}
+
+func spList() error {
+	return runRegistry(nil, func(sps *idp.ServiceProviderStore) error {
+		registered, err := sps.List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ENTITY ID\tACS\tSLO\tGROUPS\tMODE")
+		for _, sp := range registered {
+			settings, err := sps.Settings(sp.EntityID)
+			if err != nil {
+				return err
+			}
+			mode := "trusted"
+			if settings.Evil {
+				mode = "evil"
+			}
+			var acs, slo string
+			for _, d := range sp.SPSSODescriptors {
+				for _, s := range d.AssertionConsumerServices {
+					acs = firstNonEmpty(acs, s.Location)
+				}
+				for _, s := range d.SingleLogoutServices {
+					slo = firstNonEmpty(slo, s.Location)
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", sp.EntityID, firstNonEmpty(acs, "-"), firstNonEmpty(slo, "-"), firstNonEmpty(strings.Join(settings.Groups, ","), "-"), mode)
+		}
+		return w.Flush()
+	})
+}
+
+func firstNonEmpty(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func spRemove(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	entityID := args[0]
+
+	return runRegistry([]string{"sp", "remove", entityID}, func(sps *idp.ServiceProviderStore) error {
+		err := sps.Remove(entityID)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s is not registered", entityID)
+		} else if err != nil {
+			return err
+		}
+		fmt.Printf("removed %s\n", entityID)
+		return nil
+	})
+}
+
+func metadataExport(args []string) error {
+	fs := flag.NewFlagSet("metadata export", flag.ContinueOnError)
+	file := fs.String("file", "", "file to write to, defaults to stdout")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	cfg, err := config.New()
+	if err != nil {
+		return err
+	}
+	metadata, err := idp.Metadata(cfg)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	b, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, b)
+	return err
+}
+
+// configValidate checks the config without starting anything, expiring
+// certificates are warned about since the dev ones are short lived
+func configValidate() error {
+	cfg, err := config.New()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, name := range []string{"idp", "sp"} {
+		_, cert, err := config.GetKeyPair(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		warnExpiry(name, cert)
+	}
+	if err := idp.ValidateConfig(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	fmt.Println("config/config.yaml is valid")
+	return nil
+}
+
+func warnExpiry(name string, cert *x509.Certificate) {
+	switch until := time.Until(cert.NotAfter); {
+	case until < 0:
+		fmt.Fprintf(os.Stderr, "warning: the %s certificate expired on %s\n", name, cert.NotAfter.Format(time.DateOnly))
+	case until < 30*24*time.Hour:
+		fmt.Fprintf(os.Stderr, "warning: the %s certificate expires on %s\n", name, cert.NotAfter.Format(time.DateOnly))
+	}
+}
+
+// readMessage reads a saml message from the argument or the file it names,
+// or from stdin when there is none or it is -
+func readMessage(args []string) (*samldebug.Message, error) {
+	if len(args) > 1 {
+		return nil, errUsage
+	}
+	if len(args) == 1 && args[0] != "-" {
+		if info, err := os.Stat(args[0]); err != nil || info.IsDir() {
+			return samldebug.Decode(args[0])
+		}
+		b, err := os.ReadFile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return samldebug.Decode(string(b))
+	}
+
+	b, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return samldebug.Decode(string(b))
+}
+
+func samlDecode(args []string) error {
+	m, err := readMessage(args)
+	if err != nil {
+		return err
+	}
+
+	if m.Binding != "" {
+		fmt.Fprintf(os.Stderr, "binding: %s\n", m.Binding)
+	}
+	if m.RelayState != "" {
+		fmt.Fprintf(os.Stderr, "relay state: %s\n", m.RelayState)
+	}
+	fmt.Println(m.Pretty())
+	return nil
+}
+
+func samlInspect(args []string) error {
+	fs := flag.NewFlagSet("saml inspect", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "pem key to decrypt assertions with, defaults to the sp's")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	m, err := readMessage(fs.Args())
+	if err != nil {
+		return err
+	}
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	fields, err := m.Inspect(key)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s\t%s\n", f.Name, f.Value)
+	}
+	return w.Flush()
+}
+
+func samlVerify(args []string) error {
+	fs := flag.NewFlagSet("saml verify", flag.ContinueOnError)
+	certFile := fs.String("cert", "", "pem certificate the message is signed with")
+	metadata := fs.String("metadata", "", "file or url of the signer's metadata")
+	keyFile := fs.String("key", "", "pem key to decrypt assertions with, defaults to the sp's")
+	audience := fs.String("audience", "", "entity id of the sp the assertion must be for")
+	destination := fs.String("destination", "", "url the message must be sent to")
+	requestID := fs.String("request-id", "", "id of the request a response must answer")
+	now := fs.String("now", "", "RFC 3339 time the message was received, defaults to now")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	m, err := readMessage(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	opts := samldebug.Options{
+		Audience:    *audience,
+		Destination: *destination,
+		RequestID:   *requestID,
+	}
+	if *now != "" {
+		if opts.Now, err = time.Parse(time.RFC3339, *now); err != nil {
+			return fmt.Errorf("-now: %w", err)
+		}
+	}
+	if opts.Key, err = readKey(*keyFile); err != nil {
+		return err
+	}
+	if opts.Certs, err = readCerts(*certFile, *metadata); err != nil {
+		return err
+	}
+
+	checks := m.Verify(opts)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, c := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Status, c.Name, c.Detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if samldebug.Failed(checks) {
+		return fmt.Errorf("the %s would be rejected", m.Type())
+	}
+	return nil
+}
+
+// readKey reads a pem rsa key, the configured sp key when file is empty
+func readKey(file string) (*rsa.PrivateKey, error) {
+	if file == "" {
+		if _, err := config.New(); err != nil {
+			return nil, err
+		}
+		key, _, err := config.GetKeyPair("sp")
+		return key, err
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no pem key", file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an rsa key", file)
+	}
+	return key, nil
+}
+
+// readCerts reads the signer's certificates from a pem file or metadata,
+// the configured idp's when neither is given
+func readCerts(certFile, metadata string) ([]*x509.Certificate, error) {
+	if certFile != "" {
+		b, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		return samldebug.ParseCertificates(b)
+	}
+
+	var md *saml.EntityDescriptor
+	var err error
+	switch {
+	case strings.HasPrefix(metadata, "http://") || strings.HasPrefix(metadata, "https://"):
+		var u *url.URL
+		if u, err = url.Parse(metadata); err != nil {
+			return nil, err
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		md, err = samlsp.FetchMetadata(context.Background(), client, *u)
+	case metadata != "":
+		var b []byte
+		if b, err = os.ReadFile(metadata); err != nil {
+			return nil, err
+		}
+		md, err = samlsp.ParseMetadata(b)
+	default:
+		var cfg *config.Config
+		if cfg, err = config.New(); err != nil {
+			return nil, err
+		}
+		md, err = idp.Metadata(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return samldebug.MetadataCerts(md)
+}
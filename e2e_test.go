@@ -0,0 +1,777 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/idp"
+	"github.com/ghaggin/sso/internal/mail"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/sp"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testUser     = "alice"
+	testPassword = "correct-Horse-battery-7"
+	adminToken   = "e2e-admin-token"
+	scimToken    = "e2e-scim-token"
+)
+
+// harness is an idp and the test sp on httptest servers, with alice
+// registered at the idp and the sp trusted by it, and a browser to walk
+// through logins with
+type harness struct {
+	idpURL string
+	spURL  string
+	// browser follows redirects, direct stops at the first response, both
+	// share cookies. api has no cookies, so admin calls aren't made from
+	// the browser's idp session.
+	browser *http.Client
+	direct  *http.Client
+	api     *http.Client
+	// mail is the relay the idp sends its mail to
+	mail *mail.CaptureServer
+}
+
+// page is a response with its body read
+type page struct {
+	url    *url.URL
+	status int
+	header http.Header
+	body   string
+}
+
+// newHarness starts the idp and sp, configure adjusts their config
+func newHarness(t *testing.T, configure ...func(*config.Config)) *harness {
+	t.Helper()
+
+	idpServer := httptest.NewUnstartedServer(nil)
+	spServer := httptest.NewUnstartedServer(nil)
+	h := &harness{
+		idpURL: "http://" + idpServer.Listener.Addr().String(),
+		spURL:  "http://" + spServer.Listener.Addr().String(),
+	}
+
+	h.mail = &mail.CaptureServer{}
+	mailAddr, err := h.mail.Start("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		h.mail.Close()
+	})
+
+	// everything the apps write goes to the test's directory
+	dir := t.TempDir()
+	options := fx.Options(
+		fx.NopLogger,
+		fx.Decorate(
+			func() *zap.Logger {
+				return zap.NewNop()
+			},
+			func(cfg *config.Config) *config.Config {
+				cfg.IdentityProvider.URL = h.idpURL
+				cfg.IdentityProvider.ServiceProvidersPath = filepath.Join(dir, "service_providers.json")
+				cfg.ServiceProvider.URL = h.spURL
+				cfg.ServiceProvider.IDPMetadataURL = h.idpURL + "/metadata"
+				cfg.Repository = config.RepositoryJSON
+				cfg.JSONRepo.Path = filepath.Join(dir, "repo.json")
+				cfg.Provisioning.QueuePath = filepath.Join(dir, "provisioning.json")
+				cfg.Provisioning.Connectors = nil
+				cfg.Lockout.Store = config.SessionStore{Type: config.SessionStoreFile, Path: filepath.Join(dir, "lockout.json")}
+				cfg.Admin.AuditPath = filepath.Join(dir, "audit.log")
+				cfg.Upstreams = nil
+				cfg.LDAPServer.Addr = ""
+				cfg.Session.Store = config.SessionStore{Type: config.SessionStoreMemory}
+				cfg.Mail.SMTPAddr = mailAddr.String()
+				cfg.Mail.Capture = false
+
+				var permissions []string
+				for _, p := range model.Permissions {
+					permissions = append(permissions, string(p))
+				}
+				cfg.Admin.APITokens = append(cfg.Admin.APITokens, config.APIToken{
+					Name:        "e2e",
+					Token:       adminToken,
+					Permissions: permissions,
+				})
+				for _, c := range configure {
+					c(cfg)
+				}
+				return cfg
+			},
+		),
+	)
+
+	// the sp fetches the idp's metadata while it is built, so the idp is
+	// served first
+	var identityProvider *idp.IdentityProvider
+	var ctrl *idp.Controller
+	idpApp := fx.New(withMode("idp"), idp.Module, options, fx.Populate(&identityProvider, &ctrl))
+	startApp(t, idpApp)
+	idpServer.Config.Handler = identityProvider.Handler()
+	idpServer.Start()
+	t.Cleanup(idpServer.Close)
+
+	err = ctrl.CreateUser(context.Background(), &model.User{
+		Name:     testUser,
+		Password: testPassword,
+		First:    "Alice",
+		Last:     "Liddell",
+		Email:    "alice@example.com",
+	})
+	require.NoError(t, err)
+
+	var serviceProvider *sp.ServiceProvider
+	spApp := fx.New(withMode("sp"), fx.Provide(sp.New), options, fx.Populate(&serviceProvider))
+	startApp(t, spApp)
+	spServer.Config.Handler = serviceProvider.Handler()
+	spServer.Start()
+	t.Cleanup(spServer.Close)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	h.browser = &http.Client{Jar: jar, Timeout: 10 * time.Second}
+	h.direct = &http.Client{
+		Jar:     jar,
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	h.api = &http.Client{Timeout: 10 * time.Second}
+
+	// the sp is trusted the way an admin would, with its metadata
+	metadata := h.get(t, h.direct, h.spURL+"/saml/metadata")
+	require.Equal(t, http.StatusOK, metadata.status)
+	registered := h.do(t, h.api, h.admin(t, http.MethodPut, "/service", strings.NewReader(metadata.body)))
+	require.Equal(t, http.StatusOK, registered.status)
+
+	return h
+}
+
+func startApp(t *testing.T, app *fx.App) {
+	t.Helper()
+	require.NoError(t, start(app))
+	t.Cleanup(func() {
+		require.NoError(t, stop(app))
+	})
+}
+
+func (h *harness) get(t *testing.T, client *http.Client, u string) page {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	require.NoError(t, err)
+	return h.do(t, client, req)
+}
+
+func (h *harness) post(t *testing.T, client *http.Client, u string, form url.Values) page {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return h.do(t, client, req)
+}
+
+// admin is an admin api request to the idp
+func (h *harness) admin(t *testing.T, method, path string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, h.idpURL+path, body)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Accept", "application/json")
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req
+}
+
+func (h *harness) do(t *testing.T, client *http.Client, req *http.Request) page {
+	t.Helper()
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return page{url: resp.Request.URL, status: resp.StatusCode, header: resp.Header, body: string(body)}
+}
+
+// samlResponse walks the browser from start until the idp answers the sp,
+// posting saml requests on and logging in to the idp when asked. The
+// response is returned without being posted to the sp.
+func (h *harness) samlResponse(t *testing.T, start string) url.Values {
+	t.Helper()
+	p := h.get(t, h.browser, start)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusOK, p.status, p.body)
+		action, form := parseForm(t, p)
+		switch {
+		case form.Has("SAMLResponse"):
+			require.Equal(t, h.spURL+"/saml/acs", action)
+			return form
+		case form.Has("SAMLRequest"):
+			require.Equal(t, h.idpURL+"/sso", action)
+			p = h.post(t, h.browser, action, form)
+		case form.Has("username"):
+			form.Set("username", testUser)
+			form.Set("password", testPassword)
+			p = h.post(t, h.browser, action, form)
+		default:
+			t.Fatalf("unexpected page %s: %s", p.url, p.body)
+		}
+	}
+	t.Fatal("no saml response")
+	return nil
+}
+
+// acs posts the idp's response to the sp
+func (h *harness) acs(t *testing.T, response url.Values) page {
+	t.Helper()
+	return h.post(t, h.browser, h.spURL+"/saml/acs", response)
+}
+
+// requireSignedIn checks the sp's home page is shown to alice
+func (h *harness) requireSignedIn(t *testing.T, p page) {
+	t.Helper()
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	require.Equal(t, h.spURL+"/", p.url.String())
+	require.Contains(t, p.body, "uid: "+testUser)
+}
+
+// requireRejected checks the sp turned the response away, and left the
+// reason on its trace page
+func (h *harness) requireRejected(t *testing.T, p page, reason string) {
+	t.Helper()
+	require.Equal(t, http.StatusForbidden, p.status, p.body)
+
+	home := h.get(t, h.direct, h.spURL+"/")
+	require.Equal(t, http.StatusSeeOther, home.status)
+	require.Equal(t, "/saml/login", home.header.Get("Location"))
+
+	trace := h.get(t, h.direct, h.spURL+"/trace")
+	require.Contains(t, html.UnescapeString(trace.body), reason)
+}
+
+var (
+	formPattern  = regexp.MustCompile(`(?is)<form\b[^>]*>`)
+	inputPattern = regexp.MustCompile(`(?is)<input\b[^>]*>`)
+	attrPattern  = regexp.MustCompile(`(?s)([\w-]+)="([^"]*)"`)
+)
+
+// parseForm returns where the page's first form goes and the values it
+// submits, unticked checkboxes aside
+func parseForm(t *testing.T, p page) (string, url.Values) {
+	t.Helper()
+	tag := formPattern.FindString(p.body)
+	require.NotEmpty(t, tag, "no form on %s: %s", p.url, p.body)
+	action, err := p.url.Parse(attrs(tag)["action"])
+	require.NoError(t, err)
+
+	form := url.Values{}
+	for _, input := range inputPattern.FindAllString(p.body, -1) {
+		a := attrs(input)
+		if a["name"] == "" || a["type"] == "checkbox" {
+			continue
+		}
+		form.Add(a["name"], a["value"])
+	}
+	return action.String(), form
+}
+
+func attrs(tag string) map[string]string {
+	a := map[string]string{}
+	for _, m := range attrPattern.FindAllStringSubmatch(tag, -1) {
+		a[strings.ToLower(m[1])] = html.UnescapeString(m[2])
+	}
+	return a
+}
+
+func TestMetadataExchange(t *testing.T) {
+	h := newHarness(t)
+
+	p := h.get(t, h.direct, h.idpURL+"/metadata")
+	require.Equal(t, http.StatusOK, p.status)
+	idpMetadata := &saml.EntityDescriptor{}
+	require.NoError(t, xml.Unmarshal([]byte(p.body), idpMetadata))
+	require.Equal(t, h.idpURL+"/metadata", idpMetadata.EntityID)
+	require.Len(t, idpMetadata.IDPSSODescriptors, 1)
+	var ssoLocations []string
+	for _, s := range idpMetadata.IDPSSODescriptors[0].SingleSignOnServices {
+		ssoLocations = append(ssoLocations, s.Location)
+	}
+	require.Contains(t, ssoLocations, h.idpURL+"/sso")
+
+	p = h.do(t, h.direct, h.admin(t, http.MethodGet, "/service", nil))
+	require.Equal(t, http.StatusOK, p.status)
+	entities := &saml.EntitiesDescriptor{}
+	require.NoError(t, xml.Unmarshal([]byte(p.body), entities))
+	require.Len(t, entities.EntityDescriptors, 1)
+	spMetadata := entities.EntityDescriptors[0]
+	require.Equal(t, "test_sp", spMetadata.EntityID)
+	require.Equal(t, h.spURL+"/saml/acs", spMetadata.SPSSODescriptors[0].AssertionConsumerServices[0].Location)
+}
+
+func TestSPInitiatedRedirectBinding(t *testing.T) {
+	h := newHarness(t)
+
+	response := h.samlResponse(t, h.spURL+"/saml/login")
+	h.requireSignedIn(t, h.acs(t, response))
+
+	attr := h.get(t, h.browser, h.spURL+"/attr")
+	require.Equal(t, http.StatusOK, attr.status)
+	require.Contains(t, attr.body, "alice@example.com")
+
+	trace := h.get(t, h.browser, h.spURL+"/trace")
+	require.Contains(t, trace.body, saml.HTTPRedirectBinding)
+}
+
+func TestSPInitiatedPostBinding(t *testing.T) {
+	h := newHarness(t)
+
+	response := h.samlResponse(t, h.spURL+"/saml/login?binding=post")
+	h.requireSignedIn(t, h.acs(t, response))
+
+	trace := h.get(t, h.browser, h.spURL+"/trace")
+	require.Contains(t, trace.body, saml.HTTPPostBinding)
+	require.NotContains(t, trace.body, saml.HTTPRedirectBinding)
+}
+
+func TestIDPInitiated(t *testing.T) {
+	h := newHarness(t)
+
+	response := h.samlResponse(t, h.idpURL+"/sso/launch/test_sp")
+	h.requireSignedIn(t, h.acs(t, response))
+}
+
+func TestAppLauncher(t *testing.T) {
+	h := newHarness(t)
+	metadata := h.get(t, h.direct, h.spURL+"/saml/metadata")
+	p := h.do(t, h.api, h.admin(t, http.MethodPut, "/service?relay_state=/attr", strings.NewReader(metadata.body)))
+	require.Equal(t, http.StatusOK, p.status, p.body)
+
+	// the registration's relay state sends the user on from the acs
+	response := h.samlResponse(t, h.idpURL+"/sso/launch/test_sp")
+	require.Equal(t, "/attr", response.Get("RelayState"))
+	p = h.acs(t, response)
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	require.Equal(t, h.spURL+"/attr", p.url.String())
+
+	home := h.get(t, h.browser, h.idpURL+"/")
+	require.Contains(t, home.body, "/sso/launch/test_sp")
+
+	// the groups setting hides the app from everyone else
+	p = h.do(t, h.api, h.admin(t, http.MethodPut, "/service?groups=nobody", strings.NewReader(metadata.body)))
+	require.Equal(t, http.StatusOK, p.status, p.body)
+
+	launch := h.get(t, h.browser, h.idpURL+"/sso/launch/test_sp")
+	require.Equal(t, http.StatusForbidden, launch.status, launch.body)
+	home = h.get(t, h.browser, h.idpURL+"/")
+	require.NotContains(t, home.body, "/sso/launch/test_sp")
+}
+
+func TestUnknownUpstream(t *testing.T) {
+	h := newHarness(t)
+
+	for _, path := range []string{"/login/upstream/nowhere", "/login/upstream/nowhere/complete?state=x"} {
+		p := h.get(t, h.browser, h.idpURL+path)
+		require.Equal(t, http.StatusOK, p.status, path)
+		require.Contains(t, p.body, "unknown identity provider", path)
+	}
+}
+
+var resetLinkPattern = regexp.MustCompile(`http\S+/password/reset\?token=\S+`)
+
+// resetLink asks the idp for a password reset and returns the link from
+// the mail it sends
+func (h *harness) resetLink(t *testing.T) string {
+	t.Helper()
+	p := h.get(t, h.browser, h.idpURL+"/password/forgot")
+	action, form := parseForm(t, p)
+	form.Set("login", testUser)
+	p = h.post(t, h.browser, action, form)
+	require.Equal(t, http.StatusOK, p.status, p.body)
+
+	msg, err := h.mail.Wait("alice@example.com", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "Reset your password", msg.Subject())
+	link := resetLinkPattern.FindString(string(msg.Data))
+	require.NotEmpty(t, link, string(msg.Data))
+	require.True(t, strings.HasPrefix(link, h.idpURL), link)
+	return link
+}
+
+// reset chooses a new password on the reset link's page
+func (h *harness) reset(t *testing.T, link, password string) page {
+	t.Helper()
+	p := h.get(t, h.browser, link)
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	action, form := parseForm(t, p)
+	require.True(t, form.Has("token"), p.body)
+	form.Set("password", password)
+	form.Set("confirm", password)
+	return h.post(t, h.browser, action, form)
+}
+
+func TestPasswordReset(t *testing.T) {
+	h := newHarness(t)
+	link := h.resetLink(t)
+
+	// the policy applies, and a refused password leaves the link usable
+	p := h.reset(t, link, "a")
+	require.Contains(t, p.body, "password must be at least")
+	p = h.reset(t, link, testPassword)
+	require.Contains(t, p.body, "password must not be one of the last")
+
+	p = h.reset(t, link, "Another-horse-battery-8")
+	require.Contains(t, p.body, "Your password has been changed.")
+
+	// the link works once
+	p = h.get(t, h.browser, link)
+	require.Contains(t, p.body, "reset link is invalid or has expired")
+	require.NotContains(t, p.body, `name="token"`)
+}
+
+func TestPasswordResetExpiry(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.Mail.ResetTTL = 100 * time.Millisecond
+	})
+	link := h.resetLink(t)
+	time.Sleep(200 * time.Millisecond)
+
+	p := h.get(t, h.browser, link)
+	require.Contains(t, p.body, "reset link is invalid or has expired")
+}
+
+func TestPasswordHashNotTrusted(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("a"), bcrypt.MinCost)
+	require.NoError(t, err)
+	breachList := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(breachList, append(hash, '\n'), 0o600))
+
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.PasswordPolicy.BreachList = breachList
+	})
+
+	// a bcrypt hash is checked like any other password
+	p := h.reset(t, h.resetLink(t), string(hash))
+	require.Contains(t, p.body, "password appears in a list of breached passwords")
+}
+
+func TestCSRFBearerToken(t *testing.T) {
+	h := newHarness(t)
+	h.requireSignedIn(t, h.acs(t, h.samlResponse(t, h.spURL+"/saml/login")))
+
+	// only a token that matches skips the csrf check, a made up one leaves
+	// the request to the session cookie
+	req, err := http.NewRequest(http.MethodPost, h.idpURL+"/account/sessions/x/revoke", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	p := h.do(t, h.browser, req)
+	require.Equal(t, http.StatusForbidden, p.status, p.body)
+	require.Contains(t, p.body, "invalid csrf token")
+}
+
+func TestSCIMCannotGrantAdmin(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo.json")
+	require.NoError(t, os.WriteFile(repo, []byte(`{"users":[],"groups":[{"id":1,"name":"admins","members":[]}]}`), 0o600))
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.JSONRepo.Path = repo
+		cfg.SCIM.Tokens = []string{scimToken}
+		cfg.Admin.GroupRoles = map[string][]string{"admins": {"admin"}}
+	})
+
+	scim := func(method, path, body string) page {
+		req, err := http.NewRequest(method, h.idpURL+"/scim/v2"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+scimToken)
+		req.Header.Set("Content-Type", "application/scim+json")
+		return h.do(t, h.api, req)
+	}
+
+	p := scim(http.MethodGet, "/Users?filter="+url.QueryEscape(`userName eq "`+testUser+`"`), "")
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	var users struct {
+		Resources []struct {
+			ID string `json:"id"`
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(p.body), &users))
+	require.Len(t, users.Resources, 1)
+
+	// membership of admins would make alice an admin
+	p = scim(http.MethodPatch, "/Groups/1", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "add", "path": "members", "value": [{"value": "`+users.Resources[0].ID+`"}]}]
+	}`)
+	require.Equal(t, http.StatusForbidden, p.status, p.body)
+
+	p = scim(http.MethodGet, "/Groups/1", "")
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	require.NotContains(t, p.body, `"value":"`+users.Resources[0].ID+`"`)
+
+	// ordinary groups are still provisioned
+	p = scim(http.MethodPost, "/Groups", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"],
+		"displayName": "staff",
+		"members": [{"value": "`+users.Resources[0].ID+`"}]
+	}`)
+	require.Equal(t, http.StatusCreated, p.status, p.body)
+}
+
+func TestExportHashes(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.Admin.APITokens = append(cfg.Admin.APITokens, config.APIToken{
+			Name:        "reader",
+			Token:       "e2e-reader-token",
+			Permissions: []string{string(model.PermissionUsersRead)},
+		})
+	})
+
+	export := func(token, query string) page {
+		req := h.admin(t, http.MethodGet, "/users/export?format=json"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return h.do(t, h.api, req)
+	}
+
+	p := export("e2e-reader-token", "")
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	require.Contains(t, p.body, testUser)
+	require.NotContains(t, p.body, "password_hash")
+
+	p = export("e2e-reader-token", "&hashes=true")
+	require.Equal(t, http.StatusForbidden, p.status, p.body)
+
+	p = export(adminToken, "&hashes=true")
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	require.Contains(t, p.body, "password_hash")
+}
+
+func TestSPDebugRequiresLogin(t *testing.T) {
+	h := newHarness(t)
+
+	p := h.get(t, h.direct, h.spURL+"/debug/saml")
+	require.Equal(t, http.StatusSeeOther, p.status)
+	require.Equal(t, "/saml/login", p.header.Get("Location"))
+
+	h.requireSignedIn(t, h.acs(t, h.samlResponse(t, h.spURL+"/saml/login")))
+	p = h.get(t, h.direct, h.spURL+"/debug/saml")
+	require.Equal(t, http.StatusOK, p.status, p.body)
+}
+
+func TestPutServiceBadMetadata(t *testing.T) {
+	h := newHarness(t)
+
+	p := h.do(t, h.api, h.admin(t, http.MethodPut, "/service", strings.NewReader("<EntityDescriptor")))
+	require.Equal(t, http.StatusBadRequest, p.status, p.body)
+	require.Contains(t, p.body, "metadata: ")
+}
+
+func TestRoleChangeRevokesSessions(t *testing.T) {
+	h := newHarness(t)
+
+	users := h.do(t, h.api, h.admin(t, http.MethodGet, "/users", nil))
+	require.Equal(t, http.StatusOK, users.status, users.body)
+	m := regexp.MustCompile(`href="/users/(\d+)"`).FindStringSubmatch(users.body)
+	require.NotNil(t, m, users.body)
+	id := m[1]
+
+	edit := func(roles ...string) {
+		t.Helper()
+		form := url.Values{"firstname": {"Alice"}, "lastname": {"Liddell"}, "email": {"alice@example.com"}, "roles": roles}
+		p := h.do(t, h.api, h.admin(t, http.MethodPost, "/users/"+id, strings.NewReader(form.Encode())))
+		// saved edits go back to the user list
+		require.Equal(t, "/users", p.url.Path, p.body)
+	}
+	sessions := func() []model.SessionInfo {
+		t.Helper()
+		p := h.do(t, h.api, h.admin(t, http.MethodGet, "/sessions?user="+testUser, nil))
+		require.Equal(t, http.StatusOK, p.status, p.body)
+		var sessions []model.SessionInfo
+		require.NoError(t, json.Unmarshal([]byte(p.body), &sessions))
+		return sessions
+	}
+
+	edit("admin")
+	h.requireSignedIn(t, h.acs(t, h.samlResponse(t, h.spURL+"/saml/login")))
+	require.Len(t, sessions(), 1)
+
+	// saving the same roles leaves the session alone
+	edit("admin")
+	require.Len(t, sessions(), 1)
+
+	edit()
+	require.Empty(t, sessions())
+}
+
+func TestSingleLogout(t *testing.T) {
+	h := newHarness(t)
+	h.requireSignedIn(t, h.acs(t, h.samlResponse(t, h.spURL+"/saml/login")))
+
+	p := h.do(t, h.api, h.admin(t, http.MethodGet, "/sessions?user="+testUser, nil))
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	var sessions []model.SessionInfo
+	require.NoError(t, json.Unmarshal([]byte(p.body), &sessions))
+	require.Len(t, sessions, 1)
+	require.Equal(t, []string{"test_sp"}, sessions[0].ServiceProviders)
+
+	form := url.Values{"slo": {"true"}}
+	p = h.do(t, h.api, h.admin(t, http.MethodPost, "/sessions/"+sessions[0].ID+"/revoke", strings.NewReader(form.Encode())))
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	var results []idp.RevokeResult
+	require.NoError(t, json.Unmarshal([]byte(p.body), &results))
+	require.Len(t, results, 1)
+	require.Equal(t, []idp.LogoutResult{{EntityID: "test_sp"}}, results[0].Logout)
+
+	home := h.get(t, h.direct, h.spURL+"/")
+	require.Equal(t, http.StatusSeeOther, home.status)
+	require.Equal(t, "/saml/login", home.header.Get("Location"))
+}
+
+func TestRejectedResponses(t *testing.T) {
+	t.Run("expired", func(t *testing.T) {
+		h := newHarness(t)
+		response := h.samlResponse(t, h.spURL+"/saml/login")
+
+		now := saml.TimeNow
+		saml.TimeNow = func() time.Time {
+			return now().Add(time.Hour)
+		}
+		t.Cleanup(func() {
+			saml.TimeNow = now
+		})
+		h.requireRejected(t, h.acs(t, response), "expired")
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		h := newHarness(t)
+		response := h.samlResponse(t, h.spURL+"/saml/login")
+
+		// the next login is started as another sp, which the response
+		// wasn't meant for
+		p := h.get(t, h.direct, h.spURL+"/saml/login?entity_id=other_sp")
+		require.Equal(t, http.StatusFound, p.status)
+		h.requireRejected(t, h.acs(t, response), "AudienceRestriction")
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		h := newHarness(t)
+		response := h.samlResponse(t, h.spURL+"/saml/login")
+		h.requireSignedIn(t, h.acs(t, response))
+
+		p := h.acs(t, response)
+		require.Equal(t, http.StatusForbidden, p.status, p.body)
+		trace := h.get(t, h.browser, h.spURL+"/trace")
+		require.Contains(t, html.UnescapeString(trace.body), "already used")
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		h := newHarness(t)
+		response := h.samlResponse(t, h.spURL+"/saml/login")
+
+		raw, err := base64.StdEncoding.DecodeString(response.Get("SAMLResponse"))
+		require.NoError(t, err)
+		doc := string(raw)
+		start := strings.Index(doc, "SignatureValue>") + len("SignatureValue>")
+		require.Greater(t, start, len("SignatureValue>"))
+		flipped := "A"
+		if doc[start] == 'A' {
+			flipped = "B"
+		}
+		doc = doc[:start] + flipped + doc[start+1:]
+		response.Set("SAMLResponse", base64.StdEncoding.EncodeToString([]byte(doc)))
+
+		h.requireRejected(t, h.acs(t, response), "signature")
+	})
+}
+
+func TestEvilIdP(t *testing.T) {
+	form := url.Values{"entity_id": {"test_sp"}, "user": {testUser}, "target": {"admin"}}
+
+	// off unless enabled
+	h := newHarness(t)
+	p := h.do(t, h.api, h.admin(t, http.MethodPost, "/service/evil", strings.NewReader(form.Encode())))
+	require.Equal(t, http.StatusNotFound, p.status, p.body)
+
+	evil := func(acsHost string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.Evil = config.Evil{
+				Enabled:   true,
+				TestUsers: []string{testUser, "admin"},
+				ACSHosts:  []string{acsHost},
+			}
+			cfg.Admin.APITokens = append(cfg.Admin.APITokens, config.APIToken{
+				Name:        "sp",
+				Token:       "sp-write-token",
+				Permissions: []string{"sp:read", "sp:write"},
+			})
+		}
+	}
+	h = newHarness(t, evil("127.0.0.1"))
+
+	// sp:write neither runs the tests nor marks an sp for them
+	spWrite := func(req *http.Request) *http.Request {
+		req.Header.Set("Authorization", "Bearer sp-write-token")
+		return req
+	}
+	p = h.do(t, h.api, spWrite(h.admin(t, http.MethodPost, "/service/evil", strings.NewReader(form.Encode()))))
+	require.Equal(t, http.StatusForbidden, p.status, p.body)
+	metadata := h.get(t, h.direct, h.spURL+"/saml/metadata")
+	p = h.do(t, h.api, spWrite(h.admin(t, http.MethodPut, "/service?evil=true", strings.NewReader(metadata.body))))
+	require.Equal(t, http.StatusForbidden, p.status, p.body)
+
+	// the sp was registered without ?evil=true
+	p = h.do(t, h.api, h.admin(t, http.MethodPost, "/service/evil", strings.NewReader(form.Encode())))
+	require.Equal(t, http.StatusBadRequest, p.status, p.body)
+
+	p = h.do(t, h.api, h.admin(t, http.MethodPut, "/service?evil=true", strings.NewReader(metadata.body)))
+	require.Equal(t, http.StatusOK, p.status, p.body)
+
+	// responses are only about test users, or the caller when signed in
+	other := url.Values{"entity_id": {"test_sp"}, "user": {"bob"}, "target": {"admin"}}
+	p = h.do(t, h.api, h.admin(t, http.MethodPost, "/service/evil", strings.NewReader(other.Encode())))
+	require.Equal(t, http.StatusBadRequest, p.status, p.body)
+	require.Contains(t, p.body, "evil.test_users")
+
+	p = h.do(t, h.api, h.admin(t, http.MethodPost, "/service/evil", strings.NewReader(form.Encode())))
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	var results []idp.EvilResult
+	require.NoError(t, json.Unmarshal([]byte(p.body), &results))
+	require.Len(t, results, len(idp.EvilScenarios()))
+
+	for _, result := range results {
+		want := idp.EvilPass
+		if result.Scenario == "nameid-comment" {
+			// the sp signs in admin.evil.test, which only a person can
+			// tell from admin
+			want = idp.EvilReview
+		}
+		require.Equal(t, want, result.Outcome, "%s: %s %s", result.Scenario, result.Status, result.Detail)
+	}
+
+	// nothing is posted to an acs off the allowed hosts
+	h = newHarness(t, evil("sp.example.com"))
+	metadata = h.get(t, h.direct, h.spURL+"/saml/metadata")
+	p = h.do(t, h.api, h.admin(t, http.MethodPut, "/service?evil=true", strings.NewReader(metadata.body)))
+	require.Equal(t, http.StatusOK, p.status, p.body)
+	p = h.do(t, h.api, h.admin(t, http.MethodPost, "/service/evil", strings.NewReader(form.Encode())))
+	require.Equal(t, http.StatusBadRequest, p.status, p.body)
+	require.Contains(t, p.body, "evil.acs_hosts")
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// Event is one admin action
+type Event struct {
+	Time time.Time `json:"time"`
+	// Actor is the username, or token:<name> for api tokens, empty when
+	// the caller couldn't be authenticated
+	Actor  string `json:"actor"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Addr   string `json:"addr"`
+}
+
+// Logger appends events to a json lines file and the application log
+type Logger struct {
+	path string
+	log  *zap.Logger
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+type Params struct {
+	fx.In
+
+	LC     fx.Lifecycle
+	Config *config.Config
+	Log    *zap.Logger
+}
+
+func New(p Params) *Logger {
+	l := &Logger{
+		path: p.Config.Admin.AuditPath,
+		log:  p.Log,
+	}
+
+	p.LC.Append(fx.Hook{
+		OnStart: func(_ context.Context) error {
+			return l.open()
+		},
+		OnStop: func(_ context.Context) error {
+			return l.Close()
+		},
+	})
+
+	return l
+}
+
+func (l *Logger) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.f = f
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Record writes the event. A failed write is logged rather than returned,
+// the action has already happened by the time it is recorded.
+func (l *Logger) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	l.log.Info("audit",
+		zap.String("actor", e.Actor),
+		zap.String("method", e.Method),
+		zap.String("path", e.Path),
+		zap.Int("status", e.Status),
+		zap.String("addr", e.Addr),
+	)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		l.log.Error("encoding audit event", zap.Error(err))
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		l.log.Error("writing audit event", zap.Error(err))
+	}
+}
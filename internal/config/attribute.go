@@ -0,0 +1,18 @@
+package config
+
+type AttributeType string
+
+const (
+	AttributeTypeString AttributeType = "string"
+	AttributeTypeMulti  AttributeType = "multi"
+	AttributeTypeBool   AttributeType = "bool"
+	AttributeTypeDate   AttributeType = "date"
+)
+
+// Attribute describes a custom user attribute. Values are stored per user
+// by the repository and released to service providers under Name.
+type Attribute struct {
+	Name         string
+	FriendlyName string
+	Type         AttributeType
+}
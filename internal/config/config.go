@@ -1,33 +1,690 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type Config struct {
 	IdentityProvider IdentityProvider
 	ServiceProvider  ServiceProvider
 	JSONRepo         JSONRepo
+	Attributes       []Attribute
+	SCIM             SCIM
+	Provisioning     Provisioning
+	Repository       RepositoryType
+	LDAP             LDAP
+	LDAPServer       LDAPServer
+	Upstreams        []Upstream
+	Lockout          Lockout
+	Mail             Mail
+	PasswordPolicy   PasswordPolicy
+	Admin            Admin
+	Session          Session
+	Evil             Evil
 }
 
+type RepositoryType string
+
+const (
+	RepositoryJSON RepositoryType = "json"
+	RepositoryLDAP RepositoryType = "ldap"
+)
+
 type IdentityProvider struct {
 	Port int
+	// URL is where browsers and service providers reach the idp
+	URL string
+	// ServiceProvidersPath is where registered service providers are kept
+	ServiceProvidersPath string
 }
 
 type ServiceProvider struct {
 	Port int
+	// URL is where browsers and the idp reach the sp
+	URL string
+	// IDPMetadataURL is fetched for the idp's metadata when the sp starts
+	IDPMetadataURL string
+	// TraceSize is how many saml messages the sp keeps per session
+	TraceSize int
+	// Profile is the profile logins use unless /saml/login names another
+	Profile  string
+	Profiles map[string]SPProfile
 }
 
+// SPProfile is how the test sp behaves towards the idp, so one sp can
+// exercise an idp with a matrix of scenarios
+type SPProfile struct {
+	// Name selects the profile on /saml/login
+	Name     string
+	EntityID string
+	// Binding sends authn requests by redirect or post
+	Binding string
+	// ResponseBinding asks for responses by post or artifact
+	ResponseBinding string
+	ForceAuthn      bool
+	IsPassive       bool
+	// AuthnContext is the requested AuthnContextClassRef, compared with
+	// AuthnContextComparison
+	AuthnContext           string
+	AuthnContextComparison string
+	// NameIDFormat of the NameIDPolicy, transient when empty
+	NameIDFormat      string
+	AllowCreate       bool
+	SignRequest       bool
+	AllowIDPInitiated bool
+}
+
+const (
+	BindingRedirect = "redirect"
+	BindingPost     = "post"
+	BindingArtifact = "artifact"
+)
+
 type JSONRepo struct {
 	Path string
 }
 
+type SCIM struct {
+	// Tokens are the bearer tokens accepted by the scim server
+	Tokens []string
+}
+
+type Provisioning struct {
+	// QueuePath is where pending outbound changes are persisted
+	QueuePath         string
+	ReconcileInterval time.Duration
+	MaxAttempts       int
+	Connectors        []Connector
+}
+
+// Connector is a downstream service provider exposing a scim endpoint
+type Connector struct {
+	Name     string
+	EntityID string
+	URL      string
+	Token    string
+}
+
+// LDAP configures the ldap repository. Users and groups are read from the
+// directory and logins are validated by binding as the user.
+type LDAP struct {
+	// URL is ldap://host:389 or ldaps://host:636
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	// CACert is a pem file used to verify the server certificate
+	CACert string
+	// BindDN and BindPassword are the service account used for searches
+	BindDN       string
+	BindPassword string
+
+	UserBaseDN     string
+	UserFilter     string
+	LoginAttribute string
+	// IDAttribute holds a numeric user id, the id is derived from the dn
+	// when it is empty or missing on an entry
+	IDAttribute    string
+	FirstAttribute string
+	LastAttribute  string
+	EmailAttribute string
+
+	GroupBaseDN          string
+	GroupFilter          string
+	GroupNameAttribute   string
+	GroupMemberAttribute string
+
+	// AttributeMap maps custom attribute names to ldap attributes
+	AttributeMap map[string]string
+	PoolSize     int
+	Timeout      time.Duration
+}
+
+// LDAPServer configures the idp's ldap listener, it is disabled when Addr
+// is empty
+type LDAPServer struct {
+	Addr   string
+	BaseDN string
+	// StartTLS offers StartTLS with the idp certificate
+	StartTLS bool
+	// ServiceAccounts may bind and search but are not users of the idp
+	ServiceAccounts []ServiceAccount
+}
+
+type ServiceAccount struct {
+	DN string
+	// Password is plain text or a bcrypt hash
+	Password string
+}
+
+type UpstreamType string
+
+const (
+	UpstreamOIDC UpstreamType = "oidc"
+	UpstreamSAML UpstreamType = "saml"
+)
+
+// Upstream is an identity provider users can log in with instead of a
+// password. The idp acts as an oidc client or saml sp towards it.
+type Upstream struct {
+	// Name identifies the upstream in urls and linked identities
+	Name        string
+	DisplayName string
+	Type        UpstreamType
+
+	// oidc
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// saml
+	MetadataURL string
+	// TrustEmail takes the emails a saml upstream asserts as verified, so
+	// MatchEmail can link on them. Only set it for an upstream that
+	// controls its users' emails.
+	TrustEmail bool
+	// TrustMFA lets a login through this upstream stand in for the local
+	// second factor, for an upstream that enforces its own
+	TrustMFA bool
+
+	// JIT creates a local user on first login when none is linked
+	JIT bool
+	// MatchEmail links the first login to the local user with the same
+	// verified email
+	MatchEmail bool
+}
+
+// Lockout throttles failed logins. Each failure on an account doubles the
+// wait before the next attempt starts at BaseDelay, reaching a threshold
+// locks the account or address for Duration.
+type Lockout struct {
+	// Store is where counters are kept, set up like Session.Store. The
+	// file store is a json file at Path, only shared by instances on one
+	// host. Instances on several hosts need sqlite on a shared volume,
+	// postgres or redis.
+	Store            SessionStore
+	AccountThreshold int
+	IPThreshold      int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	Duration         time.Duration
+}
+
+// Mail is the outgoing mail relay. Without an smtp address, or with
+// Capture set, mail goes to an in-process smtp server that logs it.
+type Mail struct {
+	From     string
+	SMTPAddr string
+	Username string
+	Password string
+	StartTLS bool
+	Capture  bool
+	// LogBody logs captured messages whole, reset links included, rather
+	// than only their recipients and subject
+	LogBody bool
+	// ResetTTL is how long a password reset link stays valid
+	ResetTTL time.Duration
+}
+
+// PasswordPolicy applies to every password set through the idp. Only bulk
+// import's password_hash is stored as given.
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is how many of uppercase, lowercase, digits and symbols a
+	// password must mix
+	MinClasses       int
+	DisallowUsername bool
+	// History is how many recent passwords, the current one included, may
+	// not be reused
+	History int
+	// MaxAge forces a change at the next login, zero never expires
+	MaxAge time.Duration
+	// BreachList is a file of breached passwords, one per line in plain
+	// text or as sha1 hex optionally followed by :count
+	BreachList string
+}
+
+// Session sets how long a login lasts on the idp and sp
+type Session struct {
+	// IdleTimeout ends a session that hasn't been used for this long
+	IdleTimeout time.Duration
+	// Lifetime is the longest a session lasts however active it is
+	Lifetime time.Duration
+	// RememberLifetime replaces Lifetime, without an idle timeout, when
+	// keep me signed in is ticked. Zero hides the checkbox.
+	RememberLifetime time.Duration
+	Store            SessionStore
+	// Keys encrypt sessions at rest. The first seals new writes, the rest
+	// are still accepted so a key can be rotated without logging everyone
+	// out.
+	Keys []string
+}
+
+type SessionStoreType string
+
+const (
+	SessionStoreMemory   SessionStoreType = "memory"
+	SessionStoreFile     SessionStoreType = "file"
+	SessionStoreSQLite   SessionStoreType = "sqlite"
+	SessionStorePostgres SessionStoreType = "postgres"
+	SessionStoreRedis    SessionStoreType = "redis"
+)
+
+// SessionStore is where the idp and sp keep sessions. Everything but
+// memory survives a restart, sqlite, postgres and redis can also be shared
+// by instances behind a load balancer.
+type SessionStore struct {
+	Type SessionStoreType
+	// Path is the directory of the file store or the sqlite database
+	Path string
+	// DSN is the postgres connection string
+	DSN string
+	// Addr, Password and DB select the redis server and database
+	Addr     string
+	Password string
+	DB       int
+}
+
+// Evil is adversarial testing at /service/evil, which is off unless
+// Enabled. Responses are only about the caller or TestUsers, and are only
+// posted to acs urls on ACSHosts.
+type Evil struct {
+	Enabled bool
+	// TestUsers are the usernames responses may be about or impersonate,
+	// besides the signed in caller
+	TestUsers []string
+	// ACSHosts are the hostnames an sp's acs must be on to be tested
+	ACSHosts []string
+}
+
+// Admin controls access to the admin ui and api. Users with the built in
+// admin role hold every permission, Roles grants narrower sets.
+type Admin struct {
+	// Roles maps a role name to the permissions it grants
+	Roles map[string][]string
+	// UserRoles and GroupRoles grant roles by username or group
+	// membership, for bootstrapping the first admin and for repositories
+	// such as ldap where roles can't be stored on the user
+	UserRoles  map[string][]string
+	GroupRoles map[string][]string
+	APITokens  []APIToken
+	// AuditPath is the file admin actions are appended to as json lines
+	AuditPath string
+}
+
+// APIToken is a bearer token for automation against the admin api
+type APIToken struct {
+	Name        string
+	Token       string
+	Permissions []string
+}
+
 func New() (*Config, error) {
+	raw, err := readYamlConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if raw.Evil.Enabled && len(raw.Evil.ACSHosts) == 0 {
+		return nil, fmt.Errorf("evil.acs_hosts: required when evil is enabled")
+	}
+
+	lockout := Lockout{
+		AccountThreshold: withDefaultInt(raw.Lockout.AccountThreshold, 5),
+		IPThreshold:      withDefaultInt(raw.Lockout.IPThreshold, 50),
+	}
+	if lockout.BaseDelay, err = withDefaultDuration(raw.Lockout.BaseDelay, time.Second); err != nil {
+		return nil, fmt.Errorf("lockout.base_delay: %w", err)
+	}
+	if lockout.MaxDelay, err = withDefaultDuration(raw.Lockout.MaxDelay, 5*time.Minute); err != nil {
+		return nil, fmt.Errorf("lockout.max_delay: %w", err)
+	}
+	if lockout.Duration, err = withDefaultDuration(raw.Lockout.Duration, 15*time.Minute); err != nil {
+		return nil, fmt.Errorf("lockout.duration: %w", err)
+	}
+	if lockout.Store, err = lockoutStore(raw.Lockout.Store); err != nil {
+		return nil, fmt.Errorf("lockout.store: %w", err)
+	}
+
+	mail := Mail{
+		From:     withDefault(raw.Mail.From, "sso@localhost"),
+		SMTPAddr: withDefault(raw.Mail.SMTPAddr, "127.0.0.1:0"),
+		Username: raw.Mail.Username,
+		Password: raw.Mail.Password,
+		StartTLS: raw.Mail.StartTLS,
+		Capture:  raw.Mail.Capture || raw.Mail.SMTPAddr == "",
+		LogBody:  raw.Mail.LogBody,
+	}
+	if mail.ResetTTL, err = withDefaultDuration(raw.Mail.ResetTTL, 30*time.Minute); err != nil {
+		return nil, fmt.Errorf("mail.reset_ttl: %w", err)
+	}
+
+	policy := PasswordPolicy{
+		MinLength:        withDefaultInt(raw.PasswordPolicy.MinLength, 8),
+		MinClasses:       raw.PasswordPolicy.MinClasses,
+		DisallowUsername: raw.PasswordPolicy.DisallowUsername == nil || *raw.PasswordPolicy.DisallowUsername,
+		History:          raw.PasswordPolicy.History,
+		BreachList:       raw.PasswordPolicy.BreachList,
+	}
+	if policy.MaxAge, err = withDefaultDuration(raw.PasswordPolicy.MaxAge, 0); err != nil {
+		return nil, fmt.Errorf("password_policy.max_age: %w", err)
+	}
+
+	sp := ServiceProvider{
+		Port:           8123,
+		URL:            "http://localhost:8123",
+		IDPMetadataURL: "http://localhost:8124/metadata",
+		TraceSize:      withDefaultInt(raw.SP.TraceSize, 10),
+		Profile:        withDefault(raw.SP.Profile, "default"),
+	}
+	if sp.Profiles, err = spProfiles(raw.SP.Profiles); err != nil {
+		return nil, err
+	}
+	if _, ok := sp.Profiles[sp.Profile]; !ok {
+		return nil, fmt.Errorf("sp.profile: unknown profile %q", sp.Profile)
+	}
+
+	attributes, err := attributeSchema(raw.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if session.IdleTimeout, err = withDefaultDuration(raw.Session.IdleTimeout, 30*time.Minute); err != nil {
+		return nil, fmt.Errorf("session.idle_timeout: %w", err)
+	}
+	if session.Lifetime, err = withDefaultDuration(raw.Session.Lifetime, 12*time.Hour); err != nil {
+		return nil, fmt.Errorf("session.lifetime: %w", err)
+	}
+	if session.RememberLifetime, err = withDefaultDuration(raw.Session.RememberLifetime, 0); err != nil {
+		return nil, fmt.Errorf("session.remember_lifetime: %w", err)
+	}
+	if session.Store, err = sessionStore(raw.Session.Store); err != nil {
+		return nil, fmt.Errorf("session.store: %w", err)
+	}
+	for _, key := range raw.Session.Keys {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("session.keys: keys must be at least 32 characters")
+		}
+	}
+	session.Keys = raw.Session.Keys
+
 	return &Config{
 		IdentityProvider: IdentityProvider{
-			Port: 8124,
-		},
-		ServiceProvider: ServiceProvider{
-			Port: 8123,
+			Port:                 8124,
+			URL:                  "http://localhost:8124",
+			ServiceProvidersPath: "data/service_providers.json",
 		},
+		ServiceProvider: sp,
 		JSONRepo: JSONRepo{
 			Path: "data/repo.json",
 		},
+		Attributes: attributes,
+		SCIM: SCIM{
+			Tokens: raw.SCIM.Tokens,
+		},
+		Provisioning: Provisioning{
+			QueuePath:         "data/provisioning.json",
+			ReconcileInterval: 15 * time.Minute,
+			MaxAttempts:       10,
+			Connectors:        connectors(raw.Provisioning.Connectors),
+		},
+		Repository: RepositoryType(withDefault(raw.Repository, string(RepositoryJSON))),
+		LDAP: LDAP{
+			URL:                  withDefault(raw.LDAP.URL, "ldap://localhost:389"),
+			StartTLS:             raw.LDAP.StartTLS,
+			InsecureSkipVerify:   raw.LDAP.InsecureSkipVerify,
+			CACert:               raw.LDAP.CACert,
+			BindDN:               raw.LDAP.BindDN,
+			BindPassword:         raw.LDAP.BindPassword,
+			UserBaseDN:           raw.LDAP.UserBaseDN,
+			UserFilter:           withDefault(raw.LDAP.UserFilter, "(objectClass=inetOrgPerson)"),
+			LoginAttribute:       withDefault(raw.LDAP.LoginAttribute, "uid"),
+			IDAttribute:          withDefault(raw.LDAP.IDAttribute, "uidNumber"),
+			FirstAttribute:       withDefault(raw.LDAP.FirstAttribute, "givenName"),
+			LastAttribute:        withDefault(raw.LDAP.LastAttribute, "sn"),
+			EmailAttribute:       withDefault(raw.LDAP.EmailAttribute, "mail"),
+			GroupBaseDN:          withDefault(raw.LDAP.GroupBaseDN, raw.LDAP.UserBaseDN),
+			GroupFilter:          withDefault(raw.LDAP.GroupFilter, "(objectClass=groupOfNames)"),
+			GroupNameAttribute:   withDefault(raw.LDAP.GroupNameAttribute, "cn"),
+			GroupMemberAttribute: withDefault(raw.LDAP.GroupMemberAttribute, "member"),
+			AttributeMap:         raw.LDAP.AttributeMap,
+			PoolSize:             max(raw.LDAP.PoolSize, 4),
+			Timeout:              10 * time.Second,
+		},
+		LDAPServer: LDAPServer{
+			Addr:            raw.LDAPServer.Addr,
+			BaseDN:          withDefault(raw.LDAPServer.BaseDN, "dc=sso,dc=local"),
+			StartTLS:        raw.LDAPServer.StartTLS,
+			ServiceAccounts: serviceAccounts(raw.LDAPServer.ServiceAccounts),
+		},
+		Upstreams:      upstreams(raw.Upstreams),
+		Lockout:        lockout,
+		Mail:           mail,
+		PasswordPolicy: policy,
+		Admin: Admin{
+			Roles:      raw.Admin.Roles,
+			UserRoles:  raw.Admin.UserRoles,
+			GroupRoles: raw.Admin.GroupRoles,
+			APITokens:  apiTokens(raw.Admin.APITokens),
+			AuditPath:  withDefault(raw.Admin.AuditPath, "data/audit.log"),
+		},
+		Session: session,
+		Evil: Evil{
+			Enabled:   raw.Evil.Enabled,
+			TestUsers: raw.Evil.TestUsers,
+			ACSHosts:  raw.Evil.ACSHosts,
+		},
 	}, nil
 }
+
+// defaultAttributes is the schema when config has no attributes section,
+// the scim enterprise extension's attributes
+var defaultAttributes = []Attribute{
+	{Name: "department", FriendlyName: "Department", Type: AttributeTypeString},
+	{Name: "employeeNumber", FriendlyName: "Employee Number", Type: AttributeTypeString},
+	{Name: "manager", FriendlyName: "Manager", Type: AttributeTypeString},
+	{Name: "costCenter", FriendlyName: "Cost Center", Type: AttributeTypeString},
+}
+
+// attributeSchema reads the custom attribute schema. Types are string, bool
+// and date, multi makes a string attribute hold a list of values.
+func attributeSchema(raw []AttributeRaw) ([]Attribute, error) {
+	if raw == nil {
+		return defaultAttributes, nil
+	}
+
+	attrs := make([]Attribute, 0, len(raw))
+	seen := map[string]bool{}
+	for i, r := range raw {
+		if r.Name == "" {
+			return nil, fmt.Errorf("attributes[%d].name: required", i)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("attributes.%s: defined twice", r.Name)
+		}
+		seen[r.Name] = true
+
+		a := Attribute{
+			Name:         r.Name,
+			FriendlyName: withDefault(r.FriendlyName, r.Name),
+			Type:         AttributeType(withDefault(r.Type, string(AttributeTypeString))),
+		}
+		switch a.Type {
+		case AttributeTypeString:
+			if r.Multi {
+				a.Type = AttributeTypeMulti
+			}
+		case AttributeTypeBool, AttributeTypeDate:
+			if r.Multi {
+				return nil, fmt.Errorf("attributes.%s.multi: only string attributes can be multi valued", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("attributes.%s.type: unknown type %q", r.Name, r.Type)
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs, nil
+}
+
+func connectors(raw []ConnectorRaw) []Connector {
+	var c []Connector
+	for _, r := range raw {
+		c = append(c, Connector(r))
+	}
+	return c
+}
+
+// spProfiles reads the sp's profiles, each starting from the default
+// behaviour. A default profile is always there unless config replaces it.
+func spProfiles(raw map[string]SPProfileRaw) (map[string]SPProfile, error) {
+	profiles := map[string]SPProfile{"default": spProfile("default", SPProfileRaw{})}
+	for name, r := range raw {
+		p := spProfile(name, r)
+		if p.Binding != BindingRedirect && p.Binding != BindingPost {
+			return nil, fmt.Errorf("sp.profiles.%s.binding: unknown binding %q", name, p.Binding)
+		}
+		if p.ResponseBinding != BindingPost && p.ResponseBinding != BindingArtifact {
+			return nil, fmt.Errorf("sp.profiles.%s.response_binding: unknown binding %q", name, p.ResponseBinding)
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+func spProfile(name string, r SPProfileRaw) SPProfile {
+	return SPProfile{
+		Name:                   name,
+		EntityID:               withDefault(r.EntityID, "test_sp"),
+		Binding:                withDefault(r.Binding, BindingRedirect),
+		ResponseBinding:        withDefault(r.ResponseBinding, BindingPost),
+		ForceAuthn:             r.ForceAuthn,
+		IsPassive:              r.IsPassive,
+		AuthnContext:           r.AuthnContext,
+		AuthnContextComparison: r.AuthnContextComparison,
+		NameIDFormat:           r.NameIDFormat,
+		AllowCreate:            r.AllowCreate == nil || *r.AllowCreate,
+		SignRequest:            r.SignRequest == nil || *r.SignRequest,
+		AllowIDPInitiated:      r.AllowIDPInitiated == nil || *r.AllowIDPInitiated,
+	}
+}
+
+func sessionStore(raw SessionStoreRaw) (SessionStore, error) {
+	store := SessionStore{
+		Type:     SessionStoreType(withDefault(raw.Type, string(SessionStoreMemory))),
+		Path:     raw.Path,
+		DSN:      raw.DSN,
+		Addr:     raw.Addr,
+		Password: raw.Password,
+		DB:       raw.DB,
+	}
+
+	switch store.Type {
+	case SessionStoreMemory:
+	case SessionStoreFile:
+		store.Path = withDefault(store.Path, "data/sessions")
+	case SessionStoreSQLite:
+		store.Path = withDefault(store.Path, "data/sessions.sqlite")
+	case SessionStorePostgres:
+		if store.DSN == "" {
+			return store, fmt.Errorf("dsn is required for postgres")
+		}
+	case SessionStoreRedis:
+		store.Addr = withDefault(store.Addr, "localhost:6379")
+	default:
+		return store, fmt.Errorf("unknown type %q", store.Type)
+	}
+	return store, nil
+}
+
+// lockoutStore reads the counter store, which can't be memory as counters
+// have to survive a restart
+func lockoutStore(raw SessionStoreRaw) (SessionStore, error) {
+	store := SessionStore{
+		Type:     SessionStoreType(withDefault(raw.Type, string(SessionStoreFile))),
+		Path:     raw.Path,
+		DSN:      raw.DSN,
+		Addr:     raw.Addr,
+		Password: raw.Password,
+		DB:       raw.DB,
+	}
+
+	switch store.Type {
+	case SessionStoreFile:
+		store.Path = withDefault(store.Path, "data/lockout.json")
+	case SessionStoreSQLite:
+		store.Path = withDefault(store.Path, "data/lockout.sqlite")
+	case SessionStorePostgres:
+		if store.DSN == "" {
+			return store, fmt.Errorf("dsn is required for postgres")
+		}
+	case SessionStoreRedis:
+		store.Addr = withDefault(store.Addr, "localhost:6379")
+	default:
+		return store, fmt.Errorf("unknown type %q", store.Type)
+	}
+	return store, nil
+}
+
+func apiTokens(raw []APITokenRaw) []APIToken {
+	var t []APIToken
+	for _, r := range raw {
+		t = append(t, APIToken(r))
+	}
+	return t
+}
+
+func serviceAccounts(raw []ServiceAccountRaw) []ServiceAccount {
+	var a []ServiceAccount
+	for _, r := range raw {
+		a = append(a, ServiceAccount(r))
+	}
+	return a
+}
+
+func upstreams(raw []UpstreamRaw) []Upstream {
+	var u []Upstream
+	for _, r := range raw {
+		scopes := r.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		u = append(u, Upstream{
+			Name:         r.Name,
+			DisplayName:  withDefault(r.DisplayName, r.Name),
+			Type:         UpstreamType(r.Type),
+			Issuer:       r.Issuer,
+			ClientID:     r.ClientID,
+			ClientSecret: r.ClientSecret,
+			Scopes:       scopes,
+			MetadataURL:  r.MetadataURL,
+			TrustEmail:   r.TrustEmail,
+			TrustMFA:     r.TrustMFA,
+			JIT:          r.JIT,
+			MatchEmail:   r.MatchEmail,
+		})
+	}
+	return u
+}
+
+func withDefaultInt(i, def int) int {
+	if i == 0 {
+		return def
+	}
+	return i
+}
+
+func withDefaultDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func withDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
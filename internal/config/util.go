@@ -16,29 +16,209 @@ type KeyPairRaw struct {
 	Cert string `yaml:"cert"`
 }
 
+// SPRaw is the test sp's section, its key pair and how it behaves
+type SPRaw struct {
+	KeyPairRaw `yaml:",inline"`
+	TraceSize  int                     `yaml:"trace_size"`
+	Profile    string                  `yaml:"profile"`
+	Profiles   map[string]SPProfileRaw `yaml:"profiles"`
+}
+
+type SPProfileRaw struct {
+	EntityID               string `yaml:"entity_id"`
+	Binding                string `yaml:"binding"`
+	ResponseBinding        string `yaml:"response_binding"`
+	ForceAuthn             bool   `yaml:"force_authn"`
+	IsPassive              bool   `yaml:"is_passive"`
+	AuthnContext           string `yaml:"authn_context"`
+	AuthnContextComparison string `yaml:"authn_context_comparison"`
+	NameIDFormat           string `yaml:"name_id_format"`
+	AllowCreate            *bool  `yaml:"allow_create"`
+	SignRequest            *bool  `yaml:"sign_request"`
+	AllowIDPInitiated      *bool  `yaml:"allow_idp_initiated"`
+}
+
+type AttributeRaw struct {
+	Name         string `yaml:"name"`
+	FriendlyName string `yaml:"friendly_name"`
+	Type         string `yaml:"type"`
+	Multi        bool   `yaml:"multi"`
+}
+
+type SCIMRaw struct {
+	Tokens []string `yaml:"tokens"`
+}
+
+type ConnectorRaw struct {
+	Name     string `yaml:"name"`
+	EntityID string `yaml:"entity_id"`
+	URL      string `yaml:"url"`
+	Token    string `yaml:"token"`
+}
+
+type ProvisioningRaw struct {
+	Connectors []ConnectorRaw `yaml:"connectors"`
+}
+
+type LDAPRaw struct {
+	URL                  string            `yaml:"url"`
+	StartTLS             bool              `yaml:"start_tls"`
+	InsecureSkipVerify   bool              `yaml:"insecure_skip_verify"`
+	CACert               string            `yaml:"ca_cert"`
+	BindDN               string            `yaml:"bind_dn"`
+	BindPassword         string            `yaml:"bind_password"`
+	UserBaseDN           string            `yaml:"user_base_dn"`
+	UserFilter           string            `yaml:"user_filter"`
+	LoginAttribute       string            `yaml:"login_attribute"`
+	IDAttribute          string            `yaml:"id_attribute"`
+	FirstAttribute       string            `yaml:"first_attribute"`
+	LastAttribute        string            `yaml:"last_attribute"`
+	EmailAttribute       string            `yaml:"email_attribute"`
+	GroupBaseDN          string            `yaml:"group_base_dn"`
+	GroupFilter          string            `yaml:"group_filter"`
+	GroupNameAttribute   string            `yaml:"group_name_attribute"`
+	GroupMemberAttribute string            `yaml:"group_member_attribute"`
+	AttributeMap         map[string]string `yaml:"attribute_map"`
+	PoolSize             int               `yaml:"pool_size"`
+}
+
+type ServiceAccountRaw struct {
+	DN       string `yaml:"dn"`
+	Password string `yaml:"password"`
+}
+
+type LDAPServerRaw struct {
+	Addr            string              `yaml:"addr"`
+	BaseDN          string              `yaml:"base_dn"`
+	StartTLS        bool                `yaml:"start_tls"`
+	ServiceAccounts []ServiceAccountRaw `yaml:"service_accounts"`
+}
+
+type LockoutRaw struct {
+	Store            SessionStoreRaw `yaml:"store"`
+	AccountThreshold int             `yaml:"account_threshold"`
+	IPThreshold      int             `yaml:"ip_threshold"`
+	BaseDelay        string          `yaml:"base_delay"`
+	MaxDelay         string          `yaml:"max_delay"`
+	Duration         string          `yaml:"duration"`
+}
+
+type MailRaw struct {
+	From     string `yaml:"from"`
+	SMTPAddr string `yaml:"smtp_addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	StartTLS bool   `yaml:"start_tls"`
+	Capture  bool   `yaml:"capture"`
+	LogBody  bool   `yaml:"log_body"`
+	ResetTTL string `yaml:"reset_ttl"`
+}
+
+type PasswordPolicyRaw struct {
+	MinLength        int    `yaml:"min_length"`
+	MinClasses       int    `yaml:"min_classes"`
+	DisallowUsername *bool  `yaml:"disallow_username"`
+	History          int    `yaml:"history"`
+	MaxAge           string `yaml:"max_age"`
+	BreachList       string `yaml:"breach_list"`
+}
+
+type SessionRaw struct {
+	IdleTimeout      string          `yaml:"idle_timeout"`
+	Lifetime         string          `yaml:"lifetime"`
+	RememberLifetime string          `yaml:"remember_lifetime"`
+	Store            SessionStoreRaw `yaml:"store"`
+	Keys             []string        `yaml:"keys"`
+}
+
+type SessionStoreRaw struct {
+	Type     string `yaml:"type"`
+	Path     string `yaml:"path"`
+	DSN      string `yaml:"dsn"`
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+type AdminRaw struct {
+	Roles      map[string][]string `yaml:"roles"`
+	UserRoles  map[string][]string `yaml:"user_roles"`
+	GroupRoles map[string][]string `yaml:"group_roles"`
+	APITokens  []APITokenRaw       `yaml:"api_tokens"`
+	AuditPath  string              `yaml:"audit_path"`
+}
+
+type EvilRaw struct {
+	Enabled   bool     `yaml:"enabled"`
+	TestUsers []string `yaml:"test_users"`
+	ACSHosts  []string `yaml:"acs_hosts"`
+}
+
+type APITokenRaw struct {
+	Name        string   `yaml:"name"`
+	Token       string   `yaml:"token"`
+	Permissions []string `yaml:"permissions"`
+}
+
+type UpstreamRaw struct {
+	Name         string   `yaml:"name"`
+	DisplayName  string   `yaml:"display_name"`
+	Type         string   `yaml:"type"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+	MetadataURL  string   `yaml:"metadata_url"`
+	TrustEmail   bool     `yaml:"trust_email"`
+	TrustMFA     bool     `yaml:"trust_mfa"`
+	JIT          bool     `yaml:"jit"`
+	MatchEmail   bool     `yaml:"match_email"`
+}
+
 type YamlConfig struct {
-	IDP KeyPairRaw `yaml:"idp"`
-	SP  KeyPairRaw `yaml:"sp"`
+	IDP            KeyPairRaw        `yaml:"idp"`
+	SP             SPRaw             `yaml:"sp"`
+	Attributes     []AttributeRaw    `yaml:"attributes"`
+	SCIM           SCIMRaw           `yaml:"scim"`
+	Provisioning   ProvisioningRaw   `yaml:"provisioning"`
+	Repository     string            `yaml:"repository"`
+	LDAP           LDAPRaw           `yaml:"ldap"`
+	LDAPServer     LDAPServerRaw     `yaml:"ldap_server"`
+	Upstreams      []UpstreamRaw     `yaml:"upstreams"`
+	Lockout        LockoutRaw        `yaml:"lockout"`
+	Mail           MailRaw           `yaml:"mail"`
+	PasswordPolicy PasswordPolicyRaw `yaml:"password_policy"`
+	Admin          AdminRaw          `yaml:"admin"`
+	Session        SessionRaw        `yaml:"session"`
+	Evil           EvilRaw           `yaml:"evil"`
 }
 
-func GetKeyPair(name string) (*rsa.PrivateKey, *x509.Certificate, error) {
+func readYamlConfig() (*YamlConfig, error) {
 	filename, err := filepath.Abs("./config/config.yaml")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	yamlFile, err := os.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	var config YamlConfig
 	err = yaml.Unmarshal(yamlFile, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func GetKeyPair(name string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	config, err := readYamlConfig()
 	if err != nil {
 		panic(err)
 	}
 
 	var keyPairRaw KeyPairRaw
 	if name == "sp" {
-		keyPairRaw = config.SP
+		keyPairRaw = config.SP.KeyPairRaw
 	} else if name == "idp" {
 		keyPairRaw = config.IDP
 	} else {
@@ -0,0 +1,297 @@
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/crewjam/saml"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/template"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// totpIssuer names the account in authenticator apps
+const totpIssuer = "SSO"
+
+// sessionUser is the signed in user, routes using it sit behind requireAuth
+func (i *IdentityProvider) sessionUser(r *http.Request) (*model.User, error) {
+	session, err := i.sm.Get(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	return i.ctrl.GetUserByName(r.Context(), session.UID)
+}
+
+func groupNames(groups []model.Group) []string {
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// account is the self-service portal on the idp home page
+func (i *IdentityProvider) account(w http.ResponseWriter, r *http.Request) {
+	i.renderAccount(w, r, nil)
+}
+
+func (i *IdentityProvider) renderAccount(w http.ResponseWriter, r *http.Request, accountErr error) {
+	user, err := i.sessionUser(r)
+	if err != nil {
+		i.log.Error("getting account", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	groups, err := i.ctrl.GetUserGroups(r.Context(), user.ID)
+	if err != nil {
+		i.log.Error("getting account groups", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	sessions, err := i.sm.UserSessions(r.Context(), user.Name)
+	if err != nil {
+		i.log.Error("getting account sessions", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	perms, err := i.ctrl.UserPermissions(r.Context(), user)
+	if err != nil {
+		i.log.Error("getting account permissions", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	data := &model.IDPAccountData{
+		BaseData: model.BaseData{
+			PageTitle: "Account",
+		},
+		User:     *user,
+		Sessions: sessions,
+		Admin:    perms[model.PermissionUsersRead],
+	}
+	if accountErr != nil {
+		data.Error = true
+		data.ErrorMessage = accountErr.Error()
+	}
+
+	data.Groups = groupNames(groups)
+	for _, f := range attributeFields(i.ctrl.AttributeSchema(), user) {
+		if f.Value != "" {
+			data.Attributes = append(data.Attributes, f)
+		}
+	}
+	for _, d := range user.MFADevices {
+		if d.Confirmed {
+			data.Devices = append(data.Devices, d)
+		}
+	}
+
+	// the apps are the sps the user's groups let them use
+	sps, err := i.saml.ServiceProviders()
+	if err != nil {
+		i.log.Error("listing service providers", zap.Error(err))
+	}
+	for _, sp := range sps {
+		settings, err := i.saml.serviceProviders.Settings(sp.EntityID)
+		if err != nil {
+			i.log.Error("getting service provider settings", zap.Error(err))
+			continue
+		}
+		if !settings.Allows(data.Groups) {
+			continue
+		}
+
+		app := model.AppLink{
+			EntityID:  sp.EntityID,
+			Name:      appName(sp),
+			LaunchURL: "/sso/launch/" + url.PathEscape(sp.EntityID),
+		}
+		for _, a := range user.Apps {
+			if a.EntityID == sp.EntityID {
+				app.LastSignIn = a.Last
+			}
+		}
+		data.Apps = append(data.Apps, app)
+	}
+
+	err = template.Render(w, r, "idp/home.html", data)
+	if err != nil {
+		i.log.Error("error rendering idp/home.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) postAccountMFA(w http.ResponseWriter, r *http.Request) {
+	user, err := i.sessionUser(r)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+
+	r.ParseForm()
+	device, err := i.ctrl.BeginTOTP(r.Context(), user.Name, r.Form.Get("name"))
+	if err != nil {
+		i.log.Error("adding mfa device", zap.String("username", user.Name), zap.Error(err))
+		i.renderAccount(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/account/mfa/"+device.ID, http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) getAccountMFA(w http.ResponseWriter, r *http.Request) {
+	i.renderMFAEnroll(w, r, nil)
+}
+
+func (i *IdentityProvider) renderMFAEnroll(w http.ResponseWriter, r *http.Request, enrollErr error) {
+	user, err := i.sessionUser(r)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+
+	device, err := i.ctrl.GetMFADevice(r.Context(), user.Name, chi.URLParam(r, "id"))
+	if err != nil || device.Confirmed {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := &model.IDPMFAEnrollData{
+		BaseData: model.BaseData{
+			PageTitle: "Add Authenticator",
+		},
+		Device: *device,
+		URI:    totpURI(totpIssuer, user.Name, device.Secret),
+	}
+	if enrollErr != nil {
+		data.Error = true
+		data.ErrorMessage = enrollErr.Error()
+	}
+
+	err = template.Render(w, r, "idp/account_mfa.html", data)
+	if err != nil {
+		i.log.Error("error rendering idp/account_mfa.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) postAccountMFAConfirm(w http.ResponseWriter, r *http.Request) {
+	user, err := i.sessionUser(r)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+
+	r.ParseForm()
+	err = i.ctrl.ConfirmTOTP(r.Context(), user.Name, chi.URLParam(r, "id"), r.Form.Get("code"))
+	if errors.Is(err, errInvalidMFACode) {
+		i.renderMFAEnroll(w, r, err)
+		return
+	} else if err != nil {
+		i.log.Error("confirming mfa device", zap.String("username", user.Name), zap.Error(err))
+		i.renderAccount(w, r, err)
+		return
+	}
+
+	i.log.Info("mfa device added", zap.String("username", user.Name))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) postAccountMFADelete(w http.ResponseWriter, r *http.Request) {
+	user, err := i.sessionUser(r)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+
+	if err := i.ctrl.DeleteMFADevice(r.Context(), user.Name, chi.URLParam(r, "id")); err != nil {
+		i.log.Error("removing mfa device", zap.String("username", user.Name), zap.Error(err))
+		i.renderAccount(w, r, err)
+		return
+	}
+
+	i.log.Info("mfa device removed", zap.String("username", user.Name))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) postAccountSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	user, err := i.sessionUser(r)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+
+	if err := i.sm.RevokeSession(r.Context(), user.Name, chi.URLParam(r, "id")); err != nil {
+		i.log.Error("revoking session", zap.String("username", user.Name), zap.Error(err))
+		i.renderAccount(w, r, fmt.Errorf("revoking session: %w", err))
+		return
+	}
+
+	i.log.Info("session revoked", zap.String("username", user.Name))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// appName is the sp's display name from its metadata, its entity id when
+// it has none
+func appName(sp *saml.EntityDescriptor) string {
+	if sp.Organization != nil {
+		for _, name := range sp.Organization.OrganizationDisplayNames {
+			if name.Value != "" {
+				return name.Value
+			}
+		}
+	}
+	return sp.EntityID
+}
+
+// launchApp starts an idp initiated login at the service provider. The
+// RelayState is ?RelayState=, or the one the sp was registered with.
+func (i *IdentityProvider) launchApp(w http.ResponseWriter, r *http.Request) {
+	entityID, err := url.PathUnescape(chi.URLParam(r, "entityID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	settings, err := i.saml.serviceProviders.Settings(entityID)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		i.log.Error("getting service provider settings", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	user, err := i.sessionUser(r)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+	groups, err := i.ctrl.GetUserGroups(r.Context(), user.ID)
+	if err != nil {
+		i.log.Error("getting user groups", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+	if !settings.Allows(groupNames(groups)) {
+		http.Error(w, "you don't have access to "+entityID, http.StatusForbidden)
+		return
+	}
+
+	i.ctrl.RecordAppSignIn(r.Context(), user, entityID)
+	i.sm.RecordServiceProvider(r.Context(), entityID)
+
+	relayState := r.URL.Query().Get("RelayState")
+	if relayState == "" {
+		relayState = settings.RelayState
+	}
+	i.saml.IDP.ServeIDPInitiated(w, r, entityID, relayState)
+}
@@ -0,0 +1,150 @@
+package idp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ghaggin/sso/internal/audit"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/repository"
+	"go.uber.org/zap"
+)
+
+// principal is whoever is calling the admin ui or api
+type principal struct {
+	// Name is the username, or token:<name> for api tokens
+	Name        string
+	Token       bool
+	permissions map[model.Permission]bool
+}
+
+func (p *principal) Can(perm model.Permission) bool {
+	return p != nil && p.permissions[perm]
+}
+
+type principalKey struct{}
+
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// withPrincipal runs every request as p
+func withPrincipal(p *principal, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// authenticateAdmin resolves a bearer token or the signed in user. The
+// request is refused only when neither is present, routes check their own
+// permission with requirePermission.
+func (i *IdentityProvider) authenticateAdmin(r *http.Request) (*principal, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return nil, nil
+		}
+		t, ok := matchAPIToken(i.apiTokens, token)
+		if !ok {
+			return nil, nil
+		}
+		return &principal{
+			Name:        "token:" + t.name,
+			Token:       true,
+			permissions: t.permissions,
+		}, nil
+	}
+
+	session, ok := i.sm.Authenticated(r.Context())
+	if !ok {
+		return nil, nil
+	}
+
+	user, err := i.ctrl.GetUserByName(r.Context(), session.UID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	perms, err := i.ctrl.UserPermissions(r.Context(), user)
+	if err != nil {
+		return nil, err
+	}
+	return &principal{
+		Name:        user.Name,
+		permissions: perms,
+	}, nil
+}
+
+// requireAdmin guards the admin route group and audits every request to it,
+// including the ones it refuses
+func (i *IdentityProvider) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		event := audit.Event{
+			Method: r.Method,
+			Path:   r.URL.RequestURI(),
+			Addr:   remoteHost(r),
+		}
+		defer func() {
+			event.Status = rec.status
+			i.audit.Record(event)
+		}()
+
+		p, err := i.authenticateAdmin(r)
+		if err != nil {
+			i.log.Error("authenticating admin", zap.Error(err))
+			i.renderError(rec, r, err)
+			return
+		}
+
+		if p == nil {
+			// browsers are sent to log in, api clients get a challenge
+			if r.Method == http.MethodGet && r.Header.Get("Authorization") == "" {
+				i.loginFirst(rec, r)
+				return
+			}
+			rec.Header().Set("WWW-Authenticate", `Bearer realm="sso"`)
+			http.Error(rec, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		event.Actor = p.Name
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+func (i *IdentityProvider) requirePermission(perm model.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !principalFrom(r.Context()).Can(perm) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusRecorder keeps the response status for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
@@ -0,0 +1,123 @@
+package idp
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+)
+
+const (
+	attributeFormPrefix = "attr_"
+	attributeDateLayout = time.DateOnly
+)
+
+// parseAttributeForm reads the custom attribute inputs rendered by
+// attributeFields and validates them against the schema
+func parseAttributeForm(schema []config.Attribute, form url.Values) (map[string][]string, error) {
+	attrs := map[string][]string{}
+	for _, a := range schema {
+		raw := strings.TrimSpace(form.Get(attributeFormPrefix + a.Name))
+
+		switch a.Type {
+		case config.AttributeTypeString:
+			if raw != "" {
+				attrs[a.Name] = []string{raw}
+			}
+		case config.AttributeTypeMulti:
+			var values []string
+			for _, v := range strings.Split(raw, "\n") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+			if len(values) > 0 {
+				attrs[a.Name] = values
+			}
+		case config.AttributeTypeBool:
+			attrs[a.Name] = []string{fmt.Sprint(raw != "")}
+		case config.AttributeTypeDate:
+			if raw == "" {
+				continue
+			}
+			if _, err := time.Parse(attributeDateLayout, raw); err != nil {
+				return nil, fmt.Errorf("attribute %s: invalid date %q", a.Name, raw)
+			}
+			attrs[a.Name] = []string{raw}
+		default:
+			return nil, fmt.Errorf("attribute %s: unknown type %q", a.Name, a.Type)
+		}
+	}
+
+	return attrs, nil
+}
+
+// attributeFields builds the form inputs for the schema populated with the
+// user's current values
+func attributeFields(schema []config.Attribute, user *model.User) []model.AttributeField {
+	fields := make([]model.AttributeField, 0, len(schema))
+	for _, a := range schema {
+		var values []string
+		if user != nil {
+			values = user.Attributes[a.Name]
+		}
+
+		f := model.AttributeField{
+			Name:         attributeFormPrefix + a.Name,
+			FriendlyName: a.FriendlyName,
+			Type:         string(a.Type),
+			Value:        strings.Join(values, "\n"),
+		}
+		if f.FriendlyName == "" {
+			f.FriendlyName = a.Name
+		}
+		if a.Type == config.AttributeTypeBool {
+			f.Checked = len(values) > 0 && values[0] == "true"
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+// samlAttributes converts the user's stored values into attributes for
+// saml.Session.CustomAttributes. Values for attributes no longer in the
+// schema are not released.
+func samlAttributes(schema []config.Attribute, user *model.User) []saml.Attribute {
+	attrs := []saml.Attribute{}
+	for _, a := range schema {
+		values := user.Attributes[a.Name]
+		if len(values) == 0 {
+			continue
+		}
+
+		valueType := "xs:string"
+		switch a.Type {
+		case config.AttributeTypeBool:
+			valueType = "xs:boolean"
+		case config.AttributeTypeDate:
+			valueType = "xs:date"
+		}
+
+		attr := saml.Attribute{
+			FriendlyName: a.FriendlyName,
+			Name:         a.Name,
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+		}
+		for _, v := range values {
+			attr.Values = append(attr.Values, saml.AttributeValue{
+				Type:  valueType,
+				Value: v,
+			})
+		}
+
+		attrs = append(attrs, attr)
+	}
+
+	return attrs
+}
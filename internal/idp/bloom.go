@@ -0,0 +1,109 @@
+package idp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"strings"
+)
+
+// breachFalsePositiveRate is what the breach list filter is sized for, a
+// false positive only rejects a password that wasn't actually breached
+const breachFalsePositiveRate = 0.001
+
+// bloomFilter holds sha1 digests in a fixed number of bits. Positions come
+// from double hashing the digest, which is already uniformly distributed.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	n = max(n, 1)
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (b *bloomFilter) positions(sum [sha1.Size]byte, fn func(uint64) bool) {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	for i := uint64(0); i < b.k; i++ {
+		if !fn((h1 + i*h2) % b.m) {
+			return
+		}
+	}
+}
+
+func (b *bloomFilter) add(sum [sha1.Size]byte) {
+	b.positions(sum, func(pos uint64) bool {
+		b.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+func (b *bloomFilter) test(sum [sha1.Size]byte) bool {
+	found := true
+	b.positions(sum, func(pos uint64) bool {
+		found = b.bits[pos/64]&(1<<(pos%64)) != 0
+		return found
+	})
+	return found
+}
+
+// loadBreachList reads a breached password file into a bloom filter. Lines
+// are plain text passwords or sha1 hex digests with an optional :count, so
+// haveibeenpwned downloads can be used as they are.
+func loadBreachList(path string) (*bloomFilter, error) {
+	n := 0
+	err := scanLines(path, func(string) { n++ })
+	if err != nil {
+		return nil, err
+	}
+
+	filter := newBloomFilter(n, breachFalsePositiveRate)
+	err = scanLines(path, func(line string) {
+		filter.add(breachDigest(line))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func scanLines(path string, fn func(string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimRight(s.Text(), "\r"); line != "" {
+			fn(line)
+		}
+	}
+	return s.Err()
+}
+
+// breachDigest is the sha1 of a breach list line, taking lines that are
+// already a digest as they are
+func breachDigest(line string) [sha1.Size]byte {
+	hash, _, _ := strings.Cut(line, ":")
+	var sum [sha1.Size]byte
+	if len(hash) == 2*sha1.Size {
+		if _, err := hex.Decode(sum[:], []byte(hash)); err == nil {
+			return sum
+		}
+	}
+	return sha1.Sum([]byte(line))
+}
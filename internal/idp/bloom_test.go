@@ -0,0 +1,54 @@
+package idp
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	b := newBloomFilter(n, breachFalsePositiveRate)
+	for i := 0; i < n; i++ {
+		b.add(sha1.Sum([]byte(fmt.Sprintf("in-%d", i))))
+	}
+
+	// everything added is found
+	for i := 0; i < n; i++ {
+		require.True(t, b.test(sha1.Sum([]byte(fmt.Sprintf("in-%d", i)))), i)
+	}
+
+	// and little else, allowing for chance at ten times the target rate
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if b.test(sha1.Sum([]byte(fmt.Sprintf("out-%d", i)))) {
+			falsePositives++
+		}
+	}
+	require.Less(t, float64(falsePositives), n*breachFalsePositiveRate*10)
+}
+
+func TestLoadBreachList(t *testing.T) {
+	digest := sha1.Sum([]byte("hunter2"))
+	lines := []string{
+		"password",
+		// haveibeenpwned lines are upper case hex with a count
+		strings.ToUpper(fmt.Sprintf("%x", digest)) + ":42",
+		"windows-line\r",
+		"",
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600))
+
+	b, err := loadBreachList(path)
+	require.NoError(t, err)
+	for _, password := range []string{"password", "hunter2", "windows-line"} {
+		require.True(t, b.test(sha1.Sum([]byte(password))), password)
+	}
+	require.False(t, b.test(sha1.Sum([]byte("correct-Horse-battery-7"))))
+}
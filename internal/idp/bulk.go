@@ -0,0 +1,452 @@
+package idp
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/repository"
+)
+
+type BulkFormat string
+
+const (
+	BulkFormatCSV  BulkFormat = "csv"
+	BulkFormatJSON BulkFormat = "json"
+
+	// multiValueSeparator joins multi-valued attributes in a csv cell
+	multiValueSeparator = "|"
+)
+
+var (
+	errUnknownFormat = errors.New("unknown format, expected csv or json")
+)
+
+// BulkUser is one user in an import or export file
+type BulkUser struct {
+	Username     string              `json:"username"`
+	Password     string              `json:"password,omitempty"`
+	PasswordHash string              `json:"password_hash,omitempty"`
+	First        string              `json:"first"`
+	Last         string              `json:"last"`
+	Email        string              `json:"email"`
+	Disabled     bool                `json:"disabled,omitempty"`
+	Attributes   map[string][]string `json:"attributes,omitempty"`
+}
+
+// ImportReport is the per row outcome of an import
+type ImportReport struct {
+	DryRun  bool        `json:"dryRun"`
+	Created int         `json:"created"`
+	Updated int         `json:"updated"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+type ImportRow struct {
+	Line     int    `json:"line"`
+	Username string `json:"username"`
+	Action   string `json:"action"`
+	Error    string `json:"error,omitempty"`
+}
+
+func ParseBulkFormat(s string) (BulkFormat, error) {
+	switch f := BulkFormat(strings.ToLower(s)); f {
+	case BulkFormatCSV, BulkFormatJSON:
+		return f, nil
+	}
+	return "", errUnknownFormat
+}
+
+// ImportUsers streams users from r and upserts them by username. Rows
+// that fail validation are reported and skipped. With dryRun nothing is
+// written but the report shows what would happen.
+func (c *Controller) ImportUsers(ctx context.Context, r io.Reader, format BulkFormat, dryRun bool) (*ImportReport, error) {
+	var next func() (*BulkUser, int, error)
+	switch format {
+	case BulkFormatCSV:
+		var err error
+		if next, err = csvReader(r, c.attributes); err != nil {
+			return nil, err
+		}
+	case BulkFormatJSON:
+		next = jsonReader(r)
+	default:
+		return nil, errUnknownFormat
+	}
+
+	report := &ImportReport{DryRun: dryRun}
+	seen := map[string]bool{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		bu, line, err := next()
+		if errors.Is(err, io.EOF) {
+			return report, nil
+		}
+		var badRow *rowError
+		if err != nil && !errors.As(err, &badRow) {
+			// the rest of the stream can't be read
+			if line == 0 {
+				return nil, fmt.Errorf("reading import: %w", err)
+			}
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		row := ImportRow{Line: line}
+		if bu != nil {
+			row.Username = bu.Username
+		}
+
+		if err == nil && seen[bu.Username] {
+			err = errors.New("duplicate username in import")
+		}
+		if err == nil {
+			seen[bu.Username] = true
+			row.Action, err = c.importUser(ctx, bu, dryRun)
+		}
+
+		if err != nil {
+			row.Action = "error"
+			row.Error = err.Error()
+			report.Failed++
+		} else if row.Action == "create" {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+
+		report.Rows = append(report.Rows, row)
+	}
+}
+
+// rowError is a row that couldn't be read, the reader can go on to the
+// next one
+type rowError struct {
+	err error
+}
+
+func (e *rowError) Error() string { return e.err.Error() }
+func (e *rowError) Unwrap() error { return e.err }
+
+func (c *Controller) importUser(ctx context.Context, bu *BulkUser, dryRun bool) (string, error) {
+	if bu.Username == "" {
+		return "", errors.New("username is required")
+	}
+	if bu.Email != "" && !strings.Contains(bu.Email, "@") {
+		return "", fmt.Errorf("invalid email %q", bu.Email)
+	}
+	if bu.Password != "" && bu.PasswordHash != "" {
+		return "", errors.New("only one of password and password_hash may be set")
+	}
+	if bu.PasswordHash != "" && !isPasswordHash(bu.PasswordHash) {
+		return "", errors.New("password_hash is not a bcrypt hash")
+	}
+
+	attrs, err := normalizeAttributes(c.attributes, bu.Attributes)
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := c.repo.GetUserByName(ctx, bu.Username)
+	if errors.Is(err, repository.ErrNotFound) {
+		if bu.Password == "" && bu.PasswordHash == "" {
+			return "", errors.New("password or password_hash is required for new users")
+		}
+		if dryRun {
+			return "create", nil
+		}
+
+		user := &model.User{
+			Name:       bu.Username,
+			Password:   bu.Password,
+			First:      bu.First,
+			Last:       bu.Last,
+			Email:      bu.Email,
+			Disabled:   bu.Disabled,
+			Attributes: attrs,
+		}
+		if bu.PasswordHash != "" {
+			c.storePassword(user, bu.PasswordHash, nil)
+			return "create", c.addUser(ctx, user)
+		}
+		return "create", c.CreateUser(ctx, user)
+	} else if err != nil {
+		return "", err
+	}
+
+	if err := c.checkManage(ctx, existing); err != nil {
+		return "", err
+	}
+	if dryRun {
+		return "update", nil
+	}
+
+	existing.First = bu.First
+	existing.Last = bu.Last
+	existing.Email = bu.Email
+	existing.Disabled = bu.Disabled
+	existing.Attributes = attrs
+	if bu.PasswordHash != "" {
+		if bu.PasswordHash != existing.Password {
+			c.storePassword(existing, bu.PasswordHash, existing)
+		}
+		return "update", c.saveUser(ctx, existing)
+	}
+	if bu.Password != "" {
+		existing.Password = bu.Password
+	}
+	return "update", c.UpdateUser(ctx, existing)
+}
+
+// ExportUsers writes every user to w. Password hashes are only included
+// when hashes is set and never for legacy plain text passwords.
+func (c *Controller) ExportUsers(ctx context.Context, w io.Writer, format BulkFormat, hashes bool) error {
+	users, err := c.repo.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	toBulk := func(u *model.User) *BulkUser {
+		bu := &BulkUser{
+			Username:   u.Name,
+			First:      u.First,
+			Last:       u.Last,
+			Email:      u.Email,
+			Disabled:   u.Disabled,
+			Attributes: u.Attributes,
+		}
+		if hashes && isPasswordHash(u.Password) {
+			bu.PasswordHash = u.Password
+		}
+		return bu
+	}
+
+	switch format {
+	case BulkFormatJSON:
+		if _, err := io.WriteString(w, "[\n"); err != nil {
+			return err
+		}
+		for i := range users {
+			b, err := json.Marshal(toBulk(&users[i]))
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				if _, err := io.WriteString(w, ",\n"); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(w, "\n]\n")
+		return err
+	case BulkFormatCSV:
+		cw := csv.NewWriter(w)
+		header := []string{"username", "password_hash", "first", "last", "email", "disabled"}
+		for _, a := range c.attributes {
+			header = append(header, a.Name)
+		}
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+
+		for i := range users {
+			bu := toBulk(&users[i])
+			record := []string{bu.Username, bu.PasswordHash, bu.First, bu.Last, bu.Email, strconv.FormatBool(bu.Disabled)}
+			for _, a := range c.attributes {
+				record = append(record, strings.Join(bu.Attributes[a.Name], multiValueSeparator))
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return errUnknownFormat
+}
+
+// csvReader reads users by header name. Columns named after custom
+// attributes populate them, multi-valued cells are separated by "|".
+func csvReader(r io.Reader, schema []config.Attribute) (func() (*BulkUser, int, error), error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+
+	attrNames := map[string]bool{}
+	for _, a := range schema {
+		attrNames[a.Name] = true
+	}
+
+	columns := map[string]int{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		switch h {
+		case "username", "password", "password_hash", "first", "last", "email", "disabled":
+		default:
+			if !attrNames[h] {
+				return nil, fmt.Errorf("unknown csv column %q", h)
+			}
+		}
+		columns[h] = i
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, errors.New("csv header must contain username")
+	}
+
+	return func() (*BulkUser, int, error) {
+		record, err := cr.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return nil, parseErr.Line, &rowError{err}
+			}
+			return nil, 0, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		get := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		bu := &BulkUser{
+			Username:     get("username"),
+			Password:     get("password"),
+			PasswordHash: get("password_hash"),
+			First:        get("first"),
+			Last:         get("last"),
+			Email:        get("email"),
+			Attributes:   map[string][]string{},
+		}
+
+		if raw := get("disabled"); raw != "" {
+			bu.Disabled, err = strconv.ParseBool(raw)
+			if err != nil {
+				return bu, line, &rowError{fmt.Errorf("invalid disabled value %q", raw)}
+			}
+		}
+
+		for _, a := range schema {
+			raw := get(a.Name)
+			if raw == "" {
+				continue
+			}
+			if a.Type == config.AttributeTypeMulti {
+				bu.Attributes[a.Name] = strings.Split(raw, multiValueSeparator)
+			} else {
+				bu.Attributes[a.Name] = []string{raw}
+			}
+		}
+
+		return bu, line, nil
+	}, nil
+}
+
+// jsonReader streams users from a json array without loading the whole
+// document. The returned line is the index of the user in the array.
+func jsonReader(r io.Reader) func() (*BulkUser, int, error) {
+	dec := json.NewDecoder(r)
+	started := false
+	n := 0
+
+	return func() (*BulkUser, int, error) {
+		if !started {
+			started = true
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, 0, err
+			}
+			if d, ok := tok.(json.Delim); !ok || d != '[' {
+				return nil, 0, fmt.Errorf("expected json array, got %v", tok)
+			}
+		}
+
+		if !dec.More() {
+			// More hides read errors, the closing bracket reports them
+			if _, err := dec.Token(); err != nil {
+				return nil, n, err
+			}
+			return nil, n, io.EOF
+		}
+
+		n++
+		bu := &BulkUser{}
+		err := dec.Decode(bu)
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return bu, n, &rowError{err}
+		}
+		return bu, n, err
+	}
+}
+
+// normalizeAttributes validates imported attribute values against the
+// schema and canonicalises booleans and dates
+func normalizeAttributes(schema []config.Attribute, attrs map[string][]string) (map[string][]string, error) {
+	types := map[string]config.AttributeType{}
+	for _, a := range schema {
+		types[a.Name] = a.Type
+	}
+
+	out := map[string][]string{}
+	for name, values := range attrs {
+		t, ok := types[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown attribute %q", name)
+		}
+
+		var clean []string
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v != "" {
+				clean = append(clean, v)
+			}
+		}
+		if len(clean) == 0 {
+			continue
+		}
+		if t != config.AttributeTypeMulti && len(clean) > 1 {
+			return nil, fmt.Errorf("attribute %s: only one value allowed", name)
+		}
+
+		switch t {
+		case config.AttributeTypeBool:
+			b, err := strconv.ParseBool(clean[0])
+			if err != nil {
+				return nil, fmt.Errorf("attribute %s: invalid boolean %q", name, clean[0])
+			}
+			clean[0] = strconv.FormatBool(b)
+		case config.AttributeTypeDate:
+			if _, err := time.Parse(attributeDateLayout, clean[0]); err != nil {
+				return nil, fmt.Errorf("attribute %s: invalid date %q", name, clean[0])
+			}
+		}
+
+		out[name] = clean
+	}
+
+	return out, nil
+}
@@ -0,0 +1,113 @@
+package idp
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/template"
+	"go.uber.org/zap"
+)
+
+// passwordChangeUser is who may change their password: a login held back by
+// an expired password, or the signed in user
+func (i *IdentityProvider) passwordChangeUser(r *http.Request) (username string, expired bool, ok bool) {
+	if pending, ok := i.pendingLogin(r, model.PendingPasswordChange); ok {
+		return pending.UID, true, true
+	}
+
+	session, ok := i.sm.Authenticated(r.Context())
+	if !ok {
+		return "", false, false
+	}
+	return session.UID, false, true
+}
+
+func (i *IdentityProvider) getPasswordChange(w http.ResponseWriter, r *http.Request) {
+	_, expired, ok := i.passwordChangeUser(r)
+	if !ok {
+		i.loginFirst(w, r)
+		return
+	}
+
+	i.renderPasswordChange(w, r, &model.IDPPasswordChangeData{Expired: expired})
+}
+
+func (i *IdentityProvider) postPasswordChange(w http.ResponseWriter, r *http.Request) {
+	username, expired, ok := i.passwordChangeUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	r.ParseForm()
+	password := r.Form.Get("password")
+	data := &model.IDPPasswordChangeData{Expired: expired}
+
+	// the signed in user confirms who they are, throttled like a login
+	if !expired {
+		addr := remoteHost(r)
+		err := i.limiter.Check(r.Context(), username, addr)
+		if err == nil {
+			var valid bool
+			valid, err = i.ctrl.ValidateLogin(r.Context(), username, r.Form.Get("current"))
+			if err == nil && !valid {
+				err = errors.New("current password is incorrect")
+				if err := i.limiter.Fail(r.Context(), username, addr); err != nil {
+					i.log.Error("recording failed login", zap.Error(err))
+				}
+			}
+		}
+		if err != nil {
+			i.log.Error("failed password change", zap.String("username", username), zap.String("addr", addr), zap.Error(err))
+			data.Error = true
+			data.ErrorMessage = err.Error()
+			i.renderPasswordChange(w, r, data)
+			return
+		}
+	}
+
+	if password != r.Form.Get("confirm") {
+		data.Error = true
+		data.ErrorMessage = "passwords do not match"
+		i.renderPasswordChange(w, r, data)
+		return
+	}
+
+	if err := i.ctrl.ChangePassword(r.Context(), username, password); err != nil {
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		data.Violations = policyViolations(err)
+		i.renderPasswordChange(w, r, data)
+		return
+	}
+
+	i.log.Info("password changed", zap.String("username", username), zap.Bool("expired", expired))
+
+	if expired {
+		pending, _ := i.pendingLogin(r, model.PendingPasswordChange)
+		if err := i.sm.SetAuthenticated(r, username, pending != nil && pending.Remember); err != nil {
+			i.renderError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/redirect", http.StatusSeeOther)
+		return
+	}
+
+	// a new password is a change of credentials, like a login
+	if err := i.sm.RenewToken(r.Context()); err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+
+	i.renderPasswordChange(w, r, &model.IDPPasswordChangeData{Message: "Your password has been changed."})
+}
+
+func (i *IdentityProvider) renderPasswordChange(w http.ResponseWriter, r *http.Request, data *model.IDPPasswordChangeData) {
+	data.PageTitle = "Change Password"
+	err := template.Render(w, r, "idp/password_change.html", data)
+	if err != nil {
+		i.log.Error("error rendering password_change.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
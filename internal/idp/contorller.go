@@ -2,49 +2,316 @@ package idp
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/ghaggin/sso/internal/config"
 	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/provisioning"
 	"github.com/ghaggin/sso/internal/repository"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
 
 type Controller struct {
-	repo repository.Repository
-	log  *zap.Logger
+	repo       repository.Repository
+	log        *zap.Logger
+	attributes []config.Attribute
+	prov       *provisioning.Provisioner
+	resetTTL   time.Duration
+	policy     *passwordPolicy
+	roles      *roles
 }
 
 type ControllerParams struct {
 	fx.In
 
 	Logger *zap.Logger
+	Config *config.Config
 	Repo   repository.Repository
+	Prov   *provisioning.Provisioner
 }
 
 func NewController(p ControllerParams) (*Controller, error) {
+	policy, err := newPasswordPolicy(p.Config.PasswordPolicy, p.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := newRoles(p.Config.Admin)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Controller{
-		log:  p.Logger,
-		repo: p.Repo,
+		log:        p.Logger,
+		repo:       p.Repo,
+		attributes: p.Config.Attributes,
+		prov:       p.Prov,
+		resetTTL:   p.Config.Mail.ResetTTL,
+		policy:     policy,
+		roles:      roles,
 	}, nil
 }
 
 func (c *Controller) ValidateLogin(ctx context.Context, username string, password string) (bool, error) {
+	if auth, ok := c.repo.(repository.Authenticator); ok {
+		return auth.Authenticate(ctx, username, password)
+	}
+
 	u, err := c.repo.GetUserByName(ctx, username)
 	if err != nil {
 		return false, err
 	}
 
-	if u.Password == password {
+	if checkPassword(u.Password, password) && !u.Disabled {
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// CreateUser stores a new user. The password must meet the password policy
+// and is hashed.
 func (c *Controller) CreateUser(ctx context.Context, user *model.User) error {
-	return c.repo.AddUser(ctx, user)
+	if err := c.setPassword(user, nil); err != nil {
+		return err
+	}
+	return c.addUser(ctx, user)
+}
+
+// addUser stores a user whose password has already been set, or who has
+// none because they sign in upstream
+func (c *Controller) addUser(ctx context.Context, user *model.User) error {
+	// admin.user_roles can name a user that doesn't exist yet
+	if err := c.checkManage(ctx, user); err != nil {
+		return err
+	}
+
+	err := c.repo.AddUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	c.prov.Enqueue(provisioning.OpUpsert, user)
+	return nil
+}
+
+// UpdateUser saves the user and pushes the change downstream, disabled
+// users are deactivated at the service providers
+func (c *Controller) UpdateUser(ctx context.Context, user *model.User) error {
+	previous, err := c.repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if err := c.checkManage(ctx, previous); err != nil {
+		return err
+	}
+	if err := c.checkManage(ctx, user); err != nil {
+		return err
+	}
+
+	if user.Password != previous.Password {
+		err = c.setPassword(user, previous)
+	} else if user.Password != "" && !isPasswordHash(user.Password) {
+		// stored plain text from before hashing is migrated on save
+		user.Password, err = hashPassword(user.Password)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.saveUser(ctx, user)
+}
+
+// saveUser stores the user as given and pushes the change downstream
+func (c *Controller) saveUser(ctx context.Context, user *model.User) error {
+	err := c.repo.UpdateUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	c.prov.Enqueue(provisioning.OpUpsert, user)
+	return nil
+}
+
+// setPassword checks the user's new password against the policy, hashes it
+// and moves the previous one into the history. Passwords that look like
+// bcrypt hashes are hashed like any other.
+func (c *Controller) setPassword(user *model.User, previous *model.User) error {
+	if user.Password == "" {
+		return &PolicyError{Violations: []string{"password is required"}}
+	}
+	if err := c.policy.check(user, user.Password, previous); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+
+	c.storePassword(user, hash, previous)
+	return nil
+}
+
+// storePassword sets the user's password to the bcrypt hash without a
+// policy check and moves the previous one into the history. Only bulk
+// import's password_hash comes in this way.
+func (c *Controller) storePassword(user *model.User, hash string, previous *model.User) {
+	var history []string
+	if previous != nil && c.policy.cfg.History > 1 {
+		history = c.policy.history(previous)
+		history = history[:min(len(history), c.policy.cfg.History-1)]
+	}
+
+	user.Password = hash
+	user.PasswordChanged = time.Now().UTC()
+	user.PasswordHistory = history
+}
+
+// ChangePassword sets a new password for the user, subject to the password
+// policy
+func (c *Controller) ChangePassword(ctx context.Context, username, password string) error {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	user.Password = password
+	return c.UpdateUser(ctx, user)
+}
+
+// PasswordExpired reports whether the user has to change their password
+// before logging in. Directory users are left to the directory's policy.
+func (c *Controller) PasswordExpired(ctx context.Context, username string) (bool, error) {
+	if _, ok := c.repo.(repository.Authenticator); ok {
+		return false, nil
+	}
+
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return c.policy.expired(user), nil
+}
+
+// RecordAppSignIn notes that the user signed in to the service provider.
+// It is best effort, a read only directory simply doesn't keep the record.
+func (c *Controller) RecordAppSignIn(ctx context.Context, user *model.User, entityID string) {
+	now := time.Now().UTC()
+	found := false
+	// copied so the repository's record isn't modified in place
+	user.Apps = append([]model.AppSignIn(nil), user.Apps...)
+	for i := range user.Apps {
+		if user.Apps[i].EntityID == entityID {
+			user.Apps[i].Last = now
+			found = true
+		}
+	}
+	if !found {
+		user.Apps = append(user.Apps, model.AppSignIn{EntityID: entityID, Last: now})
+	}
+
+	err := c.repo.UpdateUser(ctx, user)
+	if err != nil && !errors.Is(err, repository.ErrReadOnly) {
+		c.log.Error("recording app sign in", zap.String("user", user.Name), zap.String("entityID", entityID), zap.Error(err))
+	}
+}
+
+func (c *Controller) GetUser(ctx context.Context, id int) (*model.User, error) {
+	return c.repo.GetUserByID(ctx, id)
+}
+
+func (c *Controller) GetUserByName(ctx context.Context, name string) (*model.User, error) {
+	return c.repo.GetUserByName(ctx, name)
+}
+
+func (c *Controller) DeleteUser(ctx context.Context, id int) error {
+	user, err := c.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := c.checkManage(ctx, user); err != nil {
+		return err
+	}
+
+	err = c.repo.DeleteUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	c.prov.Enqueue(provisioning.OpDeprovision, user)
+	return nil
 }
 
 func (c *Controller) GetUsers(ctx context.Context) ([]model.User, error) {
 	return c.repo.GetUsers(ctx)
 }
+
+func (c *Controller) CreateGroup(ctx context.Context, group *model.Group) error {
+	if err := c.checkManageGroup(ctx, group.Name); err != nil {
+		return err
+	}
+	return c.repo.AddGroup(ctx, group)
+}
+
+// UpdateGroup saves the group, renaming a group into or out of
+// admin.group_roles counts as changing both
+func (c *Controller) UpdateGroup(ctx context.Context, group *model.Group) error {
+	previous, err := c.repo.GetGroupByID(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	if err := c.checkManageGroup(ctx, previous.Name); err != nil {
+		return err
+	}
+	if err := c.checkManageGroup(ctx, group.Name); err != nil {
+		return err
+	}
+	return c.repo.UpdateGroup(ctx, group)
+}
+
+func (c *Controller) DeleteGroup(ctx context.Context, id int) error {
+	group, err := c.repo.GetGroupByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := c.checkManageGroup(ctx, group.Name); err != nil {
+		return err
+	}
+	return c.repo.DeleteGroup(ctx, id)
+}
+
+func (c *Controller) GetGroup(ctx context.Context, id int) (*model.Group, error) {
+	return c.repo.GetGroupByID(ctx, id)
+}
+
+func (c *Controller) GetGroups(ctx context.Context) ([]model.Group, error) {
+	return c.repo.GetGroups(ctx)
+}
+
+// GetUserGroups returns the groups the user is a member of
+func (c *Controller) GetUserGroups(ctx context.Context, id int) ([]model.Group, error) {
+	groups, err := c.repo.GetGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var member []model.Group
+	for _, g := range groups {
+		for _, m := range g.Members {
+			if m == id {
+				member = append(member, g)
+				break
+			}
+		}
+	}
+
+	return member, nil
+}
+
+// AttributeSchema returns the configured custom user attributes
+func (c *Controller) AttributeSchema() []config.Attribute {
+	return c.attributes
+}
@@ -0,0 +1,774 @@
+package idp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/template"
+	dsig "github.com/russellhaering/goxmldsig"
+	"go.uber.org/zap"
+)
+
+// Adversarial testing: an sp registered with evil set can be sent a run of
+// deliberately broken or malicious responses. Each goes straight to the
+// sp's acs over the back channel, unsolicited, and the sp is taken to have
+// accepted it when it answers with anything but an error status. The
+// responses carry real idp signatures, so it is off unless config enables
+// it and only tests the caller's own account or configured test users
+// against acs urls on the allowed hosts.
+
+// Outcomes of a scenario. Review is for a response a correct sp may accept,
+// where only what it made of the response tells whether it was fooled.
+const (
+	EvilPass   = "pass"
+	EvilFail   = "fail"
+	EvilReview = "review"
+	EvilError  = "error"
+)
+
+const (
+	// evilAudience and evilACS stand in for another sp
+	evilAudience = "https://evil.test/saml/metadata"
+	evilACS      = "https://evil.test/saml/acs"
+	// evilSuffix is what the comment injected into a NameID hides
+	evilSuffix = ".evil.test"
+)
+
+var errNotEvil = errors.New("service provider is not registered for adversarial testing")
+
+// EvilResult is how the sp took one scenario's response
+type EvilResult struct {
+	Scenario    string `json:"scenario"`
+	Description string `json:"description"`
+	Accepted    bool   `json:"accepted"`
+	Outcome     string `json:"outcome"`
+	Status      string `json:"status,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// EvilScenario is a response the evil idp can send
+type EvilScenario struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type evilScenario struct {
+	EvilScenario
+	// accept is set for the responses a correct sp signs in with
+	accept bool
+	// review is set when accepting isn't wrong in itself, only signing in
+	// the wrong user is
+	review bool
+	build  func(b *evilBuilder) (*etree.Element, error)
+}
+
+// evilScenarios run in this order. valid always runs first, it shows the sp
+// takes responses sent this way at all and replay sends it again.
+var evilScenarios = []evilScenario{
+	{
+		EvilScenario: EvilScenario{"valid", "a correctly signed response, the sp must accept it for the other results to mean anything"},
+		accept:       true,
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			el, err := b.signedAssertion(b.session.NameID, nil)
+			if err != nil {
+				return nil, err
+			}
+			b.valid = b.response(b.acs.Location, el)
+			return b.valid, nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"replay", "the valid response posted again, with the same response and assertion ids"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			if b.valid == nil {
+				return nil, errors.New("the valid response wasn't built")
+			}
+			return b.valid.Copy(), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"unsigned", "neither the response nor the assertion is signed"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			a, err := b.assertion(b.session.NameID)
+			if err != nil {
+				return nil, err
+			}
+			return b.response(b.acs.Location, a.Element()), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"untrusted-key", "the assertion is signed with a key the sp doesn't know, its certificate is in the signature's KeyInfo"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			key, cert, err := selfSignedKeyPair()
+			if err != nil {
+				return nil, err
+			}
+			a, err := b.assertion(b.session.NameID)
+			if err != nil {
+				return nil, err
+			}
+			el, err := b.sign(a, key, cert)
+			if err != nil {
+				return nil, err
+			}
+			return b.response(b.acs.Location, el), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"expired", "the assertion's conditions and subject confirmation ended an hour ago"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			el, err := b.signedAssertion(b.session.NameID, expire)
+			if err != nil {
+				return nil, err
+			}
+			return b.response(b.acs.Location, el), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"not-yet-valid", "the assertion's conditions only start in an hour"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			now := saml.TimeNow()
+			el, err := b.signedAssertion(b.session.NameID, func(a *saml.Assertion) {
+				a.Conditions.NotBefore = now.Add(time.Hour)
+				a.Conditions.NotOnOrAfter = now.Add(2 * time.Hour)
+				a.Subject.SubjectConfirmations[0].SubjectConfirmationData.NotOnOrAfter = now.Add(2 * time.Hour)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return b.response(b.acs.Location, el), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"wrong-audience", "the assertion's audience is another sp, " + evilAudience},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			el, err := b.signedAssertion(b.session.NameID, func(a *saml.Assertion) {
+				a.Conditions.AudienceRestrictions = []saml.AudienceRestriction{{
+					Audience: saml.Audience{Value: evilAudience},
+				}}
+			})
+			if err != nil {
+				return nil, err
+			}
+			return b.response(b.acs.Location, el), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"wrong-destination", "the response's Destination and the subject confirmation's Recipient are another sp's acs, " + evilACS},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			el, err := b.signedAssertion(b.session.NameID, func(a *saml.Assertion) {
+				a.Subject.SubjectConfirmations[0].SubjectConfirmationData.Recipient = evilACS
+			})
+			if err != nil {
+				return nil, err
+			}
+			return b.response(evilACS, el), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"nameid-comment", "the NameID <target>" + evilSuffix + " is signed, then a comment is put in it: <target><!---->" + evilSuffix + ". Canonicalization drops comments so the signature holds."},
+		review:       true,
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			el, err := b.signedAssertion(b.target+evilSuffix, nil)
+			if err != nil {
+				return nil, err
+			}
+			nameID := el.FindElement(".//NameID")
+			if nameID == nil {
+				return nil, errors.New("the assertion has no NameID")
+			}
+			nameID.SetText(b.target)
+			nameID.CreateComment("")
+			nameID.CreateText(evilSuffix)
+			return b.response(b.acs.Location, el), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"xsw3", "an unsigned assertion for the target is put before the signed one, which has expired"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			signed, evil, err := b.wrapping()
+			if err != nil {
+				return nil, err
+			}
+			return b.response(b.acs.Location, evil, signed), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"xsw4", "an unsigned assertion for the target wraps the signed one, which has expired"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			signed, evil, err := b.wrapping()
+			if err != nil {
+				return nil, err
+			}
+			evil.AddChild(signed)
+			return b.response(b.acs.Location, evil), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"xsw5", "the assertion for the target carries the signature, the signed assertion, expired, follows it without one"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			signed, evil, err := b.wrapping()
+			if err != nil {
+				return nil, err
+			}
+			sig := removeSignature(signed)
+			evil.InsertChildAt(1, sig)
+			return b.response(b.acs.Location, evil, signed), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"xsw6", "the assertion for the target carries the signature, the signed assertion, expired, is inside the signature without one"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			signed, evil, err := b.wrapping()
+			if err != nil {
+				return nil, err
+			}
+			sig := removeSignature(signed)
+			sig.AddChild(signed)
+			evil.InsertChildAt(1, sig)
+			return b.response(b.acs.Location, evil), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"xsw7", "the signed assertion, expired, is in an Extensions element of an unsigned assertion for the target"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			signed, evil, err := b.wrapping()
+			if err != nil {
+				return nil, err
+			}
+			extensions := etree.NewElement("samlp:Extensions")
+			extensions.AddChild(signed)
+			evil.InsertChildAt(1, extensions)
+			return b.response(b.acs.Location, evil), nil
+		},
+	},
+	{
+		EvilScenario: EvilScenario{"xsw8", "the assertion for the target carries the signature, the signed assertion, expired, is in an Object of the signature without one"},
+		build: func(b *evilBuilder) (*etree.Element, error) {
+			signed, evil, err := b.wrapping()
+			if err != nil {
+				return nil, err
+			}
+			sig := removeSignature(signed)
+			object := etree.NewElement("ds:Object")
+			object.AddChild(signed)
+			sig.AddChild(object)
+			evil.InsertChildAt(1, sig)
+			return b.response(b.acs.Location, evil), nil
+		},
+	},
+}
+
+// EvilScenarios lists the responses RunEvil can send, in the order it
+// sends them
+func EvilScenarios() []EvilScenario {
+	scenarios := make([]EvilScenario, 0, len(evilScenarios))
+	for _, s := range evilScenarios {
+		scenarios = append(scenarios, s.EvilScenario)
+	}
+	return scenarios
+}
+
+// RunEvil sends the sp the named scenarios, all of them when none are
+// named, each as a response about user. Scenarios that impersonate someone
+// name target instead. The sp's acs has to be on one of acsHosts.
+func (s *SamlIdentityProvider) RunEvil(ctx context.Context, entityID string, user *model.User, target string, names []string, acsHosts []string) ([]EvilResult, error) {
+	settings, err := s.serviceProviders.Settings(entityID)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("service provider %s is not registered", entityID)
+	} else if err != nil {
+		return nil, err
+	}
+	if !settings.Evil {
+		return nil, errNotEvil
+	}
+
+	scenarios, err := selectEvilScenarios(names)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := s.serviceProviders.Get(entityID)
+	if err != nil {
+		return nil, err
+	}
+	spsso, acs := postACS(sp)
+	if acs == nil {
+		return nil, errors.New("service provider has no post binding assertion consumer service")
+	}
+	if !allowedACS(acs.Location, acsHosts) {
+		return nil, fmt.Errorf("assertion consumer service %s is not on one of evil.acs_hosts", acs.Location)
+	}
+
+	now := saml.TimeNow()
+	session, err := s.userSession(ctx, user, now, now.Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &evilBuilder{
+		idp:     s,
+		sp:      sp,
+		spsso:   spsso,
+		acs:     acs,
+		session: session,
+		target:  target,
+	}
+
+	var results []EvilResult
+	for _, scenario := range scenarios {
+		results = append(results, b.run(ctx, scenario))
+	}
+	return results, nil
+}
+
+// selectEvilScenarios keeps the order of evilScenarios, valid is always
+// included
+func selectEvilScenarios(names []string) ([]evilScenario, error) {
+	if len(names) == 0 {
+		return evilScenarios, nil
+	}
+
+	known := map[string]bool{}
+	for _, s := range evilScenarios {
+		known[s.Name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown scenario %q", name)
+		}
+	}
+
+	var scenarios []evilScenario
+	for _, s := range evilScenarios {
+		if s.Name == "valid" || slices.Contains(names, s.Name) {
+			scenarios = append(scenarios, s)
+		}
+	}
+	return scenarios, nil
+}
+
+// postACS is the sp's post binding acs, the default one if it marks one
+func postACS(sp *saml.EntityDescriptor) (*saml.SPSSODescriptor, *saml.IndexedEndpoint) {
+	var spsso *saml.SPSSODescriptor
+	var acs *saml.IndexedEndpoint
+	for i := range sp.SPSSODescriptors {
+		d := &sp.SPSSODescriptors[i]
+		for j := range d.AssertionConsumerServices {
+			endpoint := &d.AssertionConsumerServices[j]
+			if endpoint.Binding != saml.HTTPPostBinding {
+				continue
+			}
+			if acs == nil || (endpoint.IsDefault != nil && *endpoint.IsDefault) {
+				spsso, acs = d, endpoint
+			}
+		}
+	}
+	return spsso, acs
+}
+
+// allowedACS reports whether the acs url is http(s) on one of the hosts
+func allowedACS(location string, hosts []string) bool {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return slices.ContainsFunc(hosts, func(host string) bool {
+		return strings.EqualFold(host, u.Hostname())
+	})
+}
+
+// evilBuilder builds the scenarios' responses for one run
+type evilBuilder struct {
+	idp     *SamlIdentityProvider
+	sp      *saml.EntityDescriptor
+	spsso   *saml.SPSSODescriptor
+	acs     *saml.IndexedEndpoint
+	session *saml.Session
+	target  string
+
+	// valid is the valid scenario's response, for replay
+	valid *etree.Element
+}
+
+func (b *evilBuilder) run(ctx context.Context, scenario evilScenario) EvilResult {
+	result := EvilResult{
+		Scenario:    scenario.Name,
+		Description: scenario.Description,
+	}
+
+	response, err := scenario.build(b)
+	if err != nil {
+		result.Outcome = EvilError
+		result.Detail = err.Error()
+		return result
+	}
+
+	status, location, err := postResponse(ctx, b.acs.Location, response)
+	if err != nil {
+		result.Outcome = EvilError
+		result.Detail = err.Error()
+		return result
+	}
+	result.Status = status
+	result.Accepted = !strings.HasPrefix(status, "4") && !strings.HasPrefix(status, "5")
+	if location != "" {
+		result.Detail = "redirected to " + location
+	}
+
+	switch {
+	case result.Accepted && scenario.review:
+		result.Outcome = EvilReview
+		result.Detail = fmt.Sprintf("check the sp signed in %s, not %s", b.target+evilSuffix, b.target)
+	case result.Accepted == scenario.accept:
+		result.Outcome = EvilPass
+	default:
+		result.Outcome = EvilFail
+	}
+	if scenario.Name == "valid" && !result.Accepted {
+		result.Detail = "the sp turned away a valid response, the other rejections may not be its checks at work"
+	}
+	return result
+}
+
+// assertion is what the idp asserts about the user to the sp, under nameID
+func (b *evilBuilder) assertion(nameID string) (*saml.Assertion, error) {
+	session := *b.session
+	session.NameID = nameID
+	req := &saml.IdpAuthnRequest{
+		IDP:                     b.idp.IDP,
+		HTTPRequest:             &http.Request{},
+		ServiceProviderMetadata: b.sp,
+		SPSSODescriptor:         b.spsso,
+		ACSEndpoint:             b.acs,
+		Now:                     saml.TimeNow(),
+	}
+	if err := b.idp.IDP.AssertionMaker.MakeAssertion(req, &session); err != nil {
+		return nil, err
+	}
+	return req.Assertion, nil
+}
+
+// signedAssertion is the assertion, changed by edit when given, signed with
+// the idp key
+func (b *evilBuilder) signedAssertion(nameID string, edit func(a *saml.Assertion)) (*etree.Element, error) {
+	a, err := b.assertion(nameID)
+	if err != nil {
+		return nil, err
+	}
+	if edit != nil {
+		edit(a)
+	}
+	return b.sign(a, b.idp.IDP.Key, b.idp.IDP.Certificate)
+}
+
+// sign signs the assertion the way the idp does, the signature follows the
+// Issuer
+func (b *evilBuilder) sign(a *saml.Assertion, key crypto.PrivateKey, cert *x509.Certificate) (*etree.Element, error) {
+	signingContext, err := newSigningContext(key, cert, b.idp.IDP.SignatureMethod)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := signingContext.SignEnveloped(a.Element())
+	if err != nil {
+		return nil, err
+	}
+	a.Signature = signed.Child[len(signed.Child)-1].(*etree.Element)
+	return a.Element(), nil
+}
+
+// wrapping is the signed assertion about the user, and an unsigned one
+// about the target, for the signature wrapping scenarios. The signed one
+// has expired, so an sp that signs in with either took the unsigned one.
+func (b *evilBuilder) wrapping() (signed, evil *etree.Element, err error) {
+	signed, err = b.signedAssertion(b.session.NameID, expire)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := b.assertion(b.target)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signed, a.Element(), nil
+}
+
+// response is an unsigned, unsolicited Response holding the assertions
+func (b *evilBuilder) response(destination string, assertions ...*etree.Element) *etree.Element {
+	resp := &saml.Response{
+		ID:           "id-" + randomHex(20),
+		IssueInstant: saml.TimeNow(),
+		Version:      "2.0",
+		Destination:  destination,
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  b.idp.IDP.MetadataURL.String(),
+		},
+		Status: saml.Status{
+			StatusCode: saml.StatusCode{Value: saml.StatusSuccess},
+		},
+	}
+	el := resp.Element()
+	for _, a := range assertions {
+		el.AddChild(a)
+	}
+	return el
+}
+
+// expire moves the assertion's validity to end an hour ago
+func expire(a *saml.Assertion) {
+	now := saml.TimeNow()
+	a.IssueInstant = now.Add(-2 * time.Hour)
+	a.Conditions.NotBefore = now.Add(-2 * time.Hour)
+	a.Conditions.NotOnOrAfter = now.Add(-time.Hour)
+	a.Subject.SubjectConfirmations[0].SubjectConfirmationData.NotOnOrAfter = now.Add(-time.Hour)
+}
+
+// removeSignature takes the Signature out of the element and returns it
+func removeSignature(el *etree.Element) *etree.Element {
+	for _, child := range el.ChildElements() {
+		if child.Tag == "Signature" {
+			el.RemoveChild(child)
+			return child
+		}
+	}
+	return etree.NewElement("ds:Signature")
+}
+
+// postResponse posts the response to the acs like a browser would, and
+// returns the status and where the sp redirected to
+func postResponse(ctx context.Context, location string, response *etree.Element) (string, string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(response)
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		return "", "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sloTimeout)
+	defer cancel()
+	form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString(b)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, location, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return resp.Status, resp.Header.Get("Location"), nil
+}
+
+// newSigningContext signs like saml.IdentityProvider, with exclusive
+// canonicalization and no prefix list
+func newSigningContext(key crypto.PrivateKey, cert *x509.Certificate, signatureMethod string) (*dsig.SigningContext, error) {
+	keyStore := dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	})
+	signingContext := dsig.NewDefaultSigningContext(keyStore)
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+		return nil, err
+	}
+	return signingContext, nil
+}
+
+// selfSignedKeyPair is a throwaway key and certificate no sp trusts
+func selfSignedKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "evil.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// evilData is the adversarial testing page, Results are the run just made
+type evilData struct {
+	model.BaseData
+	ServiceProviders []evilServiceProvider
+	Scenarios        []EvilScenario
+	// Subjects are who responses may be about or impersonate
+	Subjects     []string
+	EntityID     string
+	User         string
+	Target       string
+	Results      []EvilResult
+	Error        bool
+	ErrorMessage string
+}
+
+type evilServiceProvider struct {
+	EntityID string `json:"entityId"`
+	Evil     bool   `json:"evil"`
+}
+
+// evilSubjects are who the caller may send responses about or
+// impersonate: themselves when signed in, and the configured test users
+func (i *IdentityProvider) evilSubjects(r *http.Request) []string {
+	var subjects []string
+	if p := principalFrom(r.Context()); p != nil && !p.Token {
+		subjects = append(subjects, p.Name)
+	}
+	for _, name := range i.evil.TestUsers {
+		if !slices.Contains(subjects, name) {
+			subjects = append(subjects, name)
+		}
+	}
+	return subjects
+}
+
+// evilDefaults fills in the first subject as the user and the next one as
+// the target
+func evilDefaults(data *evilData) {
+	for _, name := range data.Subjects {
+		switch {
+		case data.User == "":
+			data.User = name
+		case data.Target == "" && name != data.User:
+			data.Target = name
+		}
+	}
+}
+
+// getEvil lists the registered sps, which of them can be tested and the
+// scenarios
+func (i *IdentityProvider) getEvil(w http.ResponseWriter, r *http.Request) {
+	data := &evilData{Subjects: i.evilSubjects(r)}
+	evilDefaults(data)
+	i.renderEvil(w, r, data, nil)
+}
+
+// postEvil runs the scenarios against an sp registered for adversarial
+// testing. The responses are about ?user= and the scenarios that
+// impersonate someone name ?target=, both the caller or a test user.
+func (i *IdentityProvider) postEvil(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := &evilData{
+		Subjects: i.evilSubjects(r),
+		EntityID: r.Form.Get("entity_id"),
+		User:     r.Form.Get("user"),
+		Target:   r.Form.Get("target"),
+	}
+	evilDefaults(data)
+
+	results, err := i.runEvil(r, data)
+	if err != nil {
+		if wantsJSON(r) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		i.renderEvil(w, r, data, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, results)
+		return
+	}
+	data.Results = results
+	i.renderEvil(w, r, data, nil)
+}
+
+func (i *IdentityProvider) runEvil(r *http.Request, data *evilData) ([]EvilResult, error) {
+	if data.EntityID == "" {
+		return nil, errors.New("entity_id is required")
+	}
+	if data.User == "" || data.Target == "" {
+		return nil, errors.New("user and target are required, add evil.test_users to test without signing in")
+	}
+	for _, name := range []string{data.User, data.Target} {
+		if !slices.Contains(data.Subjects, name) {
+			return nil, fmt.Errorf("%s is neither you nor one of evil.test_users", name)
+		}
+	}
+
+	user, err := i.ctrl.GetUserByName(r.Context(), data.User)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %w", data.User, err)
+	}
+	return i.saml.RunEvil(r.Context(), data.EntityID, user, data.Target, r.Form["scenario"], i.evil.ACSHosts)
+}
+
+func (i *IdentityProvider) renderEvil(w http.ResponseWriter, r *http.Request, data *evilData, evilErr error) {
+	sps, err := i.saml.ServiceProviders()
+	if err != nil {
+		i.log.Error("listing service providers", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+	for _, sp := range sps {
+		settings, err := i.saml.serviceProviders.Settings(sp.EntityID)
+		if err != nil {
+			i.log.Error("listing service providers", zap.Error(err))
+			i.renderError(w, r, err)
+			return
+		}
+		data.ServiceProviders = append(data.ServiceProviders, evilServiceProvider{EntityID: sp.EntityID, Evil: settings.Evil})
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, struct {
+			ServiceProviders []evilServiceProvider `json:"serviceProviders"`
+			Scenarios        []EvilScenario        `json:"scenarios"`
+		}{data.ServiceProviders, EvilScenarios()})
+		return
+	}
+
+	data.BaseData = model.BaseData{PageTitle: "Adversarial testing"}
+	data.Scenarios = EvilScenarios()
+	if evilErr != nil {
+		data.Error = true
+		data.ErrorMessage = evilErr.Error()
+	}
+	err = template.Render(w, r, "idp/evil.html", data)
+	if err != nil {
+		i.log.Error("error rendering idp/evil.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
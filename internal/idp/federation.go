@@ -0,0 +1,530 @@
+package idp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/oidc"
+	"github.com/ghaggin/sso/internal/repository"
+	"github.com/ghaggin/sso/internal/sp"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	// federationTimeout bounds how long an upstream login may take
+	federationTimeout = 10 * time.Minute
+)
+
+var (
+	errUnknownUpstream   = errors.New("unknown identity provider")
+	errNoLinkedUser      = errors.New("no local account is linked to this identity")
+	errAccountDisabled   = errors.New("account is disabled")
+	errFederationState   = errors.New("login expired or was started in another browser, please try again")
+	errAmbiguousEmail    = errors.New("more than one account has this email")
+	errMissingIdentifier = errors.New("identity provider did not return a subject")
+)
+
+// ExternalIdentity is a user as asserted by an upstream identity provider
+type ExternalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	First         string
+	Last          string
+}
+
+// FederatedUser returns the local user for an upstream identity. An
+// existing link wins, then a match on verified email if the upstream allows
+// it, then a new user if the upstream is jit provisioned. New links are
+// stored on the user unless the repository is read only.
+func (c *Controller) FederatedUser(ctx context.Context, upstream config.Upstream, ident *ExternalIdentity) (*model.User, error) {
+	if ident.Subject == "" {
+		return nil, errMissingIdentifier
+	}
+
+	users, err := c.repo.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	link := model.Identity{Provider: upstream.Name, Subject: ident.Subject}
+	for i := range users {
+		for _, id := range users[i].Identities {
+			if id == link {
+				return activeUser(&users[i])
+			}
+		}
+	}
+
+	if upstream.MatchEmail && ident.EmailVerified && ident.Email != "" {
+		var match *model.User
+		for i := range users {
+			if strings.EqualFold(users[i].Email, ident.Email) {
+				if match != nil {
+					return nil, errAmbiguousEmail
+				}
+				match = &users[i]
+			}
+		}
+
+		if match != nil {
+			if _, err := activeUser(match); err != nil {
+				return nil, err
+			}
+			match.Identities = append(match.Identities, link)
+			err := c.UpdateUser(ctx, match)
+			if err != nil && !errors.Is(err, repository.ErrReadOnly) {
+				return nil, err
+			}
+			c.log.Info("linked upstream identity", zap.String("upstream", upstream.Name), zap.String("user", match.Name))
+			return match, nil
+		}
+	}
+
+	if !upstream.JIT {
+		return nil, errNoLinkedUser
+	}
+
+	user := &model.User{
+		Name:       uniqueUsername(users, ident),
+		First:      ident.First,
+		Last:       ident.Last,
+		Email:      ident.Email,
+		Identities: []model.Identity{link},
+	}
+	// no local password, the user signs in upstream
+	if err := c.addUser(ctx, user); err != nil {
+		return nil, err
+	}
+	c.log.Info("created user from upstream identity", zap.String("upstream", upstream.Name), zap.String("user", user.Name))
+
+	return c.repo.GetUserByName(ctx, user.Name)
+}
+
+func activeUser(u *model.User) (*model.User, error) {
+	if u.Disabled {
+		return nil, errAccountDisabled
+	}
+	return u, nil
+}
+
+// uniqueUsername picks a name for a jit user from the upstream username or
+// email, adding a number when the name is taken
+func uniqueUsername(users []model.User, ident *ExternalIdentity) string {
+	base := ident.Username
+	if base == "" {
+		base, _, _ = strings.Cut(ident.Email, "@")
+	}
+	if base == "" {
+		base = ident.Subject
+	}
+
+	taken := map[string]bool{}
+	for _, u := range users {
+		taken[strings.ToLower(u.Name)] = true
+	}
+
+	name := base
+	for n := 2; taken[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s%d", base, n)
+	}
+	return name
+}
+
+// federation brokers logins to the configured upstream identity providers
+type federation struct {
+	log       *zap.Logger
+	baseURL   url.URL
+	upstreams map[string]*upstream
+	order     []*upstream
+
+	// saml responses are posted cross site without the session cookie, so
+	// pending requests and their results are kept here keyed by relay state
+	mu      sync.Mutex
+	pending map[string]*pendingSAML
+}
+
+type upstream struct {
+	cfg  config.Upstream
+	oidc *oidc.Client
+
+	mu   sync.Mutex
+	saml *sp.Client
+}
+
+type pendingSAML struct {
+	requestID string
+	identity  *ExternalIdentity
+	created   time.Time
+}
+
+func newFederation(upstreams []config.Upstream, baseURL url.URL, log *zap.Logger) (*federation, error) {
+	f := &federation{
+		log:       log,
+		baseURL:   baseURL,
+		upstreams: map[string]*upstream{},
+		pending:   map[string]*pendingSAML{},
+	}
+
+	for _, cfg := range upstreams {
+		if cfg.Name == "" || url.PathEscape(cfg.Name) != cfg.Name {
+			return nil, fmt.Errorf("upstream name %q must be url safe", cfg.Name)
+		}
+		if _, ok := f.upstreams[cfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate upstream %q", cfg.Name)
+		}
+
+		u := &upstream{cfg: cfg}
+		switch cfg.Type {
+		case config.UpstreamOIDC:
+			u.oidc = &oidc.Client{
+				Issuer:       cfg.Issuer,
+				ClientID:     cfg.ClientID,
+				ClientSecret: cfg.ClientSecret,
+				RedirectURL:  f.url(cfg.Name, "callback"),
+				Scopes:       cfg.Scopes,
+			}
+		case config.UpstreamSAML:
+		default:
+			return nil, fmt.Errorf("upstream %s: unknown type %q", cfg.Name, cfg.Type)
+		}
+
+		f.upstreams[cfg.Name] = u
+		f.order = append(f.order, u)
+	}
+
+	return f, nil
+}
+
+func (f *federation) url(name, action string) string {
+	return f.baseURL.ResolveReference(&url.URL{Path: "/login/upstream/" + name + "/" + action}).String()
+}
+
+// links are the upstreams offered on the login page
+func (f *federation) links() []model.UpstreamLink {
+	var links []model.UpstreamLink
+	for _, u := range f.order {
+		links = append(links, model.UpstreamLink{Name: u.cfg.Name, DisplayName: u.cfg.DisplayName})
+	}
+	return links
+}
+
+// samlClient builds the upstream's sp on first use so an unavailable
+// upstream doesn't stop the idp from starting
+func (f *federation) samlClient(ctx context.Context, u *upstream) (*sp.Client, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.saml != nil {
+		return u.saml, nil
+	}
+
+	metadataURL, err := url.Parse(u.cfg.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := samlsp.FetchMetadata(ctx, http.DefaultClient, *metadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	key, cert, err := config.GetKeyPair("idp")
+	if err != nil {
+		return nil, err
+	}
+
+	metadataSelf, _ := url.Parse(f.url(u.cfg.Name, "metadata"))
+	acs, _ := url.Parse(f.url(u.cfg.Name, "acs"))
+	u.saml = sp.NewClient(sp.ClientOptions{
+		EntityID:    metadataSelf.String(),
+		MetadataURL: *metadataSelf,
+		AcsURL:      *acs,
+		Key:         key,
+		Certificate: cert,
+		IDPMetadata: metadata,
+	})
+	return u.saml, nil
+}
+
+func (f *federation) trackSAML(relayState, requestID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for k, p := range f.pending {
+		if time.Since(p.created) > federationTimeout {
+			delete(f.pending, k)
+		}
+	}
+	f.pending[relayState] = &pendingSAML{requestID: requestID, created: time.Now()}
+}
+
+func (f *federation) pendingSAML(relayState string) (*pendingSAML, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.pending[relayState]
+	if !ok || time.Since(p.created) > federationTimeout {
+		return nil, false
+	}
+	return p, true
+}
+
+// popSAML removes the pending request once the browser completes the login
+func (f *federation) popSAML(relayState string) (*pendingSAML, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.pending[relayState]
+	delete(f.pending, relayState)
+	if !ok || time.Since(p.created) > federationTimeout {
+		return nil, false
+	}
+	return p, true
+}
+
+func (i *IdentityProvider) upstream(r *http.Request) (*upstream, error) {
+	u, ok := i.fed.upstreams[chi.URLParam(r, "name")]
+	if !ok {
+		return nil, errUnknownUpstream
+	}
+	return u, nil
+}
+
+func (i *IdentityProvider) getUpstreamLogin(w http.ResponseWriter, r *http.Request) {
+	u, err := i.upstream(r)
+	if err != nil {
+		i.renderLoginError(w, r, errUnknownUpstream)
+		return
+	}
+
+	state := &model.FederationState{
+		Upstream: u.cfg.Name,
+		State:    oidc.RandomString(),
+		Created:  time.Now(),
+	}
+
+	switch u.cfg.Type {
+	case config.UpstreamOIDC:
+		state.Nonce = oidc.RandomString()
+		state.Verifier = oidc.RandomString()
+
+		authURL, err := u.oidc.AuthCodeURL(r.Context(), state.State, state.Nonce, state.Verifier)
+		if err != nil {
+			i.upstreamLoginError(w, r, u, err)
+			return
+		}
+
+		i.sm.StoreFederationState(r.Context(), state)
+		http.Redirect(w, r, authURL, http.StatusFound)
+	case config.UpstreamSAML:
+		client, err := i.fed.samlClient(r.Context(), u)
+		if err != nil {
+			i.upstreamLoginError(w, r, u, err)
+			return
+		}
+
+		authReq, err := client.MakeAuthenticationRequest()
+		if err != nil {
+			i.upstreamLoginError(w, r, u, err)
+			return
+		}
+
+		state.RequestID = authReq.ID
+		i.sm.StoreFederationState(r.Context(), state)
+		i.fed.trackSAML(state.State, authReq.ID)
+
+		if err := client.WriteAuthenticationRequest(w, authReq, state.State); err != nil {
+			i.upstreamLoginError(w, r, u, err)
+		}
+	}
+}
+
+// getUpstreamCallback is the oidc redirect uri
+func (i *IdentityProvider) getUpstreamCallback(w http.ResponseWriter, r *http.Request) {
+	u, err := i.upstream(r)
+	if err != nil || u.oidc == nil {
+		i.renderLoginError(w, r, errUnknownUpstream)
+		return
+	}
+
+	state, ok := i.sm.PopFederationState(r.Context())
+	if !ok || state.Upstream != u.cfg.Name || state.State != r.URL.Query().Get("state") ||
+		time.Since(state.Created) > federationTimeout {
+		i.upstreamLoginError(w, r, u, errFederationState)
+		return
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		i.upstreamLoginError(w, r, u, fmt.Errorf("%s: %s %s", u.cfg.DisplayName, e, r.URL.Query().Get("error_description")))
+		return
+	}
+
+	token, err := u.oidc.Exchange(r.Context(), r.URL.Query().Get("code"), state.Verifier)
+	if err != nil {
+		i.upstreamLoginError(w, r, u, err)
+		return
+	}
+
+	claims, err := u.oidc.VerifyIDToken(r.Context(), token.IDToken, state.Nonce)
+	if err != nil {
+		i.upstreamLoginError(w, r, u, err)
+		return
+	}
+
+	i.completeUpstreamLogin(w, r, u, &ExternalIdentity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Username:      claims.PreferredUsername,
+		First:         claims.GivenName,
+		Last:          claims.FamilyName,
+	})
+}
+
+// postUpstreamACS receives the saml response. The session cookie is not
+// sent on this cross site post, so the result is parked until the browser
+// follows the redirect to getUpstreamComplete.
+func (i *IdentityProvider) postUpstreamACS(w http.ResponseWriter, r *http.Request) {
+	u, err := i.upstream(r)
+	if err != nil || u.cfg.Type != config.UpstreamSAML {
+		i.renderLoginError(w, r, errUnknownUpstream)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		i.upstreamLoginError(w, r, u, err)
+		return
+	}
+
+	relayState := r.Form.Get("RelayState")
+	pending, ok := i.fed.pendingSAML(relayState)
+	if !ok {
+		i.upstreamLoginError(w, r, u, errFederationState)
+		return
+	}
+
+	client, err := i.fed.samlClient(r.Context(), u)
+	if err != nil {
+		i.upstreamLoginError(w, r, u, err)
+		return
+	}
+
+	assertion, err := client.ParseResponse(r, []string{pending.requestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			i.log.Error("invalid upstream saml response", zap.String("upstream", u.cfg.Name), zap.Error(invalid.PrivateErr))
+		}
+		i.upstreamLoginError(w, r, u, err)
+		return
+	}
+
+	i.fed.mu.Lock()
+	pending.identity = samlIdentity(assertion, u.cfg.TrustEmail)
+	i.fed.mu.Unlock()
+
+	http.Redirect(w, r, i.fed.url(u.cfg.Name, "complete")+"?state="+url.QueryEscape(relayState), http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) getUpstreamComplete(w http.ResponseWriter, r *http.Request) {
+	u, err := i.upstream(r)
+	if err != nil {
+		i.renderLoginError(w, r, errUnknownUpstream)
+		return
+	}
+
+	relayState := r.URL.Query().Get("state")
+	state, ok := i.sm.PopFederationState(r.Context())
+	pending, found := i.fed.popSAML(relayState)
+	if !ok || !found || pending.identity == nil || state.Upstream != u.cfg.Name ||
+		state.State != relayState || state.RequestID != pending.requestID {
+		i.upstreamLoginError(w, r, u, errFederationState)
+		return
+	}
+
+	i.completeUpstreamLogin(w, r, u, pending.identity)
+}
+
+func (i *IdentityProvider) getUpstreamMetadata(w http.ResponseWriter, r *http.Request) {
+	u, err := i.upstream(r)
+	if err != nil || u.cfg.Type != config.UpstreamSAML {
+		http.NotFound(w, r)
+		return
+	}
+
+	client, err := i.fed.samlClient(r.Context(), u)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+	client.ServeMetadata(w, r)
+}
+
+// completeUpstreamLogin logs the linked local user in and resumes the
+// request that sent the browser to the login page
+func (i *IdentityProvider) completeUpstreamLogin(w http.ResponseWriter, r *http.Request, u *upstream, ident *ExternalIdentity) {
+	user, err := i.ctrl.FederatedUser(r.Context(), u.cfg, ident)
+	if err != nil {
+		i.upstreamLoginError(w, r, u, fmt.Errorf("%s: %w", ident.Subject, err))
+		return
+	}
+
+	// the second factor and password expiry apply as they do to password
+	// logins
+	i.finishLogin(w, r, user.Name, false, u.cfg.TrustMFA)
+}
+
+func (i *IdentityProvider) upstreamLoginError(w http.ResponseWriter, r *http.Request, u *upstream, err error) {
+	i.log.Error("failed login", zap.String("upstream", u.cfg.Name), zap.Error(err))
+	i.renderLoginError(w, r, err)
+}
+
+// samlIdentity reads the subject and profile from an assertion, matching
+// attributes by name or friendly name. saml has no notion of a verified
+// email, the email only counts as verified when the upstream is trusted to
+// assert its users' emails.
+func samlIdentity(a *saml.Assertion, trustEmail bool) *ExternalIdentity {
+	ident := &ExternalIdentity{}
+	if a.Subject != nil && a.Subject.NameID != nil {
+		ident.Subject = a.Subject.NameID.Value
+		if a.Subject.NameID.Format == string(saml.EmailAddressNameIDFormat) {
+			ident.Email = a.Subject.NameID.Value
+		}
+	}
+
+	get := func(names ...string) string {
+		for _, as := range a.AttributeStatements {
+			for _, attr := range as.Attributes {
+				for _, n := range names {
+					if (attr.Name == n || attr.FriendlyName == n) && len(attr.Values) > 0 {
+						return attr.Values[0].Value
+					}
+				}
+			}
+		}
+		return ""
+	}
+
+	if email := get("email", "mail", "urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"); email != "" {
+		ident.Email = email
+	}
+	ident.EmailVerified = trustEmail && ident.Email != ""
+	ident.Username = get("uid", "username", "urn:oid:0.9.2342.19200300.100.1.1")
+	ident.First = get("givenName", "firstName", "urn:oid:2.5.4.42")
+	ident.Last = get("sn", "surname", "lastName", "urn:oid:2.5.4.4")
+
+	return ident
+}
@@ -2,16 +2,31 @@ package idp
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"time"
 
+	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlidp"
+	"github.com/ghaggin/sso/internal/audit"
 	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/ldapserver"
+	"github.com/ghaggin/sso/internal/lockout"
+	"github.com/ghaggin/sso/internal/mail"
 	"github.com/ghaggin/sso/internal/middleware"
 	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/provisioning"
+	"github.com/ghaggin/sso/internal/samldebug"
+	"github.com/ghaggin/sso/internal/scim"
 	"github.com/ghaggin/sso/internal/template"
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/fx"
@@ -19,10 +34,21 @@ import (
 )
 
 type IdentityProvider struct {
-	log    *zap.Logger
-	server *http.Server
-	sm     *middleware.SessionManager
-	ctrl   *Controller
+	log       *zap.Logger
+	server    *http.Server
+	sm        *middleware.SessionManager
+	ctrl      *Controller
+	prov      *provisioning.Provisioner
+	ldap      *ldapserver.Server
+	fed       *federation
+	saml      *SamlIdentityProvider
+	limiter   *lockout.Limiter
+	mailer    mail.Mailer
+	audit     *audit.Logger
+	apiTokens []apiToken
+	evil      config.Evil
+	baseURL   string
+	ldapAddr  string
 
 	// start/stop coordination
 	shutdownCalled bool
@@ -35,11 +61,14 @@ type Params struct {
 	Config         *config.Config
 	SessionManager *middleware.SessionManager
 	Controller     *Controller
+	Provisioner    *provisioning.Provisioner
+	Limiter        *lockout.Limiter
+	Mailer         mail.Mailer
+	Audit          *audit.Logger
 }
 
 func New(p Params) (*IdentityProvider, error) {
-	// Build baseurl from port
-	baseUrl, err := url.Parse(fmt.Sprintf("http://localhost:%d", p.Config.IdentityProvider.Port))
+	baseUrl, err := url.Parse(p.Config.IdentityProvider.URL)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +86,17 @@ func New(p Params) (*IdentityProvider, error) {
 		Key:         key,
 		Certificate: cert,
 		Store:       &samlidp.MemoryStore{},
-	})
+	}, NewServiceProviderStore(p.Config.IdentityProvider.ServiceProvidersPath), p.SessionManager, p.Controller)
+
+	fed, err := newFederation(p.Config.Upstreams, *baseUrl, p.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	apiTokens, err := newAPITokens(p.Config.Admin.APITokens)
+	if err != nil {
+		return nil, err
+	}
 
 	idp := &IdentityProvider{
 		log: p.Log,
@@ -65,45 +104,194 @@ func New(p Params) (*IdentityProvider, error) {
 		server: &http.Server{
 			Addr: fmt.Sprintf("localhost:%d", p.Config.IdentityProvider.Port),
 		},
-		ctrl: p.Controller,
+		ctrl:      p.Controller,
+		prov:      p.Provisioner,
+		fed:       fed,
+		saml:      idpServer,
+		limiter:   p.Limiter,
+		mailer:    p.Mailer,
+		audit:     p.Audit,
+		apiTokens: apiTokens,
+		evil:      p.Config.Evil,
+		baseURL:   baseUrl.String(),
 	}
 
+	scimServer := scim.NewServer(p.Controller, p.Config.SCIM.Tokens, baseUrl.String()+"/scim/v2", p.Log)
+
 	// Setup Router
 	root := chi.NewRouter()
 	root.Use(idp.sm.Wrap)
+	// saml bindings post across sites, the messages carry their own
+	// signatures instead. requests with a valid api or scim token don't
+	// rely on cookies.
+	root.Use(idp.sm.CSRF(func(token string) bool {
+		_, ok := matchAPIToken(idp.apiTokens, token)
+		return ok || scimServer.ValidToken(token)
+	}, "/sso", "/logout", "/login/upstream/*/acs"))
 
 	root.Group(func(r chi.Router) {
 		r.Use(idp.requireAuth)
-		r.HandleFunc("/", idp.home)
+		r.HandleFunc("/", idp.account)
 		r.HandleFunc("/sso", idpServer.IDP.ServeSSO)
+		r.Get("/sso/launch/{entityID}", idp.launchApp)
+
+		// Account Portal
+		r.Post("/account/mfa", idp.postAccountMFA)
+		r.Get("/account/mfa/{id}", idp.getAccountMFA)
+		r.Post("/account/mfa/{id}/confirm", idp.postAccountMFAConfirm)
+		r.Post("/account/mfa/{id}/delete", idp.postAccountMFADelete)
+		r.Post("/account/sessions/{id}/revoke", idp.postAccountSessionRevoke)
 	})
 
 	// Login Flow
 	root.Get("/login", idp.getLogin)
 	root.Post("/login", idp.putLogin)
+	root.Get("/login/mfa", idp.getLoginMFA)
+	root.Post("/login/mfa", idp.postLoginMFA)
 	root.Get("/redirect", idp.redirect)
 
+	// Password Reset
+	root.Get("/password/forgot", idp.getPasswordForgot)
+	root.Post("/password/forgot", idp.postPasswordForgot)
+	root.Get("/password/reset", idp.getPasswordReset)
+	root.Post("/password/reset", idp.postPasswordReset)
+	root.Get("/password/change", idp.getPasswordChange)
+	root.Post("/password/change", idp.postPasswordChange)
+
+	// Federated Login
+	root.Get("/login/upstream/{name}", idp.getUpstreamLogin)
+	root.Get("/login/upstream/{name}/callback", idp.getUpstreamCallback)
+	root.Post("/login/upstream/{name}/acs", idp.postUpstreamACS)
+	root.Get("/login/upstream/{name}/complete", idp.getUpstreamComplete)
+	root.Get("/login/upstream/{name}/metadata", idp.getUpstreamMetadata)
+
 	// Public SAML Information
 	root.Get("/metadata", func(w http.ResponseWriter, r *http.Request) {
 		idpServer.IDP.ServeMetadata(w, r)
 	})
 
-	// Admin UI
-	root.Get("/users", idp.getUsers)
-	root.Post("/users", idp.postUsers)
-	root.Get("/users/new", idp.getUsersNew)
+	// Admin UI and API
+	root.Group(func(r chi.Router) {
+		r.Use(idp.requireAdmin)
+
+		r.Group(func(r chi.Router) {
+			r.Use(idp.requirePermission(model.PermissionUsersRead))
+			r.Get("/users", idp.getUsers)
+			r.Get("/users/export", idp.getUsersExport)
+			r.Get("/users/{id}", idp.getUser)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(idp.requirePermission(model.PermissionUsersWrite))
+			r.Post("/users", idp.postUsers)
+			r.Get("/users/new", idp.getUsersNew)
+			r.Get("/users/import", idp.getUsersImport)
+			r.Post("/users/import", idp.postUsersImport)
+			r.Post("/users/{id}", idp.postUser)
+			r.Post("/users/{id}/unlock", idp.postUserUnlock)
+		})
 
-	// API
-	root.Get("/service", idpServer.HandleGetService)
-	root.Put("/service", idpServer.HandlePutService)
-	root.Post("/service", idpServer.HandlePutService)
+		r.With(idp.requirePermission(model.PermissionProvisioningRead)).Get("/provisioning", idp.getProvisioning)
+		r.Group(func(r chi.Router) {
+			r.Use(idp.requirePermission(model.PermissionProvisioningWrite))
+			r.Post("/provisioning/reconcile", idp.postProvisioningReconcile)
+			r.Post("/provisioning/retry", idp.postProvisioningRetry)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(idp.requirePermission(model.PermissionSessionsRead))
+			r.Get("/sessions", idp.getSessions)
+			r.Get("/sessions/{id}", idp.getSession)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(idp.requirePermission(model.PermissionSessionsWrite))
+			r.Post("/sessions/{id}/revoke", idp.postSessionRevoke)
+			r.Post("/users/{id}/sessions/revoke", idp.postUserSessionsRevoke)
+		})
+
+		r.With(idp.requirePermission(model.PermissionSPRead)).Get("/service", idpServer.HandleGetService)
+		r.Group(func(r chi.Router) {
+			r.Use(idp.requirePermission(model.PermissionSPWrite))
+			r.Put("/service", idpServer.HandlePutService)
+			r.Post("/service", idpServer.HandlePutService)
+		})
+
+		// adversarial responses, for sps registered with ?evil=true, only
+		// served when evil is enabled
+		if idp.evil.Enabled {
+			r.Group(func(r chi.Router) {
+				r.Use(idp.requirePermission(model.PermissionSPEvil))
+				r.Get("/service/evil", idp.getEvil)
+				r.Post("/service/evil", idp.postEvil)
+			})
+		}
+
+		// responses pasted here are checked against the idp's own certificate
+		r.Group(func(r chi.Router) {
+			r.Use(idp.requirePermission(model.PermissionSPRead))
+			debug := samldebug.Handler(p.Log, samldebug.Defaults{Certs: []*x509.Certificate{cert}})
+			r.Get("/debug/saml", debug)
+			r.Post("/debug/saml", debug)
+		})
+	})
+
+	// Provisioning
+	root.Mount("/scim/v2", withPrincipal(scimPrincipal, scimServer.Handler()))
 
 	root.Handle("/static/*", http.StripPrefix("/static", http.FileServer(http.Dir("web/static/"))))
 
 	idp.server.Handler = root
+
+	if p.Config.LDAPServer.Addr != "" {
+		idp.ldapAddr = p.Config.LDAPServer.Addr
+		idp.ldap = &ldapserver.Server{
+			Handler: newLDAPDirectory(p.Config.LDAPServer, p.Controller, p.Limiter, p.Log),
+			Log:     p.Log,
+		}
+		if p.Config.LDAPServer.StartTLS {
+			idp.ldap.TLSConfig = &tls.Config{
+				Certificates: []tls.Certificate{{
+					Certificate: [][]byte{cert.Raw},
+					PrivateKey:  key,
+					Leaf:        cert,
+				}},
+				MinVersion: tls.VersionTLS12,
+			}
+		}
+	}
+
 	return idp, nil
 }
 
+// ValidateConfig checks the settings New and NewController interpret,
+// other than the key pair, without connecting to anything or opening any
+// stores
+func ValidateConfig(cfg *config.Config) error {
+	var errs []error
+	if _, err := newPasswordPolicy(cfg.PasswordPolicy, zap.NewNop()); err != nil {
+		errs = append(errs, fmt.Errorf("password_policy: %w", err))
+	}
+	if _, err := newRoles(cfg.Admin); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newAPITokens(cfg.Admin.APITokens); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newFederation(cfg.Upstreams, url.URL{}, zap.NewNop()); err != nil {
+		errs = append(errs, fmt.Errorf("upstreams: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// RegisterServiceProvider trusts the sp, as PUT /service does
+func (i *IdentityProvider) RegisterServiceProvider(metadata *saml.EntityDescriptor) error {
+	return i.saml.RegisterServiceProvider(metadata)
+}
+
+// Handler serves the idp, for running it on a server of the caller's
+func (i *IdentityProvider) Handler() http.Handler {
+	return i.server.Handler
+}
+
 // RegisterHooks should be invoked by fx
 func RegisterHooks(lc fx.Lifecycle, i *IdentityProvider) {
 	lc.Append(fx.Hook{
@@ -113,8 +301,22 @@ func RegisterHooks(lc fx.Lifecycle, i *IdentityProvider) {
 }
 
 func (i *IdentityProvider) start(_ context.Context) error {
+	if i.ldap != nil {
+		addr, err := i.ldap.Start(i.ldapAddr)
+		if err != nil {
+			return err
+		}
+		i.log.Info("ldap server listening", zap.String("addr", addr.String()))
+	}
+
+	// listen before returning so whatever starts next, such as the sp in
+	// -mode all, can reach the idp straight away
+	ln, err := net.Listen("tcp", i.server.Addr)
+	if err != nil {
+		return err
+	}
 	go func() {
-		err := i.server.ListenAndServe()
+		err := i.server.Serve(ln)
 		if i.shutdownCalled && errors.Is(err, http.ErrServerClosed) {
 			return
 		} else if err != nil {
@@ -126,15 +328,16 @@ func (i *IdentityProvider) start(_ context.Context) error {
 
 func (i *IdentityProvider) stop(ctx context.Context) error {
 	i.shutdownCalled = true
+	if i.ldap != nil {
+		i.ldap.Close()
+	}
 	return i.server.Shutdown(ctx)
 }
 
 func (i *IdentityProvider) requireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := i.sm.Get(r.Context())
-		if err != nil || !session.AuthValid || time.Now().After(session.AuthExpiration) {
-			i.sm.StoreLoginRedirectState(r.Context(), r)
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		if !i.signedIn(r) {
+			i.loginFirst(w, r)
 			return
 		}
 
@@ -142,24 +345,50 @@ func (i *IdentityProvider) requireAuth(next http.Handler) http.Handler {
 	})
 }
 
-func (i *IdentityProvider) home(w http.ResponseWriter, r *http.Request) {
-	err := template.Render(w, r, "idp/home.html", &template.Data{
-		PageTitle: "home",
+func (i *IdentityProvider) signedIn(r *http.Request) bool {
+	_, ok := i.sm.Authenticated(r.Context())
+	return ok
+}
+
+// loginFirst sends the browser to log in, keeping the request to resume
+// afterwards
+func (i *IdentityProvider) loginFirst(w http.ResponseWriter, r *http.Request) {
+	if err := i.sm.StorePendingAuth(r); errors.Is(err, middleware.ErrPendingAuthTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		i.log.Warn("not resuming request after login", zap.String("path", r.URL.Path), zap.Error(err))
+	}
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) getLogin(w http.ResponseWriter, r *http.Request) {
+	err := template.Render(w, r, "idp/login.html", &model.IDPLoginData{
+		BaseData: model.BaseData{
+			PageTitle: "Login",
+		},
+		Upstreams: i.fed.links(),
+		Remember:  i.sm.RememberEnabled(),
 	})
 	if err != nil {
-		i.log.Error("error rendering idp_home.html", zap.Error(err))
+		i.log.Error("error rendering idp_login.html", zap.Error(err))
 		i.renderError(w, r, err)
 	}
 }
 
-func (i *IdentityProvider) getLogin(w http.ResponseWriter, r *http.Request) {
+// renderLoginError shows the login page again with the error
+func (i *IdentityProvider) renderLoginError(w http.ResponseWriter, r *http.Request, loginErr error) {
 	err := template.Render(w, r, "idp/login.html", &model.IDPLoginData{
 		BaseData: model.BaseData{
 			PageTitle: "Login",
 		},
+		Error:        true,
+		ErrorMessage: loginErr.Error(),
+		Upstreams:    i.fed.links(),
+		Remember:     i.sm.RememberEnabled(),
 	})
 	if err != nil {
-		i.log.Error("error rendering idp_login.html", zap.Error(err))
 		i.renderError(w, r, err)
 	}
 }
@@ -168,6 +397,13 @@ func (i *IdentityProvider) putLogin(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	username := r.Form.Get("username")
 	password := r.Form.Get("password")
+	addr := remoteHost(r)
+
+	if err := i.limiter.Check(r.Context(), username, addr); err != nil {
+		i.log.Error("failed login", zap.String("username", username), zap.String("addr", addr), zap.Error(err))
+		i.renderLoginError(w, r, err)
+		return
+	}
 
 	valid, err := i.ctrl.ValidateLogin(r.Context(), username, password)
 	renderErr := false
@@ -181,22 +417,61 @@ func (i *IdentityProvider) putLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if renderErr {
-		i.log.Error("failed login", zap.String("error", renderErrMsg))
+		i.log.Error("failed login", zap.String("username", username), zap.String("addr", addr), zap.String("error", renderErrMsg))
+		if err := i.limiter.Fail(r.Context(), username, addr); err != nil {
+			i.log.Error("recording failed login", zap.Error(err))
+		}
+		i.renderLoginError(w, r, errors.New(renderErrMsg))
+		return
+	}
 
-		err := template.Render(w, r, "idp/login.html", &model.IDPLoginData{
-			BaseData: model.BaseData{
-				PageTitle: "Login",
-			},
-			Error:        true,
-			ErrorMessage: renderErrMsg,
-		})
+	i.finishLogin(w, r, username, r.Form.Get("remember") != "", false)
+}
+
+// finishLogin authenticates the session once the password checked out,
+// holding it back first for a second factor or an expired password.
+// Failures are only cleared once every step passed so a known password
+// doesn't reset the count of guessed codes.
+func (i *IdentityProvider) finishLogin(w http.ResponseWriter, r *http.Request, username string, remember, mfaDone bool) {
+	if !mfaDone {
+		required, err := i.ctrl.MFARequired(r.Context(), username)
 		if err != nil {
 			i.renderError(w, r, err)
+			return
+		}
+		if required {
+			i.sm.StorePendingLogin(r.Context(), &model.PendingLogin{
+				UID:      username,
+				Step:     model.PendingMFA,
+				Remember: remember,
+				Created:  time.Now(),
+			})
+			http.Redirect(w, r, "/login/mfa", http.StatusSeeOther)
+			return
 		}
+	}
+
+	if err := i.limiter.Succeed(r.Context(), username); err != nil {
+		i.log.Error("clearing failed logins", zap.Error(err))
+	}
+
+	expired, err := i.ctrl.PasswordExpired(r.Context(), username)
+	if err != nil {
+		i.renderError(w, r, err)
+		return
+	}
+	if expired {
+		i.sm.StorePendingLogin(r.Context(), &model.PendingLogin{
+			UID:      username,
+			Step:     model.PendingPasswordChange,
+			Remember: remember,
+			Created:  time.Now(),
+		})
+		http.Redirect(w, r, "/password/change", http.StatusSeeOther)
 		return
 	}
 
-	err = i.sm.SetAuthenticated(r.Context(), username)
+	err = i.sm.SetAuthenticated(r, username, remember)
 	if err != nil {
 		i.renderError(w, r, err)
 		return
@@ -205,31 +480,91 @@ func (i *IdentityProvider) putLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/redirect", http.StatusSeeOther)
 }
 
+// redirect resumes the request that was sent to log in. Saml AuthnRequests
+// are answered here so post bindings don't have to be posted again, other
+// requests are only resumed when they were a plain GET.
 func (i *IdentityProvider) redirect(w http.ResponseWriter, r *http.Request) {
-	if rr, found := i.sm.LoadLoginRedirectState(r.Context()); found {
-		if rr.URL.Path != "/sso" {
-			http.Redirect(w, r, rr.URL.Path, http.StatusSeeOther)
-		}
+	if !i.signedIn(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 
-		for _, cookie := range r.Cookies() {
-			rr.AddCookie(cookie)
-		}
-		i.server.Handler.ServeHTTP(w, rr)
+	pending, ok := i.sm.PopPendingAuth(r.Context())
+	if !ok || time.Since(pending.Created) > pendingAuthTimeout {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if pending.Path == "/sso" {
+		i.saml.IDP.ServeSSO(w, resumeRequest(r, pending))
+		return
+	}
+
+	if pending.Method == http.MethodGet {
+		target := &url.URL{Path: pending.Path, RawQuery: url.Values(pending.Query).Encode()}
+		http.Redirect(w, r, target.String(), http.StatusSeeOther)
 		return
 	}
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// resumeRequest rebuilds the pending request on top of r, which carries
+// the now authenticated session
+func resumeRequest(r *http.Request, pending *model.PendingAuth) *http.Request {
+	query := url.Values{}
+	for k, v := range pending.Query {
+		query[k] = v
+	}
+	form := url.Values{}
+	for k, v := range pending.Form {
+		form[k] = v
+	}
+	if pending.RelayState != "" {
+		if pending.Method == http.MethodPost {
+			form.Set("RelayState", pending.RelayState)
+		} else {
+			query.Set("RelayState", pending.RelayState)
+		}
+	}
+
+	rr := r.Clone(r.Context())
+	rr.Method = pending.Method
+	rr.URL = &url.URL{Path: pending.Path, RawQuery: query.Encode()}
+	rr.RequestURI = rr.URL.RequestURI()
+	rr.Body = http.NoBody
+	rr.ContentLength = 0
+
+	// set so ParseForm doesn't look for a body
+	rr.PostForm = form
+	rr.Form = url.Values{}
+	for _, values := range []url.Values{form, query} {
+		for k, v := range values {
+			rr.Form[k] = append(rr.Form[k], v...)
+		}
+	}
+	return rr
+}
+
+// remoteHost is the client address without the port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (i *IdentityProvider) renderError(w http.ResponseWriter, _ *http.Request, err error) {
 	w.Write([]byte(err.Error()))
 }
 
 func (i *IdentityProvider) getUsersNew(w http.ResponseWriter, r *http.Request) {
-	err := template.Render(w, r, "idp/users_new.html", &model.IDPLoginData{
+	err := template.Render(w, r, "idp/users_new.html", &model.IDPUserFormData{
 		BaseData: model.BaseData{
 			PageTitle: "New User",
 		},
+		Attributes: attributeFields(i.ctrl.AttributeSchema(), nil),
 	})
 	if err != nil {
 		i.log.Error("error rendering idp/users_new.html", zap.Error(err))
@@ -265,18 +600,379 @@ func (i *IdentityProvider) getUsers(w http.ResponseWriter, r *http.Request) {
 func (i *IdentityProvider) postUsers(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
-	err := i.ctrl.CreateUser(r.Context(), &model.User{
-		Name:     r.Form.Get("username"),
-		Password: r.Form.Get("password"),
-		First:    r.Form.Get("firstname"),
-		Last:     r.Form.Get("lastname"),
-		Email:    r.Form.Get("email"),
-	})
+	attrs, err := parseAttributeForm(i.ctrl.AttributeSchema(), r.Form)
+	if err != nil {
+		i.log.Error("error parsing user attributes", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
 
+	user := &model.User{
+		Name:       r.Form.Get("username"),
+		Password:   r.Form.Get("password"),
+		First:      r.Form.Get("firstname"),
+		Last:       r.Form.Get("lastname"),
+		Email:      r.Form.Get("email"),
+		Attributes: attrs,
+	}
+	err = i.ctrl.CreateUser(r.Context(), user)
 	if err != nil {
 		i.log.Error("error creating user", zap.Error(err))
+		user.Password = ""
+		err = template.Render(w, r, "idp/users_new.html", &model.IDPUserFormData{
+			BaseData: model.BaseData{
+				PageTitle: "New User",
+			},
+			User:         *user,
+			Attributes:   attributeFields(i.ctrl.AttributeSchema(), user),
+			Error:        true,
+			ErrorMessage: err.Error(),
+			Violations:   policyViolations(err),
+		})
+		if err != nil {
+			i.renderError(w, r, err)
+		}
+		return
+	}
+
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) getUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	user, err := i.ctrl.GetUser(r.Context(), id)
+	if err != nil {
+		i.log.Error("getting user", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	status, err := i.limiter.Status(r.Context(), user.Name)
+	if err != nil {
+		i.log.Error("getting lockout status", zap.Error(err))
 		i.renderError(w, r, err)
+		return
+	}
+
+	data := i.userEditData(r, user)
+	if status != nil {
+		data.FailedLogins = status.Failures
+		data.LockedUntil = status.LockedUntil
+	}
+
+	err = template.Render(w, r, "idp/users_edit.html", data)
+	if err != nil {
+		i.log.Error("error rendering idp/users_edit.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) postUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+
+	user, err := i.ctrl.GetUser(r.Context(), id)
+	if err != nil {
+		i.log.Error("getting user", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	if err := i.ctrl.checkManage(r.Context(), user); err != nil {
+		i.renderUserEditError(w, r, user, err)
+		return
+	}
+
+	attrs, err := parseAttributeForm(i.ctrl.AttributeSchema(), r.Form)
+	if err != nil {
+		i.renderUserEditError(w, r, user, err)
+		return
+	}
+
+	rolesChanged := false
+	if principalFrom(r.Context()).Can(model.PermissionRolesWrite) {
+		roles := r.Form["roles"]
+		if err := i.ctrl.ValidateRoles(roles); err != nil {
+			i.renderUserEditError(w, r, user, err)
+			return
+		}
+		rolesChanged = !sameRoles(user.Roles, roles)
+		user.Roles = roles
+	}
+
+	user.First = r.Form.Get("firstname")
+	user.Last = r.Form.Get("lastname")
+	user.Email = r.Form.Get("email")
+	user.Attributes = attrs
+	if password := r.Form.Get("password"); password != "" {
+		user.Password = password
+	}
+
+	err = i.ctrl.UpdateUser(r.Context(), user)
+	if policyViolations(err) != nil {
+		i.renderUserEditError(w, r, user, err)
+		return
+	} else if err != nil {
+		i.log.Error("error updating user", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	// a demoted admin is signed out everywhere rather than keeping what
+	// they opened under the old roles
+	if rolesChanged {
+		sessions, err := i.sm.RevokeUserSessions(r.Context(), user.Name)
+		if err != nil {
+			i.log.Error("revoking user sessions", zap.String("username", user.Name), zap.Error(err))
+			i.renderError(w, r, err)
+			return
+		}
+		for _, session := range sessions {
+			i.log.Info("session revoked",
+				zap.String("username", session.UID),
+				zap.String("by", principalFrom(r.Context()).Name),
+				zap.String("reason", "roles changed"))
+		}
 	}
 
 	http.Redirect(w, r, "/users", http.StatusSeeOther)
 }
+
+// sameRoles compares role lists ignoring their order
+func sameRoles(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// userEditData is the edit form for user, role checkboxes are only offered
+// to callers allowed to change them
+func (i *IdentityProvider) userEditData(r *http.Request, user *model.User) *model.IDPUserFormData {
+	data := &model.IDPUserFormData{
+		BaseData: model.BaseData{
+			PageTitle: "Edit User",
+		},
+		User:         *user,
+		Attributes:   attributeFields(i.ctrl.AttributeSchema(), user),
+		CanEditRoles: principalFrom(r.Context()).Can(model.PermissionRolesWrite),
+	}
+	for _, name := range i.ctrl.RoleNames() {
+		data.Roles = append(data.Roles, model.RoleOption{
+			Name:    name,
+			Checked: slices.Contains(user.Roles, name),
+		})
+	}
+	return data
+}
+
+func (i *IdentityProvider) renderUserEditError(w http.ResponseWriter, r *http.Request, user *model.User, editErr error) {
+	data := i.userEditData(r, user)
+	data.Error = true
+	data.ErrorMessage = editErr.Error()
+	data.Violations = policyViolations(editErr)
+
+	if err := template.Render(w, r, "idp/users_edit.html", data); err != nil {
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) postUserUnlock(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	user, err := i.ctrl.GetUser(r.Context(), id)
+	if err != nil {
+		i.log.Error("getting user", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	if err := i.limiter.Unlock(r.Context(), user.Name, principalFrom(r.Context()).Name); err != nil {
+		i.log.Error("error unlocking user", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/users/%d", id), http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) getProvisioning(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		model.BaseData
+		Connectors []provisioning.ConnectorReport
+	}{
+		BaseData: model.BaseData{
+			PageTitle: "Provisioning",
+		},
+		Connectors: i.prov.Status(),
+	}
+
+	err := template.Render(w, r, "idp/provisioning.html", &data)
+	if err != nil {
+		i.log.Error("error rendering idp/provisioning.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) postProvisioningReconcile(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	err := i.prov.Reconcile(r.Context(), r.Form.Get("connector"))
+	if err != nil {
+		i.log.Error("error reconciling connector", zap.Error(err))
+	}
+
+	http.Redirect(w, r, "/provisioning", http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) postProvisioningRetry(w http.ResponseWriter, r *http.Request) {
+	i.prov.Retry()
+	http.Redirect(w, r, "/provisioning", http.StatusSeeOther)
+}
+
+func (i *IdentityProvider) getUsersImport(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		model.BaseData
+		Report *ImportReport
+	}{
+		BaseData: model.BaseData{
+			PageTitle: "Import Users",
+		},
+	}
+
+	err := template.Render(w, r, "idp/users_import.html", &data)
+	if err != nil {
+		i.log.Error("error rendering idp/users_import.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+// postUsersImport accepts either the multipart upload from the import page,
+// which renders the report, or a raw csv/json body with format and dry_run
+// query parameters, which returns the report as json
+func (i *IdentityProvider) postUsersImport(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		format, err := ParseBulkFormat(r.URL.Query().Get("format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+		report, err := i.ctrl.ImportUsers(r.Context(), r.Body, format, dryRun)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		i.log.Info("imported users",
+			zap.Bool("dry_run", dryRun),
+			zap.Int("created", report.Created),
+			zap.Int("updated", report.Updated),
+			zap.Int("failed", report.Failed))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	// the form places the options before the file so the upload can be
+	// streamed straight into the import
+	var format BulkFormat = BulkFormatCSV
+	dryRun := false
+	var report *ImportReport
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			i.renderError(w, r, err)
+			return
+		}
+
+		switch part.FormName() {
+		case "format":
+			b, _ := io.ReadAll(io.LimitReader(part, 16))
+			if format, err = ParseBulkFormat(string(b)); err != nil {
+				i.renderError(w, r, err)
+				return
+			}
+		case "dry_run":
+			dryRun = true
+		case "file":
+			report, err = i.ctrl.ImportUsers(r.Context(), part, format, dryRun)
+			if err != nil {
+				i.renderError(w, r, err)
+				return
+			}
+		}
+	}
+
+	if report == nil {
+		i.renderError(w, r, errors.New("no file uploaded"))
+		return
+	}
+
+	i.log.Info("imported users",
+		zap.Bool("dry_run", dryRun),
+		zap.Int("created", report.Created),
+		zap.Int("updated", report.Updated),
+		zap.Int("failed", report.Failed))
+
+	data := struct {
+		model.BaseData
+		Report *ImportReport
+	}{
+		BaseData: model.BaseData{
+			PageTitle: "Import Users",
+		},
+		Report: report,
+	}
+
+	err = template.Render(w, r, "idp/users_import.html", &data)
+	if err != nil {
+		i.log.Error("error rendering idp/users_import.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) getUsersExport(w http.ResponseWriter, r *http.Request) {
+	format, err := ParseBulkFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// hashes can be cracked offline, reading them takes more than users:read
+	hashes, _ := strconv.ParseBool(r.URL.Query().Get("hashes"))
+	if hashes && !principalFrom(r.Context()).Can(model.PermissionUsersWrite) {
+		http.Error(w, "exporting password hashes requires users:write", http.StatusForbidden)
+		return
+	}
+
+	contentType := "text/csv"
+	if format == BulkFormatJSON {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+
+	err = i.ctrl.ExportUsers(r.Context(), w, format, hashes)
+	if err != nil {
+		i.log.Error("error exporting users", zap.Error(err))
+	}
+}
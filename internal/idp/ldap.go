@@ -0,0 +1,285 @@
+package idp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/ldapserver"
+	"github.com/ghaggin/sso/internal/lockout"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/repository"
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+// ldapDirectory exposes the repository's users and groups to the ldap
+// server as
+//
+//	uid=<username>,ou=people,<base dn>
+//	cn=<group>,ou=groups,<base dn>
+//
+// Users bind with their idp password. Service accounts from the config
+// can bind as well, both may search.
+type ldapDirectory struct {
+	ctrl     *Controller
+	log      *zap.Logger
+	baseDN   string
+	accounts []config.ServiceAccount
+	limiter  *lockout.Limiter
+}
+
+func newLDAPDirectory(cfg config.LDAPServer, ctrl *Controller, limiter *lockout.Limiter, log *zap.Logger) *ldapDirectory {
+	return &ldapDirectory{
+		ctrl:     ctrl,
+		log:      log,
+		baseDN:   cfg.BaseDN,
+		accounts: cfg.ServiceAccounts,
+		limiter:  limiter,
+	}
+}
+
+func (d *ldapDirectory) peopleDN() string {
+	return "ou=people," + d.baseDN
+}
+
+func (d *ldapDirectory) groupsDN() string {
+	return "ou=groups," + d.baseDN
+}
+
+func (d *ldapDirectory) userDN(name string) string {
+	return "uid=" + ldap.EscapeDN(name) + "," + d.peopleDN()
+}
+
+func (d *ldapDirectory) groupDN(name string) string {
+	return "cn=" + ldap.EscapeDN(name) + "," + d.groupsDN()
+}
+
+// username returns the uid of a dn directly below ou=people
+func (d *ldapDirectory) username(dn string) (string, bool) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) < 2 || len(parsed.RDNs[0].Attributes) != 1 {
+		return "", false
+	}
+
+	rdn := parsed.RDNs[0].Attributes[0]
+	if !strings.EqualFold(rdn.Type, "uid") {
+		return "", false
+	}
+
+	if ldapserver.NormalizeDN(d.userDN(rdn.Value)) != ldapserver.NormalizeDN(dn) {
+		return "", false
+	}
+	return rdn.Value, true
+}
+
+// Bind shares failure counters with the login page, a user's password
+// guesses over ldap count towards the same lockout
+func (d *ldapDirectory) Bind(ctx context.Context, dn, password string) error {
+	remote := ldapserver.RemoteAddr(ctx)
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+
+	account, ok := d.username(dn)
+	if !ok {
+		account = ldapserver.NormalizeDN(dn)
+	}
+
+	if err := d.limiter.Check(ctx, account, host); err != nil {
+		d.log.Error("failed ldap bind", zap.String("dn", dn), zap.String("remote", remote), zap.Error(err))
+		return ldapserver.ErrInvalidCredentials
+	}
+
+	valid, err := d.checkBind(ctx, dn, password)
+	if err != nil {
+		d.log.Error("failed ldap bind", zap.String("dn", dn), zap.String("remote", remote), zap.Error(err))
+		return err
+	}
+	if !valid {
+		d.log.Error("failed ldap bind", zap.String("dn", dn), zap.String("remote", remote), zap.String("error", "invalid credentials"))
+		if err := d.limiter.Fail(ctx, account, host); err != nil {
+			d.log.Error("recording failed ldap bind", zap.Error(err))
+		}
+		return ldapserver.ErrInvalidCredentials
+	}
+
+	if err := d.limiter.Succeed(ctx, account); err != nil {
+		d.log.Error("clearing failed ldap binds", zap.Error(err))
+	}
+	d.log.Info("ldap bind", zap.String("dn", dn), zap.String("remote", remote))
+	return nil
+}
+
+func (d *ldapDirectory) checkBind(ctx context.Context, dn, password string) (bool, error) {
+	if a, ok := d.serviceAccount(dn); ok {
+		return checkServicePassword(a.Password, password), nil
+	}
+
+	name, ok := d.username(dn)
+	if !ok {
+		return false, nil
+	}
+
+	valid, err := d.ctrl.ValidateLogin(ctx, name, password)
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+	return valid, err
+}
+
+func checkServicePassword(stored, password string) bool {
+	if isPasswordHash(stored) {
+		return checkPassword(stored, password)
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func (d *ldapDirectory) serviceAccount(dn string) (config.ServiceAccount, bool) {
+	for _, a := range d.accounts {
+		if ldapserver.NormalizeDN(a.DN) == ldapserver.NormalizeDN(dn) {
+			return a, true
+		}
+	}
+	return config.ServiceAccount{}, false
+}
+
+// Search requires a bind and returns the matching entries from the whole
+// tree. Disabled users are left out.
+func (d *ldapDirectory) Search(ctx context.Context, boundDN string, req *ldapserver.SearchRequest) ([]*ldapserver.Entry, error) {
+	if boundDN == "" {
+		return nil, ldapserver.ErrInsufficientAccess
+	}
+
+	base := req.BaseDN
+	inTree := ldapserver.InScope(base, d.baseDN, ldapserver.ScopeWholeSubtree)
+	if !inTree && !ldapserver.InScope(d.baseDN, base, ldapserver.ScopeWholeSubtree) {
+		return nil, ldapserver.ErrNoSuchObject
+	}
+
+	entries, err := d.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	baseFound := !inTree
+	var found []*ldapserver.Entry
+	for _, e := range entries {
+		if inTree && ldapserver.NormalizeDN(e.DN) == ldapserver.NormalizeDN(base) {
+			baseFound = true
+		}
+		if req.Match(e) {
+			found = append(found, e)
+		}
+	}
+	if !baseFound {
+		return nil, ldapserver.ErrNoSuchObject
+	}
+
+	return found, nil
+}
+
+func (d *ldapDirectory) entries(ctx context.Context) ([]*ldapserver.Entry, error) {
+	users, err := d.ctrl.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := d.ctrl.GetGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rdn := strings.SplitN(d.baseDN, ",", 2)[0]
+	kv := strings.SplitN(rdn, "=", 2)
+	root := &ldapserver.Entry{
+		DN: d.baseDN,
+		Attributes: map[string][]string{
+			"objectClass": {"top", "domain"},
+		},
+	}
+	if len(kv) == 2 {
+		root.Attributes[strings.TrimSpace(kv[0])] = []string{strings.TrimSpace(kv[1])}
+	}
+
+	entries := []*ldapserver.Entry{
+		root,
+		{DN: d.peopleDN(), Attributes: map[string][]string{"objectClass": {"top", "organizationalUnit"}, "ou": {"people"}}},
+		{DN: d.groupsDN(), Attributes: map[string][]string{"objectClass": {"top", "organizationalUnit"}, "ou": {"groups"}}},
+	}
+
+	byID := map[int]*model.User{}
+	memberOf := map[int][]string{}
+	for i := range users {
+		if !users[i].Disabled {
+			byID[users[i].ID] = &users[i]
+		}
+	}
+
+	for _, g := range groups {
+		dn := d.groupDN(g.Name)
+		var members []string
+		for _, id := range g.Members {
+			if u, ok := byID[id]; ok {
+				members = append(members, d.userDN(u.Name))
+				memberOf[id] = append(memberOf[id], dn)
+			}
+		}
+		attrs := map[string][]string{
+			"objectClass": {"top", "groupOfNames"},
+			"cn":          {g.Name},
+		}
+		if len(members) > 0 {
+			attrs["member"] = members
+		}
+		entries = append(entries, &ldapserver.Entry{DN: dn, Attributes: attrs})
+	}
+
+	for i := range users {
+		if u, ok := byID[users[i].ID]; ok {
+			entries = append(entries, d.userEntry(u, memberOf[u.ID]))
+		}
+	}
+
+	return entries, nil
+}
+
+func (d *ldapDirectory) userEntry(u *model.User, groups []string) *ldapserver.Entry {
+	cn := strings.TrimSpace(u.First + " " + u.Last)
+	if cn == "" {
+		cn = u.Name
+	}
+	sn := u.Last
+	if sn == "" {
+		sn = u.Name
+	}
+
+	attrs := map[string][]string{
+		"objectClass": {"top", "person", "organizationalPerson", "inetOrgPerson"},
+		"uid":         {u.Name},
+		"uidNumber":   {strconv.Itoa(u.ID)},
+		"cn":          {cn},
+		"displayName": {cn},
+		"sn":          {sn},
+	}
+	if len(groups) > 0 {
+		attrs["memberOf"] = groups
+	}
+	if u.First != "" {
+		attrs["givenName"] = []string{u.First}
+	}
+	if u.Email != "" {
+		attrs["mail"] = []string{u.Email}
+	}
+	for _, a := range d.ctrl.AttributeSchema() {
+		if v := u.Attributes[a.Name]; len(v) > 0 {
+			attrs[a.Name] = v
+		}
+	}
+
+	return &ldapserver.Entry{DN: d.userDN(u.Name), Attributes: attrs}
+}
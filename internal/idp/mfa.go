@@ -0,0 +1,242 @@
+package idp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/template"
+	"go.uber.org/zap"
+)
+
+// pendingLoginTimeout bounds how long a login held back for another step
+// may take to finish it
+const pendingLoginTimeout = 10 * time.Minute
+
+// pendingAuthTimeout bounds how long a request may wait for the login it
+// was sent to, long enough for a password reset on the way
+const pendingAuthTimeout = 30 * time.Minute
+
+var (
+	errMFADeviceNotFound = errors.New("mfa device not found")
+	errInvalidMFACode    = errors.New("invalid authentication code")
+)
+
+// BeginTOTP adds an unconfirmed authenticator app to the user, replacing
+// any earlier one that was never confirmed
+func (c *Controller) BeginTOTP(ctx context.Context, username, name string) (*model.MFADevice, error) {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Authenticator app"
+	}
+
+	device := model.MFADevice{
+		ID:      randomHex(8),
+		Name:    name,
+		Type:    "totp",
+		Secret:  secret,
+		Created: time.Now().UTC(),
+	}
+
+	devices := []model.MFADevice{}
+	for _, d := range user.MFADevices {
+		if d.Confirmed {
+			devices = append(devices, d)
+		}
+	}
+	user.MFADevices = append(devices, device)
+
+	if err := c.repo.UpdateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// ConfirmTOTP activates an enrolled device once the user proves the app
+// produces matching codes
+func (c *Controller) ConfirmTOTP(ctx context.Context, username, id, code string) error {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	// copied so the repository's record isn't modified in place
+	user.MFADevices = append([]model.MFADevice(nil), user.MFADevices...)
+	d := findMFADevice(user, id)
+	if d == nil || d.Confirmed {
+		return errMFADeviceNotFound
+	}
+
+	now := time.Now()
+	step, ok := verifyTOTP(d.Secret, code, now, d.LastStep)
+	if !ok {
+		return errInvalidMFACode
+	}
+
+	d.Confirmed = true
+	d.LastStep = step
+	d.LastUsed = now.UTC()
+	return c.repo.UpdateUser(ctx, user)
+}
+
+func (c *Controller) GetMFADevice(ctx context.Context, username, id string) (*model.MFADevice, error) {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	d := findMFADevice(user, id)
+	if d == nil {
+		return nil, errMFADeviceNotFound
+	}
+	return d, nil
+}
+
+func (c *Controller) DeleteMFADevice(ctx context.Context, username, id string) error {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	devices := []model.MFADevice{}
+	for _, d := range user.MFADevices {
+		if d.ID != id {
+			devices = append(devices, d)
+		}
+	}
+	if len(devices) == len(user.MFADevices) {
+		return errMFADeviceNotFound
+	}
+
+	user.MFADevices = devices
+	return c.repo.UpdateUser(ctx, user)
+}
+
+// MFARequired reports whether the user has a confirmed second factor
+func (c *Controller) MFARequired(ctx context.Context, username string) (bool, error) {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	for _, d := range user.MFADevices {
+		if d.Confirmed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// VerifyMFA checks a code against the user's confirmed devices
+func (c *Controller) VerifyMFA(ctx context.Context, username, code string) (bool, error) {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	user.MFADevices = append([]model.MFADevice(nil), user.MFADevices...)
+	for i := range user.MFADevices {
+		d := &user.MFADevices[i]
+		if !d.Confirmed {
+			continue
+		}
+		if step, ok := verifyTOTP(d.Secret, code, now, d.LastStep); ok {
+			d.LastStep = step
+			d.LastUsed = now.UTC()
+			return true, c.repo.UpdateUser(ctx, user)
+		}
+	}
+	return false, nil
+}
+
+func findMFADevice(user *model.User, id string) *model.MFADevice {
+	for i := range user.MFADevices {
+		if user.MFADevices[i].ID == id {
+			return &user.MFADevices[i]
+		}
+	}
+	return nil
+}
+
+// pendingLogin returns a login held back for step
+func (i *IdentityProvider) pendingLogin(r *http.Request, step model.PendingStep) (*model.PendingLogin, bool) {
+	pending, ok := i.sm.LoadPendingLogin(r.Context())
+	if !ok || pending.Step != step || time.Since(pending.Created) > pendingLoginTimeout {
+		return nil, false
+	}
+	return pending, true
+}
+
+func (i *IdentityProvider) getLoginMFA(w http.ResponseWriter, r *http.Request) {
+	if _, ok := i.pendingLogin(r, model.PendingMFA); !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	i.renderLoginMFA(w, r, nil)
+}
+
+func (i *IdentityProvider) postLoginMFA(w http.ResponseWriter, r *http.Request) {
+	pending, ok := i.pendingLogin(r, model.PendingMFA)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	username := pending.UID
+
+	r.ParseForm()
+	addr := remoteHost(r)
+
+	if err := i.limiter.Check(r.Context(), username, addr); err != nil {
+		i.log.Error("failed mfa", zap.String("username", username), zap.String("addr", addr), zap.Error(err))
+		i.renderLoginMFA(w, r, err)
+		return
+	}
+
+	valid, err := i.ctrl.VerifyMFA(r.Context(), username, r.Form.Get("code"))
+	if err == nil && !valid {
+		err = errInvalidMFACode
+	}
+	if err != nil {
+		i.log.Error("failed mfa", zap.String("username", username), zap.String("addr", addr), zap.Error(err))
+		if err := i.limiter.Fail(r.Context(), username, addr); err != nil {
+			i.log.Error("recording failed login", zap.Error(err))
+		}
+		i.renderLoginMFA(w, r, err)
+		return
+	}
+
+	i.finishLogin(w, r, username, pending.Remember, true)
+}
+
+func (i *IdentityProvider) renderLoginMFA(w http.ResponseWriter, r *http.Request, loginErr error) {
+	data := &model.IDPLoginData{
+		BaseData: model.BaseData{
+			PageTitle: "Two-factor authentication",
+		},
+	}
+	if loginErr != nil {
+		data.Error = true
+		data.ErrorMessage = loginErr.Error()
+	}
+
+	err := template.Render(w, r, "idp/login_mfa.html", data)
+	if err != nil {
+		i.log.Error("error rendering login_mfa.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
@@ -1,10 +1,20 @@
 package idp
 
-import "go.uber.org/fx"
+import (
+	"github.com/ghaggin/sso/internal/audit"
+	"github.com/ghaggin/sso/internal/lockout"
+	"github.com/ghaggin/sso/internal/mail"
+	"github.com/ghaggin/sso/internal/provisioning"
+	"go.uber.org/fx"
+)
 
 var Module = fx.Options(
 	fx.Provide(
 		New,
 		NewController,
+		provisioning.New,
+		lockout.New,
+		mail.New,
+		audit.New,
 	),
 )
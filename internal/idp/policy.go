@@ -0,0 +1,149 @@
+package idp
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+	"go.uber.org/zap"
+)
+
+// PolicyError lists every rule a new password broke so forms can show them
+// all at once
+type PolicyError struct {
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return strings.Join(e.Violations, "; ")
+}
+
+// PasswordViolations lets packages that can't import idp recognise the
+// error
+func (e *PolicyError) PasswordViolations() []string {
+	return e.Violations
+}
+
+// policyViolations returns the broken rules when err is a policy error
+func policyViolations(err error) []string {
+	var pe *PolicyError
+	if errors.As(err, &pe) {
+		return pe.Violations
+	}
+	return nil
+}
+
+type passwordPolicy struct {
+	cfg    config.PasswordPolicy
+	breach *bloomFilter
+	now    func() time.Time
+}
+
+func newPasswordPolicy(cfg config.PasswordPolicy, log *zap.Logger) (*passwordPolicy, error) {
+	p := &passwordPolicy{
+		cfg: cfg,
+		now: time.Now,
+	}
+
+	if cfg.BreachList != "" {
+		start := time.Now()
+		filter, err := loadBreachList(cfg.BreachList)
+		if err != nil {
+			return nil, fmt.Errorf("loading breach list: %w", err)
+		}
+		p.breach = filter
+		log.Info("loaded breach list",
+			zap.String("path", cfg.BreachList),
+			zap.Int("bytes", len(filter.bits)*8),
+			zap.Duration("took", time.Since(start)))
+	}
+
+	return p, nil
+}
+
+// check validates password as the user's new password. previous is the
+// stored user before the change, nil for new users.
+func (p *passwordPolicy) check(user *model.User, password string, previous *model.User) error {
+	var violations []string
+
+	if n := utf8.RuneCountInString(password); n < p.cfg.MinLength {
+		violations = append(violations, fmt.Sprintf("password must be at least %d characters", p.cfg.MinLength))
+	}
+
+	if p.cfg.MinClasses > 0 && characterClasses(password) < p.cfg.MinClasses {
+		violations = append(violations, fmt.Sprintf("password must mix at least %d of uppercase letters, lowercase letters, digits and symbols", p.cfg.MinClasses))
+	}
+
+	if p.cfg.DisallowUsername && user.Name != "" && strings.Contains(strings.ToLower(password), strings.ToLower(user.Name)) {
+		violations = append(violations, "password must not contain the username")
+	}
+
+	if previous != nil && p.cfg.History > 0 {
+		for _, hash := range p.history(previous) {
+			if checkPassword(hash, password) {
+				violations = append(violations, fmt.Sprintf("password must not be one of the last %d passwords", p.cfg.History))
+				break
+			}
+		}
+	}
+
+	if p.breach != nil && p.breach.test(sha1.Sum([]byte(password))) {
+		violations = append(violations, "password appears in a list of breached passwords")
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// history is the user's current password followed by the previous ones
+// that may not be reused
+func (p *passwordPolicy) history(user *model.User) []string {
+	var hashes []string
+	if user.Password != "" {
+		hashes = append(hashes, user.Password)
+	}
+	hashes = append(hashes, user.PasswordHistory...)
+	return hashes[:min(len(hashes), p.cfg.History)]
+}
+
+// expired reports whether the user must choose a new password before
+// logging in. Users who never changed it count from their creation.
+func (p *passwordPolicy) expired(user *model.User) bool {
+	// users without a local password sign in upstream
+	if p.cfg.MaxAge <= 0 || user.Password == "" {
+		return false
+	}
+
+	changed := user.PasswordChanged
+	if changed.IsZero() {
+		changed = user.Created
+	}
+	return p.now().Sub(changed) > p.cfg.MaxAge
+}
+
+// characterClasses counts which of uppercase, lowercase, digits and
+// symbols the password uses
+func characterClasses(password string) int {
+	var upper, lower, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return upper + lower + digit + symbol
+}
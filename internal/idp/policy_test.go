@@ -0,0 +1,85 @@
+package idp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPolicyViolations(t *testing.T) {
+	breachList := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(breachList, []byte("Password1!\n"), 0o600))
+	p, err := newPasswordPolicy(config.PasswordPolicy{
+		MinLength:        10,
+		MinClasses:       3,
+		DisallowUsername: true,
+		BreachList:       breachList,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	user := &model.User{Name: "Alice"}
+
+	for _, tt := range []struct {
+		password   string
+		violations []string
+	}{
+		{"correct-Horse-7", nil},
+		{"Short-7", []string{"password must be at least 10 characters"}},
+		{"lowercaseonly", []string{"password must mix at least 3 of uppercase letters, lowercase letters, digits and symbols"}},
+		{"my-ALICE-pass-7", []string{"password must not contain the username"}},
+		{"Password1!", []string{"password appears in a list of breached passwords"}},
+		// every broken rule is listed
+		{"alice", []string{
+			"password must be at least 10 characters",
+			"password must mix at least 3 of uppercase letters, lowercase letters, digits and symbols",
+			"password must not contain the username",
+		}},
+	} {
+		t.Run(tt.password, func(t *testing.T) {
+			err := p.check(user, tt.password, nil)
+			require.Equal(t, tt.violations, policyViolations(err))
+			if tt.violations == nil {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPolicyHistory(t *testing.T) {
+	const history = 3
+	c := &Controller{policy: &passwordPolicy{cfg: config.PasswordPolicy{History: history}, now: time.Now}}
+	user := &model.User{Name: "alice"}
+
+	// each change keeps the current password and history-1 before it
+	passwords := []string{"first", "second", "third", "fourth"}
+	for _, password := range passwords {
+		previous := *user
+		user.Password = password
+		require.NoError(t, c.setPassword(user, &previous))
+		require.LessOrEqual(t, len(user.PasswordHistory), history-1)
+	}
+
+	for _, password := range passwords[1:] {
+		err := c.policy.check(user, password, user)
+		require.Equal(t, []string{"password must not be one of the last 3 passwords"}, policyViolations(err), password)
+	}
+	// the oldest fell out of the history
+	require.NoError(t, c.policy.check(user, passwords[0], user))
+}
+
+func TestPolicyExpired(t *testing.T) {
+	now := time.Now()
+	p := &passwordPolicy{cfg: config.PasswordPolicy{MaxAge: time.Hour}, now: func() time.Time { return now }}
+
+	require.False(t, p.expired(&model.User{Password: "x", PasswordChanged: now.Add(-time.Minute)}))
+	require.True(t, p.expired(&model.User{Password: "x", PasswordChanged: now.Add(-2 * time.Hour)}))
+	// never changed counts from creation
+	require.True(t, p.expired(&model.User{Password: "x", Created: now.Add(-2 * time.Hour)}))
+	// upstream users have no password to expire
+	require.False(t, p.expired(&model.User{Created: now.Add(-2 * time.Hour)}))
+}
@@ -0,0 +1,236 @@
+package idp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+)
+
+var (
+	errPrivilegedUser  = &forbiddenError{"user holds admin permissions, changing them requires roles:write"}
+	errPrivilegedGroup = &forbiddenError{"group grants admin roles, changing it requires roles:write"}
+)
+
+// forbiddenError is a change the caller isn't allowed to make
+type forbiddenError struct {
+	msg string
+}
+
+func (e *forbiddenError) Error() string {
+	return e.msg
+}
+
+// Forbidden lets the scim server answer with 403
+func (e *forbiddenError) Forbidden() {}
+
+// scimPrincipal makes every scim request. Provisioning manages ordinary
+// users and groups but can't change who holds admin permissions.
+var scimPrincipal = &principal{
+	Name:  "scim",
+	Token: true,
+	permissions: map[model.Permission]bool{
+		model.PermissionUsersRead:  true,
+		model.PermissionUsersWrite: true,
+	},
+}
+
+// roles resolves role names to the permissions they grant
+type roles struct {
+	grants map[string]map[model.Permission]bool
+	// users and groups grant roles by username and group membership
+	users  map[string][]string
+	groups map[string][]string
+}
+
+func newRoles(cfg config.Admin) (*roles, error) {
+	all := map[model.Permission]bool{}
+	for _, p := range model.Permissions {
+		all[p] = true
+	}
+
+	r := &roles{
+		grants: map[string]map[model.Permission]bool{model.RoleAdmin: all},
+		users:  cfg.UserRoles,
+		groups: cfg.GroupRoles,
+	}
+	for name, perms := range cfg.Roles {
+		if name == model.RoleAdmin {
+			return nil, fmt.Errorf("admin.roles: %s is built in", model.RoleAdmin)
+		}
+		grant, err := parsePermissions(perms)
+		if err != nil {
+			return nil, fmt.Errorf("admin.roles.%s: %w", name, err)
+		}
+		r.grants[name] = grant
+	}
+
+	for user, names := range cfg.UserRoles {
+		if err := r.validate(names); err != nil {
+			return nil, fmt.Errorf("admin.user_roles.%s: %w", user, err)
+		}
+	}
+	for group, names := range cfg.GroupRoles {
+		if err := r.validate(names); err != nil {
+			return nil, fmt.Errorf("admin.group_roles.%s: %w", group, err)
+		}
+	}
+
+	return r, nil
+}
+
+func parsePermissions(perms []string) (map[model.Permission]bool, error) {
+	known := map[model.Permission]bool{}
+	for _, p := range model.Permissions {
+		known[p] = true
+	}
+
+	grant := map[model.Permission]bool{}
+	for _, p := range perms {
+		if !known[model.Permission(p)] {
+			return nil, fmt.Errorf("unknown permission %q", p)
+		}
+		grant[model.Permission(p)] = true
+	}
+	return grant, nil
+}
+
+// names returns every role, sorted
+func (r *roles) names() []string {
+	names := make([]string, 0, len(r.grants))
+	for name := range r.grants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *roles) validate(names []string) error {
+	for _, name := range names {
+		if _, ok := r.grants[name]; !ok {
+			return fmt.Errorf("unknown role %q", name)
+		}
+	}
+	return nil
+}
+
+// permissions merges the grants of the named roles, roles that are no
+// longer configured grant nothing
+func (r *roles) permissions(names []string, into map[model.Permission]bool) {
+	for _, name := range names {
+		for p := range r.grants[name] {
+			into[p] = true
+		}
+	}
+}
+
+// UserPermissions returns what the user's roles, and the roles configured
+// for them and their groups, allow. Disabled users hold no permissions.
+func (c *Controller) UserPermissions(ctx context.Context, user *model.User) (map[model.Permission]bool, error) {
+	perms := map[model.Permission]bool{}
+	if user.Disabled {
+		return perms, nil
+	}
+	c.roles.permissions(user.Roles, perms)
+	c.roles.permissions(c.roles.users[user.Name], perms)
+
+	if len(c.roles.groups) > 0 {
+		groups, err := c.GetUserGroups(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			c.roles.permissions(c.roles.groups[g.Name], perms)
+		}
+	}
+
+	return perms, nil
+}
+
+// checkManage refuses changes to a user holding any permission unless the
+// caller may grant roles, otherwise users:write would be enough to reset an
+// admin's password. Only the cli calls in without a principal, scim
+// requests carry scimPrincipal.
+func (c *Controller) checkManage(ctx context.Context, user *model.User) error {
+	p := principalFrom(ctx)
+	if p == nil || p.Can(model.PermissionRolesWrite) {
+		return nil
+	}
+
+	// a disabled admin still counts, the change could enable them
+	enabled := *user
+	enabled.Disabled = false
+	perms, err := c.UserPermissions(ctx, &enabled)
+	if err != nil {
+		return err
+	}
+	if len(perms) > 0 {
+		return errPrivilegedUser
+	}
+	return nil
+}
+
+// checkManageGroup refuses changes to a group that admin.group_roles grants
+// roles to, adding a member would make them an admin
+func (c *Controller) checkManageGroup(ctx context.Context, name string) error {
+	p := principalFrom(ctx)
+	if p == nil || p.Can(model.PermissionRolesWrite) {
+		return nil
+	}
+	if len(c.roles.groups[name]) > 0 {
+		return errPrivilegedGroup
+	}
+	return nil
+}
+
+// ValidateRoles rejects role names that aren't configured
+func (c *Controller) ValidateRoles(names []string) error {
+	return c.roles.validate(names)
+}
+
+// RoleNames lists the roles that can be assigned to users
+func (c *Controller) RoleNames() []string {
+	return c.roles.names()
+}
+
+// apiToken is a configured bearer token, only its digest is kept so
+// comparisons take the same time whatever the token length
+type apiToken struct {
+	name        string
+	digest      [sha256.Size]byte
+	permissions map[model.Permission]bool
+}
+
+func newAPITokens(cfg []config.APIToken) ([]apiToken, error) {
+	var tokens []apiToken
+	for _, t := range cfg {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("admin.api_tokens: name and token are required")
+		}
+		perms, err := parsePermissions(t.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("admin.api_tokens.%s: %w", t.Name, err)
+		}
+		tokens = append(tokens, apiToken{
+			name:        t.Name,
+			digest:      sha256.Sum256([]byte(t.Token)),
+			permissions: perms,
+		})
+	}
+	return tokens, nil
+}
+
+func matchAPIToken(tokens []apiToken, token string) (*apiToken, bool) {
+	digest := sha256.Sum256([]byte(token))
+	var match *apiToken
+	for i := range tokens {
+		if subtle.ConstantTimeCompare(digest[:], tokens[i].digest[:]) == 1 {
+			match = &tokens[i]
+		}
+	}
+	return match, match != nil
+}
@@ -0,0 +1,252 @@
+package idp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// ServiceProviderStore keeps the registered service providers' metadata in
+// a json file. The file is read again whenever it changes, so sps
+// registered or removed from the command line reach a running idp.
+type ServiceProviderStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	sps     map[string]*saml.EntityDescriptor
+	// settings are kept apart from the metadata, which comes from the sp
+	settings map[string]SPSettings
+}
+
+// SPSettings are what the registration says about an sp beyond its
+// metadata
+type SPSettings struct {
+	// Evil registers the sp for adversarial testing, see evil.go
+	Evil bool `json:"evil,omitempty"`
+	// RelayState is sent with idp initiated logins that don't give one
+	RelayState string `json:"relayState,omitempty"`
+	// Groups limit the sp to their members, everyone may use it without
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Allows tells whether a member of groups may use the sp
+func (s SPSettings) Allows(groups []string) bool {
+	if len(s.Groups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if slices.Contains(s.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// registeredSP is a service provider as it is persisted, the metadata is
+// kept as xml so it round trips unchanged
+type registeredSP struct {
+	EntityID string `json:"entityId"`
+	Metadata string `json:"metadata"`
+	SPSettings
+}
+
+func NewServiceProviderStore(path string) *ServiceProviderStore {
+	return &ServiceProviderStore{path: path}
+}
+
+// load refreshes the cached sps from the file, callers hold mu
+func (s *ServiceProviderStore) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.sps = map[string]*saml.EntityDescriptor{}
+		s.settings = map[string]SPSettings{}
+		s.modTime = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if s.sps != nil && info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var registered []registeredSP
+	if err := json.Unmarshal(b, &registered); err != nil {
+		return fmt.Errorf("reading %s: %w", s.path, err)
+	}
+
+	sps := make(map[string]*saml.EntityDescriptor, len(registered))
+	settings := make(map[string]SPSettings, len(registered))
+	for _, r := range registered {
+		metadata := &saml.EntityDescriptor{}
+		if err := xml.Unmarshal([]byte(r.Metadata), metadata); err != nil {
+			return fmt.Errorf("reading %s: metadata of %s: %w", s.path, r.EntityID, err)
+		}
+		sps[r.EntityID] = metadata
+		settings[r.EntityID] = r.SPSettings
+	}
+
+	s.sps = sps
+	s.settings = settings
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save replaces the file atomically with the cached sps, callers hold mu
+func (s *ServiceProviderStore) save() error {
+	registered := make([]registeredSP, 0, len(s.sps))
+	for _, metadata := range s.list() {
+		b, err := xml.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		registered = append(registered, registeredSP{
+			EntityID:   metadata.EntityID,
+			Metadata:   string(b),
+			SPSettings: s.settings[metadata.EntityID],
+		})
+	}
+
+	b, err := json.MarshalIndent(registered, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// saveOrReload saves the cached sps, when that fails the cache is dropped
+// so it is read from the file again
+func (s *ServiceProviderStore) saveOrReload() error {
+	err := s.save()
+	if err != nil {
+		s.sps = nil
+	}
+	return err
+}
+
+// list returns the cached sps ordered by entity id, callers hold mu
+func (s *ServiceProviderStore) list() []*saml.EntityDescriptor {
+	sps := make([]*saml.EntityDescriptor, 0, len(s.sps))
+	for _, metadata := range s.sps {
+		sps = append(sps, metadata)
+	}
+	slices.SortFunc(sps, func(a, b *saml.EntityDescriptor) int {
+		return strings.Compare(a.EntityID, b.EntityID)
+	})
+	return sps
+}
+
+// Get returns the sp's metadata, os.ErrNotExist when it isn't registered
+func (s *ServiceProviderStore) Get(entityID string) (*saml.EntityDescriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	metadata, ok := s.sps[entityID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return metadata, nil
+}
+
+// List returns the registered sps ordered by entity id
+func (s *ServiceProviderStore) List() ([]*saml.EntityDescriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.list(), nil
+}
+
+// Put registers the sp, replacing the metadata of one with the same entity
+// id. The settings of an sp registered again are kept.
+func (s *ServiceProviderStore) Put(metadata *saml.EntityDescriptor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.sps[metadata.EntityID] = metadata
+	return s.saveOrReload()
+}
+
+// Remove unregisters the sp, os.ErrNotExist when it wasn't registered
+func (s *ServiceProviderStore) Remove(entityID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, ok := s.sps[entityID]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.sps, entityID)
+	delete(s.settings, entityID)
+	return s.saveOrReload()
+}
+
+// Settings returns the sp's settings, os.ErrNotExist when it isn't
+// registered
+func (s *ServiceProviderStore) Settings(entityID string) (SPSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return SPSettings{}, err
+	}
+	if _, ok := s.sps[entityID]; !ok {
+		return SPSettings{}, os.ErrNotExist
+	}
+	return s.settings[entityID], nil
+}
+
+// UpdateSettings changes the sp's settings with update, os.ErrNotExist when
+// it isn't registered
+func (s *ServiceProviderStore) UpdateSettings(entityID string, update func(*SPSettings)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, ok := s.sps[entityID]; !ok {
+		return os.ErrNotExist
+	}
+	settings := s.settings[entityID]
+	update(&settings)
+	s.settings[entityID] = settings
+	return s.saveOrReload()
+}
@@ -0,0 +1,239 @@
+package idp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghaggin/sso/internal/mail"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/repository"
+	"github.com/ghaggin/sso/internal/template"
+	"go.uber.org/zap"
+)
+
+// resetInterval is the minimum time between reset mails to one user
+const resetInterval = time.Minute
+
+var errInvalidResetToken = errors.New("reset link is invalid or has expired")
+
+// forgotMessage is shown whether or not the account exists so the form
+// can't be used to find accounts
+const forgotMessage = "If the account exists and has an email address, a reset link is on its way."
+
+// CreatePasswordReset issues a reset token for the user with the given
+// username or email. The user is nil when there is nobody to send it to,
+// or a link was sent moments ago.
+func (c *Controller) CreatePasswordReset(ctx context.Context, login string) (*model.User, string, error) {
+	user, err := c.resetUser(ctx, login)
+	if err != nil || user == nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	if r := user.PasswordReset; r != nil && now.Before(r.Expires.Add(-c.resetTTL+resetInterval)) {
+		return nil, "", nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	token := fmt.Sprintf("%d.%s", user.ID, base64.RawURLEncoding.EncodeToString(b))
+
+	// replaces any earlier link
+	user.PasswordReset = &model.PasswordReset{
+		Hash:    hashResetToken(token),
+		Expires: now.Add(c.resetTTL),
+	}
+	if err := c.repo.UpdateUser(ctx, user); err != nil {
+		return nil, "", err
+	}
+
+	return user, token, nil
+}
+
+// resetUser finds the active user by username, falling back to a unique
+// email match
+func (c *Controller) resetUser(ctx context.Context, login string) (*model.User, error) {
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return nil, nil
+	}
+
+	user, err := c.repo.GetUserByName(ctx, login)
+	if errors.Is(err, repository.ErrNotFound) {
+		users, err := c.repo.GetUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i := range users {
+			if strings.EqualFold(users[i].Email, login) {
+				if user != nil {
+					return nil, nil
+				}
+				user = &users[i]
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user == nil || user.Disabled || user.Email == "" {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// CheckPasswordReset returns the user the token was issued to
+func (c *Controller) CheckPasswordReset(ctx context.Context, token string) (*model.User, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidResetToken
+	}
+	uid, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, errInvalidResetToken
+	}
+
+	user, err := c.repo.GetUserByID(ctx, uid)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, errInvalidResetToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	r := user.PasswordReset
+	if r == nil || user.Disabled || time.Now().After(r.Expires) ||
+		subtle.ConstantTimeCompare([]byte(r.Hash), []byte(hashResetToken(token))) != 1 {
+		return nil, errInvalidResetToken
+	}
+	return user, nil
+}
+
+// ResetPassword sets the password of the token's user and uses up the token
+func (c *Controller) ResetPassword(ctx context.Context, token, password string) (*model.User, error) {
+	user, err := c.CheckPasswordReset(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Password = password
+	user.PasswordReset = nil
+	if err := c.UpdateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (i *IdentityProvider) getPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	i.renderPasswordForgot(w, r, &model.IDPPasswordResetData{})
+}
+
+func (i *IdentityProvider) postPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	login := r.Form.Get("login")
+
+	user, token, err := i.ctrl.CreatePasswordReset(r.Context(), login)
+	if err != nil {
+		i.log.Error("creating password reset", zap.String("login", login), zap.Error(err))
+	} else if user != nil {
+		i.log.Info("password reset requested", zap.String("username", user.Name), zap.String("addr", remoteHost(r)))
+
+		// sent in the background so the response time doesn't give away
+		// whether the account exists
+		msg := mail.Message{
+			To:      []string{user.Email},
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s and works once.\n\n%s/password/reset?token=%s\n\nIf you didn't ask for this you can ignore this email.\n",
+				user.Name, i.ctrl.resetTTL, i.baseURL, token),
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := i.mailer.Send(ctx, msg); err != nil {
+				i.log.Error("sending password reset", zap.String("username", user.Name), zap.Error(err))
+			}
+		}()
+	}
+
+	i.renderPasswordForgot(w, r, &model.IDPPasswordResetData{Message: forgotMessage})
+}
+
+func (i *IdentityProvider) renderPasswordForgot(w http.ResponseWriter, r *http.Request, data *model.IDPPasswordResetData) {
+	data.PageTitle = "Forgot Password"
+	err := template.Render(w, r, "idp/password_forgot.html", data)
+	if err != nil {
+		i.log.Error("error rendering password_forgot.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) getPasswordReset(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	data := &model.IDPPasswordResetData{Token: token}
+	if _, err := i.ctrl.CheckPasswordReset(r.Context(), token); err != nil {
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		data.Token = ""
+	}
+	i.renderPasswordReset(w, r, data)
+}
+
+func (i *IdentityProvider) postPasswordReset(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	token := r.Form.Get("token")
+	password := r.Form.Get("password")
+
+	data := &model.IDPPasswordResetData{Token: token}
+	if password != r.Form.Get("confirm") {
+		data.Error = true
+		data.ErrorMessage = "passwords do not match"
+		i.renderPasswordReset(w, r, data)
+		return
+	}
+
+	user, err := i.ctrl.ResetPassword(r.Context(), token, password)
+	if err != nil {
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		data.Violations = policyViolations(err)
+		if errors.Is(err, errInvalidResetToken) {
+			data.Token = ""
+		}
+		i.renderPasswordReset(w, r, data)
+		return
+	}
+
+	i.log.Info("password reset", zap.String("username", user.Name), zap.String("addr", remoteHost(r)))
+
+	// proving control of the mailbox also lifts a lockout
+	if err := i.limiter.Succeed(r.Context(), user.Name); err != nil {
+		i.log.Error("clearing failed logins", zap.Error(err))
+	}
+
+	i.renderPasswordReset(w, r, &model.IDPPasswordResetData{Message: "Your password has been changed."})
+}
+
+func (i *IdentityProvider) renderPasswordReset(w http.ResponseWriter, r *http.Request, data *model.IDPPasswordResetData) {
+	data.PageTitle = "Reset Password"
+	err := template.Render(w, r, "idp/password_reset.html", data)
+	if err != nil {
+		i.log.Error("error rendering password_reset.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
@@ -2,25 +2,38 @@ package idp
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/logger"
 	"github.com/crewjam/saml/samlidp"
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/middleware"
+	"github.com/ghaggin/sso/internal/model"
 	xrv "github.com/mattermost/xml-roundtrip-validator"
 	dsig "github.com/russellhaering/goxmldsig"
 )
 
 type SamlIdentityProvider struct {
-	IDP             *saml.IdentityProvider
-	serviceProvider *saml.EntityDescriptor
+	IDP              *saml.IdentityProvider
+	serviceProviders *ServiceProviderStore
+
+	sm   *middleware.SessionManager
+	ctrl *Controller
 }
 
-func newSamlIdentityProvider(opts samlidp.Options) *SamlIdentityProvider {
+func newSamlIdentityProvider(opts samlidp.Options, sps *ServiceProviderStore, sm *middleware.SessionManager, ctrl *Controller) *SamlIdentityProvider {
 	metadataURL := opts.URL
 	metadataURL.Path += "/metadata"
 	ssoURL := opts.URL
@@ -53,8 +66,12 @@ func newSamlIdentityProvider(opts samlidp.Options) *SamlIdentityProvider {
 
 			ServiceProviderProvider: nil, // set below
 			SessionProvider:         nil, // set below
-			AssertionMaker:          saml.DefaultAssertionMaker{},
+			AssertionMaker:          sessionAssertionMaker{},
 		},
+
+		serviceProviders: sps,
+		sm:               sm,
+		ctrl:             ctrl,
 	}
 
 	s.IDP.ServiceProviderProvider = s
@@ -63,47 +80,215 @@ func newSamlIdentityProvider(opts samlidp.Options) *SamlIdentityProvider {
 	return s
 }
 
+// Metadata is the idp's saml metadata as served at /metadata, built from
+// the config alone so it can be exported without running the idp
+func Metadata(cfg *config.Config) (*saml.EntityDescriptor, error) {
+	baseURL, err := url.Parse(cfg.IdentityProvider.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	key, cert, err := config.GetKeyPair("idp")
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSamlIdentityProvider(samlidp.Options{
+		URL:         *baseURL,
+		Key:         key,
+		Certificate: cert,
+	}, nil, nil, nil)
+	return s.IDP.Metadata(), nil
+}
+
+// GetSession builds the saml session from the logged in user. Requests
+// reaching here have already passed requireAuth.
 func (s *SamlIdentityProvider) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	session, ok := s.sm.Authenticated(r.Context())
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := s.ctrl.GetUserByName(r.Context(), session.UID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	samlSession, err := s.userSession(r.Context(), user, session.Created, session.AuthExpiration)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+
+	// idp initiated logins are recorded, and checked, by the launch handler,
+	// the service provider is only looked up after the session here
+	if req.ServiceProviderMetadata != nil {
+		settings, err := s.serviceProviders.Settings(req.ServiceProviderMetadata.EntityID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil
+		}
+		if !settings.Allows(samlSession.Groups) {
+			http.Error(w, "you don't have access to "+req.ServiceProviderMetadata.EntityID, http.StatusForbidden)
+			return nil
+		}
+
+		s.ctrl.RecordAppSignIn(r.Context(), user, req.ServiceProviderMetadata.EntityID)
+		s.sm.RecordServiceProvider(r.Context(), req.ServiceProviderMetadata.EntityID)
+	}
+
+	return samlSession
+}
+
+// userSession is what assertions say about the user, for a login made at
+// created that lasts until expires
+func (s *SamlIdentityProvider) userSession(ctx context.Context, user *model.User, created, expires time.Time) (*saml.Session, error) {
+	groups, err := s.ctrl.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &saml.Session{
-		ID:                    "1",
-		CreateTime:            time.Now().Add(-time.Hour),
-		ExpireTime:            time.Now().Add(time.Hour),
-		Index:                 "2",
-		NameID:                "3",
-		NameIDFormat:          "4",
-		SubjectID:             "5",
-		Groups:                []string{"a", "b"},
-		UserName:              "6",
-		UserEmail:             "7",
-		UserCommonName:        "8",
-		UserSurname:           "9",
-		UserGivenName:         "10",
-		UserScopedAffiliation: "11",
-		CustomAttributes:      []saml.Attribute{},
+		ID:               randomHex(16),
+		CreateTime:       created,
+		ExpireTime:       expires,
+		Index:            randomHex(16),
+		NameID:           user.Name,
+		NameIDFormat:     "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+		Groups:           groupNames(groups),
+		UserName:         user.Name,
+		UserEmail:        user.Email,
+		UserCommonName:   strings.TrimSpace(user.First + " " + user.Last),
+		UserSurname:      user.Last,
+		UserGivenName:    user.First,
+		CustomAttributes: samlAttributes(s.ctrl.AttributeSchema(), user),
+	}, nil
+}
+
+// sessionAssertionMaker tells the sp when the idp session ends, through
+// SessionNotOnOrAfter, so it doesn't keep a login the idp has dropped
+type sessionAssertionMaker struct {
+	saml.DefaultAssertionMaker
+}
+
+func (m sessionAssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	if err := m.DefaultAssertionMaker.MakeAssertion(req, session); err != nil {
+		return err
+	}
+
+	if !session.ExpireTime.IsZero() {
+		expires := session.ExpireTime.UTC()
+		for i := range req.Assertion.AuthnStatements {
+			req.Assertion.AuthnStatements[i].SessionNotOnOrAfter = &expires
+		}
 	}
+	return nil
 }
 
 func (s *SamlIdentityProvider) GetServiceProvider(_ *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
-	return s.serviceProvider, nil
+	return s.serviceProviders.Get(serviceProviderID)
+}
+
+// ServiceProviders returns the registered service providers
+func (s *SamlIdentityProvider) ServiceProviders() ([]*saml.EntityDescriptor, error) {
+	return s.serviceProviders.List()
 }
 
 func (s *SamlIdentityProvider) HandlePutService(w http.ResponseWriter, r *http.Request) {
-	metadata, err := getSPMetadata(r.Body)
+	// marking an sp for adversarial testing takes the same permission as
+	// running the tests
+	if r.URL.Query().Has("evil") && !principalFrom(r.Context()).Can(model.PermissionSPEvil) {
+		http.Error(w, "evil requires the sp:evil permission", http.StatusForbidden)
+		return
+	}
+
+	update, err := SettingsUpdate(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := ParseServiceProviderMetadata(r.Body)
 	if err != nil {
+		http.Error(w, fmt.Sprintf("metadata: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.RegisterServiceProvider(metadata); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := s.serviceProviders.UpdateSettings(metadata.EntityID, update); err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
-	s.serviceProvider = metadata
 }
 
+// SettingsUpdate sets the settings given in the registration's query,
+// ?evil=, ?relay_state= and ?groups= (comma separated), and keeps the rest
+func SettingsUpdate(q url.Values) (func(*SPSettings), error) {
+	var evil *bool
+	if v := q.Get("evil"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("evil: %w", err)
+		}
+		evil = &b
+	}
+
+	return func(settings *SPSettings) {
+		if evil != nil {
+			settings.Evil = *evil
+		}
+		if v, ok := q["relay_state"]; ok {
+			settings.RelayState = v[0]
+		}
+		if v, ok := q["groups"]; ok {
+			settings.Groups = splitList(v[0])
+		}
+	}, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// RegisterServiceProvider trusts the sp, replacing earlier metadata with
+// the same entity id
+func (s *SamlIdentityProvider) RegisterServiceProvider(metadata *saml.EntityDescriptor) error {
+	return s.serviceProviders.Put(metadata)
+}
+
+// HandleGetService returns every registered sp as an EntitiesDescriptor
 func (s *SamlIdentityProvider) HandleGetService(w http.ResponseWriter, r *http.Request) {
-	err := xml.NewEncoder(w).Encode(s.serviceProvider)
+	sps, err := s.ServiceProviders()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	entities := saml.EntitiesDescriptor{}
+	for _, sp := range sps {
+		entities.EntityDescriptors = append(entities.EntityDescriptors, *sp)
+	}
+	err = xml.NewEncoder(w).Encode(entities)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 }
 
-func getSPMetadata(r io.Reader) (spMetadata *saml.EntityDescriptor, err error) {
+// ParseServiceProviderMetadata reads sp metadata, from an EntitiesDescriptor
+// the first sp is used
+func ParseServiceProviderMetadata(r io.Reader) (spMetadata *saml.EntityDescriptor, err error) {
 	var data []byte
 	if data, err = io.ReadAll(r); err != nil {
 		return nil, err
@@ -136,3 +321,11 @@ func getSPMetadata(r io.Reader) (spMetadata *saml.EntityDescriptor, err error) {
 
 	return spMetadata, nil
 }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
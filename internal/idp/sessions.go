@@ -0,0 +1,193 @@
+package idp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ghaggin/sso/internal/middleware"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/template"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// sessionsData is the admin sessions page, Results reports the sessions
+// just revoked and how logging them out of their sps went
+type sessionsData struct {
+	model.BaseData
+	User         string
+	Sessions     []model.SessionInfo
+	Results      []RevokeResult
+	Error        bool
+	ErrorMessage string
+}
+
+// RevokeResult is a revoked session and, when single logout was asked
+// for, the outcome at each sp it had signed in to
+type RevokeResult struct {
+	Session model.SessionInfo `json:"session"`
+	Logout  []LogoutResult    `json:"logout,omitempty"`
+}
+
+// wantsJSON is true for api clients, which ask for json explicitly
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// getSessions lists signed in sessions, optionally only those of ?user=
+func (i *IdentityProvider) getSessions(w http.ResponseWriter, r *http.Request) {
+	i.renderSessions(w, r, r.URL.Query().Get("user"), nil, nil)
+}
+
+func (i *IdentityProvider) renderSessions(w http.ResponseWriter, r *http.Request, user string, results []RevokeResult, sessionsErr error) {
+	var sessions []model.SessionInfo
+	var err error
+	if user != "" {
+		sessions, err = i.sm.UserSessions(r.Context(), user)
+	} else {
+		sessions, err = i.sm.Sessions(r.Context())
+	}
+	if err != nil {
+		i.log.Error("listing sessions", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, sessions)
+		return
+	}
+
+	data := &sessionsData{
+		BaseData: model.BaseData{
+			PageTitle: "Sessions",
+		},
+		User:     user,
+		Sessions: sessions,
+		Results:  results,
+	}
+	if sessionsErr != nil {
+		data.Error = true
+		data.ErrorMessage = sessionsErr.Error()
+	}
+
+	err = template.Render(w, r, "idp/sessions.html", data)
+	if err != nil {
+		i.log.Error("error rendering idp/sessions.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+func (i *IdentityProvider) getSession(w http.ResponseWriter, r *http.Request) {
+	session, err := i.sm.FindSession(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, middleware.ErrSessionNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		i.log.Error("getting session", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, session)
+		return
+	}
+
+	data := struct {
+		model.BaseData
+		Session model.SessionInfo
+	}{
+		BaseData: model.BaseData{
+			PageTitle: "Session",
+		},
+		Session: *session,
+	}
+	err = template.Render(w, r, "idp/session.html", &data)
+	if err != nil {
+		i.log.Error("error rendering idp/session.html", zap.Error(err))
+		i.renderError(w, r, err)
+	}
+}
+
+// postSessionRevoke ends one session, with slo set it is also logged out
+// of the sps it signed in to
+func (i *IdentityProvider) postSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	session, err := i.sm.RevokeSessionID(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, middleware.ErrSessionNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		i.log.Error("revoking session", zap.Error(err))
+		i.renderSessions(w, r, "", nil, fmt.Errorf("revoking session: %w", err))
+		return
+	}
+
+	i.finishRevoke(w, r, session.UID, []model.SessionInfo{*session})
+}
+
+// postUserSessionsRevoke ends every session of the user, other than the
+// admin's own
+func (i *IdentityProvider) postUserSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	user, err := i.ctrl.GetUser(r.Context(), id)
+	if err != nil {
+		i.log.Error("getting user", zap.Error(err))
+		i.renderError(w, r, err)
+		return
+	}
+
+	sessions, err := i.sm.RevokeUserSessions(r.Context(), user.Name)
+	if err != nil {
+		i.log.Error("revoking user sessions", zap.String("username", user.Name), zap.Error(err))
+		i.renderSessions(w, r, user.Name, nil, fmt.Errorf("revoking sessions: %w", err))
+		return
+	}
+
+	i.finishRevoke(w, r, user.Name, sessions)
+}
+
+func (i *IdentityProvider) finishRevoke(w http.ResponseWriter, r *http.Request, user string, sessions []model.SessionInfo) {
+	slo, _ := strconv.ParseBool(r.FormValue("slo"))
+
+	results := make([]RevokeResult, 0, len(sessions))
+	for _, session := range sessions {
+		result := RevokeResult{Session: session}
+		if slo {
+			result.Logout = i.saml.Logout(r.Context(), session)
+		}
+		for _, l := range result.Logout {
+			if l.Error != "" {
+				i.log.Warn("single logout failed",
+					zap.String("username", session.UID),
+					zap.String("entity_id", l.EntityID),
+					zap.String("error", l.Error))
+			}
+		}
+		i.log.Info("session revoked",
+			zap.String("username", session.UID),
+			zap.String("by", principalFrom(r.Context()).Name),
+			zap.Bool("slo", slo))
+		results = append(results, result)
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, results)
+		return
+	}
+	i.renderSessions(w, r, user, results, nil)
+}
@@ -0,0 +1,125 @@
+package idp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/ghaggin/sso/internal/model"
+)
+
+// sloTimeout bounds each back channel logout request
+const sloTimeout = 10 * time.Second
+
+// LogoutResult is the outcome of logging a revoked session out of an sp
+type LogoutResult struct {
+	EntityID string `json:"entityId"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Logout sends a signed LogoutRequest for the session's user to every sp
+// the session signed in to. Requests go over the back channel with the
+// post binding, the user's browser is not involved.
+func (s *SamlIdentityProvider) Logout(ctx context.Context, session model.SessionInfo) []LogoutResult {
+	var results []LogoutResult
+	for _, entityID := range session.ServiceProviders {
+		result := LogoutResult{EntityID: entityID}
+		if err := s.logoutServiceProvider(ctx, entityID, session.UID); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (s *SamlIdentityProvider) logoutServiceProvider(ctx context.Context, entityID, nameID string) error {
+	sp, err := s.GetServiceProvider(nil, entityID)
+	if err != nil {
+		return fmt.Errorf("service provider is no longer registered")
+	}
+
+	location := sloLocation(sp)
+	if location == "" {
+		return fmt.Errorf("service provider has no post binding single logout service")
+	}
+
+	req, err := s.makeLogoutRequest(location, nameID)
+	if err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sloTimeout)
+	defer cancel()
+	form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(b)}}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, location, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("single logout service returned %s", resp.Status)
+	}
+	return nil
+}
+
+func sloLocation(sp *saml.EntityDescriptor) string {
+	for _, d := range sp.SPSSODescriptors {
+		for _, slo := range d.SingleLogoutServices {
+			if slo.Binding == saml.HTTPPostBinding {
+				return slo.Location
+			}
+		}
+	}
+	return ""
+}
+
+// makeLogoutRequest builds a LogoutRequest signed with the idp key, the way
+// saml.ServiceProvider signs its own
+func (s *SamlIdentityProvider) makeLogoutRequest(destination, nameID string) (*saml.LogoutRequest, error) {
+	req := &saml.LogoutRequest{
+		ID:           "id-" + randomHex(20),
+		IssueInstant: saml.TimeNow(),
+		Version:      "2.0",
+		Destination:  destination,
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  s.IDP.MetadataURL.String(),
+		},
+		NameID: &saml.NameID{
+			Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+			Value:  nameID,
+		},
+	}
+
+	signingContext, err := newSigningContext(s.IDP.Key, s.IDP.Certificate, s.IDP.SignatureMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := signingContext.SignEnveloped(req.Element())
+	if err != nil {
+		return nil, err
+	}
+	req.Signature = signed.Child[len(signed.Child)-1].(*etree.Element)
+	return req, nil
+}
@@ -0,0 +1,71 @@
+package ldapserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"sync"
+)
+
+// Directory is an in-memory Handler. Entries with a userPassword attribute
+// can bind with it. It stands in for a real directory server when
+// developing and testing against the ldap repository.
+type Directory struct {
+	// AllowAnonymous permits searches without a bind
+	AllowAnonymous bool
+
+	mu      sync.RWMutex
+	entries []*Entry
+}
+
+func NewDirectory(entries ...*Entry) *Directory {
+	return &Directory{entries: entries}
+}
+
+// Add inserts the entry, replacing any entry with the same dn
+func (d *Directory) Add(e *Entry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, existing := range d.entries {
+		if NormalizeDN(existing.DN) == NormalizeDN(e.DN) {
+			d.entries[i] = e
+			return
+		}
+	}
+	d.entries = append(d.entries, e)
+}
+
+func (d *Directory) Bind(_ context.Context, dn, password string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, e := range d.entries {
+		if NormalizeDN(e.DN) != NormalizeDN(dn) {
+			continue
+		}
+		for _, p := range e.Get("userPassword") {
+			if subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+				return nil
+			}
+		}
+	}
+
+	return ErrInvalidCredentials
+}
+
+func (d *Directory) Search(_ context.Context, boundDN string, req *SearchRequest) ([]*Entry, error) {
+	if boundDN == "" && !d.AllowAnonymous {
+		return nil, ErrInsufficientAccess
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var found []*Entry
+	for _, e := range d.entries {
+		if req.Match(e) {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,132 @@
+package ldapserver
+
+import (
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// MatchFilter evaluates a BER encoded search filter against an entry.
+// Matching is case insensitive, extensible matches never match.
+func MatchFilter(f *ber.Packet, e *Entry) bool {
+	if f == nil {
+		return true
+	}
+
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !MatchFilter(c, e) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if MatchFilter(c, e) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(f.Children) == 1 && !MatchFilter(f.Children[0], e)
+	case ldap.FilterPresent:
+		attr := packetString(f)
+		return strings.EqualFold(attr, "objectClass") || len(e.Get(attr)) > 0
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(f.Children) != 2 {
+			return false
+		}
+		attr, want := packetString(f.Children[0]), strings.ToLower(packetString(f.Children[1]))
+		for _, v := range e.Get(attr) {
+			v = strings.ToLower(v)
+			switch f.Tag {
+			case ldap.FilterGreaterOrEqual:
+				if v >= want {
+					return true
+				}
+			case ldap.FilterLessOrEqual:
+				if v <= want {
+					return true
+				}
+			default:
+				if v == want || (strings.EqualFold(attr, "dn") && NormalizeDN(v) == NormalizeDN(want)) {
+					return true
+				}
+			}
+		}
+		return false
+	case ldap.FilterSubstrings:
+		if len(f.Children) != 2 {
+			return false
+		}
+		attr := packetString(f.Children[0])
+		for _, v := range e.Get(attr) {
+			if matchSubstrings(strings.ToLower(v), f.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return false
+}
+
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+	for _, p := range parts {
+		s := strings.ToLower(packetString(p))
+		switch p.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(v, s) {
+				return false
+			}
+			v = v[len(s):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(v, s)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(s):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(v, s) {
+				return false
+			}
+			v = ""
+		}
+	}
+	return true
+}
+
+// NormalizeDN lower cases a dn and removes insignificant spaces so dns can
+// be compared as strings
+func NormalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, p := range parts {
+		kv := strings.SplitN(p, "=", 2)
+		for j := range kv {
+			kv[j] = strings.ToLower(strings.TrimSpace(kv[j]))
+		}
+		parts[i] = strings.Join(kv, "=")
+	}
+	return strings.Join(parts, ",")
+}
+
+// InScope reports whether dn is within base for the search scope
+func InScope(dn, base string, scope Scope) bool {
+	dn, base = NormalizeDN(dn), NormalizeDN(base)
+
+	if base == "" {
+		return scope != ScopeBaseObject || dn == ""
+	}
+
+	switch scope {
+	case ScopeBaseObject:
+		return dn == base
+	case ScopeSingleLevel:
+		i := strings.Index(dn, ",")
+		return i >= 0 && dn[i+1:] == base
+	default:
+		return dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
@@ -0,0 +1,458 @@
+package ldapserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	appBindRequest      = 0
+	appBindResponse     = 1
+	appUnbindRequest    = 2
+	appSearchRequest    = 3
+	appSearchEntry      = 4
+	appSearchDone       = 5
+	appModifyRequest    = 6
+	appModifyResponse   = 7
+	appAddRequest       = 8
+	appAddResponse      = 9
+	appDelRequest       = 10
+	appDelResponse      = 11
+	appModDNRequest     = 12
+	appModDNResponse    = 13
+	appCompareRequest   = 14
+	appCompareResponse  = 15
+	appAbandonRequest   = 16
+	appExtendedRequest  = 23
+	appExtendedResponse = 24
+
+	oidStartTLS = "1.3.6.1.4.1.1466.20037"
+)
+
+var (
+	// ErrInvalidCredentials is returned by Handler.Bind for a wrong
+	// password or unknown dn
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrInsufficientAccess is returned by Handler.Search when the bound
+	// dn may not search
+	ErrInsufficientAccess = errors.New("insufficient access")
+	// ErrNoSuchObject is returned by Handler.Search for an unknown base
+	ErrNoSuchObject = errors.New("no such object")
+)
+
+// Entry is a directory entry returned by searches
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the values of the attribute, matched case insensitively
+func (e *Entry) Get(name string) []string {
+	if v, ok := e.Attributes[name]; ok {
+		return v
+	}
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+type Scope int
+
+const (
+	ScopeBaseObject   Scope = 0
+	ScopeSingleLevel  Scope = 1
+	ScopeWholeSubtree Scope = 2
+)
+
+type SearchRequest struct {
+	BaseDN     string
+	Scope      Scope
+	SizeLimit  int
+	Filter     *ber.Packet
+	Attributes []string
+}
+
+// Match reports whether the entry is within the request's base and scope
+// and matches its filter
+func (r *SearchRequest) Match(e *Entry) bool {
+	return InScope(e.DN, r.BaseDN, r.Scope) && MatchFilter(r.Filter, e)
+}
+
+// Handler serves binds and searches for a Server. boundDN is empty for
+// anonymous connections.
+type Handler interface {
+	Bind(ctx context.Context, dn, password string) error
+	Search(ctx context.Context, boundDN string, req *SearchRequest) ([]*Entry, error)
+}
+
+// Server is a minimal read-only LDAPv3 server supporting simple binds,
+// searches and StartTLS
+type Server struct {
+	Handler   Handler
+	TLSConfig *tls.Config
+	Log       *zap.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// Serve accepts connections until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.conns = map[net.Conn]struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+type session struct {
+	conn    net.Conn
+	boundDN string
+	remote  string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	sess := &session{conn: conn, remote: conn.RemoteAddr().String()}
+	ctx := WithRemoteAddr(context.Background(), sess.remote)
+
+	for {
+		packet, err := ber.ReadPacket(sess.conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.log().Debug("ldap read failed", zap.String("remote", sess.remote), zap.Error(err))
+			}
+			return
+		}
+
+		if len(packet.Children) < 2 {
+			return
+		}
+		id, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		op := packet.Children[1]
+		if op.ClassType != ber.ClassApplication {
+			return
+		}
+
+		switch op.Tag {
+		case appBindRequest:
+			s.handleBind(ctx, sess, id, op)
+		case appSearchRequest:
+			s.handleSearch(ctx, sess, id, op)
+		case appUnbindRequest:
+			return
+		case appAbandonRequest:
+			// requests are handled synchronously so there is never
+			// anything to abandon
+		case appExtendedRequest:
+			if !s.handleExtended(sess, id, op) {
+				return
+			}
+		case appModifyRequest:
+			s.writeResult(sess, id, appModifyResponse, ldap.LDAPResultUnwillingToPerform, "directory is read only")
+		case appAddRequest:
+			s.writeResult(sess, id, appAddResponse, ldap.LDAPResultUnwillingToPerform, "directory is read only")
+		case appDelRequest:
+			s.writeResult(sess, id, appDelResponse, ldap.LDAPResultUnwillingToPerform, "directory is read only")
+		case appModDNRequest:
+			s.writeResult(sess, id, appModDNResponse, ldap.LDAPResultUnwillingToPerform, "directory is read only")
+		case appCompareRequest:
+			s.writeResult(sess, id, appCompareResponse, ldap.LDAPResultUnwillingToPerform, "compare is not supported")
+		default:
+			s.writeResult(sess, id, appExtendedResponse, ldap.LDAPResultProtocolError, "unsupported operation")
+			return
+		}
+	}
+}
+
+func (s *Server) handleBind(ctx context.Context, sess *session, id int64, op *ber.Packet) {
+	if len(op.Children) < 3 {
+		s.writeResult(sess, id, appBindResponse, ldap.LDAPResultProtocolError, "malformed bind request")
+		return
+	}
+
+	dn := packetString(op.Children[1])
+	auth := op.Children[2]
+
+	// only simple authentication, context tag 0
+	if auth.ClassType != ber.ClassContext || auth.Tag != 0 {
+		s.writeResult(sess, id, appBindResponse, ldap.LDAPResultAuthMethodNotSupported, "only simple bind is supported")
+		return
+	}
+	password := packetString(auth)
+
+	sess.boundDN = ""
+	if dn == "" && password == "" {
+		// anonymous bind
+		s.writeResult(sess, id, appBindResponse, ldap.LDAPResultSuccess, "")
+		return
+	}
+	if password == "" {
+		// unauthenticated binds (rfc 4513 5.1.2) are refused
+		s.writeResult(sess, id, appBindResponse, ldap.LDAPResultUnwillingToPerform, "unauthenticated bind is not allowed")
+		return
+	}
+
+	err := s.Handler.Bind(ctx, dn, password)
+	switch {
+	case err == nil:
+		sess.boundDN = dn
+		s.writeResult(sess, id, appBindResponse, ldap.LDAPResultSuccess, "")
+	case errors.Is(err, ErrInvalidCredentials):
+		s.writeResult(sess, id, appBindResponse, ldap.LDAPResultInvalidCredentials, "")
+	default:
+		s.writeResult(sess, id, appBindResponse, resultCode(err), err.Error())
+	}
+}
+
+func (s *Server) handleSearch(ctx context.Context, sess *session, id int64, op *ber.Packet) {
+	if len(op.Children) < 8 {
+		s.writeResult(sess, id, appSearchDone, ldap.LDAPResultProtocolError, "malformed search request")
+		return
+	}
+
+	req := &SearchRequest{
+		BaseDN: packetString(op.Children[0]),
+		Filter: op.Children[6],
+	}
+	if v, ok := op.Children[1].Value.(int64); ok {
+		req.Scope = Scope(v)
+	}
+	if v, ok := op.Children[3].Value.(int64); ok {
+		req.SizeLimit = int(v)
+	}
+	for _, a := range op.Children[7].Children {
+		req.Attributes = append(req.Attributes, packetString(a))
+	}
+
+	entries, err := s.Handler.Search(ctx, sess.boundDN, req)
+	if err != nil {
+		s.writeResult(sess, id, appSearchDone, resultCode(err), err.Error())
+		return
+	}
+
+	for i, e := range entries {
+		if req.SizeLimit > 0 && i >= req.SizeLimit {
+			s.writeResult(sess, id, appSearchDone, ldap.LDAPResultSizeLimitExceeded, "")
+			return
+		}
+		s.write(sess, id, encodeEntry(e, req.Attributes))
+	}
+
+	s.writeResult(sess, id, appSearchDone, ldap.LDAPResultSuccess, "")
+}
+
+// handleExtended only supports StartTLS. It returns false when the
+// connection must be closed.
+func (s *Server) handleExtended(sess *session, id int64, op *ber.Packet) bool {
+	name := ""
+	if len(op.Children) > 0 {
+		name = packetString(op.Children[0])
+	}
+
+	if name != oidStartTLS {
+		s.writeResult(sess, id, appExtendedResponse, ldap.LDAPResultProtocolError, "unsupported extended operation")
+		return true
+	}
+	if s.TLSConfig == nil {
+		s.writeResult(sess, id, appExtendedResponse, ldap.LDAPResultUnavailable, "tls is not configured")
+		return true
+	}
+	if _, ok := sess.conn.(*tls.Conn); ok {
+		s.writeResult(sess, id, appExtendedResponse, ldap.LDAPResultOperationsError, "tls already established")
+		return true
+	}
+
+	s.writeResult(sess, id, appExtendedResponse, ldap.LDAPResultSuccess, "")
+
+	tlsConn := tls.Server(sess.conn, s.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		s.log().Debug("ldap starttls handshake failed", zap.String("remote", sess.remote), zap.Error(err))
+		return false
+	}
+
+	s.mu.Lock()
+	delete(s.conns, sess.conn)
+	s.conns[tlsConn] = struct{}{}
+	s.mu.Unlock()
+
+	sess.conn = tlsConn
+	return true
+}
+
+func (s *Server) writeResult(sess *session, id int64, tag ber.Tag, code uint16, msg string) {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, msg, ""))
+	s.write(sess, id, res)
+}
+
+func (s *Server) write(sess *session, id int64, op *ber.Packet) {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	msg.AppendChild(op)
+
+	if _, err := sess.conn.Write(msg.Bytes()); err != nil {
+		s.log().Debug("ldap write failed", zap.String("remote", sess.remote), zap.Error(err))
+	}
+}
+
+func (s *Server) log() *zap.Logger {
+	if s.Log == nil {
+		return zap.NewNop()
+	}
+	return s.Log
+}
+
+// encodeEntry builds a SearchResultEntry limited to the requested
+// attributes, all user attributes when none or "*" are requested
+func encodeEntry(e *Entry, attrs []string) *ber.Packet {
+	all := len(attrs) == 0
+	want := map[string]bool{}
+	for _, a := range attrs {
+		if a == "*" {
+			all = true
+		}
+		want[strings.ToLower(a)] = true
+	}
+
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, appSearchEntry, nil, "")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, ""))
+
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range e.Attributes {
+		if !all && !want[strings.ToLower(name)] {
+			continue
+		}
+		// passwords are never returned
+		if strings.EqualFold(name, "userPassword") {
+			continue
+		}
+
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	entry.AppendChild(list)
+
+	return entry
+}
+
+func resultCode(err error) uint16 {
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
+		return ldap.LDAPResultInvalidCredentials
+	case errors.Is(err, ErrInsufficientAccess):
+		return ldap.LDAPResultInsufficientAccessRights
+	case errors.Is(err, ErrNoSuchObject):
+		return ldap.LDAPResultNoSuchObject
+	}
+
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		return ldapErr.ResultCode
+	}
+	return ldap.LDAPResultOther
+}
+
+// packetString returns the octet string content of a primitive packet
+func packetString(p *ber.Packet) string {
+	if p.Data != nil {
+		return p.Data.String()
+	}
+	if s, ok := p.Value.(string); ok {
+		return s
+	}
+	return ""
+}
+
+type remoteAddrKey struct{}
+
+// WithRemoteAddr stores the client address for handlers
+func WithRemoteAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, remoteAddrKey{}, addr)
+}
+
+// RemoteAddr returns the client address of the connection serving ctx
+func RemoteAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrKey{}).(string)
+	return addr
+}
+
+// Start listens on addr and serves in the background, returning the bound
+// address so ":0" can be used to pick a free port
+func (s *Server) Start(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := s.Serve(l); err != nil {
+			s.log().Error("ldap server stopped", zap.Error(err))
+		}
+	}()
+
+	return l.Addr(), nil
+}
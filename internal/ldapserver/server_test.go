@@ -0,0 +1,111 @@
+package ldapserver
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMatchFilter(t *testing.T) {
+	e := &Entry{
+		DN: "uid=alice,ou=people,dc=example,dc=com",
+		Attributes: map[string][]string{
+			"objectClass": {"inetOrgPerson"},
+			"uid":         {"alice"},
+			"mail":        {"Alice@Example.com"},
+			"uidNumber":   {"1001"},
+		},
+	}
+
+	for filter, want := range map[string]bool{
+		"(uid=alice)":          true,
+		"(UID=ALICE)":          true,
+		"(uid=bob)":            false,
+		"(mail=*)":             true,
+		"(telephoneNumber=*)":  false,
+		"(mail=alice@*)":       true,
+		"(mail=*@example.com)": true,
+		"(mail=a*ce*com)":      true,
+		"(mail=*bob*)":         false,
+		"(&(objectClass=inetOrgPerson)(uid=alice))": true,
+		"(&(objectClass=inetOrgPerson)(uid=bob))":   false,
+		"(|(uid=bob)(uid=alice))":                   true,
+		"(!(uid=alice))":                            false,
+		"(uidNumber>=1000)":                         true,
+		"(uidNumber<=1000)":                         false,
+		"(uid:caseExactMatch:=alice)":               false,
+	} {
+		packet, err := ldap.CompileFilter(filter)
+		require.NoError(t, err, filter)
+		require.Equal(t, want, MatchFilter(packet, e), filter)
+	}
+}
+
+func TestInScope(t *testing.T) {
+	dn := "uid=alice, ou=People, dc=example, dc=com"
+	require.True(t, InScope(dn, "dc=example,dc=com", ScopeWholeSubtree))
+	require.True(t, InScope(dn, "ou=people,dc=example,dc=com", ScopeSingleLevel))
+	require.False(t, InScope(dn, "dc=example,dc=com", ScopeSingleLevel))
+	require.True(t, InScope(dn, "uid=alice,ou=people,dc=example,dc=com", ScopeBaseObject))
+	require.False(t, InScope(dn, "ou=groups,dc=example,dc=com", ScopeWholeSubtree))
+	require.True(t, InScope(dn, "", ScopeWholeSubtree))
+}
+
+func TestServer(t *testing.T) {
+	dir := NewDirectory(&Entry{
+		DN: "uid=alice,ou=people,dc=example,dc=com",
+		Attributes: map[string][]string{
+			"objectClass":  {"inetOrgPerson"},
+			"uid":          {"alice"},
+			"mail":         {"alice@example.com"},
+			"userPassword": {"secret"},
+		},
+	})
+	srv := &Server{Handler: dir, Log: zap.NewNop()}
+	addr, err := srv.Start("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	conn, err := ldap.DialURL("ldap://" + addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	search := func(attrs ...string) (*ldap.SearchResult, error) {
+		return conn.Search(ldap.NewSearchRequest(
+			"dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(uid=alice)", attrs, nil,
+		))
+	}
+
+	// anonymous searches are refused unless the directory allows them
+	_, err = search()
+	require.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights), err)
+
+	err = conn.Bind("uid=alice,ou=people,dc=example,dc=com", "wrong")
+	require.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials), err)
+	err = conn.Bind("uid=alice,ou=people,dc=example,dc=com", "")
+	require.Error(t, err)
+	require.NoError(t, conn.Bind("UID=Alice,OU=People,DC=Example,DC=Com", "secret"))
+
+	res, err := search()
+	require.NoError(t, err)
+	require.Len(t, res.Entries, 1)
+	require.Equal(t, "alice@example.com", res.Entries[0].GetAttributeValue("mail"))
+	require.Empty(t, res.Entries[0].GetAttributeValue("userPassword"))
+
+	res, err = search("uid")
+	require.NoError(t, err)
+	require.Len(t, res.Entries, 1)
+	require.Empty(t, res.Entries[0].GetAttributeValue("mail"))
+
+	// the directory is read only
+	err = conn.Add(ldap.NewAddRequest("uid=bob,ou=people,dc=example,dc=com", nil))
+	require.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform), err)
+
+	// without a tls config StartTLS is refused and the connection kept
+	require.Error(t, conn.StartTLS(nil))
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package lockout
+
+import "errors"
+
+// fileLocking is false where flock isn't available, the file store refuses
+// to start rather than lose counters between processes
+const fileLocking = false
+
+func lockFile(_ string) (func(), error) {
+	return nil, errors.New("file locking is not supported on this platform")
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package lockout
+
+import (
+	"os"
+	"syscall"
+)
+
+const fileLocking = true
+
+// lockFile takes an exclusive flock on path, blocking until it is free
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
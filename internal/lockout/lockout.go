@@ -0,0 +1,220 @@
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// BlockedError is returned by Check while an account or address must wait
+// before trying again
+type BlockedError struct {
+	Until time.Time
+	// Locked is set when a threshold was reached, otherwise the attempt is
+	// only delayed by backoff
+	Locked bool
+}
+
+func (e *BlockedError) Error() string {
+	// round up so a short backoff doesn't read as 0s
+	wait := (time.Until(e.Until) + time.Second - 1).Truncate(time.Second)
+	if e.Locked {
+		return fmt.Sprintf("too many failed logins, locked for %s", wait)
+	}
+	return fmt.Sprintf("too many failed logins, try again in %s", wait)
+}
+
+// Limiter counts failed logins per account and per address. Accounts back
+// off exponentially and lock at their threshold, addresses only lock so a
+// shared address isn't slowed down by one user's typos.
+type Limiter struct {
+	store Store
+	cfg   config.Lockout
+	log   *zap.Logger
+	now   func() time.Time
+}
+
+type Params struct {
+	fx.In
+
+	LC     fx.Lifecycle
+	Config *config.Config
+	Log    *zap.Logger
+}
+
+func New(p Params) (*Limiter, error) {
+	store, err := NewStore(p.Config.Lockout.Store)
+	if err != nil {
+		return nil, fmt.Errorf("lockout store: %w", err)
+	}
+	p.LC.Append(fx.Hook{
+		OnStop: func(_ context.Context) error {
+			return store.Close()
+		},
+	})
+
+	return &Limiter{
+		store: store,
+		cfg:   p.Config.Lockout,
+		log:   p.Log,
+		now:   time.Now,
+	}, nil
+}
+
+func accountKey(account string) string {
+	return "account:" + strings.ToLower(account)
+}
+
+func addrKey(addr string) string {
+	return "addr:" + addr
+}
+
+// Check returns a *BlockedError when the account or address may not try
+// to log in yet. Either may be empty.
+func (l *Limiter) Check(ctx context.Context, account, addr string) error {
+	now := l.now()
+	if account != "" {
+		c, err := l.get(ctx, accountKey(account), now)
+		if err != nil {
+			return err
+		}
+		if c != nil && now.Before(c.LockedUntil) {
+			return &BlockedError{Until: c.LockedUntil, Locked: true}
+		}
+		if c != nil {
+			if next := c.LastFailure.Add(l.delay(c.Failures)); now.Before(next) {
+				return &BlockedError{Until: next}
+			}
+		}
+	}
+
+	if addr != "" {
+		c, err := l.get(ctx, addrKey(addr), now)
+		if err != nil {
+			return err
+		}
+		if c != nil && now.Before(c.LockedUntil) {
+			return &BlockedError{Until: c.LockedUntil, Locked: true}
+		}
+	}
+	return nil
+}
+
+// Fail records a failed login and locks the account or address once it
+// reaches its threshold
+func (l *Limiter) Fail(ctx context.Context, account, addr string) error {
+	now := l.now()
+	if account != "" {
+		locked, err := l.fail(ctx, accountKey(account), l.cfg.AccountThreshold, now)
+		if err != nil {
+			return err
+		}
+		if locked {
+			l.log.Warn("security event: account locked",
+				zap.String("event", "account_locked"),
+				zap.String("account", account),
+				zap.String("addr", addr),
+				zap.Duration("duration", l.cfg.Duration))
+		}
+	}
+	if addr != "" {
+		locked, err := l.fail(ctx, addrKey(addr), l.cfg.IPThreshold, now)
+		if err != nil {
+			return err
+		}
+		if locked {
+			l.log.Warn("security event: address locked",
+				zap.String("event", "addr_locked"),
+				zap.String("addr", addr),
+				zap.String("account", account),
+				zap.Duration("duration", l.cfg.Duration))
+		}
+	}
+	return nil
+}
+
+// fail counts a failure on key and reports whether it just locked
+func (l *Limiter) fail(ctx context.Context, key string, threshold int, now time.Time) (bool, error) {
+	var locked bool
+	err := l.store.Update(ctx, key, func(c *Counter) {
+		if !l.live(c, now) {
+			*c = Counter{}
+		}
+
+		c.Failures++
+		c.LastFailure = now
+		locked = c.Failures >= threshold && !now.Before(c.LockedUntil)
+		if locked {
+			c.LockedUntil = now.Add(l.cfg.Duration)
+		}
+		c.Expires = l.expires(c)
+	})
+	return locked, err
+}
+
+// Succeed clears the account's failures after a successful login. The
+// address keeps its count so one valid account can't reset guessing
+// against others.
+func (l *Limiter) Succeed(ctx context.Context, account string) error {
+	return l.store.Delete(ctx, accountKey(account))
+}
+
+// Unlock is the admin action clearing an account's failures and lockout
+func (l *Limiter) Unlock(ctx context.Context, account, by string) error {
+	err := l.store.Delete(ctx, accountKey(account))
+	if err == nil {
+		l.log.Warn("security event: account unlocked",
+			zap.String("event", "account_unlocked"),
+			zap.String("account", account),
+			zap.String("by", by))
+	}
+	return err
+}
+
+// Status returns the account's counter, nil when it has no recent failures
+func (l *Limiter) Status(ctx context.Context, account string) (*Counter, error) {
+	return l.get(ctx, accountKey(account), l.now())
+}
+
+// get returns the key's counter, nil when there is none or it has expired
+func (l *Limiter) get(ctx context.Context, key string, now time.Time) (*Counter, error) {
+	c, err := l.store.Get(ctx, key)
+	if err != nil || c == nil || !l.live(c, now) {
+		return nil, err
+	}
+	return c, nil
+}
+
+// delay is the backoff after n failures, doubling from BaseDelay up to
+// MaxDelay
+func (l *Limiter) delay(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	d := l.cfg.BaseDelay << min(n-1, 30)
+	if d <= 0 || d > l.cfg.MaxDelay {
+		return l.cfg.MaxDelay
+	}
+	return d
+}
+
+// expires is when the counter can be forgotten: when its lock passes, or
+// once its last failure is older than the lockout duration
+func (l *Limiter) expires(c *Counter) time.Time {
+	if !c.LockedUntil.IsZero() {
+		return c.LockedUntil
+	}
+	return c.LastFailure.Add(max(l.cfg.Duration, l.cfg.MaxDelay))
+}
+
+// live reports whether the counter still counts at now. Stores expire
+// counters on their own clock, this keeps the limiter's clock the one that
+// decides.
+func (l *Limiter) live(c *Counter, now time.Time) bool {
+	return now.Before(c.Expires)
+}
@@ -0,0 +1,139 @@
+package lockout
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestLimiters returns two limiters on separate connections to one
+// store, standing in for two idp instances
+func newTestLimiters(t *testing.T, cfg config.SessionStore) (*Limiter, *Limiter) {
+	t.Helper()
+	limiter := func() *Limiter {
+		store, err := NewStore(cfg)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			store.Close()
+		})
+		return &Limiter{
+			store: store,
+			cfg: config.Lockout{
+				AccountThreshold: 1000,
+				IPThreshold:      1000,
+				BaseDelay:        time.Second,
+				MaxDelay:         time.Minute,
+				Duration:         time.Hour,
+			},
+			log: zap.NewNop(),
+			now: time.Now,
+		}
+	}
+	return limiter(), limiter()
+}
+
+func TestSharedStores(t *testing.T) {
+	for _, cfg := range []config.SessionStore{
+		{Type: config.SessionStoreFile, Path: filepath.Join(t.TempDir(), "lockout.json")},
+		{Type: config.SessionStoreSQLite, Path: filepath.Join(t.TempDir(), "lockout.sqlite")},
+	} {
+		t.Run(string(cfg.Type), func(t *testing.T) {
+			a, b := newTestLimiters(t, cfg)
+			ctx := context.Background()
+
+			// failures from both instances at once are all counted
+			var wg sync.WaitGroup
+			errs := make(chan error, 40)
+			for i := 0; i < 20; i++ {
+				for _, l := range []*Limiter{a, b} {
+					wg.Add(1)
+					go func(l *Limiter) {
+						defer wg.Done()
+						errs <- l.Fail(ctx, "alice", "192.0.2.1")
+					}(l)
+				}
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				require.NoError(t, err)
+			}
+
+			status, err := b.Status(ctx, "alice")
+			require.NoError(t, err)
+			require.Equal(t, 40, status.Failures)
+
+			// the backoff set by one instance holds on the other
+			var blocked *BlockedError
+			require.ErrorAs(t, a.Check(ctx, "alice", ""), &blocked)
+			require.False(t, blocked.Locked)
+
+			require.NoError(t, a.Unlock(ctx, "alice", "test"))
+			require.NoError(t, b.Check(ctx, "alice", ""))
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	a, _ := newTestLimiters(t, config.SessionStore{Type: config.SessionStoreSQLite, Path: filepath.Join(t.TempDir(), "lockout.sqlite")})
+	a.cfg.AccountThreshold = 3
+	a.cfg.IPThreshold = 5
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.Fail(ctx, "alice", "192.0.2.1"))
+	}
+	var blocked *BlockedError
+	require.ErrorAs(t, a.Check(ctx, "alice", ""), &blocked)
+	require.True(t, blocked.Locked)
+	require.True(t, now.Add(time.Hour).Equal(blocked.Until))
+
+	// the address isn't locked yet, other accounts can still try from it
+	require.NoError(t, a.Check(ctx, "bob", "192.0.2.1"))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, a.Fail(ctx, "bob", "192.0.2.1"))
+	}
+	require.ErrorAs(t, a.Check(ctx, "", "192.0.2.1"), &blocked)
+	require.True(t, blocked.Locked)
+
+	// the lock passes with its duration
+	now = now.Add(time.Hour + time.Second)
+	require.NoError(t, a.Check(ctx, "alice", "192.0.2.1"))
+}
+
+func TestExpiry(t *testing.T) {
+	for _, cfg := range []config.SessionStore{
+		{Type: config.SessionStoreFile, Path: filepath.Join(t.TempDir(), "lockout.json")},
+		{Type: config.SessionStoreSQLite, Path: filepath.Join(t.TempDir(), "lockout.sqlite")},
+	} {
+		t.Run(string(cfg.Type), func(t *testing.T) {
+			a, _ := newTestLimiters(t, cfg)
+			a.cfg.MaxDelay = 10 * time.Millisecond
+			a.cfg.Duration = 10 * time.Millisecond
+			ctx := context.Background()
+
+			// each account and address is its own record
+			require.NoError(t, a.Fail(ctx, "alice", "192.0.2.1"))
+			for _, key := range []string{accountKey("alice"), addrKey("192.0.2.1")} {
+				c, err := a.store.Get(ctx, key)
+				require.NoError(t, err)
+				require.Equal(t, 1, c.Failures)
+			}
+
+			// expired records are dropped by the next write
+			time.Sleep(20 * time.Millisecond)
+			require.NoError(t, a.Fail(ctx, "bob", ""))
+			c, err := a.store.Get(ctx, accountKey("alice"))
+			require.NoError(t, err)
+			require.Nil(t, c)
+		})
+	}
+}
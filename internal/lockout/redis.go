@@ -0,0 +1,125 @@
+package lockout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisPrefix namespaces the counters, each is its own key expiring with
+// the counter
+const redisPrefix = "sso:lockout:"
+
+// redisStore updates a counter in a WATCH/MULTI transaction on its key,
+// retrying when another instance changed it in between
+type redisStore struct {
+	pool *redis.Pool
+}
+
+func newRedisStore(cfg config.SessionStore) *redisStore {
+	options := []redis.DialOption{
+		redis.DialDatabase(cfg.DB),
+		redis.DialConnectTimeout(5 * time.Second),
+	}
+	if cfg.Password != "" {
+		options = append(options, redis.DialPassword(cfg.Password))
+	}
+
+	return &redisStore{
+		pool: &redis.Pool{
+			MaxIdle:     4,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", cfg.Addr, options...)
+			},
+		},
+	}
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) (*Counter, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("GET", redisPrefix+key))
+	if errors.Is(err, redis.ErrNil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := &Counter{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *redisStore) Update(ctx context.Context, key string, fn func(*Counter)) error {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key = redisPrefix + key
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+		c := &Counter{}
+		b, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, c); err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+
+		fn(c)
+
+		if b, err = json.Marshal(c); err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		conn.Send("MULTI")
+		conn.Send("SET", key, b)
+		conn.Send("PEXPIREAT", key, c.Expires.UnixMilli())
+		_, err = redis.Values(conn.Do("EXEC"))
+		if errors.Is(err, redis.ErrNil) {
+			// another instance changed the counter, fn runs again on
+			// theirs
+			continue
+		}
+		return err
+	}
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", redisPrefix+key)
+	return err
+}
+
+func (s *redisStore) Close() error {
+	return s.pool.Close()
+}
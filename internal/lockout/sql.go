@@ -0,0 +1,153 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore keeps a row per counter in the lockout_records table. Update
+// holds a write lock on the key's row for the whole transaction, so
+// instances sharing the database take turns on it. Expiry is in unix
+// nanoseconds so sqlite and postgres compare it the same way.
+type sqlStore struct {
+	db *sql.DB
+	q  sqlQueries
+}
+
+type sqlQueries struct {
+	get    string
+	insert string
+	// lock selects the row, with FOR UPDATE on postgres and by beginning
+	// transactions immediate on sqlite
+	lock   string
+	update string
+	delete string
+	prune  string
+}
+
+// newSQLiteStore opens the database in wal mode with a busy timeout, so
+// instances on the same host or volume can share it
+func newSQLiteStore(path string) (*sqlStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, sqlQueries{
+		get:    `SELECT data FROM lockout_records WHERE id = ?`,
+		insert: `INSERT INTO lockout_records (id, data, expires) VALUES (?, '{}', 0) ON CONFLICT (id) DO NOTHING`,
+		lock:   `SELECT data FROM lockout_records WHERE id = ?`,
+		update: `UPDATE lockout_records SET data = ?, expires = ? WHERE id = ?`,
+		delete: `DELETE FROM lockout_records WHERE id = ?`,
+		prune:  `DELETE FROM lockout_records WHERE expires <= ?`,
+	})
+}
+
+func newPostgresStore(dsn string) (*sqlStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, sqlQueries{
+		get:    `SELECT data FROM lockout_records WHERE id = $1`,
+		insert: `INSERT INTO lockout_records (id, data, expires) VALUES ($1, '{}', 0) ON CONFLICT (id) DO NOTHING`,
+		lock:   `SELECT data FROM lockout_records WHERE id = $1 FOR UPDATE`,
+		update: `UPDATE lockout_records SET data = $1, expires = $2 WHERE id = $3`,
+		delete: `DELETE FROM lockout_records WHERE id = $1`,
+		prune:  `DELETE FROM lockout_records WHERE expires <= $1`,
+	})
+}
+
+func newSQLStore(db *sql.DB, q sqlQueries) (*sqlStore, error) {
+	schema := []string{
+		// counters used to share a single row
+		`DROP TABLE IF EXISTS lockout_counters`,
+		`CREATE TABLE IF NOT EXISTS lockout_records (
+			id TEXT PRIMARY KEY,
+			data TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS lockout_records_expires_idx ON lockout_records (expires)`,
+	}
+	for _, s := range schema {
+		if _, err := db.Exec(s); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating lockout table: %w", err)
+		}
+	}
+
+	return &sqlStore{db: db, q: q}, nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, key string) (*Counter, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, s.q.get, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := &Counter{}
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *sqlStore) Update(ctx context.Context, key string, fn func(*Counter)) error {
+	// expired rows are cleared by whichever instance writes next, outside
+	// the transaction so it only ever locks the key's row
+	if _, err := s.db.ExecContext(ctx, s.q.prune, time.Now().UnixNano()); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.q.insert, key); err != nil {
+		return err
+	}
+	var data string
+	if err := tx.QueryRowContext(ctx, s.q.lock, key).Scan(&data); err != nil {
+		return err
+	}
+	c := &Counter{}
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		return err
+	}
+
+	fn(c)
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.q.update, string(b), c.Expires.UnixNano(), key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.q.delete, key)
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,149 @@
+package lockout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+)
+
+// Counter is the failure history of an account or address
+type Counter struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+	// Expires is when the store may forget the counter
+	Expires time.Time `json:"expires"`
+}
+
+// Store keeps one counter per account or address until it expires
+type Store interface {
+	// Get returns the key's counter, nil when there is none
+	Get(ctx context.Context, key string) (*Counter, error)
+	// Update runs fn on the key's counter, a zero Counter when there is
+	// none, and saves it. It must be atomic across every process sharing
+	// the store so concurrent failures aren't lost.
+	Update(ctx context.Context, key string, fn func(c *Counter)) error
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+// NewStore opens the store selected by the config
+func NewStore(cfg config.SessionStore) (Store, error) {
+	switch cfg.Type {
+	case config.SessionStoreFile:
+		return NewFileStore(cfg.Path)
+	case config.SessionStoreSQLite:
+		return newSQLiteStore(cfg.Path)
+	case config.SessionStorePostgres:
+		return newPostgresStore(cfg.DSN)
+	case config.SessionStoreRedis:
+		return newRedisStore(cfg), nil
+	}
+	return nil, fmt.Errorf("unknown lockout store %q", cfg.Type)
+}
+
+// FileStore keeps counters in a json file guarded by an exclusive flock on
+// a sibling lock file. flock only holds between processes on one host, so
+// instances on several hosts must use another store. Expired counters are
+// dropped whenever the file is written.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if !fileLocking {
+		return nil, errors.New("the file store needs flock, which isn't available on this platform, use sqlite, postgres or redis")
+	}
+	return &FileStore{path: path}, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+func (s *FileStore) Get(_ context.Context, key string) (*Counter, error) {
+	var counter *Counter
+	err := s.modify(func(counters map[string]*Counter) bool {
+		counter = counters[key]
+		return false
+	})
+	return counter, err
+}
+
+func (s *FileStore) Update(_ context.Context, key string, fn func(*Counter)) error {
+	return s.modify(func(counters map[string]*Counter) bool {
+		c, ok := counters[key]
+		if !ok {
+			c = &Counter{}
+			counters[key] = c
+		}
+		fn(c)
+
+		now := time.Now()
+		for k, c := range counters {
+			if !now.Before(c.Expires) {
+				delete(counters, k)
+			}
+		}
+		return true
+	})
+}
+
+func (s *FileStore) Delete(_ context.Context, key string) error {
+	return s.modify(func(counters map[string]*Counter) bool {
+		_, ok := counters[key]
+		delete(counters, key)
+		return ok
+	})
+}
+
+// modify runs fn on the counters holding the file lock and writes them back
+// when fn reports a change
+func (s *FileStore) modify(fn func(counters map[string]*Counter) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	counters := map[string]*Counter{}
+	b, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &counters); err != nil {
+			return err
+		}
+	}
+
+	if !fn(counters) {
+		return nil
+	}
+
+	b, err = json.MarshalIndent(counters, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,204 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMessageSize bounds a captured message so a stray client can't
+	// exhaust memory
+	maxMessageSize = 10 << 20
+	// maxMessages is how many messages are kept, the oldest are dropped
+	maxMessages = 100
+)
+
+// Captured is a message received by a CaptureServer
+type Captured struct {
+	From string
+	To   []string
+	// Data is the message as sent, headers and body
+	Data []byte
+}
+
+// Subject is the decoded subject header, empty when the message can't be
+// parsed
+func (c Captured) Subject() string {
+	m, err := mail.ReadMessage(bytes.NewReader(c.Data))
+	if err != nil {
+		return ""
+	}
+	subject := m.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		return decoded
+	}
+	return subject
+}
+
+// CaptureServer is an in-process smtp server that keeps the last
+// maxMessages messages instead of delivering them. It stands in for a relay during development
+// and in tests.
+type CaptureServer struct {
+	// OnMessage is called for each message after it is stored
+	OnMessage func(Captured)
+
+	mu       sync.Mutex
+	listener net.Listener
+	messages []Captured
+}
+
+// Start listens on addr and serves in the background, returning the bound
+// address so ":0" can be used to pick a free port
+func (s *CaptureServer) Start(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return l.Addr(), nil
+}
+
+func (s *CaptureServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Messages returns the messages captured so far
+func (s *CaptureServer) Messages() []Captured {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Captured(nil), s.messages...)
+}
+
+// Wait returns the first message to arrive for the recipient, waiting up to
+// timeout for it
+func (s *CaptureServer) Wait(to string, timeout time.Duration) (Captured, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, m := range s.Messages() {
+			for _, t := range m.To {
+				if strings.EqualFold(t, to) {
+					return m, nil
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return Captured{}, fmt.Errorf("no mail for %s within %s", to, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *CaptureServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	tp := textproto.NewConn(conn)
+	reply := func(code int, msg string) bool {
+		return tp.PrintfLine("%d %s", code, msg) == nil
+	}
+
+	if !reply(220, "localhost capture ready") {
+		return
+	}
+
+	var msg Captured
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply(250, "localhost")
+		case "EHLO":
+			tp.PrintfLine("250-localhost")
+			reply(250, "8BITMIME")
+		case "MAIL":
+			msg = Captured{From: address(arg)}
+			reply(250, "ok")
+		case "RCPT":
+			msg.To = append(msg.To, address(arg))
+			reply(250, "ok")
+		case "DATA":
+			if len(msg.To) == 0 {
+				reply(503, "need recipients")
+				continue
+			}
+			if !reply(354, "end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := io.ReadAll(io.LimitReader(tp.DotReader(), maxMessageSize))
+			if err != nil {
+				return
+			}
+			msg.Data = data
+			s.store(msg)
+			msg = Captured{}
+			reply(250, "ok")
+		case "RSET":
+			msg = Captured{}
+			reply(250, "ok")
+		case "NOOP":
+			reply(250, "ok")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+func (s *CaptureServer) store(msg Captured) {
+	s.mu.Lock()
+	if len(s.messages) >= maxMessages {
+		s.messages = append(s.messages[:0], s.messages[len(s.messages)-maxMessages+1:]...)
+	}
+	s.messages = append(s.messages, msg)
+	s.mu.Unlock()
+
+	if s.OnMessage != nil {
+		s.OnMessage(msg)
+	}
+}
+
+// address extracts the address from "FROM:<a@b>" and "TO:<a@b>" arguments
+func address(arg string) string {
+	if i := strings.Index(arg, "<"); i >= 0 {
+		if j := strings.Index(arg[i:], ">"); j >= 0 {
+			return arg[i+1 : i+j]
+		}
+	}
+	_, addr, _ := strings.Cut(arg, ":")
+	return strings.TrimSpace(addr)
+}
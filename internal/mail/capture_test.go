@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureServer(t *testing.T) {
+	s := &CaptureServer{}
+	addr, err := s.Start("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	m := &SMTPMailer{Addr: addr.String(), From: "sso@localhost"}
+	for i := 0; i < maxMessages+5; i++ {
+		err := m.Send(context.Background(), Message{
+			To:      []string{fmt.Sprintf("user%d@example.com", i)},
+			Subject: fmt.Sprintf("Message %d é", i),
+			Body:    "hello",
+		})
+		require.NoError(t, err)
+	}
+
+	// the oldest messages make way for new ones
+	messages := s.Messages()
+	require.Len(t, messages, maxMessages)
+	require.Equal(t, []string{"user5@example.com"}, messages[0].To)
+	require.Equal(t, "sso@localhost", messages[0].From)
+	require.Equal(t, "Message 5 é", messages[0].Subject())
+
+	msg, err := s.Wait("USER104@example.com", 0)
+	require.NoError(t, err)
+	require.Contains(t, string(msg.Data), "hello")
+	_, err = s.Wait("user0@example.com", 0)
+	require.Error(t, err)
+}
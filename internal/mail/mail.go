@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages, SMTPMailer is the only transport today
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type Params struct {
+	fx.In
+
+	LC     fx.Lifecycle
+	Config *config.Config
+	Log    *zap.Logger
+}
+
+// New returns an smtp mailer. With capture enabled an in-process smtp
+// server is started first and messages are logged instead of delivered,
+// only their recipients and subject unless LogBody is set as bodies carry
+// reset links.
+func New(p Params) (Mailer, error) {
+	cfg := p.Config.Mail
+	m := &SMTPMailer{
+		Addr:     cfg.SMTPAddr,
+		From:     cfg.From,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		StartTLS: cfg.StartTLS,
+	}
+
+	if cfg.Capture {
+		capture := &CaptureServer{
+			OnMessage: func(c Captured) {
+				fields := []zap.Field{zap.Strings("to", c.To), zap.String("subject", c.Subject())}
+				if cfg.LogBody {
+					fields = append(fields, zap.String("message", string(c.Data)))
+				}
+				p.Log.Info("captured mail", fields...)
+			},
+		}
+
+		p.LC.Append(fx.Hook{
+			OnStart: func(_ context.Context) error {
+				addr, err := capture.Start(cfg.SMTPAddr)
+				if err != nil {
+					return err
+				}
+				m.Addr = addr.String()
+				p.Log.Info("capturing mail", zap.String("addr", m.Addr))
+				return nil
+			},
+			OnStop: func(_ context.Context) error {
+				return capture.Close()
+			},
+		})
+	}
+
+	return m, nil
+}
+
+// format renders the message with the headers mail clients expect
+func format(from string, msg Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
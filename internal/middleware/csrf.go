@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	csrfKey = "csrf_key"
+
+	// CSRFField is the form field template.Render adds to post forms
+	CSRFField = "csrf_token"
+	// CSRFHeader carries the token for scripted requests
+	CSRFHeader = "X-CSRF-Token"
+
+	// csrfMultipartPeek is how much of a multipart body is read to find
+	// the token, which is the first part of a rendered form
+	csrfMultipartPeek = 4096
+)
+
+type csrfContextKey struct{}
+
+// CSRF rejects state changing requests that don't carry the session's
+// synchronizer token. exempt are path.Match patterns for endpoints that
+// take cross site posts by design, such as saml bindings. Requests with a
+// bearer token that bearer accepts, such as api tokens, aren't checked
+// either, browsers can't add the header cross site and a valid token
+// authenticates the request on its own. bearer may be nil.
+func (s *SessionManager) CSRF(bearer func(token string) bool, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the token is only created once a page needs it, so static
+			// files and api calls don't start sessions
+			session := r.Context()
+			ctx := context.WithValue(session, csrfContextKey{}, func() string {
+				return s.csrfToken(session)
+			})
+			r = r.WithContext(ctx)
+
+			if csrfSafe(r, bearer) || csrfExempt(r.URL.Path, exempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, _ := s.impl.Get(ctx, csrfKey).(string)
+			sent := requestCSRFToken(r)
+			if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CSRFToken returns the token for forms rendered in this request, empty
+// when the request didn't pass through CSRF
+func CSRFToken(ctx context.Context) string {
+	token, ok := ctx.Value(csrfContextKey{}).(func() string)
+	if !ok {
+		return ""
+	}
+	return token()
+}
+
+func (s *SessionManager) csrfToken(ctx context.Context) string {
+	if token, ok := s.impl.Get(ctx, csrfKey).(string); ok {
+		return token
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+	s.impl.Put(ctx, csrfKey, token)
+	return token
+}
+
+func csrfSafe(r *http.Request, bearer func(string) bool) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	// any other Authorization header leaves the request to its cookies
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && bearer != nil && bearer(token)
+}
+
+func csrfExempt(p string, exempt []string) bool {
+	for _, pattern := range exempt {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(CSRFHeader); token != "" {
+		return token
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.PostFormValue(CSRFField)
+	}
+
+	// multipart uploads are streamed by their handlers, so only the start
+	// of the body is read and then put back
+	prefix := make([]byte, csrfMultipartPeek)
+	n, _ := io.ReadFull(r.Body, prefix)
+	prefix = prefix[:n]
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+
+	part, err := multipart.NewReader(bytes.NewReader(prefix), params["boundary"]).NextPart()
+	if err != nil || part.FormName() != CSRFField {
+		return ""
+	}
+	token, err := io.ReadAll(io.LimitReader(part, 128))
+	if err != nil {
+		return ""
+	}
+	return string(token)
+}
@@ -2,58 +2,129 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/ghaggin/sso/internal/config"
 	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/sessionstore"
 	"go.uber.org/fx"
 )
 
 const (
-	sessionKey       = "session_key"
-	redirectStateKey = "redirect_state_key"
+	sessionKey     = "session_key"
+	pendingAuthKey = "pending_auth_key"
+	federationKey  = "federation_key"
+	pendingKey     = "pending_key"
+	traceKey       = "saml_trace_key"
+	spProfileKey   = "sp_profile_key"
 )
 
+// lastSeenInterval is how stale LastSeen may get before a request updates
+// it, so not every request rewrites the session
+const lastSeenInterval = time.Minute
+
+// maxPendingAuthSize bounds the request kept for after login, a signed
+// post binding AuthnRequest is a few kilobytes
+const maxPendingAuthSize = 16 << 10
+
 var (
-	errSessionNotFound = errors.New("session not found")
+	ErrSessionNotFound = errors.New("session not found")
+
+	ErrPendingAuthTooLarge = errors.New("request is too large to resume after login")
 )
 
 type SessionManager struct {
-	impl *scs.SessionManager
+	impl  *scs.SessionManager
+	index sessionstore.Index
+	cfg   config.Session
 }
 
 type SessionManagerParams struct {
 	fx.In
 
-	Mode config.Mode
+	LC     fx.Lifecycle
+	Mode   config.Mode
+	Config *config.Config
 }
 
 func NewSessionManager(p SessionManagerParams) (*SessionManager, error) {
 	gob.Register(&model.Session{})
-	gob.Register(&http.Request{})
-	gob.Register(&http.NoBody)
+	gob.Register(&model.FederationState{})
+	gob.Register(&model.PendingLogin{})
+	gob.Register(&model.PendingAuth{})
+	gob.Register(&model.SAMLTrace{})
+	gob.Register(&config.SPProfile{})
 
-	sm := &SessionManager{}
+	sm := &SessionManager{
+		cfg: p.Config.Session,
+	}
+	store, err := sessionstore.New(sm.cfg.Store, string(p.Mode))
+	if err != nil {
+		return nil, fmt.Errorf("session store: %w", err)
+	}
+	p.LC.Append(fx.Hook{
+		OnStop: func(_ context.Context) error {
+			return store.Close()
+		},
+	})
+	sealed, err := sessionstore.Seal(store, sm.cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	sm.index = sealed
 	sm.impl = scs.New()
+	sm.impl.Store = sealed
+	// idle and absolute expiry are checked against the session itself, the
+	// store only has to keep it for the longest of them
+	sm.impl.Lifetime = max(sm.cfg.Lifetime, sm.cfg.RememberLifetime)
 	sm.impl.Cookie = scs.SessionCookie{
-		Name:     fmt.Sprintf("%s_%s", p.Mode, getUniqueSuffix()),
+		// the name is fixed so instances sharing a store accept each
+		// other's cookies, and differs by mode since cookies ignore ports
+		Name:     fmt.Sprintf("%s_session", p.Mode),
 		Domain:   "",
 		HttpOnly: true,
 		Path:     "/",
-		Persist:  true,
+		// the cookie only outlives the browser with keep me signed in
+		Persist:  false,
 		Secure:   false,
 		SameSite: http.SameSiteLaxMode,
 	}
 
+	p.LC.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			return sm.reindex(ctx)
+		},
+	})
+
 	return sm, nil
 }
 
+// reindex adds every signed in session to the index, for sessions saved
+// before there was one. Entries already there are only rewritten.
+func (s *SessionManager) reindex(ctx context.Context) error {
+	now := time.Now()
+	return s.impl.Iterate(ctx, func(c context.Context) error {
+		session, ok := s.impl.Get(c, sessionKey).(*model.Session)
+		if !ok || !s.valid(session, now) {
+			return nil
+		}
+		return s.addIndex(session, s.impl.Token(c))
+	})
+}
+
 func (s *SessionManager) Wrap(next http.Handler) http.Handler {
 	return s.impl.LoadAndSave(next)
 }
@@ -61,42 +132,484 @@ func (s *SessionManager) Wrap(next http.Handler) http.Handler {
 func (s *SessionManager) Get(ctx context.Context) (*model.Session, error) {
 	session, ok := s.impl.Get(ctx, sessionKey).(*model.Session)
 	if !ok {
-		return nil, errSessionNotFound
+		return nil, ErrSessionNotFound
 	}
 
 	return session, nil
 }
 
-func (s *SessionManager) SetAuthenticated(ctx context.Context, name string) error {
+// Authenticated returns the signed in session, or false once it expired or
+// sat idle too long. Using it slides the idle timeout along.
+func (s *SessionManager) Authenticated(ctx context.Context) (*model.Session, bool) {
 	session, ok := s.impl.Get(ctx, sessionKey).(*model.Session)
-	if !ok {
+	now := time.Now()
+	if !ok || !s.valid(session, now) {
+		return nil, false
+	}
+
+	interval := lastSeenInterval
+	if s.cfg.IdleTimeout > 0 {
+		interval = min(interval, s.cfg.IdleTimeout/2)
+	}
+	if now.Sub(session.LastSeen) > interval {
+		renewed := *session
+		renewed.LastSeen = now
+		s.impl.Put(ctx, sessionKey, &renewed)
+		session = &renewed
+	}
+	return session, true
+}
+
+func (s *SessionManager) valid(session *model.Session, now time.Time) bool {
+	if !session.AuthValid || !now.Before(session.AuthExpiration) {
+		return false
+	}
+	if !session.Remember && s.cfg.IdleTimeout > 0 && now.Sub(session.LastSeen) > s.cfg.IdleTimeout {
+		return false
+	}
+	return true
+}
+
+// RememberEnabled reports whether keep me signed in is offered
+func (s *SessionManager) RememberEnabled() bool {
+	return s.cfg.RememberLifetime > 0
+}
+
+// SetAuthenticated signs the session in as name. The session token is
+// renewed so one planted before login can't be used after it.
+func (s *SessionManager) SetAuthenticated(r *http.Request, name string, remember bool) error {
+	ctx := r.Context()
+	session, ok := s.impl.Get(ctx, sessionKey).(*model.Session)
+	if ok {
+		s.unindex(session, s.impl.Token(ctx))
+	} else {
 		session = &model.Session{}
 	}
+	if err := s.impl.RenewToken(ctx); err != nil {
+		return err
+	}
+
+	remember = remember && s.RememberEnabled()
+	lifetime := s.cfg.Lifetime
+	if remember {
+		lifetime = s.cfg.RememberLifetime
+	}
 
+	now := time.Now()
 	session.UID = name
 	session.AuthValid = true
-	session.AuthExpiration = time.Now().Add(time.Minute)
+	session.AuthExpiration = now.Add(lifetime)
+	session.LastSeen = now
+	session.Remember = remember
+	session.Created = now
+	session.Addr = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		session.Addr = host
+	}
+	session.UserAgent = r.UserAgent()
 
+	if err := s.addIndex(session, s.impl.Token(ctx)); err != nil {
+		return err
+	}
 	s.impl.Put(ctx, sessionKey, session)
+	s.impl.RememberMe(ctx, remember)
+	// signing in ends any login held back for another step, and forms
+	// rendered before it need a fresh token
+	s.impl.Remove(ctx, pendingKey)
+	s.impl.Remove(ctx, csrfKey)
+	return nil
+}
+
+// LimitExpiration ends the session no later than t, an sp uses it to stay
+// within the idp session it was given
+func (s *SessionManager) LimitExpiration(ctx context.Context, t time.Time) {
+	session, ok := s.impl.Get(ctx, sessionKey).(*model.Session)
+	if !ok || t.IsZero() || !t.Before(session.AuthExpiration) {
+		return
+	}
+
+	limited := *session
+	limited.AuthExpiration = t
+	s.impl.Put(ctx, sessionKey, &limited)
+}
+
+// RenewToken gives the session a new token, for when what it is allowed to
+// do changes
+func (s *SessionManager) RenewToken(ctx context.Context) error {
+	session, ok := s.impl.Get(ctx, sessionKey).(*model.Session)
+	if !ok || !session.AuthValid {
+		return s.impl.RenewToken(ctx)
+	}
+
+	s.unindex(session, s.impl.Token(ctx))
+	if err := s.impl.RenewToken(ctx); err != nil {
+		return err
+	}
+	return s.addIndex(session, s.impl.Token(ctx))
+}
+
+// signed in sessions are indexed by user and by ID, so they can be listed
+// and revoked without reading every session
+func userIndexKey(uid string) string {
+	sum := sha256.Sum256([]byte(uid))
+	return "user:" + hex.EncodeToString(sum[:])
+}
+
+func idIndexKey(id string) string {
+	return "id:" + id
+}
+
+func (s *SessionManager) addIndex(session *model.Session, token string) error {
+	if err := s.index.AddIndex(userIndexKey(session.UID), token, session.AuthExpiration); err != nil {
+		return err
+	}
+	return s.index.AddIndex(idIndexKey(sessionID(token)), token, session.AuthExpiration)
+}
+
+// unindex drops the token's entries. It is best effort, an entry left
+// behind points to a session that is gone and is skipped until it lapses.
+func (s *SessionManager) unindex(session *model.Session, token string) {
+	if token == "" || session.UID == "" {
+		return
+	}
+	_ = s.index.RemoveIndex(userIndexKey(session.UID), token)
+	_ = s.index.RemoveIndex(idIndexKey(sessionID(token)), token)
+}
+
+// StorePendingAuth keeps what is needed to resume r after login. Only the
+// method, path, query and form values are kept, and nothing over
+// maxPendingAuthSize.
+func (s *SessionManager) StorePendingAuth(r *http.Request) error {
+	pending, err := newPendingAuth(r)
+	if err != nil {
+		return err
+	}
+
+	s.impl.Put(r.Context(), pendingAuthKey, pending)
 	return nil
 }
 
-func (s *SessionManager) StoreLoginRedirectState(ctx context.Context, r *http.Request) {
-	s.impl.Put(ctx, redirectStateKey, r)
+// PopPendingAuth returns and removes the request waiting for login. Paths
+// are checked again so only this origin's own pages are ever resumed.
+func (s *SessionManager) PopPendingAuth(ctx context.Context) (*model.PendingAuth, bool) {
+	pending, ok := s.impl.Pop(ctx, pendingAuthKey).(*model.PendingAuth)
+	if !ok || !LocalPath(pending.Path) {
+		return nil, false
+	}
+	return pending, true
 }
 
-func (s *SessionManager) LoadLoginRedirectState(ctx context.Context) (*http.Request, bool) {
-	r, ok := s.impl.Get(ctx, redirectStateKey).(*http.Request)
-	return r, ok
+func newPendingAuth(r *http.Request) (*model.PendingAuth, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxPendingAuthSize)
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, ErrPendingAuthTooLarge
+		}
+		return nil, err
+	}
+
+	query := r.URL.Query()
+	form := url.Values{}
+	for k, v := range r.PostForm {
+		if k != CSRFField {
+			form[k] = v
+		}
+	}
+
+	relayState := form.Get("RelayState")
+	if relayState == "" {
+		relayState = query.Get("RelayState")
+	}
+	form.Del("RelayState")
+	query.Del("RelayState")
+
+	if !LocalPath(r.URL.Path) {
+		return nil, fmt.Errorf("refusing to resume %q after login", r.URL.Path)
+	}
+
+	size := len(r.Method) + len(r.URL.Path) + len(relayState)
+	for _, values := range []url.Values{query, form} {
+		for k, v := range values {
+			size += len(k)
+			for _, s := range v {
+				size += len(s)
+			}
+		}
+	}
+	if size > maxPendingAuthSize {
+		return nil, ErrPendingAuthTooLarge
+	}
+
+	return &model.PendingAuth{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      query,
+		Form:       form,
+		RelayState: relayState,
+		Created:    time.Now(),
+	}, nil
 }
 
-func getUniqueSuffix() string {
-	charSet := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	n := len(charSet)
-	var s string
-	for len(s) < 7 {
-		i := rand.Intn(n)
-		s += string(charSet[i])
+// LocalPath accepts absolute paths on this origin, rejecting anything a
+// browser could read as another host such as //host or /\host. Paths with a
+// query or escapes are refused too.
+func LocalPath(p string) bool {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+		return false
+	}
+	for _, c := range p {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return false
+		}
 	}
-	return s
+	u, err := url.Parse(p)
+	return err == nil && u.Scheme == "" && u.Host == "" && u.Path == p
+}
+
+func (s *SessionManager) StoreFederationState(ctx context.Context, state *model.FederationState) {
+	s.impl.Put(ctx, federationKey, state)
+}
+
+// PopFederationState returns and removes the pending upstream login so a
+// response can only be used once
+func (s *SessionManager) PopFederationState(ctx context.Context) (*model.FederationState, bool) {
+	state, ok := s.impl.Pop(ctx, federationKey).(*model.FederationState)
+	return state, ok
+}
+
+// StorePendingLogin holds back a login until its next step is done
+func (s *SessionManager) StorePendingLogin(ctx context.Context, pending *model.PendingLogin) {
+	s.impl.Put(ctx, pendingKey, pending)
+}
+
+func (s *SessionManager) LoadPendingLogin(ctx context.Context) (*model.PendingLogin, bool) {
+	pending, ok := s.impl.Get(ctx, pendingKey).(*model.PendingLogin)
+	return pending, ok
+}
+
+// TraceSAML keeps msg among the session's last limit saml messages
+func (s *SessionManager) TraceSAML(ctx context.Context, msg model.SAMLMessage, limit int) {
+	messages := s.SAMLTrace(ctx)
+	messages = append(slices.Clone(messages), msg)
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	s.impl.Put(ctx, traceKey, &model.SAMLTrace{Messages: messages})
+}
+
+// SAMLTrace returns the session's saml messages, oldest first
+func (s *SessionManager) SAMLTrace(ctx context.Context) []model.SAMLMessage {
+	trace, ok := s.impl.Get(ctx, traceKey).(*model.SAMLTrace)
+	if !ok {
+		return nil
+	}
+	return trace.Messages
+}
+
+// StoreSPProfile keeps the profile the sp last started a login with, so
+// the response is accepted as that profile would
+func (s *SessionManager) StoreSPProfile(ctx context.Context, profile *config.SPProfile) {
+	s.impl.Put(ctx, spProfileKey, profile)
+}
+
+func (s *SessionManager) LoadSPProfile(ctx context.Context) (*config.SPProfile, bool) {
+	profile, ok := s.impl.Get(ctx, spProfileKey).(*config.SPProfile)
+	return profile, ok
+}
+
+// RecordServiceProvider notes that the session signed in to the sp, so
+// it can be logged out there when the session is revoked
+func (s *SessionManager) RecordServiceProvider(ctx context.Context, entityID string) {
+	session, ok := s.impl.Get(ctx, sessionKey).(*model.Session)
+	if !ok || slices.Contains(session.ServiceProviders, entityID) {
+		return
+	}
+
+	recorded := *session
+	recorded.ServiceProviders = append(slices.Clone(session.ServiceProviders), entityID)
+	s.impl.Put(ctx, sessionKey, &recorded)
+}
+
+// Sessions lists every signed in session, newest first. Sessions are read
+// from the store rather than kept in memory, so instances sharing a store
+// see the same sessions.
+func (s *SessionManager) Sessions(ctx context.Context) ([]model.SessionInfo, error) {
+	return s.sessions(ctx, func(*model.Session) bool { return true })
+}
+
+// UserSessions lists the signed in sessions of the user, marking the one
+// making the request
+func (s *SessionManager) UserSessions(ctx context.Context, uid string) ([]model.SessionInfo, error) {
+	return s.indexed(ctx, userIndexKey(uid), func(session *model.Session) bool {
+		return session.UID == uid
+	})
+}
+
+// FindSession returns the signed in session with the ID
+func (s *SessionManager) FindSession(ctx context.Context, id string) (*model.SessionInfo, error) {
+	sessions, err := s.indexed(ctx, idIndexKey(id), func(*model.Session) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return &sessions[0], nil
+}
+
+func (s *SessionManager) sessions(ctx context.Context, match func(*model.Session) bool) ([]model.SessionInfo, error) {
+	current := s.impl.Token(ctx)
+	now := time.Now()
+
+	var sessions []model.SessionInfo
+	err := s.impl.Iterate(ctx, func(c context.Context) error {
+		session, ok := s.impl.Get(c, sessionKey).(*model.Session)
+		if !ok || !s.valid(session, now) || !match(session) {
+			return nil
+		}
+
+		token := s.impl.Token(c)
+		sessions = append(sessions, sessionInfo(session, token, token == current))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// indexed lists the signed in sessions under the index key that match
+func (s *SessionManager) indexed(ctx context.Context, key string, match func(*model.Session) bool) ([]model.SessionInfo, error) {
+	current := s.impl.Token(ctx)
+	now := time.Now()
+
+	var sessions []model.SessionInfo
+	err := s.loadIndexed(key, func(c context.Context, session *model.Session, token string) error {
+		if s.valid(session, now) && match(session) {
+			sessions = append(sessions, sessionInfo(session, token, token == current))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// loadIndexed calls fn with each session under the index key, dropping
+// entries whose session is gone
+func (s *SessionManager) loadIndexed(key string, fn func(c context.Context, session *model.Session, token string) error) error {
+	tokens, err := s.index.LookupIndex(key)
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		// a fresh context, Load keeps any session already in the one it
+		// is given
+		c, err := s.impl.Load(context.Background(), token)
+		if err != nil {
+			return err
+		}
+		session, ok := s.impl.Get(c, sessionKey).(*model.Session)
+		if !ok {
+			_ = s.index.RemoveIndex(key, token)
+			continue
+		}
+		if err := fn(c, session, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortSessions(sessions []model.SessionInfo) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.After(sessions[j].Created)
+	})
+}
+
+func sessionInfo(session *model.Session, token string, current bool) model.SessionInfo {
+	return model.SessionInfo{
+		ID:               sessionID(token),
+		UID:              session.UID,
+		Created:          session.Created,
+		LastSeen:         session.LastSeen,
+		Expires:          session.AuthExpiration,
+		Remember:         session.Remember,
+		Addr:             session.Addr,
+		UserAgent:        session.UserAgent,
+		ServiceProviders: session.ServiceProviders,
+		Current:          current,
+	}
+}
+
+// RevokeSession ends one of the user's other sessions by its ID. The
+// session making the request would be saved again as it finishes, so it
+// can't be revoked this way.
+func (s *SessionManager) RevokeSession(ctx context.Context, uid, id string) error {
+	revoked, err := s.revoke(ctx, idIndexKey(id), func(session *model.Session) bool {
+		return session.UID == uid
+	})
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSessionID ends any user's session by its ID and returns it, so the
+// caller can log it out of the sps it used
+func (s *SessionManager) RevokeSessionID(ctx context.Context, id string) (*model.SessionInfo, error) {
+	revoked, err := s.revoke(ctx, idIndexKey(id), func(*model.Session) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	if len(revoked) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return &revoked[0], nil
+}
+
+// RevokeUserSessions ends every session of the user other than the one
+// making the request, and returns what was ended
+func (s *SessionManager) RevokeUserSessions(ctx context.Context, uid string) ([]model.SessionInfo, error) {
+	return s.revoke(ctx, userIndexKey(uid), func(session *model.Session) bool {
+		return session.UID == uid
+	})
+}
+
+func (s *SessionManager) revoke(ctx context.Context, key string, match func(*model.Session) bool) ([]model.SessionInfo, error) {
+	current := s.impl.Token(ctx)
+	now := time.Now()
+
+	var revoked []model.SessionInfo
+	err := s.loadIndexed(key, func(c context.Context, session *model.Session, token string) error {
+		if token == current || !match(session) {
+			return nil
+		}
+
+		if s.valid(session, now) {
+			revoked = append(revoked, sessionInfo(session, token, false))
+		}
+		if err := s.impl.Destroy(c); err != nil {
+			return err
+		}
+		s.unindex(session, token)
+		return nil
+	})
+	return revoked, err
+}
+
+// sessionID is a digest of the token, safe to put in pages and forms
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
 }
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalPath(t *testing.T) {
+	for _, tt := range []struct {
+		path  string
+		local bool
+	}{
+		{"/", true},
+		{"/users/3", true},
+		{"/saml/login", true},
+
+		{"", false},
+		{"users", false},
+		{"//evil", false},
+		{"///evil", false},
+		{`/\evil`, false},
+		{`\\evil`, false},
+		{"https://evil", false},
+		{"/https://evil", true},
+		{"javascript:alert(1)", false},
+		// encoded slashes decode to another path than the one checked
+		{"/%2F%2Fevil", false},
+		{"/%2fevil", false},
+		{"/%5Cevil", false},
+		{"/a%2Fb", false},
+		{"/\tevil", false},
+		{"/\nevil", false},
+		{"/a?next=//evil", false},
+		{"/a#frag", false},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			require.Equal(t, tt.local, LocalPath(tt.path))
+		})
+	}
+}
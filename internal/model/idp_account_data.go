@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+type IDPAccountData struct {
+	BaseData
+	User       User
+	Groups     []string
+	Attributes []AttributeField
+	Devices    []MFADevice
+	Apps       []AppLink
+	Sessions   []SessionInfo
+	// Admin links the admin ui for users allowed to view it
+	Admin        bool
+	Error        bool
+	ErrorMessage string
+}
+
+// AppLink is a service provider the user can launch from the portal
+type AppLink struct {
+	EntityID string
+	// Name is the display name in the sp's metadata, or its entity id
+	Name       string
+	LaunchURL  string
+	LastSignIn time.Time
+}
+
+type IDPMFAEnrollData struct {
+	BaseData
+	Device       MFADevice
+	URI          string
+	Error        bool
+	ErrorMessage string
+}
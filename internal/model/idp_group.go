@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+type Group struct {
+	ID         int       `json:"id"`
+	ExternalID string    `json:"externalId,omitempty"`
+	Name       string    `json:"name"`
+	Members    []int     `json:"members"`
+	Created    time.Time `json:"created"`
+	Modified   time.Time `json:"modified"`
+}
@@ -4,4 +4,13 @@ type IDPLoginData struct {
 	BaseData
 	Error        bool
 	ErrorMessage string
+	Upstreams    []UpstreamLink
+	// Remember offers keep me signed in
+	Remember bool
+}
+
+// UpstreamLink is a "sign in with" button on the login page
+type UpstreamLink struct {
+	Name        string
+	DisplayName string
 }
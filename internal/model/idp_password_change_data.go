@@ -0,0 +1,13 @@
+package model
+
+type IDPPasswordChangeData struct {
+	BaseData
+	Error        bool
+	ErrorMessage string
+	// Violations are the password policy rules a new password broke
+	Violations []string
+	// Expired is set while a login waits for the change, the current
+	// password was just entered so it isn't asked for again
+	Expired bool
+	Message string
+}
@@ -0,0 +1,12 @@
+package model
+
+type IDPPasswordResetData struct {
+	BaseData
+	Error        bool
+	ErrorMessage string
+	// Violations are the password policy rules a new password broke
+	Violations []string
+	// Message replaces the form once the request went through
+	Message string
+	Token   string
+}
@@ -1,10 +1,61 @@
 package model
 
+import "time"
+
 type User struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	Password string `json:"password"`
-	First    string `json:"first"`
-	Last     string `json:"last"`
-	Email    string `json:"email"`
+	ID         int                 `json:"id"`
+	ExternalID string              `json:"externalId,omitempty"`
+	Name       string              `json:"name"`
+	Password   string              `json:"password"`
+	First      string              `json:"first"`
+	Last       string              `json:"last"`
+	Email      string              `json:"email"`
+	Disabled   bool                `json:"disabled,omitempty"`
+	Roles      []string            `json:"roles,omitempty"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+	Identities []Identity          `json:"identities,omitempty"`
+	// PasswordReset is the outstanding reset link, if any
+	PasswordReset *PasswordReset `json:"passwordReset,omitempty"`
+	// PasswordHistory holds the hashes of earlier passwords, newest first
+	PasswordHistory []string    `json:"passwordHistory,omitempty"`
+	PasswordChanged time.Time   `json:"passwordChanged"`
+	MFADevices      []MFADevice `json:"mfaDevices,omitempty"`
+	// Apps are the service providers the user signed in to
+	Apps     []AppSignIn `json:"apps,omitempty"`
+	Created  time.Time   `json:"created"`
+	Modified time.Time   `json:"modified"`
+}
+
+// Identity links a user to their account at an upstream identity provider
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+}
+
+// PasswordReset holds the hash of a single use reset token, the token
+// itself is only ever sent to the user
+type PasswordReset struct {
+	Hash    string    `json:"hash"`
+	Expires time.Time `json:"expires"`
+}
+
+// MFADevice is a second factor, only totp authenticator apps for now. A
+// device counts once it has been confirmed with a code.
+type MFADevice struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Secret    string    `json:"secret"`
+	Confirmed bool      `json:"confirmed"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+	// LastStep is the last totp time step accepted, so a code can't be
+	// used twice
+	LastStep int64 `json:"lastStep,omitempty"`
+}
+
+// AppSignIn records when the user last signed in to a service provider
+type AppSignIn struct {
+	EntityID string    `json:"entityId"`
+	Last     time.Time `json:"last"`
 }
@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+type IDPUserFormData struct {
+	BaseData
+	User         User
+	Attributes   []AttributeField
+	Error        bool
+	ErrorMessage string
+	// Violations are the password policy rules a new password broke
+	Violations   []string
+	FailedLogins int
+	LockedUntil  time.Time
+	Roles        []RoleOption
+	CanEditRoles bool
+}
+
+// RoleOption is a role rendered as a checkbox
+type RoleOption struct {
+	Name    string
+	Checked bool
+}
+
+// AttributeField is a custom attribute rendered as a form input
+type AttributeField struct {
+	Name         string
+	FriendlyName string
+	Type         string
+	Value        string
+	Checked      bool
+}
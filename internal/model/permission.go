@@ -0,0 +1,36 @@
+package model
+
+// Permission is a single admin capability
+type Permission string
+
+const (
+	PermissionUsersRead  Permission = "users:read"
+	PermissionUsersWrite Permission = "users:write"
+	PermissionRolesWrite Permission = "roles:write"
+	PermissionSPRead     Permission = "sp:read"
+	PermissionSPWrite    Permission = "sp:write"
+	// PermissionSPEvil runs adversarial tests, which sp:write doesn't
+	// grant
+	PermissionSPEvil            Permission = "sp:evil"
+	PermissionProvisioningRead  Permission = "provisioning:read"
+	PermissionProvisioningWrite Permission = "provisioning:write"
+	PermissionSessionsRead      Permission = "sessions:read"
+	PermissionSessionsWrite     Permission = "sessions:write"
+)
+
+// RoleAdmin is built in and holds every permission
+const RoleAdmin = "admin"
+
+// Permissions lists every known permission
+var Permissions = []Permission{
+	PermissionUsersRead,
+	PermissionUsersWrite,
+	PermissionRolesWrite,
+	PermissionSPRead,
+	PermissionSPWrite,
+	PermissionSPEvil,
+	PermissionProvisioningRead,
+	PermissionProvisioningWrite,
+	PermissionSessionsRead,
+	PermissionSessionsWrite,
+}
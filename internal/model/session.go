@@ -8,4 +8,94 @@ type Session struct {
 	UID            string
 	AuthValid      bool
 	AuthExpiration time.Time
+	// LastSeen is when the session was last used, for the idle timeout
+	LastSeen time.Time
+	// Remember is set for keep me signed in, which has no idle timeout
+	Remember bool
+	// where the user signed in from
+	Created   time.Time
+	Addr      string
+	UserAgent string
+	// ServiceProviders are the entity ids the session signed in to, for
+	// single logout
+	ServiceProviders []string
+}
+
+// FederationState tracks a login in progress at an upstream identity
+// provider until its response comes back
+type FederationState struct {
+	Upstream string
+	// oidc state, nonce and pkce verifier
+	State    string
+	Nonce    string
+	Verifier string
+	// saml authn request id
+	RequestID string
+	Created   time.Time
+}
+
+// PendingAuth is a request that was sent to log in first and is resumed
+// once the session is authenticated, such as a saml AuthnRequest
+type PendingAuth struct {
+	Method string
+	Path   string
+	Query  map[string][]string
+	// Form holds posted values, a post binding SAMLRequest for instance
+	Form       map[string][]string
+	RelayState string
+	Created    time.Time
+}
+
+// PendingLogin is a login that passed the password check and waits for
+// another step before the session is authenticated
+type PendingLogin struct {
+	UID      string
+	Step     PendingStep
+	Remember bool
+	Created  time.Time
+}
+
+type PendingStep string
+
+const (
+	PendingMFA            PendingStep = "mfa"
+	PendingPasswordChange PendingStep = "password_change"
+)
+
+// SessionInfo describes a signed in session
+type SessionInfo struct {
+	// ID identifies the session without revealing its token
+	ID               string    `json:"id"`
+	UID              string    `json:"uid"`
+	Created          time.Time `json:"created"`
+	LastSeen         time.Time `json:"lastSeen"`
+	Expires          time.Time `json:"expires"`
+	Remember         bool      `json:"remember"`
+	Addr             string    `json:"addr"`
+	UserAgent        string    `json:"userAgent"`
+	ServiceProviders []string  `json:"serviceProviders"`
+	Current          bool      `json:"current"`
+}
+
+// SAMLMessage is a saml message the test sp sent or received, kept with
+// its session for the trace page
+type SAMLMessage struct {
+	Time time.Time
+	// Sent is set for messages to the idp
+	Sent bool
+	Type string
+	// Profile is the test sp profile the message was sent or accepted with
+	Profile    string
+	Binding    string
+	RelayState string
+	XML        string
+	// Assertion is the assertion accepted from a response, decrypted
+	Assertion string
+	// Error is why a received message was rejected
+	Error string
+}
+
+// SAMLTrace is a session's last saml messages, oldest first
+type SAMLTrace struct {
+	Messages []SAMLMessage
 }
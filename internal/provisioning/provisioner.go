@@ -0,0 +1,478 @@
+package provisioning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/repository"
+	"github.com/ghaggin/sso/internal/scim"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	baseBackoff = 5 * time.Second
+	maxBackoff  = time.Hour
+	pollPeriod  = time.Second
+)
+
+// Provisioner pushes user changes to downstream scim endpoints. Changes
+// are queued durably and delivered by a background worker with
+// exponential backoff.
+type Provisioner struct {
+	log         *zap.Logger
+	repo        repository.Repository
+	path        string
+	interval    time.Duration
+	maxAttempts int
+	connectors  map[string]config.Connector
+	clients     map[string]*scim.Client
+
+	mu   sync.Mutex
+	data *queueData
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Params struct {
+	fx.In
+
+	LC     fx.Lifecycle
+	Config *config.Config
+	Repo   repository.Repository
+	Log    *zap.Logger
+}
+
+func New(p Params) (*Provisioner, error) {
+	cfg := p.Config.Provisioning
+	pr := &Provisioner{
+		log:         p.Log,
+		repo:        p.Repo,
+		path:        cfg.QueuePath,
+		interval:    cfg.ReconcileInterval,
+		maxAttempts: cfg.MaxAttempts,
+		connectors:  map[string]config.Connector{},
+		clients:     map[string]*scim.Client{},
+		wake:        make(chan struct{}, 1),
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	for _, c := range cfg.Connectors {
+		pr.connectors[c.Name] = c
+		pr.clients[c.Name] = scim.NewClient(c.URL, c.Token, httpClient)
+	}
+
+	data, err := readQueue(pr.path)
+	if err != nil {
+		// only log, queued changes are lost but reconciliation will
+		// catch up downstream state
+		pr.log.Warn("failed reading provisioning queue", zap.Error(err))
+	}
+	pr.data = data
+
+	p.LC.Append(fx.Hook{
+		OnStart: pr.start,
+		OnStop:  pr.stop,
+	})
+
+	return pr, nil
+}
+
+func (p *Provisioner) start(_ context.Context) error {
+	if len(p.connectors) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+
+	go p.run(ctx)
+	return nil
+}
+
+func (p *Provisioner) stop(_ context.Context) error {
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return writeQueue(p.path, p.data)
+}
+
+// Enqueue schedules op for the user on every connector. A pending job for
+// the same user is replaced since delivery always uses the latest state.
+func (p *Provisioner) Enqueue(op Op, user *model.User) {
+	if len(p.connectors) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	for name := range p.connectors {
+		p.enqueueLocked(name, op, user.ID, user.Name)
+	}
+	p.persistLocked()
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Provisioner) enqueueLocked(connector string, op Op, userID int, userName string) {
+	now := time.Now()
+	for i, j := range p.data.Jobs {
+		if j.Connector == connector && j.UserName == userName && !j.Failed {
+			p.data.Jobs[i].Op = op
+			p.data.Jobs[i].UserID = userID
+			p.data.Jobs[i].NextAttempt = now
+			return
+		}
+	}
+
+	p.data.NextID++
+	p.data.Jobs = append(p.data.Jobs, Job{
+		ID:          p.data.NextID,
+		Connector:   connector,
+		Op:          op,
+		UserID:      userID,
+		UserName:    userName,
+		NextAttempt: now,
+		Created:     now,
+	})
+}
+
+func (p *Provisioner) persistLocked() {
+	if err := writeQueue(p.path, p.data); err != nil {
+		p.log.Error("failed writing provisioning queue", zap.Error(err))
+	}
+}
+
+func (p *Provisioner) run(ctx context.Context) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(pollPeriod)
+	defer ticker.Stop()
+
+	p.ReconcileAll(ctx)
+	lastReconcile := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+
+		p.deliverDue(ctx)
+
+		if p.interval > 0 && time.Since(lastReconcile) >= p.interval {
+			p.ReconcileAll(ctx)
+			lastReconcile = time.Now()
+		}
+	}
+}
+
+func (p *Provisioner) deliverDue(ctx context.Context) {
+	now := time.Now()
+
+	p.mu.Lock()
+	var due []Job
+	for _, j := range p.data.Jobs {
+		if !j.Failed && !j.NextAttempt.After(now) {
+			due = append(due, j)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, j := range due {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := p.deliver(ctx, j)
+		p.complete(j, err)
+	}
+}
+
+func (p *Provisioner) deliver(ctx context.Context, j Job) error {
+	client, ok := p.clients[j.Connector]
+	if !ok {
+		return fmt.Errorf("unknown connector %s", j.Connector)
+	}
+
+	remote, err := client.FindUser(ctx, j.UserName)
+	if err != nil {
+		return err
+	}
+
+	switch j.Op {
+	case OpUpsert:
+		user, err := p.repo.GetUserByID(ctx, j.UserID)
+		if errors.Is(err, repository.ErrNotFound) {
+			// deleted after being queued
+			return p.deprovision(ctx, client, remote)
+		} else if err != nil {
+			return err
+		}
+
+		if remote == nil {
+			_, err = client.CreateUser(ctx, scim.NewUser(user))
+		} else {
+			_, err = client.ReplaceUser(ctx, remote.ID, scim.NewUser(user))
+		}
+		return err
+	case OpDeprovision:
+		return p.deprovision(ctx, client, remote)
+	}
+
+	return fmt.Errorf("unknown op %s", j.Op)
+}
+
+func (p *Provisioner) deprovision(ctx context.Context, client *scim.Client, remote *scim.User) error {
+	if remote == nil || (remote.Active != nil && !*remote.Active) {
+		return nil
+	}
+	return client.SetActive(ctx, remote.ID, false)
+}
+
+// complete records the outcome of a delivery attempt
+func (p *Provisioner) complete(j Job, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := p.statusLocked(j.Connector)
+
+	idx := -1
+	for i, q := range p.data.Jobs {
+		if q.ID == j.ID {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return
+	}
+
+	if err == nil {
+		// the job may have been replaced by a newer change while it was
+		// being delivered, in that case deliver again
+		if q := p.data.Jobs[idx]; q.Op == j.Op && q.UserID == j.UserID && !q.NextAttempt.After(j.NextAttempt) {
+			p.data.Jobs = append(p.data.Jobs[:idx], p.data.Jobs[idx+1:]...)
+		}
+		status.LastSuccess = time.Now()
+		p.persistLocked()
+		p.log.Info("provisioned user",
+			zap.String("connector", j.Connector),
+			zap.String("op", string(j.Op)),
+			zap.String("user", j.UserName))
+		return
+	}
+
+	q := &p.data.Jobs[idx]
+	q.Attempts++
+	q.LastError = err.Error()
+	q.NextAttempt = time.Now().Add(backoff(q.Attempts))
+	if p.maxAttempts > 0 && q.Attempts >= p.maxAttempts {
+		q.Failed = true
+	}
+
+	status.LastError = err.Error()
+	status.LastErrorTime = time.Now()
+	p.persistLocked()
+
+	p.log.Error("failed provisioning user",
+		zap.String("connector", j.Connector),
+		zap.String("op", string(j.Op)),
+		zap.String("user", j.UserName),
+		zap.Int("attempts", q.Attempts),
+		zap.Bool("failed", q.Failed),
+		zap.Error(err))
+}
+
+func backoff(attempts int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+func (p *Provisioner) statusLocked(connector string) *ConnectorStatus {
+	s, ok := p.data.Status[connector]
+	if !ok {
+		s = &ConnectorStatus{}
+		p.data.Status[connector] = s
+	}
+	return s
+}
+
+// ReconcileAll diffs local users against every connector
+func (p *Provisioner) ReconcileAll(ctx context.Context) {
+	for name := range p.connectors {
+		if err := p.Reconcile(ctx, name); err != nil {
+			p.log.Error("failed reconciling connector", zap.String("connector", name), zap.Error(err))
+		}
+	}
+}
+
+// Reconcile compares the IdP's users with the connector's and queues the
+// changes needed to bring the connector in line
+func (p *Provisioner) Reconcile(ctx context.Context, connector string) error {
+	client, ok := p.clients[connector]
+	if !ok {
+		return fmt.Errorf("unknown connector %s", connector)
+	}
+
+	local, err := p.repo.GetUsers(ctx)
+	if err == nil {
+		var remote []scim.User
+		remote, err = client.ListUsers(ctx)
+		if err == nil {
+			p.diff(connector, local, remote)
+			return nil
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.statusLocked(connector)
+	status.LastReconcile = time.Now()
+	status.ReconcileResult = "failed: " + err.Error()
+	status.LastError = err.Error()
+	status.LastErrorTime = status.LastReconcile
+	p.persistLocked()
+	return err
+}
+
+func (p *Provisioner) diff(connector string, local []model.User, remote []scim.User) {
+	remoteByName := map[string]scim.User{}
+	for _, r := range remote {
+		remoteByName[r.UserName] = r
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var upserts, deprovisions int
+	localNames := map[string]bool{}
+	for _, u := range local {
+		localNames[u.Name] = true
+
+		r, ok := remoteByName[u.Name]
+		if !ok || !inSync(scim.NewUser(&u), &r) {
+			p.enqueueLocked(connector, OpUpsert, u.ID, u.Name)
+			upserts++
+		}
+	}
+
+	for _, r := range remote {
+		if !localNames[r.UserName] && (r.Active == nil || *r.Active) {
+			p.enqueueLocked(connector, OpDeprovision, -1, r.UserName)
+			deprovisions++
+		}
+	}
+
+	status := p.statusLocked(connector)
+	status.LastReconcile = time.Now()
+	status.ReconcileResult = fmt.Sprintf("%d local, %d remote, %d to update, %d to deprovision",
+		len(local), len(remote), upserts, deprovisions)
+	p.persistLocked()
+
+	if upserts+deprovisions > 0 {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// inSync compares the attributes the IdP is authoritative for
+func inSync(want, have *scim.User) bool {
+	activeWant := want.Active == nil || *want.Active
+	activeHave := have.Active == nil || *have.Active
+
+	email := func(u *scim.User) string {
+		if len(u.Emails) == 0 {
+			return ""
+		}
+		return u.Emails[0].Value
+	}
+	name := func(u *scim.User) scim.Name {
+		if u.Name == nil {
+			return scim.Name{}
+		}
+		return scim.Name{GivenName: u.Name.GivenName, FamilyName: u.Name.FamilyName}
+	}
+
+	return activeWant == activeHave && email(want) == email(have) && name(want) == name(have)
+}
+
+// Retry requeues jobs that exhausted their attempts
+func (p *Provisioner) Retry() {
+	p.mu.Lock()
+	for i := range p.data.Jobs {
+		if p.data.Jobs[i].Failed {
+			p.data.Jobs[i].Failed = false
+			p.data.Jobs[i].Attempts = 0
+			p.data.Jobs[i].NextAttempt = time.Now()
+		}
+	}
+	p.persistLocked()
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ConnectorReport summarises a connector for the status page
+type ConnectorReport struct {
+	config.Connector
+	ConnectorStatus
+	Pending int
+	Failed  int
+	Jobs    []Job
+}
+
+// Status returns a snapshot of every connector and its outstanding jobs
+func (p *Provisioner) Status() []ConnectorReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var reports []ConnectorReport
+	for name, c := range p.connectors {
+		r := ConnectorReport{Connector: c}
+		if s, ok := p.data.Status[name]; ok {
+			r.ConnectorStatus = *s
+		}
+		for _, j := range p.data.Jobs {
+			if j.Connector != name {
+				continue
+			}
+			if j.Failed {
+				r.Failed++
+			} else {
+				r.Pending++
+			}
+			r.Jobs = append(r.Jobs, j)
+		}
+		reports = append(reports, r)
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
@@ -0,0 +1,86 @@
+package provisioning
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Op string
+
+const (
+	// OpUpsert creates or replaces the user downstream from its current
+	// state in the repository
+	OpUpsert Op = "upsert"
+	// OpDeprovision deactivates the user downstream
+	OpDeprovision Op = "deprovision"
+)
+
+type Job struct {
+	ID          int       `json:"id"`
+	Connector   string    `json:"connector"`
+	Op          Op        `json:"op"`
+	UserID      int       `json:"userId"`
+	UserName    string    `json:"userName"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	Failed      bool      `json:"failed,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// ConnectorStatus is the last known health of a connector
+type ConnectorStatus struct {
+	LastSuccess     time.Time `json:"lastSuccess"`
+	LastError       string    `json:"lastError,omitempty"`
+	LastErrorTime   time.Time `json:"lastErrorTime"`
+	LastReconcile   time.Time `json:"lastReconcile"`
+	ReconcileResult string    `json:"reconcileResult,omitempty"`
+}
+
+// queueData is the persisted state of the outbound queue
+type queueData struct {
+	NextID int                         `json:"nextId"`
+	Jobs   []Job                       `json:"jobs"`
+	Status map[string]*ConnectorStatus `json:"status"`
+}
+
+func readQueue(path string) (*queueData, error) {
+	d := &queueData{Status: map[string]*ConnectorStatus{}}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	} else if err != nil {
+		return d, err
+	}
+
+	if err := json.Unmarshal(b, d); err != nil {
+		return d, err
+	}
+	if d.Status == nil {
+		d.Status = map[string]*ConnectorStatus{}
+	}
+	return d, nil
+}
+
+// writeQueue replaces the queue file atomically so a crash never leaves a
+// partially written queue behind
+func writeQueue(path string, d *queueData) error {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
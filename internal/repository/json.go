@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/ghaggin/sso/internal/config"
 	"github.com/ghaggin/sso/internal/model"
@@ -17,13 +19,15 @@ var (
 )
 
 type Data struct {
-	Users []model.User `json:"users"`
+	Users  []model.User  `json:"users"`
+	Groups []model.Group `json:"groups"`
 }
 
 type jsonRepo struct {
 	path string
 	log  *zap.Logger
 
+	mu   sync.RWMutex
 	data *Data
 }
 
@@ -57,6 +61,8 @@ func NewJSON(p jsonParams) (Repository, error) {
 }
 
 func (r *jsonRepo) stop(_ context.Context) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.writefile()
 }
 
@@ -94,6 +100,9 @@ func (r *jsonRepo) writefile() error {
 }
 
 func (r *jsonRepo) GetUserByName(_ context.Context, name string) (*model.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	for _, u := range r.data.Users {
 		if u.Name == name {
 			return &u, nil
@@ -103,17 +112,171 @@ func (r *jsonRepo) GetUserByName(_ context.Context, name string) (*model.User, e
 	return nil, ErrNotFound
 }
 
+func (r *jsonRepo) GetUserByID(_ context.Context, id int) (*model.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, u := range r.data.Users {
+		if u.ID == id {
+			return &u, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
 func (r *jsonRepo) AddUser(_ context.Context, user *model.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	user.ID = 0
-	l := len(r.data.Users)
-	if l > 0 {
-		user.ID = r.data.Users[l-1].ID + 1
+	for _, u := range r.data.Users {
+		if u.Name == user.Name {
+			return ErrAlreadyExists
+		}
+		if u.ID >= user.ID {
+			user.ID = u.ID + 1
+		}
 	}
 
+	user.Created = time.Now().UTC()
+	user.Modified = user.Created
 	r.data.Users = append(r.data.Users, *user)
 	return nil
 }
 
+func (r *jsonRepo) UpdateUser(_ context.Context, user *model.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	idx := -1
+	for i, u := range r.data.Users {
+		if u.ID == user.ID {
+			idx = i
+		} else if u.Name == user.Name {
+			return ErrAlreadyExists
+		}
+	}
+	if idx < 0 {
+		return ErrNotFound
+	}
+
+	user.Created = r.data.Users[idx].Created
+	user.Modified = time.Now().UTC()
+	r.data.Users[idx] = *user
+	return nil
+}
+
+func (r *jsonRepo) DeleteUser(_ context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, u := range r.data.Users {
+		if u.ID != id {
+			continue
+		}
+
+		r.data.Users = append(r.data.Users[:i], r.data.Users[i+1:]...)
+
+		// drop memberships of the deleted user
+		for gi, g := range r.data.Groups {
+			members := []int{}
+			for _, m := range g.Members {
+				if m != id {
+					members = append(members, m)
+				}
+			}
+			r.data.Groups[gi].Members = members
+		}
+		return nil
+	}
+
+	return ErrNotFound
+}
+
 func (r *jsonRepo) GetUsers(_ context.Context) ([]model.User, error) {
-	return r.data.Users, nil
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]model.User, len(r.data.Users))
+	copy(users, r.data.Users)
+	return users, nil
+}
+
+func (r *jsonRepo) GetGroupByID(_ context.Context, id int) (*model.Group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, g := range r.data.Groups {
+		if g.ID == id {
+			return &g, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (r *jsonRepo) AddGroup(_ context.Context, group *model.Group) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	group.ID = 0
+	for _, g := range r.data.Groups {
+		if g.Name == group.Name {
+			return ErrAlreadyExists
+		}
+		if g.ID >= group.ID {
+			group.ID = g.ID + 1
+		}
+	}
+
+	group.Created = time.Now().UTC()
+	group.Modified = group.Created
+	r.data.Groups = append(r.data.Groups, *group)
+	return nil
+}
+
+func (r *jsonRepo) UpdateGroup(_ context.Context, group *model.Group) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	idx := -1
+	for i, g := range r.data.Groups {
+		if g.ID == group.ID {
+			idx = i
+		} else if g.Name == group.Name {
+			return ErrAlreadyExists
+		}
+	}
+	if idx < 0 {
+		return ErrNotFound
+	}
+
+	group.Created = r.data.Groups[idx].Created
+	group.Modified = time.Now().UTC()
+	r.data.Groups[idx] = *group
+	return nil
+}
+
+func (r *jsonRepo) DeleteGroup(_ context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, g := range r.data.Groups {
+		if g.ID == id {
+			r.data.Groups = append(r.data.Groups[:i], r.data.Groups[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (r *jsonRepo) GetGroups(_ context.Context) ([]model.Group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	groups := make([]model.Group, len(r.data.Groups))
+	copy(groups, r.data.Groups)
+	return groups, nil
 }
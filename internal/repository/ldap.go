@@ -0,0 +1,413 @@
+package repository
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var (
+	errNoCACerts = errors.New("no certificates found in ca_cert")
+)
+
+// ldapRepo reads users and groups from a directory. It is read only, users
+// are managed in the directory itself.
+type ldapRepo struct {
+	cfg  config.LDAP
+	log  *zap.Logger
+	tls  *tls.Config
+	pool chan *ldap.Conn
+}
+
+type ldapParams struct {
+	fx.In
+
+	LC     fx.Lifecycle
+	Config *config.Config
+	Log    *zap.Logger
+}
+
+func NewLDAP(p ldapParams) (Repository, error) {
+	u, err := url.Parse(p.Config.LDAP.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap url: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: p.Config.LDAP.InsecureSkipVerify,
+	}
+	if p.Config.LDAP.CACert != "" {
+		b, err := os.ReadFile(p.Config.LDAP.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errNoCACerts
+		}
+	}
+
+	r := &ldapRepo{
+		cfg:  p.Config.LDAP,
+		log:  p.Log,
+		tls:  tlsConfig,
+		pool: make(chan *ldap.Conn, p.Config.LDAP.PoolSize),
+	}
+
+	p.LC.Append(fx.Hook{
+		OnStop: r.stop,
+	})
+
+	return r, nil
+}
+
+func (r *ldapRepo) stop(_ context.Context) error {
+	for {
+		select {
+		case conn := <-r.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// dial opens a connection, upgrading it with StartTLS when configured
+func (r *ldapRepo) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(r.cfg.URL,
+		ldap.DialWithTLSConfig(r.tls),
+		ldap.DialWithDialer(&net.Dialer{Timeout: r.cfg.Timeout}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(r.cfg.Timeout)
+
+	if r.cfg.StartTLS && !strings.HasPrefix(strings.ToLower(r.cfg.URL), "ldaps://") {
+		if err := conn.StartTLS(r.tls); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// get returns a pooled connection bound as the service account
+func (r *ldapRepo) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-r.pool:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+		default:
+			conn, err := r.dial()
+			if err != nil {
+				return nil, err
+			}
+			if err := r.bindService(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+}
+
+// put returns a connection to the pool, closing it when the pool is full
+// or the connection failed
+func (r *ldapRepo) put(conn *ldap.Conn, err error) {
+	if err != nil && !ldap.IsErrorAnyOf(err, ldap.LDAPResultNoSuchObject) {
+		conn.Close()
+		return
+	}
+
+	select {
+	case r.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (r *ldapRepo) bindService(conn *ldap.Conn) error {
+	if r.cfg.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(r.cfg.BindDN, r.cfg.BindPassword)
+}
+
+func (r *ldapRepo) search(baseDN, filter string, attrs []string) ([]*ldap.Entry, error) {
+	conn, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, attrs, nil,
+	))
+	r.put(conn, err)
+	if ldap.IsErrorAnyOf(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Entries, nil
+}
+
+// Authenticate finds the user's dn with the service account and then
+// binds as the user. The connection is rebound as the service account
+// before it returns to the pool.
+func (r *ldapRepo) Authenticate(_ context.Context, username, password string) (bool, error) {
+	if password == "" {
+		// an empty password is an unauthenticated bind and always succeeds
+		return false, nil
+	}
+
+	entries, err := r.search(r.cfg.UserBaseDN, r.userFilter(r.cfg.LoginAttribute, username), []string{"dn"})
+	if err != nil {
+		return false, err
+	}
+	if len(entries) != 1 {
+		return false, nil
+	}
+
+	conn, err := r.get()
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.Bind(entries[0].DN, password)
+	if ldap.IsErrorAnyOf(err, ldap.LDAPResultInvalidCredentials) {
+		r.put(conn, r.bindService(conn))
+		return false, nil
+	} else if err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	r.put(conn, r.bindService(conn))
+	return true, nil
+}
+
+func (r *ldapRepo) userFilter(attr, value string) string {
+	return fmt.Sprintf("(&%s(%s=%s))", r.cfg.UserFilter, attr, ldap.EscapeFilter(value))
+}
+
+func (r *ldapRepo) userAttributes() []string {
+	attrs := []string{
+		r.cfg.LoginAttribute, r.cfg.IDAttribute, r.cfg.FirstAttribute,
+		r.cfg.LastAttribute, r.cfg.EmailAttribute, "createTimestamp", "modifyTimestamp",
+	}
+	for _, a := range r.cfg.AttributeMap {
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+func (r *ldapRepo) toUser(e *ldap.Entry) *model.User {
+	u := &model.User{
+		ID:       r.entryID(e),
+		Name:     e.GetAttributeValue(r.cfg.LoginAttribute),
+		First:    e.GetAttributeValue(r.cfg.FirstAttribute),
+		Last:     e.GetAttributeValue(r.cfg.LastAttribute),
+		Email:    e.GetAttributeValue(r.cfg.EmailAttribute),
+		Created:  generalizedTime(e.GetAttributeValue("createTimestamp")),
+		Modified: generalizedTime(e.GetAttributeValue("modifyTimestamp")),
+	}
+
+	for name, attr := range r.cfg.AttributeMap {
+		if values := e.GetAttributeValues(attr); len(values) > 0 {
+			if u.Attributes == nil {
+				u.Attributes = map[string][]string{}
+			}
+			u.Attributes[name] = values
+		}
+	}
+
+	return u
+}
+
+// entryID uses the id attribute when it holds a positive number and
+// otherwise derives a stable id from the dn
+func (r *ldapRepo) entryID(e *ldap.Entry) int {
+	if id, err := strconv.Atoi(e.GetAttributeValue(r.cfg.IDAttribute)); err == nil && id > 0 {
+		return id
+	}
+	return dnID(e.DN)
+}
+
+func dnID(dn string) int {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(dn)))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+func generalizedTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse("20060102150405Z0700", s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func (r *ldapRepo) GetUserByName(_ context.Context, name string) (*model.User, error) {
+	entries, err := r.search(r.cfg.UserBaseDN, r.userFilter(r.cfg.LoginAttribute, name), r.userAttributes())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, ErrNotFound
+	}
+	return r.toUser(entries[0]), nil
+}
+
+func (r *ldapRepo) GetUserByID(ctx context.Context, id int) (*model.User, error) {
+	entries, err := r.search(r.cfg.UserBaseDN, r.userFilter(r.cfg.IDAttribute, strconv.Itoa(id)), r.userAttributes())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 1 {
+		return r.toUser(entries[0]), nil
+	}
+
+	// ids derived from the dn can't be searched for
+	users, err := r.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if users[i].ID == id {
+			return &users[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *ldapRepo) GetUsers(_ context.Context) ([]model.User, error) {
+	entries, err := r.search(r.cfg.UserBaseDN, r.cfg.UserFilter, r.userAttributes())
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]model.User, 0, len(entries))
+	for _, e := range entries {
+		users = append(users, *r.toUser(e))
+	}
+	return users, nil
+}
+
+func (r *ldapRepo) GetGroupByID(ctx context.Context, id int) (*model.Group, error) {
+	groups, err := r.GetGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if groups[i].ID == id {
+			return &groups[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetGroups maps group member dns to user ids. Members that aren't users
+// matched by the user filter are dropped.
+func (r *ldapRepo) GetGroups(_ context.Context) ([]model.Group, error) {
+	entries, err := r.search(r.cfg.GroupBaseDN, r.cfg.GroupFilter,
+		[]string{r.cfg.GroupNameAttribute, r.cfg.GroupMemberAttribute, "createTimestamp", "modifyTimestamp"})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return []model.Group{}, nil
+	}
+
+	userEntries, err := r.search(r.cfg.UserBaseDN, r.cfg.UserFilter, []string{r.cfg.IDAttribute})
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]int{}
+	for _, e := range userEntries {
+		ids[normalizeDN(e.DN)] = r.entryID(e)
+	}
+
+	groups := make([]model.Group, 0, len(entries))
+	for _, e := range entries {
+		g := model.Group{
+			ID:       dnID(e.DN),
+			Name:     e.GetAttributeValue(r.cfg.GroupNameAttribute),
+			Members:  []int{},
+			Created:  generalizedTime(e.GetAttributeValue("createTimestamp")),
+			Modified: generalizedTime(e.GetAttributeValue("modifyTimestamp")),
+		}
+		for _, m := range e.GetAttributeValues(r.cfg.GroupMemberAttribute) {
+			if id, ok := ids[normalizeDN(m)]; ok {
+				g.Members = append(g.Members, id)
+			}
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+
+	var parts []string
+	for _, rdn := range parsed.RDNs {
+		for _, a := range rdn.Attributes {
+			parts = append(parts, strings.ToLower(a.Type)+"="+strings.ToLower(a.Value))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *ldapRepo) AddUser(_ context.Context, _ *model.User) error {
+	return ErrReadOnly
+}
+
+func (r *ldapRepo) UpdateUser(_ context.Context, _ *model.User) error {
+	return ErrReadOnly
+}
+
+func (r *ldapRepo) DeleteUser(_ context.Context, _ int) error {
+	return ErrReadOnly
+}
+
+func (r *ldapRepo) AddGroup(_ context.Context, _ *model.Group) error {
+	return ErrReadOnly
+}
+
+func (r *ldapRepo) UpdateGroup(_ context.Context, _ *model.Group) error {
+	return ErrReadOnly
+}
+
+func (r *ldapRepo) DeleteGroup(_ context.Context, _ int) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,315 @@
+package repository
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/ldapserver"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+)
+
+const (
+	testBaseDN      = "dc=example,dc=com"
+	testServiceDN   = "cn=sso,ou=services,dc=example,dc=com"
+	testServicePass = "service-secret"
+)
+
+// testDirectory is the directory the ldap repository is tested against:
+// two people, a service account, an entry the user filter leaves out and
+// two groups
+func testDirectory() *ldapserver.Directory {
+	return ldapserver.NewDirectory(
+		&ldapserver.Entry{
+			DN: testServiceDN,
+			Attributes: map[string][]string{
+				"objectClass":  {"applicationProcess"},
+				"cn":           {"sso"},
+				"userPassword": {testServicePass},
+			},
+		},
+		&ldapserver.Entry{
+			DN: "uid=alice,ou=people,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass":      {"inetOrgPerson"},
+				"uid":              {"alice"},
+				"uidNumber":        {"1001"},
+				"givenName":        {"Alice"},
+				"sn":               {"Liddell"},
+				"mail":             {"alice@example.com"},
+				"departmentNumber": {"Engineering", "Research"},
+				"createTimestamp":  {"20240102030405Z"},
+				"userPassword":     {"alice-password"},
+			},
+		},
+		&ldapserver.Entry{
+			// no uidNumber, the id comes from the dn
+			DN: "uid=bob,ou=people,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass":  {"inetOrgPerson"},
+				"uid":          {"bob"},
+				"givenName":    {"Bob"},
+				"sn":           {"Builder"},
+				"userPassword": {"bob-password"},
+			},
+		},
+		&ldapserver.Entry{
+			DN: "cn=printer,ou=people,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass":  {"device"},
+				"uid":          {"printer"},
+				"userPassword": {"printer-password"},
+			},
+		},
+		&ldapserver.Entry{
+			DN: "cn=staff,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass": {"groupOfNames"},
+				"cn":          {"staff"},
+				"member": {
+					"uid=alice,ou=people,dc=example,dc=com",
+					"UID=Bob, OU=People, DC=Example, DC=Com",
+					"cn=printer,ou=people,dc=example,dc=com",
+				},
+			},
+		},
+		&ldapserver.Entry{
+			DN: "cn=admins,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass": {"groupOfNames"},
+				"cn":          {"admins"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+			},
+		},
+	)
+}
+
+// startLDAP serves the directory on a local port, with StartTLS when
+// tlsConfig is set, and returns its url
+func startLDAP(t *testing.T, dir *ldapserver.Directory, tlsConfig *tls.Config) string {
+	t.Helper()
+	srv := &ldapserver.Server{Handler: dir, TLSConfig: tlsConfig, Log: zap.NewNop()}
+	addr, err := srv.Start("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	return "ldap://" + addr.String()
+}
+
+// testLDAPConfig is the repository config for testDirectory
+func testLDAPConfig(url string) config.LDAP {
+	return config.LDAP{
+		URL:                  url,
+		BindDN:               testServiceDN,
+		BindPassword:         testServicePass,
+		UserBaseDN:           "ou=people," + testBaseDN,
+		UserFilter:           "(objectClass=inetOrgPerson)",
+		LoginAttribute:       "uid",
+		IDAttribute:          "uidNumber",
+		FirstAttribute:       "givenName",
+		LastAttribute:        "sn",
+		EmailAttribute:       "mail",
+		GroupBaseDN:          "ou=groups," + testBaseDN,
+		GroupFilter:          "(objectClass=groupOfNames)",
+		GroupNameAttribute:   "cn",
+		GroupMemberAttribute: "member",
+		AttributeMap:         map[string]string{"department": "departmentNumber"},
+		PoolSize:             2,
+		Timeout:              5 * time.Second,
+	}
+}
+
+func newTestLDAP(t *testing.T, cfg config.LDAP) *ldapRepo {
+	t.Helper()
+	lc := fxtest.NewLifecycle(t)
+	repo, err := NewLDAP(ldapParams{
+		LC:     lc,
+		Config: &config.Config{LDAP: cfg},
+		Log:    zap.NewNop(),
+	})
+	require.NoError(t, err)
+	lc.RequireStart()
+	t.Cleanup(lc.RequireStop)
+	return repo.(*ldapRepo)
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	repo := newTestLDAP(t, testLDAPConfig(startLDAP(t, testDirectory(), nil)))
+	ctx := context.Background()
+
+	ok, err := repo.Authenticate(ctx, "alice", "alice-password")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	for name, password := range map[string]string{
+		"alice":   "wrong",
+		"bob":     "",
+		"nobody":  "alice-password",
+		"printer": "printer-password",
+		"*":       "alice-password",
+	} {
+		ok, err := repo.Authenticate(ctx, name, password)
+		require.NoError(t, err, name)
+		require.False(t, ok, name)
+	}
+
+	// the pooled connection went back to the service account after the
+	// user's bind
+	ok, err = repo.Authenticate(ctx, "bob", "bob-password")
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = repo.GetUsers(ctx)
+	require.NoError(t, err)
+}
+
+func TestLDAPServiceAccount(t *testing.T) {
+	cfg := testLDAPConfig(startLDAP(t, testDirectory(), nil))
+	cfg.BindPassword = "wrong"
+	repo := newTestLDAP(t, cfg)
+
+	_, err := repo.GetUsers(context.Background())
+	require.Error(t, err)
+}
+
+func TestLDAPUsers(t *testing.T) {
+	repo := newTestLDAP(t, testLDAPConfig(startLDAP(t, testDirectory(), nil)))
+	ctx := context.Background()
+
+	alice, err := repo.GetUserByName(ctx, "alice")
+	require.NoError(t, err)
+	require.Equal(t, 1001, alice.ID)
+	require.Equal(t, "Alice", alice.First)
+	require.Equal(t, "Liddell", alice.Last)
+	require.Equal(t, "alice@example.com", alice.Email)
+	require.Equal(t, []string{"Engineering", "Research"}, alice.Attributes["department"])
+	require.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), alice.Created.UTC())
+	require.Empty(t, alice.Password)
+
+	bob, err := repo.GetUserByName(ctx, "bob")
+	require.NoError(t, err)
+	require.Equal(t, dnID("uid=bob,ou=people,dc=example,dc=com"), bob.ID)
+
+	byID, err := repo.GetUserByID(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Equal(t, "alice", byID.Name)
+	byID, err = repo.GetUserByID(ctx, bob.ID)
+	require.NoError(t, err)
+	require.Equal(t, "bob", byID.Name)
+
+	_, err = repo.GetUserByName(ctx, "printer")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = repo.GetUserByID(ctx, 42)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	users, err := repo.GetUsers(ctx)
+	require.NoError(t, err)
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	slices.Sort(names)
+	require.Equal(t, []string{"alice", "bob"}, names)
+
+	require.ErrorIs(t, repo.AddUser(ctx, &model.User{Name: "carol"}), ErrReadOnly)
+	require.ErrorIs(t, repo.DeleteUser(ctx, alice.ID), ErrReadOnly)
+}
+
+func TestLDAPGroups(t *testing.T) {
+	repo := newTestLDAP(t, testLDAPConfig(startLDAP(t, testDirectory(), nil)))
+	ctx := context.Background()
+
+	alice, err := repo.GetUserByName(ctx, "alice")
+	require.NoError(t, err)
+	bob, err := repo.GetUserByName(ctx, "bob")
+	require.NoError(t, err)
+
+	groups, err := repo.GetGroups(ctx)
+	require.NoError(t, err)
+	members := map[string][]int{}
+	for _, g := range groups {
+		members[g.Name] = g.Members
+	}
+	// dns are compared normalised, and the printer isn't a user
+	require.Equal(t, map[string][]int{
+		"staff":  {alice.ID, bob.ID},
+		"admins": {alice.ID},
+	}, members)
+
+	staff, err := repo.GetGroupByID(ctx, dnID("cn=staff,ou=groups,dc=example,dc=com"))
+	require.NoError(t, err)
+	require.Equal(t, "staff", staff.Name)
+	_, err = repo.GetGroupByID(ctx, 42)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	tlsURL := startLDAP(t, testDirectory(), &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	cfg := testLDAPConfig(tlsURL)
+	cfg.StartTLS = true
+	cfg.CACert = caFile
+	repo := newTestLDAP(t, cfg)
+	ok, err := repo.Authenticate(context.Background(), "alice", "alice-password")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// the certificate isn't trusted without the ca
+	cfg.CACert = ""
+	repo = newTestLDAP(t, cfg)
+	_, err = repo.Authenticate(context.Background(), "alice", "alice-password")
+	require.Error(t, err)
+
+	// a server without tls refuses StartTLS rather than carrying on in
+	// the clear
+	cfg = testLDAPConfig(startLDAP(t, testDirectory(), nil))
+	cfg.StartTLS = true
+	cfg.CACert = caFile
+	repo = newTestLDAP(t, cfg)
+	_, err = repo.Authenticate(context.Background(), "alice", "alice-password")
+	require.Error(t, err)
+}
+
+// testCertificate makes a self signed certificate for 127.0.0.1 and writes
+// it to a pem file for config.LDAP.CACert
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
@@ -3,16 +3,58 @@ package repository
 import (
 	"context"
 	"errors"
+	"fmt"
 
+	"github.com/ghaggin/sso/internal/config"
 	"github.com/ghaggin/sso/internal/model"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrReadOnly is returned by writes to a repository whose users are
+	// managed elsewhere
+	ErrReadOnly = errors.New("repository is read only")
 )
 
 type Repository interface {
 	GetUserByName(ctx context.Context, name string) (*model.User, error)
+	GetUserByID(ctx context.Context, id int) (*model.User, error)
 	AddUser(ctx context.Context, user *model.User) error
+	UpdateUser(ctx context.Context, user *model.User) error
+	DeleteUser(ctx context.Context, id int) error
 	GetUsers(ctx context.Context) ([]model.User, error)
+
+	GetGroupByID(ctx context.Context, id int) (*model.Group, error)
+	AddGroup(ctx context.Context, group *model.Group) error
+	UpdateGroup(ctx context.Context, group *model.Group) error
+	DeleteGroup(ctx context.Context, id int) error
+	GetGroups(ctx context.Context) ([]model.Group, error)
+}
+
+// Authenticator is implemented by repositories that validate passwords
+// themselves instead of storing them on the user
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (bool, error)
+}
+
+type Params struct {
+	fx.In
+
+	LC     fx.Lifecycle
+	Config *config.Config
+	Log    *zap.Logger
+}
+
+// New returns the repository selected by the config
+func New(p Params) (Repository, error) {
+	switch p.Config.Repository {
+	case config.RepositoryJSON:
+		return NewJSON(jsonParams{LC: p.LC, Config: p.Config, Log: p.Log})
+	case config.RepositoryLDAP:
+		return NewLDAP(ldapParams{LC: p.LC, Config: p.Config, Log: p.Log})
+	}
+	return nil, fmt.Errorf("unknown repository %q", p.Config.Repository)
 }
@@ -0,0 +1,183 @@
+// Package samldebug decodes, summarises and checks saml protocol messages
+// for debugging integrations, from the command line and /debug/saml
+package samldebug
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+)
+
+// maxInflated bounds a deflated redirect binding message
+const maxInflated = 1 << 20
+
+// Message is a decoded saml message
+type Message struct {
+	// Binding is the redirect or post binding the message was sent with,
+	// empty when the xml was given as it is
+	Binding string
+	// Param is SAMLRequest or SAMLResponse when the message came as a
+	// query string or form
+	Param      string
+	RelayState string
+	// SigAlg and Signature sign a redirect binding message's query string
+	SigAlg    string
+	Signature string
+	// signedQuery is the part of the query the redirect signature covers,
+	// as it was encoded when it was sent
+	signedQuery string
+
+	XML []byte
+	doc *etree.Document
+}
+
+// Decode accepts a message as raw xml, as the base64 value of a post form
+// or redirect url, url escaped or not, or as a whole query string, form
+// body or redirect url carrying SAMLRequest or SAMLResponse
+func Decode(input string) (*Message, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil, errors.New("nothing to decode")
+	}
+
+	m := &Message{}
+	value := input
+	if strings.HasPrefix(input, "<") {
+		m.XML = []byte(input)
+		return m, m.parse()
+	}
+
+	if strings.Contains(input, "SAMLRequest=") || strings.Contains(input, "SAMLResponse=") {
+		query := input
+		if i := strings.Index(query, "?"); i >= 0 {
+			query = query[i+1:]
+		}
+		if i := strings.Index(query, "#"); i >= 0 {
+			query = query[:i]
+		}
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("parsing query: %w", err)
+		}
+
+		m.Param = "SAMLRequest"
+		if values.Has("SAMLResponse") {
+			m.Param = "SAMLResponse"
+		}
+		value = values.Get(m.Param)
+		m.RelayState = values.Get("RelayState")
+		m.SigAlg = values.Get("SigAlg")
+		m.Signature = values.Get("Signature")
+		m.signedQuery = signedQuery(query, m.Param)
+	} else if strings.Contains(input, "%") {
+		unescaped, err := url.QueryUnescape(input)
+		if err != nil {
+			return nil, fmt.Errorf("url decoding: %w", err)
+		}
+		value = unescaped
+	}
+
+	raw, err := decodeBase64(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("<")) {
+		m.Binding = saml.HTTPPostBinding
+		m.XML = raw
+	} else {
+		m.Binding = saml.HTTPRedirectBinding
+		if m.XML, err = inflate(raw); err != nil {
+			return nil, fmt.Errorf("neither xml nor deflated xml: %w", err)
+		}
+	}
+	return m, m.parse()
+}
+
+// decodeBase64 tolerates the line breaks and missing padding messages pick
+// up when they are copied around
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawStdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decoding: %w", err)
+	}
+	return b, nil
+}
+
+func inflate(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxInflated+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxInflated {
+		return nil, errors.New("inflated message is too large")
+	}
+	return out, nil
+}
+
+// signedQuery rebuilds the octets a redirect binding signature covers from
+// the query as it was received, the values must not be re-encoded
+func signedQuery(query, param string) string {
+	parts := map[string]string{}
+	for _, part := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(part, "=")
+		if _, ok := parts[name]; !ok {
+			parts[name] = part
+		}
+	}
+
+	var signed []string
+	for _, name := range []string{param, "RelayState", "SigAlg"} {
+		if part, ok := parts[name]; ok {
+			signed = append(signed, part)
+		}
+	}
+	return strings.Join(signed, "&")
+}
+
+func (m *Message) parse() error {
+	if err := xrv.Validate(bytes.NewReader(m.XML)); err != nil {
+		return fmt.Errorf("xml does not round trip, it may have been tampered with: %w", err)
+	}
+
+	m.doc = etree.NewDocument()
+	if err := m.doc.ReadFromBytes(m.XML); err != nil {
+		return fmt.Errorf("parsing xml: %w", err)
+	}
+	if m.doc.Root() == nil {
+		return errors.New("no xml element")
+	}
+	return nil
+}
+
+// Type is the message's root element, such as Response or AuthnRequest
+func (m *Message) Type() string {
+	return m.doc.Root().Tag
+}
+
+// Pretty is the xml indented for reading, it is not what was signed
+func (m *Message) Pretty() string {
+	doc := m.doc.Copy()
+	doc.Indent(2)
+	s, err := doc.WriteToString()
+	if err != nil {
+		return string(m.XML)
+	}
+	return s
+}
@@ -0,0 +1,102 @@
+package samldebug
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"net/http"
+	"strings"
+
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/template"
+	"go.uber.org/zap"
+)
+
+// Defaults fill in what the /debug/saml form leaves empty, they are the
+// checks the server serving the page would make itself
+type Defaults struct {
+	Certs       []*x509.Certificate
+	Key         *rsa.PrivateKey
+	Audience    string
+	Destination string
+}
+
+type pageData struct {
+	model.BaseData
+	Message     string
+	Cert        string
+	Audience    string
+	Destination string
+	RequestID   string
+
+	Decoded bool
+	Type    string
+	Binding string
+	XML     string
+	Fields  []Field
+	Checks  []Check
+	Error   string
+}
+
+// Handler serves /debug/saml, a form a message is pasted into to have it
+// decoded, inspected and verified
+func Handler(log *zap.Logger, defaults Defaults) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := &pageData{
+			BaseData: model.BaseData{
+				PageTitle: "SAML debugger",
+			},
+			Audience:    defaults.Audience,
+			Destination: defaults.Destination,
+		}
+
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data.Message = r.Form.Get("message")
+			data.Cert = r.Form.Get("cert")
+			data.Audience = strings.TrimSpace(r.Form.Get("audience"))
+			data.Destination = strings.TrimSpace(r.Form.Get("destination"))
+			data.RequestID = strings.TrimSpace(r.Form.Get("request_id"))
+			data.debug(defaults)
+		}
+
+		if err := template.Render(w, r, "debug_saml.html", data); err != nil {
+			log.Error("error rendering debug_saml.html", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func (d *pageData) debug(defaults Defaults) {
+	m, err := Decode(d.Message)
+	if err != nil {
+		d.Error = err.Error()
+		return
+	}
+	d.Decoded = true
+	d.Type = m.Type()
+	d.Binding = m.Binding
+	d.XML = m.Pretty()
+
+	certs := defaults.Certs
+	if strings.TrimSpace(d.Cert) != "" {
+		if certs, err = ParseCertificates([]byte(d.Cert)); err != nil {
+			d.Error = "certificate: " + err.Error()
+			return
+		}
+	}
+
+	if d.Fields, err = m.Inspect(defaults.Key); err != nil {
+		d.Error = err.Error()
+		return
+	}
+	d.Checks = m.Verify(Options{
+		Certs:       certs,
+		Key:         defaults.Key,
+		Audience:    d.Audience,
+		Destination: d.Destination,
+		RequestID:   d.RequestID,
+	})
+}
@@ -0,0 +1,354 @@
+package samldebug
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// Field is a labelled part of a message, in document order
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Inspect lists the parts of the message that matter when a login fails.
+// An encrypted assertion is shown decrypted when key is given.
+func (m *Message) Inspect(key *rsa.PrivateKey) ([]Field, error) {
+	root := m.doc.Root()
+	f := &fields{}
+	f.add("Type", root.Tag)
+	f.add("Binding", m.Binding)
+	f.add("RelayState", m.RelayState)
+	if m.Signature != "" {
+		f.add("Query signature", m.SigAlg)
+	}
+
+	switch root.Tag {
+	case "Response":
+		resp := &saml.Response{}
+		if err := m.unmarshal(root, resp); err != nil {
+			return nil, err
+		}
+		f.add("ID", resp.ID)
+		f.time("IssueInstant", resp.IssueInstant)
+		f.add("Destination", resp.Destination)
+		f.add("InResponseTo", resp.InResponseTo)
+		f.issuer(resp.Issuer)
+		f.add("Status", status(resp.Status))
+		f.add("Signature", signatureSummary(root))
+
+		assertion, el, err := m.assertion(key)
+		if errors.Is(err, errEncrypted) {
+			f.add("Assertion", "encrypted, a key is needed to decrypt it")
+		} else if err != nil {
+			return nil, err
+		} else if assertion != nil {
+			if resp.EncryptedAssertion != nil {
+				f.add("Assertion", "encrypted, shown decrypted")
+			}
+			f.assertion(assertion, el)
+		}
+	case "Assertion":
+		assertion, el, err := m.assertion(key)
+		if err != nil {
+			return nil, err
+		}
+		f.assertion(assertion, el)
+	case "AuthnRequest":
+		req := &saml.AuthnRequest{}
+		if err := m.unmarshal(root, req); err != nil {
+			return nil, err
+		}
+		f.add("ID", req.ID)
+		f.time("IssueInstant", req.IssueInstant)
+		f.add("Destination", req.Destination)
+		f.issuer(req.Issuer)
+		f.add("AssertionConsumerServiceURL", req.AssertionConsumerServiceURL)
+		f.add("ProtocolBinding", req.ProtocolBinding)
+		if req.ForceAuthn != nil {
+			f.add("ForceAuthn", fmt.Sprint(*req.ForceAuthn))
+		}
+		if req.IsPassive != nil {
+			f.add("IsPassive", fmt.Sprint(*req.IsPassive))
+		}
+		if p := req.NameIDPolicy; p != nil {
+			if p.Format != nil {
+				f.add("NameIDPolicy Format", *p.Format)
+			}
+			if p.AllowCreate != nil {
+				f.add("NameIDPolicy AllowCreate", fmt.Sprint(*p.AllowCreate))
+			}
+		}
+		if c := req.RequestedAuthnContext; c != nil {
+			f.add("RequestedAuthnContext", strings.TrimSpace(c.Comparison+" "+c.AuthnContextClassRef))
+		}
+		f.add("Signature", signatureSummary(root))
+	case "LogoutRequest":
+		req := &saml.LogoutRequest{}
+		if err := m.unmarshal(root, req); err != nil {
+			return nil, err
+		}
+		f.add("ID", req.ID)
+		f.time("IssueInstant", req.IssueInstant)
+		f.add("Destination", req.Destination)
+		f.issuer(req.Issuer)
+		if req.NameID != nil {
+			f.add("NameID", req.NameID.Value)
+		}
+		if req.SessionIndex != nil {
+			f.add("SessionIndex", req.SessionIndex.Value)
+		}
+		f.add("Signature", signatureSummary(root))
+	case "LogoutResponse":
+		resp := &saml.LogoutResponse{}
+		if err := m.unmarshal(root, resp); err != nil {
+			return nil, err
+		}
+		f.add("ID", resp.ID)
+		f.time("IssueInstant", resp.IssueInstant)
+		f.add("Destination", resp.Destination)
+		f.add("InResponseTo", resp.InResponseTo)
+		f.issuer(resp.Issuer)
+		f.add("Status", status(resp.Status))
+		f.add("Signature", signatureSummary(root))
+	default:
+		return nil, fmt.Errorf("%s is not a saml message this can inspect", root.Tag)
+	}
+	return f.list, nil
+}
+
+type fields struct {
+	list []Field
+}
+
+// add skips empty values, optional parts of a message are left out
+func (f *fields) add(name, value string) {
+	if value != "" {
+		f.list = append(f.list, Field{Name: name, Value: value})
+	}
+}
+
+func (f *fields) time(name string, t time.Time) {
+	if !t.IsZero() {
+		f.add(name, t.UTC().Format(time.RFC3339))
+	}
+}
+
+func (f *fields) timePtr(name string, t *time.Time) {
+	if t != nil {
+		f.time(name, *t)
+	}
+}
+
+func (f *fields) issuer(issuer *saml.Issuer) {
+	if issuer != nil {
+		f.add("Issuer", issuer.Value)
+	}
+}
+
+func (f *fields) assertion(a *saml.Assertion, el *etree.Element) {
+	f.add("Assertion ID", a.ID)
+	f.time("Assertion IssueInstant", a.IssueInstant)
+	f.add("Assertion Issuer", a.Issuer.Value)
+	f.add("Assertion Signature", signatureSummary(el))
+
+	if s := a.Subject; s != nil {
+		if s.NameID != nil {
+			f.add("Subject NameID", s.NameID.Value)
+			f.add("Subject NameID Format", s.NameID.Format)
+		}
+		for _, c := range s.SubjectConfirmations {
+			f.add("SubjectConfirmation Method", c.Method)
+			if d := c.SubjectConfirmationData; d != nil {
+				f.add("SubjectConfirmation Recipient", d.Recipient)
+				f.add("SubjectConfirmation InResponseTo", d.InResponseTo)
+				f.time("SubjectConfirmation NotOnOrAfter", d.NotOnOrAfter)
+			}
+		}
+	}
+
+	if c := a.Conditions; c != nil {
+		f.time("Conditions NotBefore", c.NotBefore)
+		f.time("Conditions NotOnOrAfter", c.NotOnOrAfter)
+		for _, r := range c.AudienceRestrictions {
+			f.add("Audience", r.Audience.Value)
+		}
+	}
+
+	for _, s := range a.AuthnStatements {
+		f.time("AuthnInstant", s.AuthnInstant)
+		f.add("SessionIndex", s.SessionIndex)
+		f.timePtr("SessionNotOnOrAfter", s.SessionNotOnOrAfter)
+		if s.AuthnContext.AuthnContextClassRef != nil {
+			f.add("AuthnContextClassRef", s.AuthnContext.AuthnContextClassRef.Value)
+		}
+	}
+
+	for _, s := range a.AttributeStatements {
+		for _, attr := range s.Attributes {
+			name := "Attribute " + attr.Name
+			if attr.FriendlyName != "" && attr.FriendlyName != attr.Name {
+				name += " (" + attr.FriendlyName + ")"
+			}
+			values := make([]string, 0, len(attr.Values))
+			for _, v := range attr.Values {
+				values = append(values, v.Value)
+			}
+			f.list = append(f.list, Field{Name: name, Value: strings.Join(values, ", ")})
+		}
+	}
+}
+
+func status(s saml.Status) string {
+	value := strings.TrimPrefix(s.StatusCode.Value, "urn:oasis:names:tc:SAML:2.0:status:")
+	if s.StatusCode.StatusCode != nil {
+		value += " / " + strings.TrimPrefix(s.StatusCode.StatusCode.Value, "urn:oasis:names:tc:SAML:2.0:status:")
+	}
+	if s.StatusMessage != nil && s.StatusMessage.Value != "" {
+		value += ": " + s.StatusMessage.Value
+	}
+	return value
+}
+
+// errEncrypted is returned for an encrypted assertion without a key
+var errEncrypted = errors.New("assertion is encrypted")
+
+// assertion returns the message's assertion, decrypting it with key when
+// it is encrypted. Both are nil for a response without an assertion, such
+// as a failed login.
+func (m *Message) assertion(key *rsa.PrivateKey) (*saml.Assertion, *etree.Element, error) {
+	root := m.doc.Root()
+	el := root
+	if root.Tag != "Assertion" {
+		el = root.FindElement("./Assertion")
+	}
+
+	if el == nil {
+		encrypted := root.FindElement("./EncryptedAssertion")
+		if encrypted == nil {
+			return nil, nil, nil
+		}
+		if key == nil {
+			return nil, nil, errEncrypted
+		}
+		var err error
+		if el, err = decrypt(encrypted, key); err != nil {
+			return nil, nil, fmt.Errorf("decrypting assertion: %w", err)
+		}
+	}
+
+	assertion := &saml.Assertion{}
+	if err := m.unmarshal(el, assertion); err != nil {
+		return nil, nil, err
+	}
+	return assertion, el, nil
+}
+
+// decrypt returns the element encrypted in el, as saml.ServiceProvider
+// decrypts assertions
+func decrypt(el *etree.Element, key *rsa.PrivateKey) (*etree.Element, error) {
+	data := el.FindElement("./EncryptedData")
+	if data == nil {
+		return nil, errors.New("no EncryptedData")
+	}
+
+	var dataKey any = key
+	if keyEl := el.FindElement("./EncryptedKey"); keyEl != nil {
+		var err error
+		if dataKey, err = xmlenc.Decrypt(key, keyEl); err != nil {
+			return nil, fmt.Errorf("decrypting the key, it was probably encrypted for another sp: %w", err)
+		}
+	}
+
+	plaintext, err := xmlenc.Decrypt(dataKey, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := xrv.Validate(bytes.NewReader(plaintext)); err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(plaintext); err != nil {
+		return nil, err
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("nothing was encrypted")
+	}
+	return doc.Root(), nil
+}
+
+// detach copies el with the namespaces it inherits declared on it, so it
+// can be unmarshalled or verified on its own
+func detach(el *etree.Element) (*etree.Element, error) {
+	ctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil, err
+	}
+	if ctx, err = ctx.SubContext(el); err != nil {
+		return nil, err
+	}
+	return etreeutils.NSDetatch(ctx, el)
+}
+
+func (m *Message) unmarshal(el *etree.Element, v any) error {
+	detached, err := detach(el)
+	if err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(detached)
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", el.Tag, err)
+	}
+	return nil
+}
+
+// signatureOf is the enveloped signature of el, if it has one
+func signatureOf(el *etree.Element) *etree.Element {
+	for _, child := range el.ChildElements() {
+		if child.Tag == "Signature" && child.NamespaceURI() == "http://www.w3.org/2000/09/xmldsig#" {
+			return child
+		}
+	}
+	return nil
+}
+
+func signatureSummary(el *etree.Element) string {
+	sig := signatureOf(el)
+	if sig == nil {
+		return "not signed"
+	}
+
+	summary := "signed"
+	if method := sig.FindElement("./SignedInfo/SignatureMethod"); method != nil {
+		summary += " with " + algorithmName(method.SelectAttrValue("Algorithm", ""))
+	}
+	if ref := sig.FindElement("./SignedInfo/Reference"); ref != nil {
+		summary += ", reference " + ref.SelectAttrValue("URI", `""`)
+	}
+	return summary
+}
+
+// algorithmName shortens an xmldsig algorithm uri to its fragment, such as
+// rsa-sha256
+func algorithmName(uri string) string {
+	if i := strings.LastIndex(uri, "#"); i >= 0 {
+		return uri[i+1:]
+	}
+	return uri
+}
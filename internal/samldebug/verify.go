@@ -0,0 +1,526 @@
+package samldebug
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// Check is the outcome of one of the checks a service provider makes
+// before accepting a message, Detail explains a failure
+type Check struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// Options are what the message is checked against, checks whose
+// expectation is empty are skipped
+type Options struct {
+	// Certs are the signer's certificates, usually from its metadata
+	Certs []*x509.Certificate
+	// Key decrypts encrypted assertions
+	Key *rsa.PrivateKey
+	// Audience is the sp's entity id
+	Audience string
+	// Destination is the url the message was sent to, the sp's acs url
+	// for a response
+	Destination string
+	// RequestID is the id of the AuthnRequest a response answers
+	RequestID string
+	// Now is when the message was received, the current time when zero
+	Now time.Time
+}
+
+type checks struct {
+	list []Check
+}
+
+func (c *checks) ok(name, format string, args ...any) {
+	c.list = append(c.list, Check{Name: name, Status: CheckOK, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *checks) fail(name, format string, args ...any) {
+	c.list = append(c.list, Check{Name: name, Status: CheckFailed, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *checks) skip(name, format string, args ...any) {
+	c.list = append(c.list, Check{Name: name, Status: CheckSkipped, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Failed is true when any check failed
+func Failed(list []Check) bool {
+	for _, c := range list {
+		if c.Status == CheckFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify makes the checks crewjam/saml makes before accepting the message
+// and explains the ones that fail
+func (m *Message) Verify(opts Options) []Check {
+	if opts.Now.IsZero() {
+		opts.Now = saml.TimeNow()
+	}
+
+	c := &checks{}
+	root := m.doc.Root()
+	switch root.Tag {
+	case "Response":
+		m.verifyResponse(c, opts)
+	case "Assertion":
+		assertion, el, err := m.assertion(nil)
+		if err != nil {
+			c.fail("Assertion", "%v", err)
+			break
+		}
+		verifyAssertion(c, assertion, opts)
+		if signatureOf(el) != nil {
+			verifySignature(c, "Assertion signature", el, opts)
+		} else {
+			c.fail("Signed", "the assertion isn't signed")
+		}
+	case "AuthnRequest", "LogoutRequest", "LogoutResponse":
+		m.verifyProtocolMessage(c, opts)
+	default:
+		c.fail("Type", "%s is not a saml message this can verify", root.Tag)
+	}
+
+	if m.Signature != "" {
+		m.verifyQuerySignature(c, opts)
+	}
+	return c.list
+}
+
+func (m *Message) verifyResponse(c *checks, opts Options) {
+	root := m.doc.Root()
+	resp := &saml.Response{}
+	if err := m.unmarshal(root, resp); err != nil {
+		c.fail("Response", "%v", err)
+		return
+	}
+
+	if code := resp.Status.StatusCode.Value; code == saml.StatusSuccess {
+		c.ok("Status", "Success")
+	} else {
+		c.fail("Status", "the idp refused the login: %s", status(resp.Status))
+	}
+
+	verifyDestination(c, "Destination", resp.Destination, opts)
+	verifyIssueInstant(c, "IssueInstant", resp.IssueInstant, opts)
+
+	responseSigned := signatureOf(root) != nil
+	if responseSigned {
+		verifySignature(c, "Response signature", root, opts)
+	}
+
+	assertion, el, err := m.assertion(opts.Key)
+	if errors.Is(err, errEncrypted) {
+		c.skip("Assertion", "the assertion is encrypted and there is no key to decrypt it")
+		return
+	} else if err != nil {
+		c.fail("Assertion", "%v", err)
+		return
+	} else if assertion == nil {
+		c.fail("Assertion", "the response has no assertion")
+		return
+	}
+
+	assertionSigned := signatureOf(el) != nil
+	if assertionSigned {
+		verifySignature(c, "Assertion signature", el, opts)
+	}
+	if !responseSigned && !assertionSigned {
+		c.fail("Signed", "neither the response nor the assertion is signed, one of them must be")
+	}
+
+	// the response and its assertion must answer the same request
+	if d := subjectConfirmationData(assertion); d != nil && d.InResponseTo != resp.InResponseTo {
+		c.fail("InResponseTo", "the response answers %q but its assertion answers %q", resp.InResponseTo, d.InResponseTo)
+	} else {
+		verifyInResponseTo(c, resp.InResponseTo, opts)
+	}
+
+	verifyAssertion(c, assertion, opts)
+}
+
+// verifyAssertion checks the parts of the assertion a service provider
+// checks, the signature is checked by the caller
+func verifyAssertion(c *checks, a *saml.Assertion, opts Options) {
+	verifyIssueInstant(c, "Assertion IssueInstant", a.IssueInstant, opts)
+
+	if d := subjectConfirmationData(a); d == nil {
+		c.fail("SubjectConfirmation", "the assertion has no bearer SubjectConfirmationData")
+	} else {
+		verifyDestination(c, "Recipient", d.Recipient, opts)
+		verifyNotOnOrAfter(c, "SubjectConfirmation NotOnOrAfter", d.NotOnOrAfter, opts)
+	}
+
+	if a.Conditions == nil {
+		c.skip("Conditions", "the assertion has no Conditions")
+		return
+	}
+	verifyNotBefore(c, "Conditions NotBefore", a.Conditions.NotBefore, opts)
+	verifyNotOnOrAfter(c, "Conditions NotOnOrAfter", a.Conditions.NotOnOrAfter, opts)
+
+	var audiences []string
+	for _, r := range a.Conditions.AudienceRestrictions {
+		audiences = append(audiences, r.Audience.Value)
+	}
+	switch {
+	case len(audiences) == 0:
+		c.ok("Audience", "the assertion isn't restricted to an audience")
+	case opts.Audience == "":
+		c.skip("Audience", "no audience given, the assertion is for %s", strings.Join(audiences, ", "))
+	default:
+		for _, audience := range audiences {
+			if audience != opts.Audience {
+				c.fail("Audience", "the assertion is for %q, not %q, the idp has the sp registered under another entity id", audience, opts.Audience)
+				return
+			}
+		}
+		c.ok("Audience", "%s", opts.Audience)
+	}
+}
+
+// verifyProtocolMessage checks a request, or a logout response, as the
+// party it was sent to would
+func (m *Message) verifyProtocolMessage(c *checks, opts Options) {
+	root := m.doc.Root()
+	var destination, inResponseTo string
+	var issueInstant time.Time
+	switch root.Tag {
+	case "AuthnRequest":
+		req := &saml.AuthnRequest{}
+		if err := m.unmarshal(root, req); err != nil {
+			c.fail(root.Tag, "%v", err)
+			return
+		}
+		destination, issueInstant = req.Destination, req.IssueInstant
+	case "LogoutRequest":
+		req := &saml.LogoutRequest{}
+		if err := m.unmarshal(root, req); err != nil {
+			c.fail(root.Tag, "%v", err)
+			return
+		}
+		destination, issueInstant = req.Destination, req.IssueInstant
+	case "LogoutResponse":
+		resp := &saml.LogoutResponse{}
+		if err := m.unmarshal(root, resp); err != nil {
+			c.fail(root.Tag, "%v", err)
+			return
+		}
+		destination, issueInstant, inResponseTo = resp.Destination, resp.IssueInstant, resp.InResponseTo
+		if resp.Status.StatusCode.Value == saml.StatusSuccess {
+			c.ok("Status", "Success")
+		} else {
+			c.fail("Status", "logout failed: %s", status(resp.Status))
+		}
+	}
+
+	verifyDestination(c, "Destination", destination, opts)
+	verifyIssueInstant(c, "IssueInstant", issueInstant, opts)
+	if root.Tag == "LogoutResponse" {
+		verifyInResponseTo(c, inResponseTo, opts)
+	}
+
+	if signatureOf(root) != nil {
+		verifySignature(c, "Signature", root, opts)
+	} else if m.Signature == "" {
+		c.skip("Signature", "the message isn't signed")
+	}
+}
+
+func subjectConfirmationData(a *saml.Assertion) *saml.SubjectConfirmationData {
+	if a.Subject == nil {
+		return nil
+	}
+	for _, sc := range a.Subject.SubjectConfirmations {
+		if sc.Method == "urn:oasis:names:tc:SAML:2.0:cm:bearer" && sc.SubjectConfirmationData != nil {
+			return sc.SubjectConfirmationData
+		}
+	}
+	return nil
+}
+
+func verifyDestination(c *checks, name, destination string, opts Options) {
+	switch {
+	case opts.Destination == "":
+		c.skip(name, "no destination given, the message is for %q", destination)
+	case destination == "" && name == "Destination":
+		c.ok(name, "not set, only signed messages must name their destination")
+	case destination != opts.Destination:
+		c.fail(name, "the message is for %q, not %q, check the acs url the idp has in the sp's metadata", destination, opts.Destination)
+	default:
+		c.ok(name, "%s", destination)
+	}
+}
+
+func verifyInResponseTo(c *checks, inResponseTo string, opts Options) {
+	switch {
+	case inResponseTo == "" && opts.RequestID != "":
+		c.fail("InResponseTo", "unsolicited, it doesn't answer %q, the idp lost the request or the login was started at the idp", opts.RequestID)
+	case inResponseTo == "":
+		c.ok("InResponseTo", "unsolicited, the sp must allow idp initiated login")
+	case opts.RequestID == "":
+		c.skip("InResponseTo", "no request id given, the message answers %s", inResponseTo)
+	case inResponseTo != opts.RequestID:
+		c.fail("InResponseTo", "the message answers %q, not %q, the request the sp tracked expired or belongs to another browser", inResponseTo, opts.RequestID)
+	default:
+		c.ok("InResponseTo", "%s", inResponseTo)
+	}
+}
+
+func verifyIssueInstant(c *checks, name string, issued time.Time, opts Options) {
+	switch {
+	case issued.IsZero():
+		c.fail(name, "missing")
+	case issued.After(opts.Now.Add(saml.MaxClockSkew)):
+		c.fail(name, "issued %s in the future, the idp's clock is ahead", issued.Sub(opts.Now).Round(time.Second))
+	case opts.Now.After(issued.Add(saml.MaxIssueDelay)):
+		c.fail(name, "issued %s ago, messages expire after %s", opts.Now.Sub(issued).Round(time.Second), saml.MaxIssueDelay)
+	default:
+		c.ok(name, "%s", issued.UTC().Format(time.RFC3339))
+	}
+}
+
+func verifyNotBefore(c *checks, name string, notBefore time.Time, opts Options) {
+	switch {
+	case notBefore.IsZero():
+		c.ok(name, "not set")
+	case notBefore.After(opts.Now.Add(saml.MaxClockSkew)):
+		c.fail(name, "not valid for another %s, the idp's clock is ahead", notBefore.Sub(opts.Now).Round(time.Second))
+	default:
+		c.ok(name, "%s", notBefore.UTC().Format(time.RFC3339))
+	}
+}
+
+func verifyNotOnOrAfter(c *checks, name string, notOnOrAfter time.Time, opts Options) {
+	switch {
+	case notOnOrAfter.IsZero():
+		c.ok(name, "not set")
+	case !opts.Now.Before(notOnOrAfter.Add(saml.MaxClockSkew)):
+		c.fail(name, "expired %s ago", opts.Now.Sub(notOnOrAfter).Round(time.Second))
+	default:
+		c.ok(name, "%s", notOnOrAfter.UTC().Format(time.RFC3339))
+	}
+}
+
+// verifySignature checks the enveloped signature of el against the certs
+// and that its reference can't be pointed at another element
+func verifySignature(c *checks, name string, el *etree.Element, opts Options) {
+	verifyReference(c, name+" reference", el)
+
+	if len(opts.Certs) == 0 {
+		c.skip(name, "no certificate given")
+		return
+	}
+
+	detached, err := detach(el)
+	if err != nil {
+		c.fail(name, "%v", err)
+		return
+	}
+	// crewjam/saml ignores a KeyInfo without a certificate, so must we
+	if sig := signatureOf(detached); sig != nil {
+		if keyInfo := sig.FindElement("./KeyInfo"); keyInfo != nil && keyInfo.FindElement("./X509Data/X509Certificate") == nil {
+			sig.RemoveChild(keyInfo)
+		}
+	}
+
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: opts.Certs})
+	ctx.IdAttribute = "ID"
+	ctx.Clock = dsig.NewFakeClockAt(opts.Now)
+	if _, err := ctx.Validate(detached); err != nil {
+		c.fail(name, "%v%s", err, signatureHint(err))
+		return
+	}
+	c.ok(name, "valid")
+}
+
+// signatureHint explains goxmldsig's errors, which don't say why
+func signatureHint(err error) string {
+	switch msg := err.Error(); {
+	case errors.Is(err, dsig.ErrMissingSignature):
+		return ", the signature doesn't reference the element it is in"
+	case strings.Contains(msg, "Could not verify certificate against trusted certs"):
+		return ", the message was signed with a certificate other than the one given, the idp's key may have been rotated"
+	case strings.Contains(msg, "Cert is not valid at this time"):
+		return ", the signing certificate has expired or isn't valid yet"
+	case strings.Contains(msg, "Signature could not be verified"):
+		return ", the signed xml was changed after it was signed, or the digest doesn't match"
+	}
+	return ""
+}
+
+// verifyReference checks the signature covers el and only el. An id that
+// occurs twice in a document is how signature wrapping attacks get a
+// signed element checked while another is used.
+func verifyReference(c *checks, name string, el *etree.Element) {
+	sig := signatureOf(el)
+	refs := sig.FindElements("./SignedInfo/Reference")
+	if len(refs) != 1 {
+		c.fail(name, "the signature has %d references, it must have one", len(refs))
+		return
+	}
+
+	id := el.SelectAttrValue("ID", "")
+	uri := refs[0].SelectAttrValue("URI", "")
+	if uri != "#"+id {
+		c.fail(name, "the signature references %q but the signed %s has ID %q", uri, el.Tag, id)
+		return
+	}
+
+	count := countID(rootOf(el), id)
+	if count > 1 {
+		c.fail(name, "%d elements have ID %q, the message may have been wrapped", count, id)
+		return
+	}
+	c.ok(name, "%s", uri)
+}
+
+func rootOf(el *etree.Element) *etree.Element {
+	for el.Parent() != nil && el.Parent().Tag != "" {
+		el = el.Parent()
+	}
+	return el
+}
+
+// countID counts the elements under and including el with the id
+func countID(el *etree.Element, id string) int {
+	count := 0
+	if el.SelectAttrValue("ID", "") == id {
+		count++
+	}
+	for _, child := range el.ChildElements() {
+		count += countID(child, id)
+	}
+	return count
+}
+
+// verifyQuerySignature checks the signature of a redirect binding message,
+// which signs the query string rather than the xml
+func (m *Message) verifyQuerySignature(c *checks, opts Options) {
+	const name = "Query signature"
+	var hash crypto.Hash
+	switch m.SigAlg {
+	case dsig.RSASHA1SignatureMethod:
+		hash = crypto.SHA1
+	case dsig.RSASHA256SignatureMethod:
+		hash = crypto.SHA256
+	case dsig.RSASHA512SignatureMethod:
+		hash = crypto.SHA512
+	default:
+		c.fail(name, "unsupported SigAlg %q", m.SigAlg)
+		return
+	}
+	if len(opts.Certs) == 0 {
+		c.skip(name, "no certificate given")
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		c.fail(name, "decoding: %v", err)
+		return
+	}
+	h := hash.New()
+	h.Write([]byte(m.signedQuery))
+	digest := h.Sum(nil)
+
+	for _, cert := range opts.Certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			c.ok(name, "valid")
+			return
+		}
+	}
+	c.fail(name, "not signed by the certificate given, or the query was re-encoded after it was signed")
+}
+
+// MetadataCerts returns the signing certificates in an entity's metadata
+func MetadataCerts(md *saml.EntityDescriptor) ([]*x509.Certificate, error) {
+	var descriptors [][]saml.KeyDescriptor
+	for _, d := range md.IDPSSODescriptors {
+		descriptors = append(descriptors, d.KeyDescriptors)
+	}
+	for _, d := range md.SPSSODescriptors {
+		descriptors = append(descriptors, d.KeyDescriptors)
+	}
+
+	var certs []*x509.Certificate
+	for _, kds := range descriptors {
+		for _, kd := range kds {
+			if kd.Use != "" && kd.Use != "signing" {
+				continue
+			}
+			for _, data := range kd.KeyInfo.X509Data.X509Certificates {
+				der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data.Data), ""))
+				if err != nil {
+					return nil, fmt.Errorf("metadata certificate: %w", err)
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, fmt.Errorf("metadata certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no signing certificate in the metadata of %s", md.EntityID)
+	}
+	return certs, nil
+}
+
+// ParseCertificates reads pem certificates, or a single base64 certificate
+// as it appears in metadata
+func ParseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) > 0 {
+		return certs, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(b)), ""))
+	if err != nil {
+		return nil, errors.New("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
@@ -0,0 +1,157 @@
+package scim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ghaggin/sso/internal/model"
+)
+
+// Client talks to a downstream scim server
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// NewUser builds the representation of u pushed to downstream servers.
+// Server assigned attributes and the password are left out.
+func NewUser(u *model.User) *User {
+	user := userFromModel(u, nil, "")
+	user.ID = ""
+	user.Meta = nil
+	return user
+}
+
+// FindUser returns the user with the given userName or nil when the server
+// has no such user
+func (c *Client) FindUser(ctx context.Context, userName string) (*User, error) {
+	q := url.Values{}
+	q.Set("filter", fmt.Sprintf("userName eq %q", userName))
+
+	var list struct {
+		Resources []User `json:"Resources"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/Users?"+q.Encode(), nil, &list); err != nil {
+		return nil, err
+	}
+
+	if len(list.Resources) == 0 {
+		return nil, nil
+	}
+	return &list.Resources[0], nil
+}
+
+// ListUsers pages through every user on the server
+func (c *Client) ListUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	for start := 1; ; {
+		var list struct {
+			TotalResults int    `json:"totalResults"`
+			Resources    []User `json:"Resources"`
+		}
+		path := fmt.Sprintf("/Users?startIndex=%d&count=%d", start, defaultPageSize)
+		if err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+			return nil, err
+		}
+
+		users = append(users, list.Resources...)
+		start += len(list.Resources)
+		if len(list.Resources) == 0 || len(users) >= list.TotalResults {
+			return users, nil
+		}
+	}
+}
+
+func (c *Client) CreateUser(ctx context.Context, user *User) (*User, error) {
+	created := &User{}
+	return created, c.do(ctx, http.MethodPost, "/Users", user, created)
+}
+
+func (c *Client) ReplaceUser(ctx context.Context, id string, user *User) (*User, error) {
+	updated := &User{}
+	return updated, c.do(ctx, http.MethodPut, "/Users/"+url.PathEscape(id), user, updated)
+}
+
+// SetActive flips the active flag of a user with a PATCH request
+func (c *Client) SetActive(ctx context.Context, id string, active bool) error {
+	req := &PatchRequest{
+		Schemas: []string{schemaPatchOp},
+		Operations: []PatchOperation{
+			{Op: "replace", Path: "active", Value: active},
+		},
+	}
+	return c.do(ctx, http.MethodPatch, "/Users/"+url.PathEscape(id), req, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var scimErr Error
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &scimErr) == nil && scimErr.Detail != "" {
+			return &StatusError{Status: resp.StatusCode, Detail: scimErr.Detail}
+		}
+		return &StatusError{Status: resp.StatusCode, Detail: strings.TrimSpace(string(b))}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// StatusError is returned by the client for non-2xx responses
+type StatusError struct {
+	Status int
+	Detail string
+}
+
+func (e *StatusError) Error() string {
+	return "scim: " + strconv.Itoa(e.Status) + " " + http.StatusText(e.Status) + ": " + e.Detail
+}
@@ -0,0 +1,414 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errInvalidFilter = errors.New("invalid filter")
+)
+
+// filter is a parsed scim filter expression (RFC 7644 section 3.4.2.2)
+// evaluated against the generic json form of a resource
+type filter interface {
+	match(resource map[string]any) bool
+}
+
+type logicalFilter struct {
+	and         bool
+	left, right filter
+}
+
+func (f *logicalFilter) match(r map[string]any) bool {
+	if f.and {
+		return f.left.match(r) && f.right.match(r)
+	}
+	return f.left.match(r) || f.right.match(r)
+}
+
+type notFilter struct {
+	f filter
+}
+
+func (f *notFilter) match(r map[string]any) bool {
+	return !f.f.match(r)
+}
+
+type compareFilter struct {
+	path  string
+	op    string
+	value any
+}
+
+func (f *compareFilter) match(r map[string]any) bool {
+	values := resolvePath(r, f.path)
+	if f.op == "pr" {
+		for _, v := range values {
+			if v != nil && v != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, v := range values {
+		if compare(v, f.op, f.value) {
+			return true
+		}
+	}
+
+	// ne matches when the attribute is absent
+	return len(values) == 0 && f.op == "ne"
+}
+
+// valuePathFilter matches when any element of the multi-valued attribute
+// matches the inner filter, e.g. emails[type eq "work"]
+type valuePathFilter struct {
+	attr string
+	f    filter
+}
+
+func (f *valuePathFilter) match(r map[string]any) bool {
+	for _, v := range resolveElements(r, f.attr) {
+		if m, ok := v.(map[string]any); ok && f.f.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(actual any, op string, expected any) bool {
+	switch a := actual.(type) {
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return false
+		}
+		a, e = strings.ToLower(a), strings.ToLower(e)
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		case "co":
+			return strings.Contains(a, e)
+		case "sw":
+			return strings.HasPrefix(a, e)
+		case "ew":
+			return strings.HasSuffix(a, e)
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case bool:
+		e, ok := expected.(bool)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		}
+	case float64:
+		e, ok := expected.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case nil:
+		return (op == "eq" && expected == nil) || (op == "ne" && expected != nil)
+	}
+
+	return false
+}
+
+// resolvePath returns every value found at the attribute path. Multi-valued
+// attributes are flattened and complex values without a sub-attribute
+// resolve to their "value".
+func resolvePath(r map[string]any, path string) []any {
+	current := resolveElements(r, path)
+	values := make([]any, 0, len(current))
+	for _, v := range current {
+		if m, ok := v.(map[string]any); ok {
+			if inner, ok := getKey(m, "value"); ok {
+				v = inner
+			}
+		}
+		values = append(values, v)
+	}
+
+	return values
+}
+
+// resolveElements is resolvePath keeping complex values whole, for value
+// path filters to match their sub-attributes
+func resolveElements(r map[string]any, path string) []any {
+	container, rest := splitExtension(r, path)
+	if container == nil {
+		return nil
+	}
+
+	current := []any{container}
+	for _, part := range strings.Split(rest, ".") {
+		var next []any
+		for _, c := range current {
+			m, ok := c.(map[string]any)
+			if !ok {
+				continue
+			}
+			v, ok := getKey(m, part)
+			if !ok {
+				continue
+			}
+			if arr, ok := v.([]any); ok {
+				next = append(next, arr...)
+			} else {
+				next = append(next, v)
+			}
+		}
+		current = next
+	}
+
+	return current
+}
+
+// splitExtension resolves fully qualified paths such as
+// urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department to
+// the extension object and the remaining attribute path
+func splitExtension(r map[string]any, path string) (map[string]any, string) {
+	if !strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return r, path
+	}
+
+	for k, v := range r {
+		if !strings.HasPrefix(strings.ToLower(path), strings.ToLower(k)+":") {
+			continue
+		}
+		if strings.EqualFold(k, schemaUser) || strings.EqualFold(k, schemaGroup) {
+			return r, path[len(k)+1:]
+		}
+		m, _ := v.(map[string]any)
+		return m, path[len(k)+1:]
+	}
+
+	// core schema prefixes are allowed even though they aren't keys
+	for _, s := range []string{schemaUser, schemaGroup} {
+		if strings.HasPrefix(strings.ToLower(path), strings.ToLower(s)+":") {
+			return r, path[len(s)+1:]
+		}
+	}
+
+	return nil, ""
+}
+
+// getKey looks up an attribute name case insensitively
+func getKey(m map[string]any, name string) (any, bool) {
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseFilter(s string) (filter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", errInvalidFilter, p.tokens[p.pos])
+	}
+
+	return f, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) expect(t string) error {
+	if got := p.next(); got != t {
+		return fmt.Errorf("%w: expected %q got %q", errInvalidFilter, t, got)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filter, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{and: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseFactor() (filter, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("%w: unexpected end", errInvalidFilter)
+	case t == "(":
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	case strings.EqualFold(t, "not"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{f: f}, p.expect(")")
+	case isPunct(t) || strings.HasPrefix(t, `"`):
+		return nil, fmt.Errorf("%w: unexpected %q", errInvalidFilter, t)
+	}
+
+	if p.peek() == "[" {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &valuePathFilter{attr: t, f: inner}, nil
+	}
+
+	op := strings.ToLower(p.next())
+	switch op {
+	case "pr":
+		return &compareFilter{path: t, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("%w: unknown operator %q", errInvalidFilter, op)
+	}
+
+	raw := p.next()
+	if raw == "" || isPunct(raw) {
+		return nil, fmt.Errorf("%w: missing value for %s", errInvalidFilter, t)
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return nil, fmt.Errorf("%w: bad value %s", errInvalidFilter, raw)
+	}
+
+	return &compareFilter{path: t, op: op, value: value}, nil
+}
+
+func isPunct(t string) bool {
+	return t == "(" || t == ")" || t == "[" || t == "]"
+}
+
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated string", errInvalidFilter)
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t()[]\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
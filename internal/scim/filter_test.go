@@ -0,0 +1,109 @@
+package scim
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testUser is the generic json form of a user as the filters see it
+const testUser = `{
+	"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+	"userName": "Alice",
+	"active": true,
+	"name": {"givenName": "Alice", "familyName": "Liddell"},
+	"emails": [
+		{"value": "alice@example.com", "type": "work", "primary": true},
+		{"value": "alice@home.example", "type": "home"}
+	],
+	"groups": [{"value": "7", "display": "staff"}],
+	"title": "",
+	"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "Wonderland"}
+}`
+
+func decodeResource(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var r map[string]any
+	require.NoError(t, json.Unmarshal([]byte(s), &r))
+	return r
+}
+
+func TestFilter(t *testing.T) {
+	user := decodeResource(t, testUser)
+
+	for _, tt := range []struct {
+		filter string
+		match  bool
+	}{
+		// attribute names and string values compare case insensitively
+		{`userName eq "alice"`, true},
+		{`USERNAME Eq "ALICE"`, true},
+		{`userName eq "bob"`, false},
+		{`userName ne "bob"`, true},
+		{`nickName ne "bob"`, true},
+		{`userName co "lic"`, true},
+		{`userName sw "al"`, true},
+		{`userName ew "ce"`, true},
+		{`userName gt "aa"`, true},
+		{`userName lt "aa"`, false},
+		{`active eq true`, true},
+		{`active eq "true"`, false},
+		{`name.familyName eq "Liddell"`, true},
+		{`emails eq "alice@home.example"`, true},
+		{`emails.type eq "home"`, true},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department eq "wonderland"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice"`, true},
+
+		{`userName pr`, true},
+		{`title pr`, false},
+		{`nickName pr`, false},
+
+		{`userName eq "alice" and active eq true`, true},
+		{`userName eq "alice" and active eq false`, false},
+		{`userName eq "bob" or active eq true`, true},
+		{`userName eq "bob" or active eq false`, false},
+		// and binds tighter than or
+		{`userName eq "bob" and active eq true or title pr`, false},
+		{`userName eq "alice" or userName eq "bob" and active eq false`, true},
+		{`(userName eq "alice" or userName eq "bob") and active eq false`, false},
+		{`not (userName eq "bob")`, true},
+		{`not (userName eq "alice" and active eq true)`, false},
+
+		// value paths match one element against every condition
+		{`emails[type eq "work" and primary eq true]`, true},
+		{`emails[type eq "home" and primary eq true]`, false},
+		{`emails[type eq "home"] and userName eq "alice"`, true},
+		{`groups[display eq "staff"]`, true},
+	} {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := parseFilter(tt.filter)
+			require.NoError(t, err)
+			require.Equal(t, tt.match, f.match(user))
+		})
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName is "alice"`,
+		`userName eq "alice`,
+		`userName eq alice`,
+		`userName eq "alice" and`,
+		`userName eq "alice" or or active eq true`,
+		`(userName eq "alice"`,
+		`userName eq "alice")`,
+		`not userName eq "alice"`,
+		`emails[type eq "work"`,
+		`"alice" eq userName`,
+		`userName eq ("alice")`,
+	} {
+		t.Run(filter, func(t *testing.T) {
+			_, err := parseFilter(filter)
+			require.ErrorIs(t, err, errInvalidFilter)
+		})
+	}
+}
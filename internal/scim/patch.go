@@ -0,0 +1,290 @@
+package scim
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errInvalidPath  = errors.New("invalid path")
+	errInvalidValue = errors.New("invalid value")
+	errNoTarget     = errors.New("no target")
+)
+
+// patchPath is a parsed PATCH operation path: attr[filter].sub
+type patchPath struct {
+	attr   string
+	filter filter
+	sub    string
+}
+
+func parsePatchPath(path string) (*patchPath, error) {
+	p := &patchPath{}
+
+	if i := strings.Index(path, "["); i >= 0 {
+		j := strings.LastIndex(path, "]")
+		if j < i {
+			return nil, fmt.Errorf("%w: %s", errInvalidPath, path)
+		}
+
+		f, err := parseFilter(path[i+1 : j])
+		if err != nil {
+			return nil, err
+		}
+
+		p.attr = path[:i]
+		p.filter = f
+		p.sub = strings.TrimPrefix(path[j+1:], ".")
+		return p, nil
+	}
+
+	// extension urns contain dots in the version, so only split the
+	// attribute after the last colon
+	prefix, rest := "", path
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		prefix, rest = path[:i+1], path[i+1:]
+	}
+	p.attr = rest
+	if i := strings.Index(rest, "."); i >= 0 {
+		p.attr, p.sub = rest[:i], rest[i+1:]
+	}
+	p.attr = prefix + p.attr
+
+	return p, nil
+}
+
+// applyPatch applies the operations to the generic json form of a resource
+func applyPatch(r map[string]any, ops []PatchOperation) error {
+	for _, op := range ops {
+		var err error
+		switch strings.ToLower(op.Op) {
+		case "add":
+			err = patchSet(r, op, true)
+		case "replace":
+			err = patchSet(r, op, false)
+		case "remove":
+			err = patchRemove(r, op)
+		default:
+			err = fmt.Errorf("%w: unknown op %q", errInvalidValue, op.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func patchSet(r map[string]any, op PatchOperation, add bool) error {
+	if op.Path == "" {
+		values, ok := op.Value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%w: value must be an object when path is omitted", errInvalidValue)
+		}
+		for k, v := range values {
+			// extension objects are set attribute by attribute so their
+			// urn isn't mistaken for an attribute path
+			if ext, ok := v.(map[string]any); ok && isSchemaURN(k) {
+				if err := patchSet(r, PatchOperation{Op: op.Op, Value: prefixKeys(ext, k+":")}, add); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := patchSet(r, PatchOperation{Op: op.Op, Path: k, Value: v}, add); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	p, err := parsePatchPath(op.Path)
+	if err != nil {
+		return err
+	}
+
+	container, attr := patchContainer(r, p.attr, true)
+	if container == nil {
+		return fmt.Errorf("%w: %s", errInvalidPath, op.Path)
+	}
+
+	if p.filter != nil {
+		matched := false
+		for _, e := range elements(container, attr) {
+			if !p.filter.match(e) {
+				continue
+			}
+			matched = true
+			if p.sub != "" {
+				e[p.sub] = op.Value
+			} else if values, ok := op.Value.(map[string]any); ok {
+				for k, v := range values {
+					e[k] = v
+				}
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%w: %s", errNoTarget, op.Path)
+		}
+		return nil
+	}
+
+	if p.sub != "" {
+		key := keyName(container, attr)
+		inner, _ := container[key].(map[string]any)
+		if inner == nil {
+			inner = map[string]any{}
+		}
+		inner[keyName(inner, p.sub)] = op.Value
+		container[key] = inner
+		return nil
+	}
+
+	key := keyName(container, attr)
+	existing, isArray := container[key].([]any)
+	switch v := op.Value.(type) {
+	case []any:
+		if add && isArray {
+			container[key] = append(existing, v...)
+		} else {
+			container[key] = v
+		}
+	case map[string]any:
+		inner, _ := container[key].(map[string]any)
+		if !add || inner == nil {
+			inner = map[string]any{}
+		}
+		for k, iv := range v {
+			inner[keyName(inner, k)] = iv
+		}
+		container[key] = inner
+	default:
+		container[key] = v
+	}
+
+	return nil
+}
+
+func patchRemove(r map[string]any, op PatchOperation) error {
+	if op.Path == "" {
+		return fmt.Errorf("%w: remove requires a path", errNoTarget)
+	}
+
+	p, err := parsePatchPath(op.Path)
+	if err != nil {
+		return err
+	}
+
+	container, attr := patchContainer(r, p.attr, false)
+	if container == nil {
+		return nil
+	}
+	key := keyName(container, attr)
+
+	if p.filter != nil {
+		var kept []any
+		for _, e := range elements(container, attr) {
+			if !p.filter.match(e) {
+				kept = append(kept, e)
+			} else if p.sub != "" {
+				delete(e, keyName(e, p.sub))
+				kept = append(kept, e)
+			}
+		}
+		container[key] = kept
+		return nil
+	}
+
+	if p.sub != "" {
+		if inner, ok := container[key].(map[string]any); ok {
+			delete(inner, keyName(inner, p.sub))
+		}
+		return nil
+	}
+
+	// some clients remove members by value instead of with a filter
+	if values, ok := op.Value.([]any); ok {
+		remove := map[string]bool{}
+		for _, v := range values {
+			if m, ok := v.(map[string]any); ok {
+				remove[fmt.Sprint(m["value"])] = true
+			}
+		}
+		var kept []any
+		for _, e := range elements(container, attr) {
+			if !remove[fmt.Sprint(e["value"])] {
+				kept = append(kept, e)
+			}
+		}
+		container[key] = kept
+		return nil
+	}
+
+	delete(container, key)
+	return nil
+}
+
+// patchContainer resolves the object holding attr, creating extension
+// objects when create is set
+func patchContainer(r map[string]any, attr string, create bool) (map[string]any, string) {
+	if !strings.HasPrefix(strings.ToLower(attr), "urn:") {
+		return r, attr
+	}
+
+	i := strings.LastIndex(attr, ":")
+	urn, name := attr[:i], attr[i+1:]
+	if strings.EqualFold(urn, schemaUser) || strings.EqualFold(urn, schemaGroup) {
+		return r, name
+	}
+
+	key := keyName(r, urn)
+	ext, ok := r[key].(map[string]any)
+	if !ok {
+		if !create {
+			return nil, ""
+		}
+		ext = map[string]any{}
+		r[key] = ext
+	}
+
+	return ext, name
+}
+
+func elements(container map[string]any, attr string) []map[string]any {
+	arr, _ := container[keyName(container, attr)].([]any)
+	var out []map[string]any
+	for _, v := range arr {
+		if m, ok := v.(map[string]any); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func isSchemaURN(s string) bool {
+	for _, urn := range []string{schemaUser, schemaGroup, schemaEnterpriseUser} {
+		if strings.EqualFold(s, urn) {
+			return true
+		}
+	}
+	return false
+}
+
+func prefixKeys(m map[string]any, prefix string) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[prefix+k] = v
+	}
+	return out
+}
+
+// keyName returns the existing key matching name case insensitively, or
+// name itself
+func keyName(m map[string]any, name string) string {
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
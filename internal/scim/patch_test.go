@@ -0,0 +1,137 @@
+package scim
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchMultiValued(t *testing.T) {
+	const group = `{
+		"displayName": "staff",
+		"members": [{"value": "1"}, {"value": "2"}]
+	}`
+
+	for _, tt := range []struct {
+		name     string
+		resource string
+		ops      string
+		want     string
+	}{
+		{
+			name:     "add appends",
+			resource: group,
+			ops:      `[{"op": "add", "path": "members", "value": [{"value": "3"}]}]`,
+			want:     `{"displayName": "staff", "members": [{"value": "1"}, {"value": "2"}, {"value": "3"}]}`,
+		},
+		{
+			name:     "add creates the attribute",
+			resource: `{"displayName": "staff"}`,
+			ops:      `[{"op": "add", "path": "members", "value": [{"value": "1"}]}]`,
+			want:     `{"displayName": "staff", "members": [{"value": "1"}]}`,
+		},
+		{
+			name:     "add without a path",
+			resource: group,
+			ops:      `[{"op": "add", "value": {"members": [{"value": "3"}]}}]`,
+			want:     `{"displayName": "staff", "members": [{"value": "1"}, {"value": "2"}, {"value": "3"}]}`,
+		},
+		{
+			name:     "replace swaps every value",
+			resource: group,
+			ops:      `[{"op": "replace", "path": "members", "value": [{"value": "3"}]}]`,
+			want:     `{"displayName": "staff", "members": [{"value": "3"}]}`,
+		},
+		{
+			name:     "replace a sub-attribute of matching values",
+			resource: testUser,
+			ops:      `[{"op": "replace", "path": "emails[type eq \"home\"].value", "value": "alice@new.example"}]`,
+			want: `{"emails": [
+				{"value": "alice@example.com", "type": "work", "primary": true},
+				{"value": "alice@new.example", "type": "home"}
+			]}`,
+		},
+		{
+			name:     "replace merges into matching values",
+			resource: testUser,
+			ops:      `[{"op": "replace", "path": "emails[type eq \"work\"]", "value": {"primary": false}}]`,
+			want: `{"emails": [
+				{"value": "alice@example.com", "type": "work", "primary": false},
+				{"value": "alice@home.example", "type": "home"}
+			]}`,
+		},
+		{
+			name:     "remove with a filter",
+			resource: group,
+			ops:      `[{"op": "remove", "path": "members[value eq \"1\"]"}]`,
+			want:     `{"displayName": "staff", "members": [{"value": "2"}]}`,
+		},
+		{
+			name:     "remove by value",
+			resource: group,
+			ops:      `[{"op": "remove", "path": "members", "value": [{"value": "2"}]}]`,
+			want:     `{"displayName": "staff", "members": [{"value": "1"}]}`,
+		},
+		{
+			name:     "remove a sub-attribute of matching values",
+			resource: testUser,
+			ops:      `[{"op": "remove", "path": "emails[primary eq true].primary"}]`,
+			want: `{"emails": [
+				{"value": "alice@example.com", "type": "work"},
+				{"value": "alice@home.example", "type": "home"}
+			]}`,
+		},
+		{
+			name:     "remove the attribute",
+			resource: group,
+			ops:      `[{"op": "remove", "path": "members"}]`,
+			want:     `{"displayName": "staff"}`,
+		},
+		{
+			name:     "operations apply in order",
+			resource: group,
+			ops: `[
+				{"op": "remove", "path": "members"},
+				{"op": "add", "path": "members", "value": [{"value": "4"}]}
+			]`,
+			want: `{"displayName": "staff", "members": [{"value": "4"}]}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := decodeResource(t, tt.resource)
+			var ops []PatchOperation
+			require.NoError(t, json.Unmarshal([]byte(tt.ops), &ops))
+
+			require.NoError(t, applyPatch(r, ops))
+			want := decodeResource(t, tt.want)
+			for k, v := range want {
+				require.Equal(t, v, r[k], k)
+			}
+			if _, ok := want["members"]; !ok {
+				require.NotContains(t, r, "members")
+			}
+		})
+	}
+}
+
+func TestPatchInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		ops string
+		err error
+	}{
+		{`[{"op": "move", "path": "members"}]`, errInvalidValue},
+		{`[{"op": "add", "value": [{"value": "1"}]}]`, errInvalidValue},
+		{`[{"op": "remove"}]`, errNoTarget},
+		{`[{"op": "replace", "path": "members[value eq \"9\"]", "value": {"display": "x"}}]`, errNoTarget},
+		{`[{"op": "replace", "path": "members[value eq]", "value": {}}]`, errInvalidFilter},
+		{`[{"op": "replace", "path": "members]value eq \"1\"[", "value": {}}]`, errInvalidPath},
+	} {
+		t.Run(tt.ops, func(t *testing.T) {
+			r := decodeResource(t, `{"members": [{"value": "1"}]}`)
+			var ops []PatchOperation
+			require.NoError(t, json.Unmarshal([]byte(tt.ops), &ops))
+			require.ErrorIs(t, applyPatch(r, ops), tt.err)
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package scim
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ghaggin/sso/internal/model"
+)
+
+const (
+	schemaUser           = "urn:ietf:params:scim:schemas:core:2.0:User"
+	schemaGroup          = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	schemaEnterpriseUser = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	schemaListResponse   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	schemaPatchOp        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	schemaError          = "urn:ietf:params:scim:api:messages:2.0:Error"
+	schemaSPConfig       = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	schemaSchema         = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	schemaResourceType   = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+type Meta struct {
+	ResourceType string `json:"resourceType,omitempty"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location,omitempty"`
+	Version      string `json:"version,omitempty"`
+}
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type MultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type Manager struct {
+	Value string `json:"value,omitempty"`
+}
+
+type EnterpriseUser struct {
+	EmployeeNumber string   `json:"employeeNumber,omitempty"`
+	CostCenter     string   `json:"costCenter,omitempty"`
+	Department     string   `json:"department,omitempty"`
+	Manager        *Manager `json:"manager,omitempty"`
+}
+
+type User struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName"`
+	Name        *Name           `json:"name,omitempty"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Emails      []MultiValue    `json:"emails,omitempty"`
+	Active      *bool           `json:"active,omitempty"`
+	Password    string          `json:"password,omitempty"`
+	Groups      []MultiValue    `json:"groups,omitempty"`
+	Enterprise  *EnterpriseUser `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+	Meta        *Meta           `json:"meta,omitempty"`
+}
+
+type Group struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []MultiValue `json:"members,omitempty"`
+	Meta        *Meta        `json:"meta,omitempty"`
+}
+
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	StartIndex   int      `json:"startIndex"`
+	Resources    []any    `json:"Resources"`
+}
+
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// etag is a weak entity tag derived from the record's modification time,
+// which the repository bumps on every write
+func etag(id int, modified time.Time) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d/%d", id, modified.UnixNano())))
+	return fmt.Sprintf(`W/"%x"`, sum[:8])
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func userFromModel(u *model.User, groups []model.Group, baseURL string) *User {
+	active := !u.Disabled
+	user := &User{
+		Schemas:    []string{schemaUser},
+		ID:         strconv.Itoa(u.ID),
+		ExternalID: u.ExternalID,
+		UserName:   u.Name,
+		Name: &Name{
+			GivenName:  u.First,
+			FamilyName: u.Last,
+		},
+		Active: &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Created:      formatTime(u.Created),
+			LastModified: formatTime(u.Modified),
+			Location:     baseURL + "/Users/" + strconv.Itoa(u.ID),
+			Version:      etag(u.ID, u.Modified),
+		},
+	}
+
+	if u.First != "" || u.Last != "" {
+		user.Name.Formatted = u.First + " " + u.Last
+		user.DisplayName = user.Name.Formatted
+	}
+
+	if u.Email != "" {
+		user.Emails = []MultiValue{{Value: u.Email, Type: "work", Primary: true}}
+	}
+
+	for _, g := range groups {
+		user.Groups = append(user.Groups, MultiValue{
+			Value:   strconv.Itoa(g.ID),
+			Display: g.Name,
+			Ref:     baseURL + "/Groups/" + strconv.Itoa(g.ID),
+		})
+	}
+
+	ent := &EnterpriseUser{
+		EmployeeNumber: firstValue(u.Attributes["employeeNumber"]),
+		CostCenter:     firstValue(u.Attributes["costCenter"]),
+		Department:     firstValue(u.Attributes["department"]),
+	}
+	if m := firstValue(u.Attributes["manager"]); m != "" {
+		ent.Manager = &Manager{Value: m}
+	}
+	if *ent != (EnterpriseUser{}) {
+		user.Schemas = append(user.Schemas, schemaEnterpriseUser)
+		user.Enterprise = ent
+	}
+
+	return user
+}
+
+// applyToModel copies the writable attributes of the scim user onto u.
+// The password is only replaced when one is supplied.
+func (user *User) applyToModel(u *model.User) {
+	u.Name = user.UserName
+	u.ExternalID = user.ExternalID
+	u.First, u.Last = "", ""
+	if user.Name != nil {
+		u.First = user.Name.GivenName
+		u.Last = user.Name.FamilyName
+	}
+
+	u.Email = ""
+	for _, e := range user.Emails {
+		if u.Email == "" || e.Primary {
+			u.Email = e.Value
+		}
+	}
+
+	u.Disabled = user.Active != nil && !*user.Active
+
+	if user.Password != "" {
+		u.Password = user.Password
+	}
+
+	// copy so the repository's record isn't modified in place
+	attrs := map[string][]string{}
+	for k, v := range u.Attributes {
+		attrs[k] = v
+	}
+	u.Attributes = attrs
+
+	ent := user.Enterprise
+	if ent == nil {
+		ent = &EnterpriseUser{}
+	}
+	setValue(u.Attributes, "employeeNumber", ent.EmployeeNumber)
+	setValue(u.Attributes, "costCenter", ent.CostCenter)
+	setValue(u.Attributes, "department", ent.Department)
+	manager := ""
+	if ent.Manager != nil {
+		manager = ent.Manager.Value
+	}
+	setValue(u.Attributes, "manager", manager)
+}
+
+func groupFromModel(g *model.Group, users map[int]string, baseURL string) *Group {
+	group := &Group{
+		Schemas:     []string{schemaGroup},
+		ID:          strconv.Itoa(g.ID),
+		ExternalID:  g.ExternalID,
+		DisplayName: g.Name,
+		Meta: &Meta{
+			ResourceType: "Group",
+			Created:      formatTime(g.Created),
+			LastModified: formatTime(g.Modified),
+			Location:     baseURL + "/Groups/" + strconv.Itoa(g.ID),
+			Version:      etag(g.ID, g.Modified),
+		},
+	}
+
+	for _, m := range g.Members {
+		group.Members = append(group.Members, MultiValue{
+			Value:   strconv.Itoa(m),
+			Display: users[m],
+			Ref:     baseURL + "/Users/" + strconv.Itoa(m),
+		})
+	}
+
+	return group
+}
+
+// applyToModel copies the writable attributes of the scim group onto g.
+// Members must reference existing user ids.
+func (group *Group) applyToModel(g *model.Group, users map[int]string) error {
+	g.Name = group.DisplayName
+	g.ExternalID = group.ExternalID
+	g.Members = []int{}
+
+	seen := map[int]bool{}
+	for _, m := range group.Members {
+		id, err := strconv.Atoi(m.Value)
+		if err != nil {
+			return fmt.Errorf("invalid member %q", m.Value)
+		}
+		if _, ok := users[id]; !ok {
+			return fmt.Errorf("unknown member %q", m.Value)
+		}
+		if !seen[id] {
+			seen[id] = true
+			g.Members = append(g.Members, id)
+		}
+	}
+
+	return nil
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func setValue(attrs map[string][]string, name, value string) {
+	if value == "" {
+		delete(attrs, name)
+		return
+	}
+	attrs[name] = []string{value}
+}
+
+// toMap converts a resource to its generic json form for filtering and
+// patching
+func toMap(v any) (map[string]any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]any{}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+func fromMap(m map[string]any, v any) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,174 @@
+package scim
+
+// schemaAttribute describes an attribute in the /Schemas discovery endpoint
+type schemaAttribute struct {
+	Name          string            `json:"name"`
+	Type          string            `json:"type"`
+	MultiValued   bool              `json:"multiValued"`
+	Required      bool              `json:"required"`
+	CaseExact     bool              `json:"caseExact"`
+	Mutability    string            `json:"mutability"`
+	Returned      string            `json:"returned"`
+	Uniqueness    string            `json:"uniqueness"`
+	SubAttributes []schemaAttribute `json:"subAttributes,omitempty"`
+}
+
+type schemaResource struct {
+	Schemas     []string          `json:"schemas"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Attributes  []schemaAttribute `json:"attributes"`
+	Meta        *Meta             `json:"meta"`
+}
+
+func attribute(name, typ string, sub ...schemaAttribute) schemaAttribute {
+	return schemaAttribute{
+		Name:          name,
+		Type:          typ,
+		Mutability:    "readWrite",
+		Returned:      "default",
+		Uniqueness:    "none",
+		SubAttributes: sub,
+	}
+}
+
+func multi(a schemaAttribute) schemaAttribute {
+	a.MultiValued = true
+	return a
+}
+
+func required(a schemaAttribute) schemaAttribute {
+	a.Required = true
+	return a
+}
+
+func unique(a schemaAttribute) schemaAttribute {
+	a.Uniqueness = "server"
+	return a
+}
+
+func mutability(a schemaAttribute, m string) schemaAttribute {
+	a.Mutability = m
+	if m == "writeOnly" {
+		a.Returned = "never"
+	}
+	return a
+}
+
+func schemas(baseURL string) []schemaResource {
+	ref := attribute("$ref", "reference")
+	return []schemaResource{
+		{
+			Schemas:     []string{schemaSchema},
+			ID:          schemaUser,
+			Name:        "User",
+			Description: "User Account",
+			Attributes: []schemaAttribute{
+				required(unique(attribute("userName", "string"))),
+				attribute("externalId", "string"),
+				attribute("name", "complex",
+					attribute("formatted", "string"),
+					attribute("givenName", "string"),
+					attribute("familyName", "string"),
+				),
+				attribute("displayName", "string"),
+				multi(attribute("emails", "complex",
+					attribute("value", "string"),
+					attribute("type", "string"),
+					attribute("primary", "boolean"),
+				)),
+				attribute("active", "boolean"),
+				mutability(attribute("password", "string"), "writeOnly"),
+				mutability(multi(attribute("groups", "complex",
+					attribute("value", "string"),
+					attribute("display", "string"),
+					ref,
+				)), "readOnly"),
+			},
+			Meta: &Meta{ResourceType: "Schema", Location: baseURL + "/Schemas/" + schemaUser},
+		},
+		{
+			Schemas:     []string{schemaSchema},
+			ID:          schemaEnterpriseUser,
+			Name:        "EnterpriseUser",
+			Description: "Enterprise User",
+			Attributes: []schemaAttribute{
+				attribute("employeeNumber", "string"),
+				attribute("costCenter", "string"),
+				attribute("department", "string"),
+				attribute("manager", "complex",
+					attribute("value", "string"),
+				),
+			},
+			Meta: &Meta{ResourceType: "Schema", Location: baseURL + "/Schemas/" + schemaEnterpriseUser},
+		},
+		{
+			Schemas:     []string{schemaSchema},
+			ID:          schemaGroup,
+			Name:        "Group",
+			Description: "Group",
+			Attributes: []schemaAttribute{
+				required(unique(attribute("displayName", "string"))),
+				attribute("externalId", "string"),
+				multi(attribute("members", "complex",
+					attribute("value", "string"),
+					attribute("display", "string"),
+					ref,
+				)),
+			},
+			Meta: &Meta{ResourceType: "Schema", Location: baseURL + "/Schemas/" + schemaGroup},
+		},
+	}
+}
+
+func resourceTypes(baseURL string) []any {
+	return []any{
+		map[string]any{
+			"schemas":     []string{schemaResourceType},
+			"id":          "User",
+			"name":        "User",
+			"endpoint":    "/Users",
+			"description": "User Account",
+			"schema":      schemaUser,
+			"schemaExtensions": []map[string]any{
+				{"schema": schemaEnterpriseUser, "required": false},
+			},
+			"meta": &Meta{ResourceType: "ResourceType", Location: baseURL + "/ResourceTypes/User"},
+		},
+		map[string]any{
+			"schemas":     []string{schemaResourceType},
+			"id":          "Group",
+			"name":        "Group",
+			"endpoint":    "/Groups",
+			"description": "Group",
+			"schema":      schemaGroup,
+			"meta":        &Meta{ResourceType: "ResourceType", Location: baseURL + "/ResourceTypes/Group"},
+		},
+	}
+}
+
+func serviceProviderConfig(baseURL string) map[string]any {
+	supported := func(b bool) map[string]any {
+		return map[string]any{"supported": b}
+	}
+
+	return map[string]any{
+		"schemas":        []string{schemaSPConfig},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": maxPageSize},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(true),
+		"authenticationSchemes": []map[string]any{
+			{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer Token",
+				"description": "Authentication with a preconfigured bearer token",
+				"primary":     true,
+			},
+		},
+		"meta": &Meta{ResourceType: "ServiceProviderConfig", Location: baseURL + "/ServiceProviderConfig"},
+	}
+}
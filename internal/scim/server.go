@@ -0,0 +1,704 @@
+package scim
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	contentType     = "application/scim+json"
+	defaultPageSize = 100
+	maxPageSize     = 200
+)
+
+// Backend is the user and group store served over scim
+type Backend interface {
+	GetUsers(ctx context.Context) ([]model.User, error)
+	GetUser(ctx context.Context, id int) (*model.User, error)
+	CreateUser(ctx context.Context, user *model.User) error
+	UpdateUser(ctx context.Context, user *model.User) error
+	DeleteUser(ctx context.Context, id int) error
+
+	GetGroups(ctx context.Context) ([]model.Group, error)
+	GetGroup(ctx context.Context, id int) (*model.Group, error)
+	CreateGroup(ctx context.Context, group *model.Group) error
+	UpdateGroup(ctx context.Context, group *model.Group) error
+	DeleteGroup(ctx context.Context, id int) error
+	GetUserGroups(ctx context.Context, id int) ([]model.Group, error)
+}
+
+// Server implements the scim 2.0 protocol (RFC 7644) for users and groups
+type Server struct {
+	backend Backend
+	tokens  []string
+	baseURL string
+	log     *zap.Logger
+}
+
+// NewServer creates a scim server. baseURL is the absolute url the
+// handler is mounted at and is used for resource locations.
+func NewServer(backend Backend, tokens []string, baseURL string, log *zap.Logger) *Server {
+	return &Server{
+		backend: backend,
+		tokens:  tokens,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		log:     log,
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(s.requireToken)
+
+	r.Get("/ServiceProviderConfig", s.getServiceProviderConfig)
+	r.Get("/Schemas", s.getSchemas)
+	r.Get("/Schemas/{id}", s.getSchema)
+	r.Get("/ResourceTypes", s.getResourceTypes)
+
+	r.Get("/Users", s.listUsers)
+	r.Post("/Users", s.createUser)
+	r.Get("/Users/{id}", s.getUser)
+	r.Put("/Users/{id}", s.replaceUser)
+	r.Patch("/Users/{id}", s.patchUser)
+	r.Delete("/Users/{id}", s.deleteUser)
+
+	r.Get("/Groups", s.listGroups)
+	r.Post("/Groups", s.createGroup)
+	r.Get("/Groups/{id}", s.getGroup)
+	r.Put("/Groups/{id}", s.replaceGroup)
+	r.Patch("/Groups/{id}", s.patchGroup)
+	r.Delete("/Groups/{id}", s.deleteGroup)
+
+	return r
+}
+
+// ValidToken reports whether token is one of the scim bearer tokens
+func (s *Server) ValidToken(token string) bool {
+	for _, t := range s.tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && s.ValidToken(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.log.Warn("rejected scim request", zap.String("remote", r.RemoteAddr))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		s.writeError(w, http.StatusUnauthorized, "", "invalid or missing bearer token")
+	})
+}
+
+func (s *Server) getServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, serviceProviderConfig(s.baseURL))
+}
+
+func (s *Server) getSchemas(w http.ResponseWriter, r *http.Request) {
+	var resources []any
+	for _, sch := range schemas(s.baseURL) {
+		resources = append(resources, sch)
+	}
+	s.writeJSON(w, http.StatusOK, listResponse(resources, len(resources), 1))
+}
+
+func (s *Server) getSchema(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	for _, sch := range schemas(s.baseURL) {
+		if sch.ID == id {
+			s.writeJSON(w, http.StatusOK, sch)
+			return
+		}
+	}
+	s.writeError(w, http.StatusNotFound, "", "schema not found")
+}
+
+func (s *Server) getResourceTypes(w http.ResponseWriter, r *http.Request) {
+	resources := resourceTypes(s.baseURL)
+	s.writeJSON(w, http.StatusOK, listResponse(resources, len(resources), 1))
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	f, startIndex, count, err := listParams(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	users, err := s.backend.GetUsers(r.Context())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	var matched []any
+	for _, u := range users {
+		groups, err := s.backend.GetUserGroups(r.Context(), u.ID)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+
+		user := userFromModel(&u, groups, s.baseURL)
+		if f != nil {
+			m, err := toMap(user)
+			if err != nil {
+				s.handleError(w, err)
+				return
+			}
+			if !f.match(m) {
+				continue
+			}
+		}
+		matched = append(matched, user)
+	}
+
+	s.writeJSON(w, http.StatusOK, page(matched, startIndex, count))
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
+	user, err := s.loadUser(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" && match == user.Meta.Version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.writeResource(w, http.StatusOK, user, user.Meta)
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if user.UserName == "" {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+
+	u := &model.User{}
+	user.applyToModel(u)
+	if err := s.backend.CreateUser(r.Context(), u); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.log.Info("scim created user", zap.String("user", u.Name))
+	created := userFromModel(u, nil, s.baseURL)
+	s.writeResource(w, http.StatusCreated, created, created.Meta)
+}
+
+func (s *Server) replaceUser(w http.ResponseWriter, r *http.Request) {
+	current, err := s.loadUser(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if !s.checkIfMatch(w, r, current.Meta.Version) {
+		return
+	}
+
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if user.UserName == "" {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+
+	s.saveUser(w, r, current.ID, &user)
+}
+
+func (s *Server) patchUser(w http.ResponseWriter, r *http.Request) {
+	current, err := s.loadUser(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if !s.checkIfMatch(w, r, current.Meta.Version) {
+		return
+	}
+
+	ops, err := decodePatch(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	m, err := toMap(current)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if err := applyPatch(m, ops); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// some clients send booleans as strings
+	if active, ok := m["active"].(string); ok {
+		m["active"] = strings.EqualFold(active, "true")
+	}
+
+	var user User
+	if err := fromMap(m, &user); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	s.saveUser(w, r, current.ID, &user)
+}
+
+func (s *Server) saveUser(w http.ResponseWriter, r *http.Request, id string, user *User) {
+	uid, _ := strconv.Atoi(id)
+	u, err := s.backend.GetUser(r.Context(), uid)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	user.applyToModel(u)
+	if err := s.backend.UpdateUser(r.Context(), u); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	groups, err := s.backend.GetUserGroups(r.Context(), u.ID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.log.Info("scim updated user", zap.String("user", u.Name))
+	updated := userFromModel(u, groups, s.baseURL)
+	s.writeResource(w, http.StatusOK, updated, updated.Meta)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	current, err := s.loadUser(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if !s.checkIfMatch(w, r, current.Meta.Version) {
+		return
+	}
+
+	id, _ := strconv.Atoi(current.ID)
+	if err := s.backend.DeleteUser(r.Context(), id); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.log.Info("scim deleted user", zap.String("user", current.UserName))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) loadUser(r *http.Request) (*User, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, repository.ErrNotFound
+	}
+
+	u, err := s.backend.GetUser(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := s.backend.GetUserGroups(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return userFromModel(u, groups, s.baseURL), nil
+}
+
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request) {
+	f, startIndex, count, err := listParams(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	groups, err := s.backend.GetGroups(r.Context())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+
+	names, err := s.userNames(r.Context())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	var matched []any
+	for _, g := range groups {
+		group := groupFromModel(&g, names, s.baseURL)
+		if f != nil {
+			m, err := toMap(group)
+			if err != nil {
+				s.handleError(w, err)
+				return
+			}
+			if !f.match(m) {
+				continue
+			}
+		}
+		matched = append(matched, group)
+	}
+
+	s.writeJSON(w, http.StatusOK, page(matched, startIndex, count))
+}
+
+func (s *Server) getGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := s.loadGroup(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" && match == group.Meta.Version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.writeResource(w, http.StatusOK, group, group.Meta)
+}
+
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	var group Group
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if group.DisplayName == "" {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	names, err := s.userNames(r.Context())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	g := &model.Group{}
+	if err := group.applyToModel(g, names); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if err := s.backend.CreateGroup(r.Context(), g); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.log.Info("scim created group", zap.String("group", g.Name))
+	created := groupFromModel(g, names, s.baseURL)
+	s.writeResource(w, http.StatusCreated, created, created.Meta)
+}
+
+func (s *Server) replaceGroup(w http.ResponseWriter, r *http.Request) {
+	current, err := s.loadGroup(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if !s.checkIfMatch(w, r, current.Meta.Version) {
+		return
+	}
+
+	var group Group
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if group.DisplayName == "" {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	s.saveGroup(w, r, current.ID, &group)
+}
+
+func (s *Server) patchGroup(w http.ResponseWriter, r *http.Request) {
+	current, err := s.loadGroup(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if !s.checkIfMatch(w, r, current.Meta.Version) {
+		return
+	}
+
+	ops, err := decodePatch(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	m, err := toMap(current)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if err := applyPatch(m, ops); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	var group Group
+	if err := fromMap(m, &group); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	s.saveGroup(w, r, current.ID, &group)
+}
+
+func (s *Server) saveGroup(w http.ResponseWriter, r *http.Request, id string, group *Group) {
+	gid, _ := strconv.Atoi(id)
+	g, err := s.backend.GetGroup(r.Context(), gid)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	names, err := s.userNames(r.Context())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if err := group.applyToModel(g, names); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if err := s.backend.UpdateGroup(r.Context(), g); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.log.Info("scim updated group", zap.String("group", g.Name))
+	updated := groupFromModel(g, names, s.baseURL)
+	s.writeResource(w, http.StatusOK, updated, updated.Meta)
+}
+
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	current, err := s.loadGroup(r)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if !s.checkIfMatch(w, r, current.Meta.Version) {
+		return
+	}
+
+	id, _ := strconv.Atoi(current.ID)
+	if err := s.backend.DeleteGroup(r.Context(), id); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.log.Info("scim deleted group", zap.String("group", current.DisplayName))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) loadGroup(r *http.Request) (*Group, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, repository.ErrNotFound
+	}
+
+	g, err := s.backend.GetGroup(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := s.userNames(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	return groupFromModel(g, names, s.baseURL), nil
+}
+
+// userNames maps user ids to user names for group member display values
+func (s *Server) userNames(ctx context.Context) (map[int]string, error) {
+	users, err := s.backend.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Name
+	}
+	return names, nil
+}
+
+// checkIfMatch enforces optimistic concurrency when the client sends an
+// If-Match precondition
+func (s *Server) checkIfMatch(w http.ResponseWriter, r *http.Request, version string) bool {
+	match := r.Header.Get("If-Match")
+	if match == "" || match == "*" || match == version {
+		return true
+	}
+
+	s.writeError(w, http.StatusPreconditionFailed, "", "resource version does not match If-Match")
+	return false
+}
+
+func decodePatch(r *http.Request) ([]PatchOperation, error) {
+	var req PatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidValue, err)
+	}
+
+	if len(req.Schemas) != 1 || req.Schemas[0] != schemaPatchOp {
+		return nil, fmt.Errorf("%w: schemas must be %s", errInvalidValue, schemaPatchOp)
+	}
+
+	return req.Operations, nil
+}
+
+func listParams(r *http.Request) (filter, int, int, error) {
+	q := r.URL.Query()
+
+	var f filter
+	if raw := q.Get("filter"); raw != "" {
+		var err error
+		if f, err = parseFilter(raw); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	startIndex := 1
+	if raw := q.Get("startIndex"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 1 {
+			startIndex = n
+		}
+	}
+
+	count := defaultPageSize
+	if raw := q.Get("count"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil {
+			count = max(0, min(n, maxPageSize))
+		}
+	}
+
+	return f, startIndex, count, nil
+}
+
+// page slices resources using the 1-based startIndex
+func page(resources []any, startIndex, count int) *ListResponse {
+	total := len(resources)
+	start := min(startIndex-1, total)
+	end := min(start+count, total)
+	return listResponse(resources[start:end], total, startIndex)
+}
+
+func listResponse(resources []any, total, startIndex int) *ListResponse {
+	if resources == nil {
+		resources = []any{}
+	}
+
+	return &ListResponse{
+		Schemas:      []string{schemaListResponse},
+		TotalResults: total,
+		ItemsPerPage: len(resources),
+		StartIndex:   startIndex,
+		Resources:    resources,
+	}
+}
+
+func (s *Server) writeResource(w http.ResponseWriter, status int, v any, meta *Meta) {
+	w.Header().Set("ETag", meta.Version)
+	w.Header().Set("Location", meta.Location)
+	s.writeJSON(w, status, v)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Error("writing scim response", zap.Error(err))
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, scimType, detail string) {
+	s.writeJSON(w, status, &Error{
+		Schemas:  []string{schemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+// passwordPolicyError is implemented by the backend's password policy
+// errors
+type passwordPolicyError interface {
+	PasswordViolations() []string
+}
+
+// forbiddenError is implemented by backend errors for changes the scim
+// client isn't allowed to make
+type forbiddenError interface {
+	Forbidden()
+}
+
+func (s *Server) handleError(w http.ResponseWriter, err error) {
+	var policyErr passwordPolicyError
+	var forbiddenErr forbiddenError
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		s.writeError(w, http.StatusNotFound, "", "resource not found")
+	case errors.Is(err, repository.ErrAlreadyExists):
+		s.writeError(w, http.StatusConflict, "uniqueness", err.Error())
+	case errors.Is(err, repository.ErrReadOnly):
+		s.writeError(w, http.StatusBadRequest, "mutability", err.Error())
+	case errors.Is(err, errInvalidFilter):
+		s.writeError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+	case errors.Is(err, errInvalidPath):
+		s.writeError(w, http.StatusBadRequest, "invalidPath", err.Error())
+	case errors.Is(err, errNoTarget):
+		s.writeError(w, http.StatusBadRequest, "noTarget", err.Error())
+	case errors.Is(err, errInvalidValue):
+		s.writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+	case errors.As(err, &policyErr):
+		s.writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+	case errors.As(err, &forbiddenErr):
+		s.writeError(w, http.StatusForbidden, "", err.Error())
+	default:
+		s.log.Error("scim request failed", zap.Error(err))
+		s.writeError(w, http.StatusInternalServerError, "", http.StatusText(http.StatusInternalServerError))
+	}
+}
@@ -0,0 +1,170 @@
+package sessionstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// fileStore keeps sessions in a bbolt database. bbolt locks the file, so
+// only one process can use it, each namespace gets its own file. Index
+// entries are keyed by the index key and token separated by a zero byte,
+// with the expiry as their value.
+type fileStore struct {
+	db      *bolt.DB
+	bucket  []byte
+	index   []byte
+	cleaner *cleaner
+}
+
+func newFileStore(dir, namespace string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, namespace+".db")
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is in use by another process, use sqlite, postgres or redis to share sessions", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{db: db, bucket: []byte("sessions"), index: []byte("index")}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{s.bucket, s.index} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s.cleaner = startCleaner(s.deleteExpired)
+	return s, nil
+}
+
+// values are the expiry in unix nanoseconds followed by the session data
+func encodeFileValue(b []byte, expiry time.Time) []byte {
+	v := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint64(v, uint64(expiry.UnixNano()))
+	copy(v[8:], b)
+	return v
+}
+
+func decodeFileValue(v []byte, now time.Time) ([]byte, bool) {
+	if len(v) < 8 || int64(binary.BigEndian.Uint64(v)) <= now.UnixNano() {
+		return nil, false
+	}
+	// bbolt values are only valid inside the transaction
+	return append([]byte(nil), v[8:]...), true
+}
+
+func (s *fileStore) Find(token string) ([]byte, bool, error) {
+	var b []byte
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, found = decodeFileValue(tx.Bucket(s.bucket).Get([]byte(token)), time.Now())
+		return nil
+	})
+	return b, found, err
+}
+
+func (s *fileStore) Commit(token string, b []byte, expiry time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(token), encodeFileValue(b, expiry))
+	})
+}
+
+func (s *fileStore) Delete(token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(token))
+	})
+}
+
+func (s *fileStore) All() (map[string][]byte, error) {
+	sessions := map[string][]byte{}
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(k, v []byte) error {
+			if b, ok := decodeFileValue(v, now); ok {
+				sessions[string(k)] = b
+			}
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func fileIndexKey(key, token string) []byte {
+	return []byte(key + "\x00" + token)
+}
+
+func (s *fileStore) AddIndex(key, token string, expiry time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.index).Put(fileIndexKey(key, token), encodeFileValue(nil, expiry))
+	})
+}
+
+func (s *fileStore) RemoveIndex(key, token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.index).Delete(fileIndexKey(key, token))
+	})
+}
+
+func (s *fileStore) LookupIndex(key string) ([]string, error) {
+	var tokens []string
+	prefix := []byte(key + "\x00")
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.index).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if _, ok := decodeFileValue(v, now); ok {
+				tokens = append(tokens, string(k[len(prefix):]))
+			}
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+func (s *fileStore) deleteExpired() error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{s.bucket, s.index} {
+			bucket := tx.Bucket(name)
+			// deleting under a cursor skips keys, so collect them first
+			var expired [][]byte
+			err := bucket.ForEach(func(k, v []byte) error {
+				if _, ok := decodeFileValue(v, now); !ok {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *fileStore) Close() error {
+	s.cleaner.Stop()
+	return s.db.Close()
+}
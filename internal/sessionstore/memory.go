@@ -0,0 +1,128 @@
+package sessionstore
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryStore keeps sessions in the process, they are lost on restart.
+// Expired ones are swept by a cleaner, which Close waits for, unlike
+// scs's memstore whose cleanup goroutine can't be stopped safely right
+// after it starts.
+type memoryStore struct {
+	mu      sync.RWMutex
+	items   map[string]memoryItem
+	index   map[string]map[string]time.Time
+	cleaner *cleaner
+}
+
+type memoryItem struct {
+	data   []byte
+	expiry time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{
+		items: map[string]memoryItem{},
+		index: map[string]map[string]time.Time{},
+	}
+	s.cleaner = startCleaner(s.deleteExpired)
+	return s
+}
+
+func (s *memoryStore) Find(token string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.items[token]
+	if !ok || !time.Now().Before(item.expiry) {
+		return nil, false, nil
+	}
+	return item.data, true, nil
+}
+
+func (s *memoryStore) Commit(token string, b []byte, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[token] = memoryItem{data: b, expiry: expiry}
+	return nil
+}
+
+func (s *memoryStore) Delete(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, token)
+	return nil
+}
+
+func (s *memoryStore) All() (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sessions := map[string][]byte{}
+	now := time.Now()
+	for token, item := range s.items {
+		if now.Before(item.expiry) {
+			sessions[token] = item.data
+		}
+	}
+	return sessions, nil
+}
+
+func (s *memoryStore) AddIndex(key, token string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index[key] == nil {
+		s.index[key] = map[string]time.Time{}
+	}
+	s.index[key][token] = expiry
+	return nil
+}
+
+func (s *memoryStore) RemoveIndex(key, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.index[key], token)
+	if len(s.index[key]) == 0 {
+		delete(s.index, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) LookupIndex(key string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tokens []string
+	now := time.Now()
+	for token, expiry := range s.index[key] {
+		if now.Before(expiry) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *memoryStore) deleteExpired() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for token, item := range s.items {
+		if !now.Before(item.expiry) {
+			delete(s.items, token)
+		}
+	}
+	for key, tokens := range s.index {
+		for token, expiry := range tokens {
+			if !now.Before(expiry) {
+				delete(tokens, token)
+			}
+		}
+		if len(tokens) == 0 {
+			delete(s.index, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	s.cleaner.Stop()
+	return nil
+}
@@ -0,0 +1,166 @@
+package sessionstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisStore keeps each session under sso:<namespace>:<token> with redis
+// expiring it, so any server speaking the redis protocol will do. Index
+// keys are sorted sets under sso:<namespace>_index:<key>, scored by expiry
+// in unix milliseconds.
+type redisStore struct {
+	pool        *redis.Pool
+	prefix      string
+	indexPrefix string
+}
+
+func newRedisStore(cfg config.SessionStore, namespace string) *redisStore {
+	options := []redis.DialOption{
+		redis.DialDatabase(cfg.DB),
+		redis.DialConnectTimeout(5 * time.Second),
+	}
+	if cfg.Password != "" {
+		options = append(options, redis.DialPassword(cfg.Password))
+	}
+
+	return &redisStore{
+		pool: &redis.Pool{
+			MaxIdle:     10,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", cfg.Addr, options...)
+			},
+		},
+		prefix:      "sso:" + namespace + ":",
+		indexPrefix: "sso:" + namespace + "_index:",
+	}
+}
+
+func (s *redisStore) Find(token string) ([]byte, bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("GET", s.prefix+token))
+	if errors.Is(err, redis.ErrNil) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func (s *redisStore) Commit(token string, b []byte, expiry time.Time) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ttl := time.Until(expiry).Milliseconds()
+	if ttl <= 0 {
+		_, err := conn.Do("DEL", s.prefix+token)
+		return err
+	}
+	_, err := conn.Do("SET", s.prefix+token, b, "PX", ttl)
+	return err
+}
+
+func (s *redisStore) Delete(token string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", s.prefix+token)
+	return err
+}
+
+func (s *redisStore) All() (map[string][]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	sessions := map[string][]byte{}
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", s.prefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) > 0 {
+			args := make([]any, len(keys))
+			for i, k := range keys {
+				args[i] = k
+			}
+			// keys can expire between the scan and the get
+			data, err := redis.ByteSlices(conn.Do("MGET", args...))
+			if err != nil {
+				return nil, err
+			}
+			for i, b := range data {
+				if b != nil {
+					sessions[keys[i][len(s.prefix):]] = b
+				}
+			}
+		}
+
+		if cursor == 0 {
+			return sessions, nil
+		}
+	}
+}
+
+func (s *redisStore) AddIndex(key, token string, expiry time.Time) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	k := s.indexPrefix + key
+	now := time.Now().UnixMilli()
+	conn.Send("ZADD", k, expiry.UnixMilli(), token)
+	conn.Send("ZREMRANGEBYSCORE", k, "-inf", now)
+	conn.Send("ZRANGE", k, -1, -1, "WITHSCORES")
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	last, err := redis.Int64Map(conn.Receive())
+	if err != nil {
+		return err
+	}
+
+	// the set lasts as long as its latest entry
+	for _, latest := range last {
+		_, err = conn.Do("PEXPIREAT", k, latest)
+	}
+	return err
+}
+
+func (s *redisStore) RemoveIndex(key, token string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", s.indexPrefix+key, token)
+	return err
+}
+
+func (s *redisStore) LookupIndex(key string) ([]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", s.indexPrefix+key, fmt.Sprintf("(%d", time.Now().UnixMilli()), "+inf"))
+}
+
+func (s *redisStore) Close() error {
+	return s.pool.Close()
+}
@@ -0,0 +1,97 @@
+package sessionstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+)
+
+// sealedStore encrypts session data with aes-gcm before it reaches the
+// store. Writes use the first key and reads try them all, sessions sealed
+// with an older key move to the first one the next time they are saved.
+// Data that no key opens is treated as missing.
+type sealedStore struct {
+	Store
+	aeads []cipher.AEAD
+}
+
+// Seal wraps store so sessions are encrypted at rest with keys, store is
+// returned as it is without keys
+func Seal(store Store, keys []string) (Store, error) {
+	if len(keys) == 0 {
+		return store, nil
+	}
+
+	s := &sealedStore{Store: store}
+	for _, key := range keys {
+		sum := sha256.Sum256([]byte(key))
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		s.aeads = append(s.aeads, aead)
+	}
+	return s, nil
+}
+
+// the token is authenticated with the data so a sealed session can't be
+// copied to another token
+func (s *sealedStore) seal(token string, b []byte) ([]byte, error) {
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, b, []byte(token)), nil
+}
+
+func (s *sealedStore) open(token string, b []byte) ([]byte, bool) {
+	for _, aead := range s.aeads {
+		if len(b) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := b[:aead.NonceSize()], b[aead.NonceSize():]
+		if plain, err := aead.Open(nil, nonce, ciphertext, []byte(token)); err == nil {
+			return plain, true
+		}
+	}
+	return nil, false
+}
+
+func (s *sealedStore) Find(token string) ([]byte, bool, error) {
+	b, found, err := s.Store.Find(token)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	plain, ok := s.open(token, b)
+	return plain, ok, nil
+}
+
+func (s *sealedStore) Commit(token string, b []byte, expiry time.Time) error {
+	sealed, err := s.seal(token, b)
+	if err != nil {
+		return err
+	}
+	return s.Store.Commit(token, sealed, expiry)
+}
+
+func (s *sealedStore) All() (map[string][]byte, error) {
+	all, err := s.Store.All()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[string][]byte, len(all))
+	for token, b := range all {
+		if plain, ok := s.open(token, b); ok {
+			sessions[token] = plain
+		}
+	}
+	return sessions, nil
+}
@@ -0,0 +1,193 @@
+package sessionstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore keeps sessions in a <namespace>_sessions table and their index
+// in <namespace>_sessions_index. Expiry is in unix nanoseconds so sqlite and
+// postgres compare it the same way.
+type sqlStore struct {
+	db      *sql.DB
+	table   string
+	rebind  func(string) string
+	cleaner *cleaner
+}
+
+// newSQLiteStore opens the database in wal mode with a busy timeout, so
+// instances on the same host or volume can share it
+func newSQLiteStore(path, namespace string) (*sqlStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, namespace, "BLOB", func(q string) string { return q })
+}
+
+func newPostgresStore(dsn, namespace string) (*sqlStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, namespace, "BYTEA", postgresRebind)
+}
+
+func newSQLStore(db *sql.DB, namespace, blobType string, rebind func(string) string) (*sqlStore, error) {
+	s := &sqlStore{
+		db:     db,
+		table:  namespace + "_sessions",
+		rebind: rebind,
+	}
+
+	schema := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			token TEXT PRIMARY KEY,
+			data %s NOT NULL,
+			expiry BIGINT NOT NULL
+		)`, s.table, blobType),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %[1]s_expiry_idx ON %[1]s (expiry)`, s.table),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_index (
+			index_key TEXT NOT NULL,
+			token TEXT NOT NULL,
+			expiry BIGINT NOT NULL,
+			PRIMARY KEY (index_key, token)
+		)`, s.table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %[1]s_index_expiry_idx ON %[1]s_index (expiry)`, s.table),
+	}
+	for _, q := range schema {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating session table: %w", err)
+		}
+	}
+
+	s.cleaner = startCleaner(s.deleteExpired)
+	return s, nil
+}
+
+// postgresRebind numbers ? placeholders as $1, $2...
+func postgresRebind(q string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) query(q string) string {
+	return s.rebind(fmt.Sprintf(q, s.table))
+}
+
+func (s *sqlStore) Find(token string) ([]byte, bool, error) {
+	var b []byte
+	err := s.db.QueryRow(
+		s.query(`SELECT data FROM %s WHERE token = ? AND expiry > ?`),
+		token, time.Now().UnixNano(),
+	).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func (s *sqlStore) Commit(token string, b []byte, expiry time.Time) error {
+	_, err := s.db.Exec(
+		s.query(`INSERT INTO %s (token, data, expiry) VALUES (?, ?, ?)
+			ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry`),
+		token, b, expiry.UnixNano(),
+	)
+	return err
+}
+
+func (s *sqlStore) Delete(token string) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM %s WHERE token = ?`), token)
+	return err
+}
+
+func (s *sqlStore) All() (map[string][]byte, error) {
+	rows, err := s.db.Query(s.query(`SELECT token, data FROM %s WHERE expiry > ?`), time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := map[string][]byte{}
+	for rows.Next() {
+		var token string
+		var b []byte
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		sessions[token] = b
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqlStore) AddIndex(key, token string, expiry time.Time) error {
+	_, err := s.db.Exec(
+		s.query(`INSERT INTO %s_index (index_key, token, expiry) VALUES (?, ?, ?)
+			ON CONFLICT (index_key, token) DO UPDATE SET expiry = excluded.expiry`),
+		key, token, expiry.UnixNano(),
+	)
+	return err
+}
+
+func (s *sqlStore) RemoveIndex(key, token string) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM %s_index WHERE index_key = ? AND token = ?`), key, token)
+	return err
+}
+
+func (s *sqlStore) LookupIndex(key string) ([]string, error) {
+	rows, err := s.db.Query(
+		s.query(`SELECT token FROM %s_index WHERE index_key = ? AND expiry > ?`),
+		key, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *sqlStore) deleteExpired() error {
+	now := time.Now().UnixNano()
+	if _, err := s.db.Exec(s.query(`DELETE FROM %s WHERE expiry <= ?`), now); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(s.query(`DELETE FROM %s_index WHERE expiry <= ?`), now)
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	s.cleaner.Stop()
+	return s.db.Close()
+}
@@ -0,0 +1,91 @@
+package sessionstore
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/ghaggin/sso/internal/config"
+)
+
+// cleanupInterval is how often expired sessions are deleted from stores
+// that don't expire them on their own
+const cleanupInterval = 5 * time.Minute
+
+var validNamespace = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Store is a scs store that can be iterated, for listing every session,
+// indexed, for finding a user's sessions, and closed on shutdown
+type Store interface {
+	scs.Store
+	scs.IterableStore
+	Index
+	Close() error
+}
+
+// Index maps keys, such as a user, to session tokens so their sessions are
+// found without reading every one. Entries lapse at their expiry and may
+// outlive the session they point to, so callers check the session is still
+// there.
+type Index interface {
+	AddIndex(key, token string, expiry time.Time) error
+	RemoveIndex(key, token string) error
+	LookupIndex(key string) ([]string, error)
+}
+
+// New opens the store selected by the config. namespace keeps the idp's
+// and sp's sessions apart when they share a database or redis server.
+func New(cfg config.SessionStore, namespace string) (Store, error) {
+	if !validNamespace.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid session namespace %q", namespace)
+	}
+
+	switch cfg.Type {
+	case config.SessionStoreMemory:
+		return newMemoryStore(), nil
+	case config.SessionStoreFile:
+		return newFileStore(cfg.Path, namespace)
+	case config.SessionStoreSQLite:
+		return newSQLiteStore(cfg.Path, namespace)
+	case config.SessionStorePostgres:
+		return newPostgresStore(cfg.DSN, namespace)
+	case config.SessionStoreRedis:
+		return newRedisStore(cfg, namespace), nil
+	}
+	return nil, fmt.Errorf("unknown session store %q", cfg.Type)
+}
+
+// cleaner calls deleteExpired every cleanupInterval until stopped
+type cleaner struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startCleaner(deleteExpired func() error) *cleaner {
+	c := &cleaner{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// a failed sweep is retried on the next tick, expired
+				// sessions are never returned in the meantime
+				_ = deleteExpired()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *cleaner) Stop() {
+	close(c.stop)
+	<-c.done
+}
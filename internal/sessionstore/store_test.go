@@ -0,0 +1,54 @@
+package sessionstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	for _, cfg := range []config.SessionStore{
+		{Type: config.SessionStoreMemory},
+		{Type: config.SessionStoreFile, Path: t.TempDir()},
+		{Type: config.SessionStoreSQLite, Path: filepath.Join(t.TempDir(), "sessions.sqlite")},
+	} {
+		t.Run(string(cfg.Type), func(t *testing.T) {
+			store, err := New(cfg, "idp")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				store.Close()
+			})
+			sealed, err := Seal(store, []string{"key"})
+			require.NoError(t, err)
+
+			later := time.Now().Add(time.Hour)
+			require.NoError(t, sealed.AddIndex("user:alice", "a1", later))
+			require.NoError(t, sealed.AddIndex("user:alice", "a2", later))
+			require.NoError(t, sealed.AddIndex("user:bob", "b1", later))
+			// lapsed entries aren't returned
+			require.NoError(t, sealed.AddIndex("user:alice", "a3", time.Now().Add(-time.Second)))
+
+			tokens, err := sealed.LookupIndex("user:alice")
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"a1", "a2"}, tokens)
+
+			require.NoError(t, sealed.RemoveIndex("user:alice", "a1"))
+			tokens, err = sealed.LookupIndex("user:alice")
+			require.NoError(t, err)
+			require.Equal(t, []string{"a2"}, tokens)
+
+			tokens, err = sealed.LookupIndex("user:carol")
+			require.NoError(t, err)
+			require.Empty(t, tokens)
+
+			// the index isn't listed among the sessions
+			require.NoError(t, sealed.Commit("a2", []byte("data"), later))
+			all, err := sealed.All()
+			require.NoError(t, err)
+			require.Equal(t, map[string][]byte{"a2": []byte("data")}, all)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package sp
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Client is the SAML service provider side of a login. It is used by the
+// test sp and by the idp when it brokers logins to an upstream idp.
+type Client struct {
+	ServiceProvider *saml.ServiceProvider
+	// Binding of the authn request, redirect is preferred when empty
+	Binding         string
+	ResponseBinding string
+	IsPassive       bool
+	// AllowCreate of the NameIDPolicy, true when nil
+	AllowCreate *bool
+}
+
+type ClientOptions struct {
+	EntityID          string
+	MetadataURL       url.URL
+	AcsURL            url.URL
+	SloURL            url.URL
+	Key               *rsa.PrivateKey
+	Certificate       *x509.Certificate
+	IDPMetadata       *saml.EntityDescriptor
+	AllowIDPInitiated bool
+}
+
+func NewClient(opts ClientOptions) *Client {
+	// only advertise single logout when there is an endpoint for it
+	var logoutBindings []string
+	if opts.SloURL.String() != "" {
+		logoutBindings = []string{saml.HTTPPostBinding}
+	}
+
+	return &Client{
+		ResponseBinding: saml.HTTPPostBinding,
+		ServiceProvider: &saml.ServiceProvider{
+			EntityID:           opts.EntityID,
+			Key:                opts.Key,
+			Certificate:        opts.Certificate,
+			MetadataURL:        opts.MetadataURL,
+			AcsURL:             opts.AcsURL,
+			SloURL:             opts.SloURL,
+			IDPMetadata:        opts.IDPMetadata,
+			SignatureMethod:    dsig.RSASHA1SignatureMethod,
+			AllowIDPInitiated:  opts.AllowIDPInitiated,
+			DefaultRedirectURI: "/",
+			LogoutBindings:     logoutBindings,
+		},
+	}
+}
+
+func (c *Client) ServeMetadata(w http.ResponseWriter, _ *http.Request) {
+	buf, err := xml.MarshalIndent(c.ServiceProvider.Metadata(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	if _, err := w.Write(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *Client) binding() (string, string) {
+	if c.Binding != "" {
+		return c.Binding, c.ServiceProvider.GetSSOBindingLocation(c.Binding)
+	}
+
+	binding := saml.HTTPRedirectBinding
+	location := c.ServiceProvider.GetSSOBindingLocation(binding)
+	if location == "" {
+		binding = saml.HTTPPostBinding
+		location = c.ServiceProvider.GetSSOBindingLocation(binding)
+	}
+	return binding, location
+}
+
+// MakeAuthenticationRequest builds an authn request for the idp. Its ID
+// must be tracked by the caller and passed to ParseResponse.
+func (c *Client) MakeAuthenticationRequest() (*saml.AuthnRequest, error) {
+	binding, location := c.binding()
+	if location == "" {
+		return nil, fmt.Errorf("idp has no sso endpoint for %s", binding)
+	}
+
+	// crewjam/saml signs post requests as it makes them, the signature has
+	// to wait until the fields it doesn't know about are set
+	unsigned := *c.ServiceProvider
+	unsigned.SignatureMethod = ""
+	req, err := unsigned.MakeAuthenticationRequest(location, binding, c.ResponseBinding)
+	if err != nil {
+		return nil, err
+	}
+	if c.IsPassive {
+		req.IsPassive = &c.IsPassive
+	}
+	if c.AllowCreate != nil {
+		req.NameIDPolicy.AllowCreate = c.AllowCreate
+	}
+
+	if c.ServiceProvider.SignatureMethod != "" && binding == saml.HTTPPostBinding {
+		if err := c.ServiceProvider.SignAuthnRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// WriteAuthenticationRequest sends the browser to the idp with the request,
+// either by redirect or by an auto submitted form
+func (c *Client) WriteAuthenticationRequest(w http.ResponseWriter, authReq *saml.AuthnRequest, relayState string) error {
+	binding, _ := c.binding()
+
+	if binding == saml.HTTPRedirectBinding {
+		redirectURL, err := authReq.Redirect(relayState, c.ServiceProvider)
+		if err != nil {
+			return err
+		}
+		w.Header().Add("Location", redirectURL.String())
+		w.WriteHeader(http.StatusFound)
+		return nil
+	}
+
+	w.Header().Add("Content-Security-Policy", ""+
+		"default-src; "+
+		"script-src 'sha256-AjPdJSbZmeWHnEc5ykvJFay8FTWeTeRbs9dutfZ0HqE='; "+
+		"reflected-xss block; referrer no-referrer;")
+	w.Header().Add("Content-type", "text/html")
+	var buf bytes.Buffer
+	buf.WriteString(`<!DOCTYPE html><html><body>`)
+	buf.Write(authReq.Post(relayState))
+	buf.WriteString(`</body></html>`)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ParseResponse validates the idp's response to one of the given requests.
+// Unsolicited responses are accepted when the client allows idp initiated
+// logins.
+func (c *Client) ParseResponse(r *http.Request, requestIDs []string) (*saml.Assertion, error) {
+	if c.ServiceProvider.AllowIDPInitiated {
+		requestIDs = append(requestIDs, "")
+	}
+	return c.ServiceProvider.ParseResponse(r, requestIDs)
+}
+
+// ParseLogoutRequest validates a post binding LogoutRequest from the idp.
+// The request must be signed with a certificate from the idp metadata and
+// addressed to this sp.
+func (c *Client) ParseLogoutRequest(r *http.Request) (*saml.LogoutRequest, error) {
+	raw, err := base64.StdEncoding.DecodeString(r.PostFormValue("SAMLRequest"))
+	if err != nil {
+		return nil, fmt.Errorf("decoding SAMLRequest: %w", err)
+	}
+	if err := xrv.Validate(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, err
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("empty LogoutRequest")
+	}
+	if err := c.validateSignature(doc.Root()); err != nil {
+		return nil, err
+	}
+
+	req := &saml.LogoutRequest{}
+	if err := xml.Unmarshal(raw, req); err != nil {
+		return nil, err
+	}
+
+	sp := c.ServiceProvider
+	if req.Destination != sp.SloURL.String() {
+		return nil, fmt.Errorf("destination %q is not %q", req.Destination, sp.SloURL.String())
+	}
+	if req.Issuer == nil || req.Issuer.Value != sp.IDPMetadata.EntityID {
+		return nil, errors.New("issuer is not the idp")
+	}
+	if req.IssueInstant.Add(saml.MaxIssueDelay).Before(saml.TimeNow()) {
+		return nil, errors.New("LogoutRequest expired")
+	}
+	if req.NameID == nil || req.NameID.Value == "" {
+		return nil, errors.New("LogoutRequest has no NameID")
+	}
+	return req, nil
+}
+
+func (c *Client) validateSignature(el *etree.Element) error {
+	certs, err := c.idpSigningCerts()
+	if err != nil {
+		return err
+	}
+
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	ctx.IdAttribute = "ID"
+	if saml.Clock != nil {
+		ctx.Clock = saml.Clock
+	}
+	if _, err := ctx.Validate(el); err != nil {
+		return fmt.Errorf("validating signature: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) idpSigningCerts() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, d := range c.ServiceProvider.IDPMetadata.IDPSSODescriptors {
+		for _, kd := range d.KeyDescriptors {
+			if kd.Use != "" && kd.Use != "signing" {
+				continue
+			}
+			for _, xc := range kd.KeyInfo.X509Data.X509Certificates {
+				der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(xc.Data), ""))
+				if err != nil {
+					return nil, err
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, err
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("idp metadata has no signing certificate")
+	}
+	return certs, nil
+}
@@ -0,0 +1,121 @@
+package sp
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/crewjam/saml"
+	"github.com/ghaggin/sso/internal/config"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var bindings = map[string]string{
+	config.BindingRedirect: saml.HTTPRedirectBinding,
+	config.BindingPost:     saml.HTTPPostBinding,
+	config.BindingArtifact: saml.HTTPArtifactBinding,
+}
+
+// nameIDFormats are the short names name_id_format takes besides a urn
+var nameIDFormats = map[string]saml.NameIDFormat{
+	"unspecified": saml.UnspecifiedNameIDFormat,
+	"transient":   saml.TransientNameIDFormat,
+	"persistent":  saml.PersistentNameIDFormat,
+	"email":       saml.EmailAddressNameIDFormat,
+}
+
+// profile is the named profile, or the default one, with the settings
+// given in the query in place of its own. The query takes the same names
+// as the profile's config.
+func (s *samlImpl) profile(q url.Values) (*config.SPProfile, error) {
+	name := q.Get("profile")
+	if name == "" {
+		name = s.defaultProfile
+	}
+	p, ok := s.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+
+	if v := q.Get("entity_id"); v != "" {
+		p.EntityID = v
+	}
+	if v := q.Get("binding"); v != "" {
+		if v != config.BindingRedirect && v != config.BindingPost {
+			return nil, fmt.Errorf("binding: unknown binding %q", v)
+		}
+		p.Binding = v
+	}
+	if v := q.Get("response_binding"); v != "" {
+		if v != config.BindingPost && v != config.BindingArtifact {
+			return nil, fmt.Errorf("response_binding: unknown binding %q", v)
+		}
+		p.ResponseBinding = v
+	}
+	if v, ok := q["authn_context"]; ok {
+		p.AuthnContext = v[0]
+	}
+	if v, ok := q["authn_context_comparison"]; ok {
+		p.AuthnContextComparison = v[0]
+	}
+	if v, ok := q["name_id_format"]; ok {
+		p.NameIDFormat = v[0]
+	}
+
+	for param, field := range map[string]*bool{
+		"force_authn":         &p.ForceAuthn,
+		"is_passive":          &p.IsPassive,
+		"allow_create":        &p.AllowCreate,
+		"sign_request":        &p.SignRequest,
+		"allow_idp_initiated": &p.AllowIDPInitiated,
+	} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", param, err)
+		}
+		*field = b
+	}
+	return &p, nil
+}
+
+// clientFor is the sp as the profile has it behave
+func (s *samlImpl) clientFor(p *config.SPProfile) *Client {
+	sp := *s.client.ServiceProvider
+	sp.EntityID = p.EntityID
+	sp.AllowIDPInitiated = p.AllowIDPInitiated
+	sp.SignatureMethod = ""
+	if p.SignRequest {
+		sp.SignatureMethod = dsig.RSASHA1SignatureMethod
+	}
+	if p.ForceAuthn {
+		sp.ForceAuthn = &p.ForceAuthn
+	}
+	if p.AuthnContext != "" {
+		sp.RequestedAuthnContext = &saml.RequestedAuthnContext{
+			Comparison:           p.AuthnContextComparison,
+			AuthnContextClassRef: p.AuthnContext,
+		}
+	}
+	if format, ok := nameIDFormats[p.NameIDFormat]; ok {
+		sp.AuthnNameIDFormat = format
+	} else {
+		sp.AuthnNameIDFormat = saml.NameIDFormat(p.NameIDFormat)
+	}
+
+	// crewjam/saml always asks for AllowCreate, only say otherwise
+	var allowCreate *bool
+	if !p.AllowCreate {
+		allowCreate = &p.AllowCreate
+	}
+	return &Client{
+		ServiceProvider: &sp,
+		Binding:         bindings[p.Binding],
+		ResponseBinding: bindings[p.ResponseBinding],
+		IsPassive:       p.IsPassive,
+		AllowCreate:     allowCreate,
+	}
+}
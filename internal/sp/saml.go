@@ -1,37 +1,49 @@
 package sp
 
 import (
-	"bytes"
 	"context"
-	"encoding/xml"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
 	"github.com/ghaggin/sso/internal/config"
 	"github.com/ghaggin/sso/internal/middleware"
-	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/ghaggin/sso/internal/samldebug"
 )
 
 type SAML interface {
+	Metadata() []*saml.EntityDescriptor
+	Profiles() []string
 	ServeMetadata(w http.ResponseWriter, _ *http.Request)
 	ServeACS(w http.ResponseWriter, r *http.Request)
+	ServeSLO(w http.ResponseWriter, r *http.Request)
 	HandleStartAuthFlow(w http.ResponseWriter, r *http.Request)
+	DebugDefaults() samldebug.Defaults
 }
 
 type samlImpl struct {
-	ServiceProvider *saml.ServiceProvider
-	Binding         string
-	ResponseBinding string
-	OnError         func(w http.ResponseWriter, r *http.Request, err error)
-	RequestTracker  samlsp.RequestTracker
+	// client is the sp as the default profile has it behave
+	client         *Client
+	OnError        func(w http.ResponseWriter, r *http.Request, err error)
+	RequestTracker samlsp.RequestTracker
 
 	sm *middleware.SessionManager
+	// traceSize is how many messages are kept per session for /trace
+	traceSize      int
+	profiles       map[string]config.SPProfile
+	defaultProfile string
+	// assertions are the ones already signed in with
+	assertions *usedAssertions
 }
 
-func NewSAML(port, idpURL string, sm *middleware.SessionManager) (SAML, error) {
-	idpMetadataURL, err := url.Parse(idpURL)
+func NewSAML(cfg config.ServiceProvider, sm *middleware.SessionManager) (SAML, error) {
+	idpMetadataURL, err := url.Parse(cfg.IDPMetadataURL)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +52,7 @@ func NewSAML(port, idpURL string, sm *middleware.SessionManager) (SAML, error) {
 		return nil, err
 	}
 
-	rootURL, err := url.Parse("http://localhost" + port)
+	rootURL, err := url.Parse(cfg.URL)
 	if err != nil {
 		return nil, err
 	}
@@ -51,77 +63,87 @@ func NewSAML(port, idpURL string, sm *middleware.SessionManager) (SAML, error) {
 	}
 
 	opts := samlsp.Options{
-		EntityID:          "test_sp",
-		URL:               *rootURL,
-		Key:               key,
-		Certificate:       cert,
-		IDPMetadata:       idpMetadata,
-		AllowIDPInitiated: true,
+		URL:         *rootURL,
+		Key:         key,
+		Certificate: cert,
+		IDPMetadata: idpMetadata,
 	}
 
-	var forceAuthn *bool
-	if opts.ForceAuthn {
-		forceAuthn = &opts.ForceAuthn
+	samlSP := &samlImpl{
+		client: NewClient(ClientOptions{
+			MetadataURL: *opts.URL.ResolveReference(&url.URL{Path: "saml/metadata"}),
+			AcsURL:      *opts.URL.ResolveReference(&url.URL{Path: "saml/acs"}),
+			SloURL:      *opts.URL.ResolveReference(&url.URL{Path: "saml/slo"}),
+			Key:         opts.Key,
+			Certificate: opts.Certificate,
+			IDPMetadata: opts.IDPMetadata,
+		}),
+		OnError:        samlsp.DefaultOnError,
+		sm:             sm,
+		traceSize:      cfg.TraceSize,
+		profiles:       cfg.Profiles,
+		defaultProfile: cfg.Profile,
+		assertions:     &usedAssertions{ids: map[string]time.Time{}},
 	}
+	profile := cfg.Profiles[cfg.Profile]
+	samlSP.client = samlSP.clientFor(&profile)
 
-	if opts.DefaultRedirectURI == "" {
-		opts.DefaultRedirectURI = "/"
-	}
+	samlSP.RequestTracker = requestTracker{samlsp.DefaultRequestTracker(opts, samlSP.client.ServiceProvider)}
 
-	if len(opts.LogoutBindings) == 0 {
-		opts.LogoutBindings = []string{saml.HTTPPostBinding}
-	}
+	return samlSP, nil
+}
 
-	samlSP := &samlImpl{
-		Binding:         "",
-		ResponseBinding: saml.HTTPPostBinding,
-		OnError:         samlsp.DefaultOnError,
-		ServiceProvider: &saml.ServiceProvider{
-			EntityID:              opts.EntityID,
-			Key:                   opts.Key,
-			Certificate:           opts.Certificate,
-			HTTPClient:            opts.HTTPClient,
-			Intermediates:         opts.Intermediates,
-			MetadataURL:           *opts.URL.ResolveReference(&url.URL{Path: "saml/metadata"}),
-			AcsURL:                *opts.URL.ResolveReference(&url.URL{Path: "saml/acs"}),
-			SloURL:                *opts.URL.ResolveReference(&url.URL{Path: "saml/slo"}),
-			IDPMetadata:           opts.IDPMetadata,
-			ForceAuthn:            forceAuthn,
-			RequestedAuthnContext: opts.RequestedAuthnContext,
-			SignatureMethod:       dsig.RSASHA1SignatureMethod,
-			AllowIDPInitiated:     opts.AllowIDPInitiated,
-			DefaultRedirectURI:    opts.DefaultRedirectURI,
-			LogoutBindings:        opts.LogoutBindings,
-		},
-
-		sm: sm,
-	}
-
-	samlSP.RequestTracker = samlsp.DefaultRequestTracker(opts, samlSP.ServiceProvider)
-	if opts.UseArtifactResponse {
-		samlSP.ResponseBinding = saml.HTTPArtifactBinding
+// Metadata is the sp's metadata for each entity id its profiles use, the
+// default profile's first
+func (s *samlImpl) Metadata() []*saml.EntityDescriptor {
+	metadata := []*saml.EntityDescriptor{s.client.ServiceProvider.Metadata()}
+	seen := map[string]bool{s.client.ServiceProvider.EntityID: true}
+	for _, name := range s.Profiles() {
+		profile := s.profiles[name]
+		if seen[profile.EntityID] {
+			continue
+		}
+		seen[profile.EntityID] = true
+		metadata = append(metadata, s.clientFor(&profile).ServiceProvider.Metadata())
 	}
+	return metadata
+}
 
-	return samlSP, nil
+// Profiles are the names of the sp's profiles, sorted
+func (s *samlImpl) Profiles() []string {
+	names := make([]string, 0, len(s.profiles))
+	for name := range s.profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
 }
 
-func (s *samlImpl) ServeMetadata(w http.ResponseWriter, _ *http.Request) {
-	buf, err := xml.MarshalIndent(s.ServiceProvider.Metadata(), "", "  ")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// DebugDefaults checks messages pasted into /debug/saml as ServeACS would.
+// Without certificates in the idp metadata signatures aren't checked.
+func (s *samlImpl) DebugDefaults() samldebug.Defaults {
+	sp := s.client.ServiceProvider
+	certs, _ := samldebug.MetadataCerts(sp.IDPMetadata)
+	return samldebug.Defaults{
+		Certs:       certs,
+		Key:         sp.Key,
+		Audience:    sp.EntityID,
+		Destination: sp.AcsURL.String(),
 	}
+}
 
-	w.Header().Set("Content-Type", "application/samlmetadata+xml")
-	if _, err := w.Write(buf); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// ServeMetadata serves the metadata of the profile named by the profile
+// parameter, as /saml/login takes it
+func (s *samlImpl) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	profile, err := s.profile(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	s.clientFor(profile).ServeMetadata(w, r)
 }
 
 func (s *samlImpl) ServeACS(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
 	err := r.ParseForm()
 	if err != nil {
 		s.OnError(w, r, err)
@@ -129,48 +151,92 @@ func (s *samlImpl) ServeACS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	possibleRequestIDs := []string{}
-	if s.ServiceProvider.AllowIDPInitiated {
-		possibleRequestIDs = append(possibleRequestIDs, "")
-	}
-
 	trackedRequests := s.RequestTracker.GetTrackedRequests(r)
 	for _, tr := range trackedRequests {
 		possibleRequestIDs = append(possibleRequestIDs, tr.SAMLRequestID)
 	}
+	// a request is answered once, posting its response again is a replay.
+	// The RelayState of an idp initiated login isn't a tracked request, a
+	// local path in it is where the user is sent.
+	redirect := "/"
+	if index := r.Form.Get("RelayState"); index != "" {
+		err := s.RequestTracker.StopTrackingRequest(w, r, index)
+		if errors.Is(err, http.ErrNoCookie) {
+			if middleware.LocalPath(index) {
+				redirect = index
+			}
+		} else if err != nil {
+			s.OnError(w, r, err)
+			return
+		}
+	}
 
-	assertion, err := s.ServiceProvider.ParseResponse(r, possibleRequestIDs)
+	// the response is accepted as the profile the login started with would,
+	// idp initiated logins get the default
+	profile, ok := s.sm.LoadSPProfile(r.Context())
+	if !ok {
+		defaultProfile := s.profiles[s.defaultProfile]
+		profile = &defaultProfile
+	}
+	assertion, err := s.clientFor(profile).ParseResponse(r, possibleRequestIDs)
+	if err == nil {
+		// samlsp skips InResponseTo when idp initiated logins are allowed,
+		// so a replay is only caught by the assertion's id
+		err = s.assertions.use(assertion)
+	}
+	s.traceResponse(r, profile, assertion, err)
 	if err != nil {
 		s.OnError(w, r, err)
 		return
 	}
 
-	// TODO: handle assertion
-	for _, as := range assertion.AttributeStatements {
-		for _, a := range as.Attributes {
-			if a.FriendlyName == "uid" && len(a.Values) == 1 {
-				s.sm.SetAuthenticated(ctx, a.Values[0].Value)
-			}
+	uid := userID(assertion)
+	if uid == "" {
+		s.OnError(w, r, errors.New("the assertion names no user"))
+		return
+	}
+	if err := s.sm.SetAuthenticated(r, uid, false); err != nil {
+		s.OnError(w, r, err)
+		return
+	}
+
+	// the sp session doesn't outlast the idp's
+	for _, st := range assertion.AuthnStatements {
+		if st.SessionNotOnOrAfter != nil {
+			s.sm.LimitExpiration(r.Context(), *st.SessionNotOnOrAfter)
 		}
 	}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// ServeSLO ends the user's sessions when the idp logs them out over the
+// back channel
+func (s *samlImpl) ServeSLO(w http.ResponseWriter, r *http.Request) {
+	req, err := s.client.ParseLogoutRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.sm.RevokeUserSessions(r.Context(), req.NameID.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
+// HandleStartAuthFlow sends the user to the idp as the profile selected
+// by the query would, see profile
 func (s *samlImpl) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request) {
-	var binding, bindingLocation string
-	if s.Binding != "" {
-		binding = s.Binding
-		bindingLocation = s.ServiceProvider.GetSSOBindingLocation(binding)
-	} else {
-		binding = saml.HTTPRedirectBinding
-		bindingLocation = s.ServiceProvider.GetSSOBindingLocation(binding)
-		if bindingLocation == "" {
-			binding = saml.HTTPPostBinding
-			bindingLocation = s.ServiceProvider.GetSSOBindingLocation(binding)
-		}
+	profile, err := s.profile(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	client := s.clientFor(profile)
 
-	authReq, err := s.ServiceProvider.MakeAuthenticationRequest(bindingLocation, binding, s.ResponseBinding)
+	authReq, err := client.MakeAuthenticationRequest()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -185,32 +251,60 @@ func (s *samlImpl) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.sm.StoreSPProfile(r.Context(), profile)
+	s.traceRequest(r, client, profile, authReq, relayState)
 
-	if binding == saml.HTTPRedirectBinding {
-		redirectURL, err := authReq.Redirect(relayState, s.ServiceProvider)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Add("Location", redirectURL.String())
-		w.WriteHeader(http.StatusFound)
-		return
+	if err := client.WriteAuthenticationRequest(w, authReq, relayState); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	if binding == saml.HTTPPostBinding {
-		w.Header().Add("Content-Security-Policy", ""+
-			"default-src; "+
-			"script-src 'sha256-AjPdJSbZmeWHnEc5ykvJFay8FTWeTeRbs9dutfZ0HqE='; "+
-			"reflected-xss block; referrer no-referrer;")
-		w.Header().Add("Content-type", "text/html")
-		var buf bytes.Buffer
-		buf.WriteString(`<!DOCTYPE html><html><body>`)
-		buf.Write(authReq.Post(relayState))
-		buf.WriteString(`</body></html>`)
-		if _, err := w.Write(buf.Bytes()); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+}
+
+// requestTracker is samlsp's cookie tracker, but answered requests are
+// really forgotten. samlsp expires the cookie without the path it was set
+// on, which leaves the browser holding the original.
+type requestTracker struct {
+	samlsp.CookieRequestTracker
+}
+
+func (t requestTracker) StopTrackingRequest(w http.ResponseWriter, r *http.Request, index string) error {
+	if _, err := r.Cookie(t.NamePrefix + index); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     t.NamePrefix + index,
+		Path:     t.ServiceProvider.AcsURL.Path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   t.ServiceProvider.AcsURL.Scheme == "https",
+		SameSite: t.SameSite,
+	})
+	return nil
+}
+
+// usedAssertions remembers assertion ids until the assertions expire, so
+// none is accepted twice
+type usedAssertions struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+func (u *usedAssertions) use(assertion *saml.Assertion) error {
+	now := saml.TimeNow()
+	expires := now.Add(saml.MaxIssueDelay)
+	if assertion.Conditions != nil && assertion.Conditions.NotOnOrAfter.After(expires) {
+		expires = assertion.Conditions.NotOnOrAfter
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, t := range u.ids {
+		if !now.Before(t) {
+			delete(u.ids, id)
 		}
-		return
 	}
-	panic("not reached")
+	if _, ok := u.ids[assertion.ID]; ok {
+		return fmt.Errorf("assertion %s was already used", assertion.ID)
+	}
+	u.ids[assertion.ID] = expires
+	return nil
 }
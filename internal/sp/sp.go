@@ -4,11 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"time"
 
-	"github.com/crewjam/saml/samlsp"
+	"github.com/crewjam/saml"
 	"github.com/ghaggin/sso/internal/config"
 	"github.com/ghaggin/sso/internal/middleware"
+	"github.com/ghaggin/sso/internal/samldebug"
 	"github.com/ghaggin/sso/internal/template"
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/fx"
@@ -19,6 +19,7 @@ type ServiceProvider struct {
 	log    *zap.Logger
 	server *http.Server
 	sm     *middleware.SessionManager
+	saml   SAML
 }
 
 type Params struct {
@@ -30,7 +31,7 @@ type Params struct {
 }
 
 func New(p Params) (*ServiceProvider, error) {
-	samlSP, err := NewSAML(fmt.Sprintf(":%d", p.Config.ServiceProvider.Port), "http://localhost:8124/metadata", p.SessionManager)
+	samlSP, err := NewSAML(p.Config.ServiceProvider, p.SessionManager)
 	if err != nil {
 		panic(err)
 	}
@@ -40,28 +41,41 @@ func New(p Params) (*ServiceProvider, error) {
 		server: &http.Server{
 			Addr: fmt.Sprintf("localhost:%d", p.Config.ServiceProvider.Port),
 		},
-		sm: p.SessionManager,
+		sm:   p.SessionManager,
+		saml: samlSP,
 	}
 
 	root := chi.NewRouter()
 	root.Use(p.SessionManager.Wrap)
+	// the idp posts saml responses across sites
+	root.Use(p.SessionManager.CSRF(nil, "/saml/acs", "/saml/slo"))
 
 	// Auth
 	root.Group(func(r chi.Router) {
 		r.Use(sp.requireAuth)
 		r.Get("/", sp.home)
-		r.Get("/attr", getAttrVals)
+		r.Get("/attr", sp.attr)
+
+		// the defaults carry the sp's private key for decrypting assertions
+		debug := samldebug.Handler(p.Log, samlSP.DebugDefaults())
+		r.Get("/debug/saml", debug)
+		r.Post("/debug/saml", debug)
 	})
 
 	// No Auth
 	root.Group(func(r chi.Router) {
 		r.HandleFunc("/login", sp.login)
+		// the trace is most useful when a login failed
+		r.Get("/trace", sp.trace)
 		r.HandleFunc("/saml/login", func(w http.ResponseWriter, r *http.Request) {
 			samlSP.HandleStartAuthFlow(w, r)
 		})
 
 		r.Get("/saml/metadata", samlSP.ServeMetadata)
 		r.Post("/saml/acs", samlSP.ServeACS)
+		// artifacts come back by redirect
+		r.Get("/saml/acs", samlSP.ServeACS)
+		r.Post("/saml/slo", samlSP.ServeSLO)
 
 		r.Handle("/static/*", http.StripPrefix("/static", http.FileServer(http.Dir("web/static/"))))
 	})
@@ -70,6 +84,17 @@ func New(p Params) (*ServiceProvider, error) {
 	return sp, nil
 }
 
+// Metadata is the sp's saml metadata, one per entity id its profiles use,
+// for registering it with the idp
+func (s *ServiceProvider) Metadata() []*saml.EntityDescriptor {
+	return s.saml.Metadata()
+}
+
+// Handler serves the sp, for running it on a server of the caller's
+func (s *ServiceProvider) Handler() http.Handler {
+	return s.server.Handler
+}
+
 func RegisterHooks(lc fx.Lifecycle, s *ServiceProvider) {
 	lc.Append(fx.Hook{
 		OnStart: s.Start,
@@ -99,17 +124,24 @@ func (s *ServiceProvider) home(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type loginData struct {
+	template.Data
+	Profiles []string
+}
+
 func (s *ServiceProvider) login(w http.ResponseWriter, r *http.Request) {
-	template.Render(w, r, "login.html", &template.Data{
-		PageTitle: "login",
+	template.Render(w, r, "login.html", &loginData{
+		Data: template.Data{
+			PageTitle: "login",
+		},
+		Profiles: s.saml.Profiles(),
 	})
 }
 
 // Presence of a user in the context indicates auth
 func (s *ServiceProvider) requireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := s.sm.Get(r.Context())
-		if err != nil || !session.AuthValid || time.Now().After(session.AuthExpiration) {
+		if _, ok := s.sm.Authenticated(r.Context()); !ok {
 			http.Redirect(w, r, "/saml/login", http.StatusSeeOther)
 			return
 		}
@@ -117,30 +149,3 @@ func (s *ServiceProvider) requireAuth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-
-func getAttrVals(w http.ResponseWriter, r *http.Request) {
-	s := samlsp.SessionFromContext(r.Context())
-	if s == nil {
-		fmt.Fprint(w, "s is null")
-		return
-	}
-
-	sa, ok := s.(samlsp.SessionWithAttributes)
-	if !ok {
-		fmt.Fprint(w, "couldn't cast sa")
-		return
-	}
-	attrs := sa.GetAttributes()
-
-	for attr, attrVal := range attrs {
-		fmtAttrVal := ""
-		for i, v := range attrVal {
-			if i == 0 {
-				fmtAttrVal = v
-				continue
-			}
-			fmtAttrVal = fmtAttrVal + ", " + v
-		}
-		fmt.Fprintf(w, "%v: %v\n", attr, fmtAttrVal)
-	}
-}
@@ -0,0 +1,178 @@
+package sp
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/ghaggin/sso/internal/config"
+	"github.com/ghaggin/sso/internal/model"
+	"github.com/ghaggin/sso/internal/samldebug"
+	"github.com/ghaggin/sso/internal/template"
+	"go.uber.org/zap"
+)
+
+// traceRequest keeps the authn request as it is sent to the idp
+func (s *samlImpl) traceRequest(r *http.Request, client *Client, profile *config.SPProfile, authReq *saml.AuthnRequest, relayState string) {
+	binding, _ := client.binding()
+	s.sm.TraceSAML(r.Context(), model.SAMLMessage{
+		Time:       saml.TimeNow(),
+		Sent:       true,
+		Type:       "AuthnRequest",
+		Profile:    profile.Name,
+		Binding:    binding,
+		RelayState: relayState,
+		XML:        elementXML(authReq.Element()),
+	}, s.traceSize)
+}
+
+// traceResponse keeps the response posted to the acs, with the assertion
+// that was accepted from it or why it was rejected. Artifacts are resolved
+// inside crewjam/saml so only the assertion is kept of those.
+func (s *samlImpl) traceResponse(r *http.Request, profile *config.SPProfile, assertion *saml.Assertion, err error) {
+	msg := model.SAMLMessage{
+		Time:       saml.TimeNow(),
+		Type:       "Response",
+		Profile:    profile.Name,
+		Binding:    saml.HTTPPostBinding,
+		RelayState: r.Form.Get("RelayState"),
+	}
+	if r.Form.Get("SAMLart") != "" {
+		msg.Binding = saml.HTTPArtifactBinding
+	} else if raw, decodeErr := base64.StdEncoding.DecodeString(r.Form.Get("SAMLResponse")); decodeErr == nil {
+		msg.XML = string(raw)
+	}
+
+	// crewjam/saml keeps the reason a response was rejected from its error
+	// so it isn't shown to users, the trace is where to find it
+	var invalid *saml.InvalidResponseError
+	switch {
+	case errors.As(err, &invalid) && invalid.PrivateErr != nil:
+		msg.Error = invalid.PrivateErr.Error()
+	case err != nil:
+		msg.Error = err.Error()
+	default:
+		// the signature comes out of parsing as an empty element, which
+		// would be written as </>
+		a := *assertion
+		if a.Signature != nil && a.Signature.Tag == "" {
+			a.Signature = nil
+		}
+		msg.Assertion = elementXML(a.Element())
+	}
+	s.sm.TraceSAML(r.Context(), msg, s.traceSize)
+}
+
+func elementXML(el *etree.Element) string {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	xml, err := doc.WriteToString()
+	if err != nil {
+		return err.Error()
+	}
+	return xml
+}
+
+// userID is who the assertion signs in, the uid attribute or else the
+// subject's NameID
+func userID(assertion *saml.Assertion) string {
+	for _, as := range assertion.AttributeStatements {
+		for _, a := range as.Attributes {
+			if (a.FriendlyName == "uid" || a.Name == "uid") && len(a.Values) == 1 {
+				return a.Values[0].Value
+			}
+		}
+	}
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		return assertion.Subject.NameID.Value
+	}
+	return ""
+}
+
+type attrData struct {
+	template.Data
+	Fields []samldebug.Field
+	Error  string
+}
+
+// attr shows the assertion the session signed in with
+func (s *ServiceProvider) attr(w http.ResponseWriter, r *http.Request) {
+	session, _ := s.sm.Authenticated(r.Context())
+	data := &attrData{
+		Data: template.Data{
+			PageTitle: "attributes",
+			UID:       session.UID,
+		},
+	}
+
+	var assertion string
+	for _, msg := range s.sm.SAMLTrace(r.Context()) {
+		if msg.Assertion != "" {
+			assertion = msg.Assertion
+		}
+	}
+	if assertion == "" {
+		data.Error = "the assertion is no longer in the session's trace"
+	} else if m, err := samldebug.Decode(assertion); err != nil {
+		data.Error = err.Error()
+	} else if data.Fields, err = m.Inspect(nil); err != nil {
+		data.Error = err.Error()
+	}
+
+	if err := template.Render(w, r, "attr.html", data); err != nil {
+		s.log.Error("error rendering attr.html", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// tracedMessage is a message on the trace page, with its xml indented
+type tracedMessage struct {
+	model.SAMLMessage
+	Pretty          string
+	PrettyAssertion string
+}
+
+type traceData struct {
+	template.Data
+	Messages []tracedMessage
+}
+
+// trace shows the session's saml messages, newest first
+func (s *ServiceProvider) trace(w http.ResponseWriter, r *http.Request) {
+	data := &traceData{
+		Data: template.Data{
+			PageTitle: "saml trace",
+		},
+	}
+	if session, ok := s.sm.Authenticated(r.Context()); ok {
+		data.UID = session.UID
+	}
+
+	messages := s.sm.SAMLTrace(r.Context())
+	for i := len(messages) - 1; i >= 0; i-- {
+		data.Messages = append(data.Messages, tracedMessage{
+			SAMLMessage:     messages[i],
+			Pretty:          pretty(messages[i].XML),
+			PrettyAssertion: pretty(messages[i].Assertion),
+		})
+	}
+
+	if err := template.Render(w, r, "trace.html", data); err != nil {
+		s.log.Error("error rendering trace.html", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// pretty indents xml for reading, leaving what can't be parsed as it is
+func pretty(xml string) string {
+	if xml == "" {
+		return ""
+	}
+	m, err := samldebug.Decode(xml)
+	if err != nil {
+		return xml
+	}
+	return m.Pretty()
+}
@@ -4,12 +4,18 @@ import (
 	"bytes"
 	"html/template"
 	"net/http"
+	"regexp"
+
+	"github.com/ghaggin/sso/internal/middleware"
 )
 
 const (
 	templateDir string = "web/tmpl"
 )
 
+// postForm matches the opening tag of forms that submit with post
+var postForm = regexp.MustCompile(`(?i)<form\b[^>]*\bmethod\s*=\s*["']?post\b[^>]*>`)
+
 type Data struct {
 	PageTitle string
 	UID       string
@@ -31,6 +37,22 @@ func Render(w http.ResponseWriter, r *http.Request, tmpl string, td any) error {
 		return err
 	}
 
-	_, err = buf.WriteTo(w)
+	page := buf.Bytes()
+	if postForm.Match(page) {
+		page = injectCSRF(page, middleware.CSRFToken(r.Context()))
+	}
+	_, err = w.Write(page)
 	return err
 }
+
+// injectCSRF adds the synchronizer token as the first field of every post
+// form, so templates don't have to remember it
+func injectCSRF(page []byte, token string) []byte {
+	if token == "" {
+		return page
+	}
+	field := []byte(`<input type="hidden" name="` + middleware.CSRFField + `" value="` + token + `">`)
+	return postForm.ReplaceAllFunc(page, func(tag []byte) []byte {
+		return append(append([]byte{}, tag...), field...)
+	})
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/ghaggin/sso/internal/config"
 	"github.com/ghaggin/sso/internal/idp"
@@ -13,39 +21,201 @@ import (
 )
 
 func main() {
-	var mode = flag.String("mode", "", "either sp or idp")
+	// sso <command>, the -mode flags predate the commands and still work
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		err := runCommand(os.Args[1:])
+		if errors.Is(err, errUsage) {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "sso:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var mode = flag.String("mode", "", "one of sp, idp, all, import or export")
+	var file = flag.String("file", "", "file to import from or export to, defaults to stdin/stdout")
+	var format = flag.String("format", "csv", "import/export format, csv or json")
+	var dryRun = flag.Bool("dry-run", false, "validate an import without writing anything")
+	var hashes = flag.Bool("hashes", false, "include password hashes in an export")
 	flag.Parse()
 
-	newMode := func() config.Mode {
-		return config.Mode(*mode)
+	var err error
+	if *mode == "import" || *mode == "export" {
+		var f idp.BulkFormat
+		if f, err = idp.ParseBulkFormat(*format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		var ctrl *idp.Controller
+		err = runIdP(func(ctx context.Context) error {
+			return runBulk(ctx, ctrl, *mode, *file, f, *dryRun, *hashes)
+		}, &ctrl)
+	} else if *mode == "" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	} else {
+		err = serve(*mode)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the idp, the sp or both until interrupted
+func serve(mode string) error {
+	switch mode {
+	case "sp":
+		fx.New(
+			withMode("sp"),
+			fx.Provide(sp.New),
+			fx.Invoke(sp.RegisterHooks),
+		).Run()
+	case "idp":
+		fx.New(
+			withMode("idp"),
+			idp.Module,
+			fx.Invoke(idp.RegisterHooks),
+		).Run()
+	case "all":
+		return runAll()
+	default:
+		return fmt.Errorf("unrecognized mode %q", mode)
 	}
+	return nil
+}
 
-	deps := fx.Options(
+// withMode provides what every mode shares, each app gets its own session
+// manager named after its mode
+func withMode(mode config.Mode) fx.Option {
+	return fx.Options(
 		fx.Provide(
 			zap.NewDevelopment,
 			config.New,
 			middleware.NewSessionManager,
-			repository.NewJSON,
-			newMode,
+			repository.New,
+			func() config.Mode {
+				return mode
+			},
 		),
 	)
+}
 
-	var app *fx.App
-	if *mode == "sp" {
-		app = fx.New(
-			deps,
-			fx.Provide(sp.New),
-			fx.Invoke(sp.RegisterHooks),
-		)
-	} else if *mode == "idp" {
-		app = fx.New(
-			deps,
-			idp.Module,
-			fx.Invoke(idp.RegisterHooks),
-		)
-	} else {
-		panic("unrecognized mode")
+// runAll runs the idp and sp as two apps in this process and registers the
+// sp with the idp. The sp fetches the idp's metadata while it is built, so
+// the idp is started first and stopped last.
+func runAll() error {
+	var i *idp.IdentityProvider
+	idpApp := fx.New(
+		withMode("idp"),
+		idp.Module,
+		fx.Invoke(idp.RegisterHooks),
+		fx.Populate(&i),
+	)
+	if err := start(idpApp); err != nil {
+		return fmt.Errorf("starting idp: %w", err)
 	}
+	defer func() {
+		if err := stop(idpApp); err != nil {
+			fmt.Fprintln(os.Stderr, "stopping idp:", err)
+		}
+	}()
 
-	app.Run()
+	var s *sp.ServiceProvider
+	spApp := fx.New(
+		withMode("sp"),
+		fx.Provide(sp.New),
+		fx.Invoke(sp.RegisterHooks),
+		fx.Populate(&s),
+	)
+	if err := start(spApp); err != nil {
+		return fmt.Errorf("starting sp: %w", err)
+	}
+	defer func() {
+		if err := stop(spApp); err != nil {
+			fmt.Fprintln(os.Stderr, "stopping sp:", err)
+		}
+	}()
+
+	for _, metadata := range s.Metadata() {
+		if err := i.RegisterServiceProvider(metadata); err != nil {
+			return fmt.Errorf("registering sp: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "registered sp %s with the idp\n", metadata.EntityID)
+	}
+
+	// the apps are started by hand so fx isn't listening for signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	return nil
+}
+
+func start(app *fx.App) error {
+	if err := app.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), app.StartTimeout())
+	defer cancel()
+	return app.Start(ctx)
+}
+
+func stop(app *fx.App) error {
+	ctx, cancel := context.WithTimeout(context.Background(), app.StopTimeout())
+	defer cancel()
+	return app.Stop(ctx)
+}
+
+// runBulk imports or exports users directly against the configured
+// repository. The IDP should not be running since the json repository is
+// only written on shutdown.
+func runBulk(ctx context.Context, ctrl *idp.Controller, mode, file string, format idp.BulkFormat, dryRun, hashes bool) error {
+	if mode == "export" {
+		var w io.Writer = os.Stdout
+		if file != "" {
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return ctrl.ExportUsers(ctx, w, format, hashes)
+	}
+
+	var r io.Reader = os.Stdin
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	report, err := ctrl.ImportUsers(ctx, r, format, dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range report.Rows {
+		if row.Error != "" {
+			fmt.Printf("line %d: %s: %s\n", row.Line, row.Username, row.Error)
+		} else {
+			fmt.Printf("line %d: %s: %s\n", row.Line, row.Username, row.Action)
+		}
+	}
+	if dryRun {
+		fmt.Print("dry run: ")
+	}
+	fmt.Printf("%d created, %d updated, %d failed\n", report.Created, report.Updated, report.Failed)
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d rows failed", report.Failed)
+	}
+	return nil
 }
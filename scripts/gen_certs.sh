@@ -5,4 +5,4 @@
 
 DIR="../keys"
 
-openssl req -x509 -newkey rsa:2048 -keyout "$DIR/$1.key" -out "$DIR/$1.cert" -days 365 -nodes -subj "/CN=$2"
+openssl req -x509 -newkey rsa:2048 -keyout "$DIR/$1.key" -out "$DIR/$1.cert" -days 3650 -nodes -subj "/CN=$2"